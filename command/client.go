@@ -3,6 +3,8 @@
 package command
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/HouzuoGuo/cryptctl/fs"
@@ -22,8 +24,14 @@ import (
 const (
 	DEFUALT_ALIVE_TIMEOUT   = 3 * routine.REPORT_ALIVE_INTERVAL_SEC
 	AUTO_UNLOCK_DAEMON      = "cryptctl-auto-unlock@"
+	CLIENT_DAEMON           = "cryptctl-client"
 	CLIENT_CONFIG_PATH      = "/etc/sysconfig/cryptctl-client"
 	ONLINE_UNLOCK_RETRY_SEC = 24 * 3600
+	KERNEL_CMDLINE_PATH     = "/proc/cmdline"
+	CLIENT_GENTLS_PATH      = "/etc/cryptctl/clienttls"
+	CLIENT_CERT_FILE        = "client.crt"
+	CLIENT_CERT_KEY_FILE    = "client.key"
+	CLIENT_CA_CERT_FILE     = "ca.crt"
 	MSG_ASK_HOSTNAME        = "Key server's host name"
 	MSG_ASK_PORT            = "Key server's port number"
 	MSG_ASK_CA              = "(Optional) PEM-encoded CA certificate of key server"
@@ -33,7 +41,9 @@ const (
 Only a single key server can be used to unlock all encrypted disks on this computer.
 Do you wish to proceed and switch to the new key server?`
 	MSG_ASK_SRC_DIR           = "Path of directory to be encrypted"
-	MSG_ASK_ENC_DISK          = "Path of disk partition (/dev/sdXXX) that will hold the directory after encryption"
+	MSG_ASK_ENC_DISK          = "Path of disk partition or volume (e.g. /dev/sdXXX, /dev/mapper/vg-lv) that will hold the directory after encryption"
+	MSG_ASK_BIND              = "Bind the key to key server without storing it there (network-bound, no MaxActive and alive reports)?"
+	MSG_ASK_ALLOWED_CLIENTS   = "Computers allowed to unlock the disk without password (comma-separated cert:FINGERPRINT, cn:NAME, ip:ADDRESS[/PREFIX], token), or \"any\""
 	MSG_ASK_MAX_ACTIVE        = "How many computers can use the encrypted disk simultaneously"
 	MSG_ASK_ALIVE_TIMEOUT     = "If the key server does not hear from this computer for so many seconds, other computers will be allowed to use the key"
 	MSG_ASK_KEYREC_PATH       = "Path of the key record"
@@ -57,10 +67,25 @@ The encryption sequence will carry out the following tasks:
 	MSG_E_READ_FILE           = "Failed to read file \"%s\" - %v"
 	MSG_E_BAD_KEYREC          = "Failed to read record content (is the file damaged?) - %v"
 	MSG_UNLOCK_IS_NOP         = "cryptctl is doing nothing because client configuration is empty"
+	MSG_ALIVE_BY_DAEMON       = "\"%s\" will be kept alive by the heartbeat of %s\n"
 	MSG_ERASE_UUID            = "UUID of the file system to erase"
 	MSG_ERASE_UUID_AGAIN      = "Warning! Data on \"%s\" will be irreversibly lost, type the UUID once again to confirm"
 	MSG_E_ERASE_UUID_MISMATCH = "UUID input does not match."
 	MSG_E_ERASE_NO_CONF       = "The erase operation must contact key server in order to erase a key, but cryptctl configuration is empty."
+	MSG_CRYPTTAB_UUID         = "UUID of the encrypted disk to be unlocked by systemd-cryptsetup"
+	MSG_CRYPTTAB_DONE         = "The disk will be unlocked by systemd-cryptsetup and mounted by \"%s\" from now on.\n"
+	MSG_E_CRYPTTAB_NO_CONF    = "systemd-cryptsetup must retrieve the key from key server, but cryptctl configuration is empty."
+	MSG_ASK_CERT_NAME         = "Common name of this computer's certificate"
+	MSG_ENROL_DONE            = `This computer has enrolled with the key server:
+  Certificate: %s (valid until %s)
+  Key:         %s
+  Fingerprint: %s
+The key server accepts "cn:%s" and "cert:%s" as this computer's identity.
+The certificate is renewed automatically by %s.service before it expires.
+`
+	MSG_AUDIT_PINS_MATCH    = "Key server presents a pinned public key."
+	MSG_AUDIT_PINS_MISMATCH = "Warning! Key server does not present any of the pinned public keys, this computer will refuse to contact it."
+	MSG_AUDIT_NO_PINS       = "Public key pinning is not configured, consider adding the above public key to %s in %s.\n"
 
 	ClientDaemonService = "cryptctl-client"
 )
@@ -123,17 +148,26 @@ func EncryptFS() error {
 	srcDir = filepath.Clean(srcDir)
 	encDisk := sys.InputAbsFilePath(true, "", MSG_ASK_ENC_DISK)
 	encDisk = filepath.Clean(encDisk)
-	maxActive := sys.InputInt(true, 1, 1, 99999, MSG_ASK_MAX_ACTIVE)
-	if maxActive == 0 {
-		maxActive = 1
-	}
-	aliveTimeout := sys.InputInt(true, DEFUALT_ALIVE_TIMEOUT, DEFUALT_ALIVE_TIMEOUT, 3600*24*7, MSG_ASK_ALIVE_TIMEOUT)
-	if aliveTimeout == 0 {
-		aliveTimeout = DEFUALT_ALIVE_TIMEOUT
-	}
-	roundedAliveTimeout := aliveTimeout / routine.REPORT_ALIVE_INTERVAL_SEC * routine.REPORT_ALIVE_INTERVAL_SEC
-	if roundedAliveTimeout != aliveTimeout {
-		fmt.Printf(MSG_ALIVE_TIMEOUT_ROUNDED, roundedAliveTimeout)
+	bound := sys.InputBool(false, MSG_ASK_BIND)
+	maxActive := 1
+	roundedAliveTimeout := DEFUALT_ALIVE_TIMEOUT
+	var allowedClients []string
+	if !bound {
+		if allowedClients, err = InputAllowedClients(keydb.CLIENT_ID_NEW_TOKEN, true); err != nil {
+			return err
+		}
+		maxActive = sys.InputInt(true, 1, 1, 99999, MSG_ASK_MAX_ACTIVE)
+		if maxActive == 0 {
+			maxActive = 1
+		}
+		aliveTimeout := sys.InputInt(true, DEFUALT_ALIVE_TIMEOUT, DEFUALT_ALIVE_TIMEOUT, 3600*24*7, MSG_ASK_ALIVE_TIMEOUT)
+		if aliveTimeout == 0 {
+			aliveTimeout = DEFUALT_ALIVE_TIMEOUT
+		}
+		roundedAliveTimeout = aliveTimeout / routine.REPORT_ALIVE_INTERVAL_SEC * routine.REPORT_ALIVE_INTERVAL_SEC
+		if roundedAliveTimeout != aliveTimeout {
+			fmt.Printf(MSG_ALIVE_TIMEOUT_ROUNDED, roundedAliveTimeout)
+		}
 	}
 
 	// Check pre-conditions for encryption
@@ -146,9 +180,14 @@ func EncryptFS() error {
 	if !sys.InputBool(false, MSG_ASK_PROCEED) {
 		return errors.New(MSG_E_CANCELLED)
 	}
-	// Alive-report interval is hard coded for now until there is a very good reason to change it
-	uuid, err := routine.EncryptFS(os.Stdout, client, password, srcDir, encDisk, maxActive,
-		routine.REPORT_ALIVE_INTERVAL_SEC, roundedAliveTimeout/routine.REPORT_ALIVE_INTERVAL_SEC)
+	var uuid string
+	if bound {
+		uuid, err = routine.EncryptFSBound(os.Stdout, client, srcDir, encDisk)
+	} else {
+		// Alive-report interval is hard coded for now until there is a very good reason to change it
+		uuid, err = routine.EncryptFS(os.Stdout, client, password, srcDir, encDisk, maxActive,
+			routine.REPORT_ALIVE_INTERVAL_SEC, roundedAliveTimeout/routine.REPORT_ALIVE_INTERVAL_SEC, allowedClients)
+	}
 	if err != nil {
 		return err
 	}
@@ -185,7 +224,7 @@ func ManOnlineUnlockFS() error {
 	if err != nil {
 		return err
 	}
-	return routine.ManOnlineUnlockFS(os.Stdout, client, password)
+	return routine.ManOnlineUnlockFS(os.Stdout, client, password, askAdminToken)
 }
 
 // Sub-command: unlock a single file systems using a key record file.
@@ -207,7 +246,35 @@ func ManOfflineUnlockFS() error {
 	if newMountOptions := sys.Input(false, rec.GetMountOptionStr(), MSG_ASK_MOUNT_OPT); newMountOptions != "" {
 		rec.MountOptions = strings.Split(newMountOptions, ",")
 	}
-	return routine.UnlockFS(os.Stderr, rec, 3)
+	_, err = routine.UnlockFS(os.Stderr, rec, 3)
+	return err
+}
+
+/*
+Interactively read the computers that may retrieve a key without password. Return an empty array if any computer may
+do so. Entry "token" is kept as-is only if allowNewToken is true, the caller is responsible for issuing the token.
+*/
+func InputAllowedClients(defaultVal string, allowNewToken bool) ([]string, error) {
+	input := sys.Input(false, defaultVal, MSG_ASK_ALLOWED_CLIENTS)
+	if input == "" {
+		input = defaultVal
+	}
+	ret := make([]string, 0, 4)
+	if strings.TrimSpace(input) == "any" {
+		return ret, nil
+	}
+	for _, entry := range strings.Split(input, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		} else if entry == keydb.CLIENT_ID_NEW_TOKEN && allowNewToken {
+			ret = append(ret, entry)
+		} else if normalised, err := keydb.NormaliseAllowedClient(entry); err != nil {
+			return nil, err
+		} else {
+			ret = append(ret, normalised)
+		}
+	}
+	return ret, nil
 }
 
 /*
@@ -229,12 +296,222 @@ func AutoOnlineUnlockFS(uuid string) error {
 	if err != nil {
 		return err
 	}
-	if err := routine.AutoOnlineUnlockFS(os.Stdout, client, uuid, ONLINE_UNLOCK_RETRY_SEC); err != nil {
+	_, bound := routine.GetDiskBinding(uuid)
+	if unlockedDev, found := routine.GetUnlockedDevice(uuid); found {
+		if bound {
+			// Key server does not keep track of network-bound disks
+			return nil
+		}
+		// initramfs has unlocked the disk (e.g. root file system) using the key retrieved from this computer.
+		fmt.Printf("\"%s\" has already been unlocked as \"%s\"\n", uuid, unlockedDev.Path)
+		return keepAlive(client, uuid)
+	} else if _, found := routine.GetCrypttabEntry(uuid); found {
+		// systemd-cryptsetup retrieves the key and unlocks the disk, wait for it to finish before reporting alive.
+		if err := routine.WaitForCrypttabUnlock(os.Stdout, uuid, ONLINE_UNLOCK_RETRY_SEC); err != nil {
+			return err
+		}
+		if !bound {
+			// Keep the disk alive while the mount unit mounts it
+			if err := routine.RegisterAliveDisk(uuid); err != nil {
+				return err
+			}
+		}
+		// The mount unit cannot run hook scripts, applications that depend on the file system start from here.
+		if _, err := routine.RunCrypttabPostMountHooks(os.Stdout, uuid, ONLINE_UNLOCK_RETRY_SEC); err != nil {
+			log.Print(err)
+		}
+	} else if _, err := routine.AutoOnlineUnlockFS(os.Stdout, client, uuid, ONLINE_UNLOCK_RETRY_SEC); err != nil {
 		return err
 	}
+	if bound {
+		return nil
+	}
+	return keepAlive(client, uuid)
+}
+
+/*
+Let client daemon keep the unlocked disk alive as part of this computer's heartbeat. If client daemon is not running,
+keep sending alive reports for the disk alone, and block caller until the program quits or server rejects the disk.
+*/
+func keepAlive(client *keyserv.CryptClient, uuid string) error {
+	if err := routine.RegisterAliveDisk(uuid); err != nil {
+		return err
+	}
+	if sys.SystemctlIsRunning(CLIENT_DAEMON) {
+		fmt.Printf(MSG_ALIVE_BY_DAEMON, uuid, CLIENT_DAEMON)
+		return nil
+	}
 	return routine.ReportAlive(os.Stderr, client, uuid)
 }
 
+/*
+Sub-command: invoked when the auto-unlock service of the disk stops normally. Umount the file system and close the
+encrypted disk, then tell key server that this computer no longer holds its key, so that another computer may take over
+the disk right away. Nothing is done to a disk that is not kept alive, such as one rejected by server.
+*/
+func ReleaseKey(uuid string) error {
+	if !isKeptAlive(uuid) {
+		return nil
+	}
+	// The key is not released unless the disk is really closed
+	if _, _, err := routine.CloseDisk(os.Stdout, uuid, keydb.ON_BUSY_FAIL); err != nil {
+		return fmt.Errorf("ReleaseKey: failed to close disk \"%s\" - %v", uuid, err)
+	}
+	return releaseClosedDisk(uuid)
+}
+
+// Return true only if the disk is registered to be kept alive on key server.
+func isKeptAlive(uuid string) bool {
+	for _, aliveUUID := range routine.GetRegisteredAliveDisks() {
+		if aliveUUID == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// Connect to key server using client configuration, then release the key of the disk that has been closed.
+func releaseClosedDisk(uuid string) error {
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return err
+	}
+	if sysconf.GetString(keyserv.CLIENT_CONF_HOST, "") == "" {
+		fmt.Println(MSG_UNLOCK_IS_NOP)
+		return nil
+	}
+	client, err := keyserv.NewCryptClientFromSysconfig(sysconf)
+	if err != nil {
+		return err
+	}
+	return routine.ReleaseKey(os.Stdout, client, uuid)
+}
+
+/*
+Sub-command: connect to key server using client configuration, then report the negotiated TLS parameters, the server
+certificates, and whether the server presents a pinned public key.
+*/
+func AuditTLS() error {
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return err
+	}
+	if sysconf.GetString(keyserv.CLIENT_CONF_HOST, "") == "" {
+		fmt.Println(MSG_UNLOCK_IS_NOP)
+		return nil
+	}
+	client, err := keyserv.NewCryptClientFromSysconfig(sysconf)
+	if err != nil {
+		return err
+	}
+	pins, err := keyserv.ParseSPKIPins(sysconf.GetString(keyserv.TLS_CONF_PINNED_KEYS, ""))
+	if err != nil {
+		return err
+	}
+	// Connect without pinning so that the administrator gets to see the keys even if they do not match
+	client.PinKeys(nil)
+	audit, err := client.AuditTLS()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Key server: %s\n", client.Address)
+	fmt.Print(audit.Describe())
+	if len(pins) == 0 {
+		fmt.Printf(MSG_AUDIT_NO_PINS, keyserv.TLS_CONF_PINNED_KEYS, CLIENT_CONFIG_PATH)
+		return nil
+	}
+	if err := keyserv.MatchPinnedKeys(pins, audit.VerifiedChains); err != nil {
+		return errors.New(MSG_AUDIT_PINS_MISMATCH)
+	}
+	fmt.Println(MSG_AUDIT_PINS_MATCH)
+	return nil
+}
+
+/*
+Sub-command: unlock encrypted disks in initramfs, such as the one holding root file system. If UUIDs are not given,
+they are read from kernel command line. If key server cannot be reached, ask for disk passphrase on the console.
+*/
+func InitrdUnlockFS(uuids []string) error {
+	sys.LockMem()
+	cmdline, err := ioutil.ReadFile(KERNEL_CMDLINE_PATH)
+	if err != nil {
+		return fmt.Errorf("Failed to read kernel command line - %v", err)
+	}
+	cmdlineUUIDs, timeoutSec := routine.ParseInitrdCmdline(string(cmdline))
+	if len(uuids) == 0 {
+		uuids = cmdlineUUIDs
+	}
+	// The client remains nil if key server is not configured, which leads to the passphrase prompt.
+	var client *keyserv.CryptClient
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err == nil && sysconf.GetString(keyserv.CLIENT_CONF_HOST, "") != "" {
+		if client, err = keyserv.NewCryptClientFromSysconfig(sysconf); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			client = nil
+		}
+	}
+	var lastErr error
+	for _, uuid := range uuids {
+		if err := routine.InitrdUnlockFS(os.Stderr, client, uuid, timeoutSec); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+/*
+Sub-command: let systemd-cryptsetup unlock an encrypted disk via crypttab using a key retrieved from key server, and
+mount the file system via a systemd mount unit.
+*/
+func InstallCrypttab() error {
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return err
+	}
+	if sysconf.GetString(keyserv.CLIENT_CONF_HOST, "") == "" {
+		return errors.New(MSG_E_CRYPTTAB_NO_CONF)
+	}
+	uuid := sys.Input(true, "", MSG_CRYPTTAB_UUID)
+	mountPoint := sys.InputAbsFilePath(true, "", MSG_ASK_MOUNT)
+	mountOptions := make([]string, 0, 0)
+	if mountOptionStr := sys.Input(false, "", MSG_ASK_MOUNT_OPT); mountOptionStr != "" {
+		mountOptions = strings.Split(mountOptionStr, ",")
+	}
+	if err := routine.InstallCrypttabUnlock(os.Stdout, uuid, mountPoint, mountOptions); err != nil {
+		return err
+	}
+	fmt.Printf(MSG_CRYPTTAB_DONE, fs.GetSystemdMountNameForDir(mountPoint))
+	return nil
+}
+
+// Sub-command: undo the installation of crypttab entry and mount unit made by InstallCrypttab.
+func UninstallCrypttab(uuid string) error {
+	return routine.UninstallCrypttabUnlock(os.Stdout, uuid)
+}
+
+// Sub-command: retrieve encryption key from key server and place it into the key file named by crypttab entry.
+func FetchKey(uuid string) error {
+	sys.LockMem()
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		return err
+	}
+	if sysconf.GetString(keyserv.CLIENT_CONF_HOST, "") == "" {
+		return errors.New(MSG_E_CRYPTTAB_NO_CONF)
+	}
+	client, err := keyserv.NewCryptClientFromSysconfig(sysconf)
+	if err != nil {
+		return err
+	}
+	return routine.FetchKeyForCrypttab(os.Stdout, client, uuid, ONLINE_UNLOCK_RETRY_SEC)
+}
+
+// Sub-command: erase the key file placed by FetchKey after systemd-cryptsetup has unlocked the disk.
+func EraseFetchedKey(uuid string) error {
+	return routine.EraseFetchedKey(uuid)
+}
+
 /*
 Sub-command: erase encryption headers for the encrypted disk, so that its content becomes irreversibly lost.
 */
@@ -268,15 +545,116 @@ func EraseKey() error {
 	if confirmUUID != uuid {
 		return errors.New(MSG_E_ERASE_UUID_MISMATCH)
 	}
-	if err := routine.EraseKey(os.Stdout, client, password, uuid); err != nil {
+	if err := routine.EraseKey(os.Stdout, client, password, uuid, askAdminToken); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+Sub-command: obtain a client certificate from key server's built-in certificate authority using the server's password,
+and use the certificate to identify this computer to the key server from now on.
+*/
+func EnrolClient() error {
+	sys.LockMem()
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, true)
+	if err != nil {
+		return err
+	}
+	defaultHost := sysconf.GetString(keyserv.CLIENT_CONF_HOST, "")
+	host := sys.Input(true, defaultHost, MSG_ASK_HOSTNAME)
+	if host == "" {
+		host = defaultHost
+	}
+	if defaultHost != "" && host != defaultHost {
+		if !sys.InputBool(false, MSG_ASK_DIFF_HOST, defaultHost, host) {
+			return errors.New(MSG_E_CANCELLED)
+		}
+	}
+	defaultPort := sysconf.GetInt(keyserv.CLIENT_CONF_PORT, keyserv.SRV_DEFAULT_PORT)
+	port := sys.InputInt(true, defaultPort, 1, 65535, MSG_ASK_PORT)
+	if port == 0 {
+		port = defaultPort
+	}
+	defaultCAFile := sysconf.GetString(keyserv.CLIENT_CONF_CA, "")
+	caFile := sys.InputAbsFilePath(false, defaultCAFile, MSG_ASK_CA)
+	if caFile == "" {
+		caFile = defaultCAFile
+	}
+	client, password, err := ConnectToKeyServer(caFile, "", "", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return err
+	}
+	salt, err := client.GetSalt()
+	if err != nil {
+		return err
+	}
+	defaultName, _ := sys.GetHostnameAndIP()
+	commonName := sys.Input(false, defaultName, MSG_ASK_CERT_NAME)
+	if commonName == "" {
+		commonName = defaultName
+	}
+	if err := os.MkdirAll(CLIENT_GENTLS_PATH, 0700); err != nil {
+		return fmt.Errorf("Failed to create directory \"%s\" for storing client certificate - %v", CLIENT_GENTLS_PATH, err)
+	}
+	certFile := filepath.Join(CLIENT_GENTLS_PATH, CLIENT_CERT_FILE)
+	certKeyFile := filepath.Join(CLIENT_GENTLS_PATH, CLIENT_CERT_KEY_FILE)
+	cert, err := routine.EnrolClient(client, keyserv.HashPassword(salt, password), commonName,
+		certFile, certKeyFile, filepath.Join(CLIENT_GENTLS_PATH, CLIENT_CA_CERT_FILE))
+	if err != nil {
 		return err
 	}
+	// Put latest key server details into client configuration file
+	sysconf.Set(keyserv.CLIENT_CONF_HOST, host)
+	sysconf.Set(keyserv.CLIENT_CONF_PORT, strconv.Itoa(port))
+	sysconf.Set(keyserv.CLIENT_CONF_CA, caFile)
+	sysconf.Set(keyserv.CLIENT_CONF_CERT, certFile)
+	sysconf.Set(keyserv.CLIENT_CONF_CERT_KEY, certKeyFile)
+	if err := ioutil.WriteFile(CLIENT_CONFIG_PATH, []byte(sysconf.ToText()), 0600); err != nil {
+		return fmt.Errorf(MSG_E_SAVE_SYSCONF, CLIENT_CONFIG_PATH, err)
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	fmt.Printf(MSG_ENROL_DONE, certFile, cert.NotAfter.Format(TIME_OUTPUT_FORMAT), certKeyFile,
+		hex.EncodeToString(fingerprint[:]), strings.ToLower(commonName), hex.EncodeToString(fingerprint[:]), ClientDaemonService)
+	// Client daemon renews the certificate
+	if err := sys.SystemctlEnableStart(ClientDaemonService); err != nil {
+		return fmt.Errorf("Failed to start cryptctl client daemon - %v", err)
+	}
 	return nil
 }
 
+/*
+Renew the client certificate if it was issued by key server's built-in certificate authority and it is about to expire.
+Return a client that presents the renewed certificate, or the same client if nothing was renewed.
+*/
+func renewClientCert(sysconf *sys.Sysconfig, client *keyserv.CryptClient) *keyserv.CryptClient {
+	certFile := sysconf.GetString(keyserv.CLIENT_CONF_CERT, "")
+	if certFile == "" || filepath.Dir(certFile) != CLIENT_GENTLS_PATH {
+		// The certificate is managed outside of cryptctl
+		return client
+	}
+	cert, err := routine.RenewClientCertIfDue(client, certFile, sysconf.GetString(keyserv.CLIENT_CONF_CERT_KEY, ""))
+	if err != nil {
+		log.Printf("Failed to renew client certificate: %v", err)
+		return client
+	} else if cert == nil {
+		return client
+	}
+	log.Printf("Client certificate has been renewed, it is now valid until %s.", cert.NotAfter.Format(TIME_OUTPUT_FORMAT))
+	renewedClient, err := keyserv.NewCryptClientFromSysconfig(sysconf)
+	if err != nil {
+		log.Printf("Failed to load renewed client certificate: %v", err)
+		return client
+	}
+	// The persistent connection still presents the old certificate
+	client.Close()
+	return renewedClient
+}
+
 /*
 ClientDaemon runs the main routine of "client-daemon" sub-command.
-The routine primarily polls for pending commands and execute them.
+The routine sends a single heartbeat on behalf of all unlocked disks, and executes the pending commands that arrive in
+the heartbeat response.
 */
 func ClientDaemon() error {
 	sys.LockMem()
@@ -292,9 +670,12 @@ func ClientDaemon() error {
 	if err != nil {
 		return err
 	}
-	log.Printf("Going to poll for commands from server %s every 30 seconds.", client.Address)
+	log.Printf("Going to send heartbeat to server %s every %d seconds, and receive commands as they are issued.", client.Address, routine.REPORT_ALIVE_INTERVAL_SEC)
+	intervalSec := routine.REPORT_ALIVE_INTERVAL_SEC
+	numFailures := 0
+	lastContact := time.Now()
 	for {
-		time.Sleep(30 * time.Second)
+		client = renewClientCert(sysconf, client)
 
 		devs := fs.GetBlockDevices()
 		uuids := make([]string, 0, len(devs))
@@ -304,87 +685,202 @@ func ClientDaemon() error {
 			}
 		}
 
-		resp, err := client.PollCommand(keyserv.PollCommandReq{UUIDs: uuids})
+		resp, err := routine.SendHeartbeat(client, routine.GetAliveDisks(), uuids)
+		// In case of failure, only report the first few occasions among consecutive failures.
 		if err != nil {
-			log.Printf("Failed to poll for pending commands: %v", err)
+			if numFailures == 5 {
+				log.Print("Suppress further heartbeat failure messages until next success.")
+			} else if numFailures < 5 {
+				log.Printf("Failed to send heartbeat: %v", err)
+			}
+			numFailures++
+			for _, uuid := range routine.GetOfflineExceeded(lastContact, time.Now(), routine.GetAliveDisks()...) {
+				log.Printf("Lock disk \"%s\" because server has been unreachable for longer than its offline tolerance", uuid)
+				stopKeepingAlive(uuid)
+				if err := routine.LockOfflineDisk(os.Stdout, uuid); err != nil {
+					log.Print(err)
+				}
+			}
+			time.Sleep(time.Duration(intervalSec) * time.Second)
 			continue
+		} else if numFailures > 0 {
+			log.Print("Heartbeat has succeeded.")
 		}
-		for uuid, cmds := range resp.Commands {
-			for _, cmd := range cmds {
-				if cmd.IsValid() {
-					log.Printf("Going to execute command %+v", cmd)
-					ExecutePendingCommand(client, uuid, cmd)
-				} else {
-					log.Printf("Ignoring expired command: %+v\n", cmd)
+		numFailures = 0
+		lastContact = time.Now()
+		for _, uuid := range resp.Rejected {
+			log.Printf("Stop keeping disk \"%s\" alive because server has rejected it", uuid)
+			stopKeepingAlive(uuid)
+			// The lock action may wait for its grace period
+			go func(client *keyserv.CryptClient, uuid string) {
+				if _, err := routine.SelfLockDisk(os.Stdout, client, uuid); err != nil {
+					log.Print(err)
 				}
+			}(client, uuid)
+		}
+		executePendingCommands(client, resp.Commands)
+		// Server asks to keep up with the most demanding disk
+		intervalSec = routine.REPORT_ALIVE_INTERVAL_SEC
+		if resp.IntervalSec > 0 {
+			intervalSec = resp.IntervalSec
+		}
+		// Until the next heartbeat is due, receive pending commands the moment they are issued
+		nextBeat := time.Now().Add(time.Duration(intervalSec) * time.Second)
+		for remaining := time.Until(nextBeat); remaining >= time.Second; remaining = time.Until(nextBeat) {
+			cmds, err := routine.WaitForCommands(client, uuids, int(remaining/time.Second))
+			if err != nil {
+				// Heartbeat will tell whether server is reachable
+				time.Sleep(time.Until(nextBeat))
+				break
 			}
+			executePendingCommands(client, cmds)
 		}
+	}
+}
+
+/*
+Stop keeping the disk alive, forget its lease, and stop its auto-unlock service. The disk is forgotten before the service
+stops, so that stopping the service does not release its key. Failures are logged.
+*/
+func stopKeepingAlive(uuid string) {
+	if err := routine.UnregisterAliveDisk(uuid); err != nil {
+		log.Print(err)
+	}
+	if err := routine.RemoveLease(uuid); err != nil {
+		log.Print(err)
+	}
+	if err := sys.SystemctlStop(AUTO_UNLOCK_DAEMON + uuid); err != nil {
+		log.Printf("Failed to stop service %s: %v", AUTO_UNLOCK_DAEMON+uuid, err)
+	}
+}
 
+// Execute the valid commands among those freshly received from server, and ignore the expired ones.
+func executePendingCommands(client *keyserv.CryptClient, commands map[string][]keydb.PendingCommand) {
+	for uuid, cmds := range commands {
+		for _, cmd := range cmds {
+			if cmd.IsValid() {
+				log.Printf("Going to execute command %+v", cmd)
+				ExecutePendingCommand(client, uuid, cmd)
+			} else {
+				log.Printf("Ignoring expired command: %+v\n", cmd)
+			}
+		}
 	}
 }
 
 /*
-UmountCryptDev un-mounts and closes the crypt block device associated with the block device specified in UUID.
-Returns human-readable result text.
+UmountCryptDev un-mounts and closes the crypt block device associated with the block device specified in UUID, running
+the hook scripts of the phases along the way, and then stops the service that keeps the disk alive. A disk that is
+unlocked but not mounted is closed all the same. Processes that keep the file system busy are dealt with as told by
+onBusy (keydb.ON_BUSY_*). Returns human-readable result text, along with the outcome of the hook scripts and the
+processes that kept the file system busy.
 */
-func UmountCryptDev(uuid string) string {
-	/*
-		First steps should umount and close the disk.
-		At very last, if no errors are encountered, stop reporting alive-messages.
-	*/
-	devs := fs.GetBlockDevices()
-	underlyingDev, found := devs.GetByCriteria(uuid, "", "", "", "", "", "")
-	if !found {
-		return "The disk disappeared from system"
-	}
-	cryptDev, found := devs.GetByCriteria("", "", "crypt", "", "", underlyingDev.Name, "")
-	if !found {
-		return "The disk is not unlocked to begin with"
-	}
-	if cryptDev.MountPoint == "" {
-		return "The disk is not mounted to begin with"
-	}
-	time.Sleep(3 * time.Second)
-	log.Printf("Umount %s ...", cryptDev.MountPoint)
-	if err := fs.Umount(cryptDev.MountPoint); err != nil {
-		return fmt.Sprintf("Failed to umount encrypted device - %v", err)
-	}
-	time.Sleep(3 * time.Second)
-	log.Printf("Closing down %s ...", cryptDev.Path)
-	if err := fs.CryptClose(cryptDev.Path); err != nil {
-		return fmt.Sprintf("Failed to close encrypted device - %v", err)
+func UmountCryptDev(uuid, onBusy string) (string, map[string]string) {
+	wasUnlocked, details, err := routine.CloseDisk(os.Stdout, uuid, onBusy)
+	if err != nil {
+		return fmt.Sprintf("Failed to umount and close encrypted device - %v", err), details
+	} else if !wasUnlocked {
+		return "The disk is not unlocked to begin with", details
 	}
 	serviceName := AUTO_UNLOCK_DAEMON + uuid
+	if err := sys.SystemctlStop(serviceName); err != nil {
+		return fmt.Sprintf("failed to stop service %s - %v", serviceName, err), details
+	}
+	return "Success", details
+}
+
+/*
+Unlock and mount the disk using its key retrieved from key server, then start the service that keeps the disk alive, the
+service finds the disk already unlocked. A disk unlocked by systemd-cryptsetup is left to the service. Return the outcome
+of the hook scripts.
+*/
+func mountCryptDev(client *keyserv.CryptClient, uuid string) (map[string]string, error) {
+	details := make(map[string]string)
+	_, unlocked := routine.GetUnlockedDevice(uuid)
+	if _, crypttab := routine.GetCrypttabEntry(uuid); !unlocked && !crypttab {
+		hookDetails, err := routine.AutoOnlineUnlockFS(os.Stdout, client, uuid, 0)
+		for key, val := range hookDetails {
+			details[key] = val
+		}
+		if err != nil {
+			return details, err
+		}
+	}
+	if err := sys.SystemctlStart(AUTO_UNLOCK_DAEMON + uuid); err != nil {
+		return details, fmt.Errorf("Failed to start background daemon that reports disk status - %v", err)
+	}
+	return details, nil
+}
+
+/*
+Stop keeping the disk alive, umount and close the disk, and erase the copy of its key fetched for systemd-cryptsetup.
+The disk may then only be unlocked again with the help of key server. Processes that keep the file system busy are dealt
+with as told by onBusy (keydb.ON_BUSY_*). Return the outcome of the hook scripts and the processes that kept the file
+system busy.
+*/
+func lockCryptDev(uuid, onBusy string) (map[string]string, error) {
 	if err := sys.SystemctlStop(AUTO_UNLOCK_DAEMON + uuid); err != nil {
-		return fmt.Sprintf("failed to stop service %s - %v", serviceName, err)
+		log.Printf("lockCryptDev: failed to stop service %s - %v", AUTO_UNLOCK_DAEMON+uuid, err)
+	}
+	if err := routine.UnregisterAliveDisk(uuid); err != nil {
+		return nil, err
+	}
+	_, details, err := routine.CloseDisk(os.Stdout, uuid, onBusy)
+	if err != nil {
+		return details, err
 	}
-	return "Success"
+	return details, routine.EraseFetchedKey(uuid)
 }
 
 /*
 ExecutePendingCommand is called by client daemon to execute a freshly polled pending command.
-Execution result is logged into
+Execution result, along with the structured details of the outcome, is saved on key server.
 */
-func ExecutePendingCommand(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) {
-	result := "Success"
-	if cmd.Content == PendingCommandMount {
-		// Mounting an already mounted disk will result in a failure and no other negative consequence
-		if err := sys.SystemctlStart(AUTO_UNLOCK_DAEMON + uuid); err != nil {
-			result = fmt.Sprintf("Failed to start background daemon that reports disk status - %v", err)
+func ExecutePendingCommand(client *keyserv.CryptClient, uuid string, pending keydb.PendingCommand) {
+	cmd := pending.GetCommand()
+	result := keydb.CommandResult{Details: map[string]string{}}
+	// Server has validated the command too, but this computer has the final say.
+	err := cmd.Validate(uuid)
+	if err == nil {
+		switch cmd.Action {
+		case keydb.CMD_MOUNT:
+			result.Details, err = mountCryptDev(client, uuid)
+		case keydb.CMD_UMOUNT:
+			// Similar to mount, umount a disk that is not mounted is a failure and results in no other negative consequence.
+			var msg string
+			if msg, result.Details = UmountCryptDev(uuid, cmd.Params[keydb.CMD_PARAM_ON_BUSY]); msg != "Success" {
+				err = errors.New(msg)
+			}
+		case keydb.CMD_REMOUNT_RO:
+			result.Details["mount_point"], err = routine.RemountDiskReadOnly(uuid)
+		case keydb.CMD_LOCK:
+			result.Details, err = lockCryptDev(uuid, cmd.Params[keydb.CMD_PARAM_ON_BUSY])
+		case keydb.CMD_RUN_HOOK:
+			result.Details, err = routine.RunHook(cmd.Params[keydb.CMD_PARAM_HOOK], uuid)
+		case keydb.CMD_REPORT_STATUS:
+			result.Details, err = routine.GetDiskStatus(uuid)
+		case keydb.CMD_ROTATE_KEY:
+			err = routine.RotateDiskKey(client, uuid, cmd.ID)
+		case keydb.CMD_SELF_DESTRUCT:
+			if result.Details, err = lockCryptDev(uuid, keydb.ON_BUSY_FAIL); err == nil {
+				err = routine.SelfDestructDisk(uuid)
+			}
 		}
-	} else if cmd.Content == PendingCommandUmount {
-		// Similar to mount, umount a disk that is not mounted is a failure and results in no other negative consequence.
-		result = UmountCryptDev(uuid)
-	} else {
-		result = fmt.Sprintf("Client does not understand command \"%v\"", cmd.Content)
 	}
-	log.Printf("ExecutePendingCommand: result is %s", result)
+	result.Success = err == nil
+	result.Finished = time.Now()
+	result.Message = "Success"
+	if err != nil {
+		result.Message = err.Error()
+	}
+	log.Printf("ExecutePendingCommand: result of %s is %s", cmd.Action, result.Message)
 	if err := client.SaveCommandResult(keyserv.SaveCommandResultReq{
 		UUID:           uuid,
-		CommandContent: cmd.Content,
-		Result:         result,
+		CommandContent: pending.Content,
+		Result:         result.Message,
+		CommandID:      cmd.ID,
+		Outcome:        result,
 	}); err != nil {
 		log.Printf("ExecutePendingCommand: failed to save command result - %v", err)
 	}
-	return
 }
@@ -0,0 +1,191 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/fs"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/routine"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Exit status of OCF resource agent actions, as defined by the OCF resource agent API.
+const (
+	OCF_SUCCESS           = 0 // OCF_SUCCESS means the action succeeded, or the disk is unlocked, mounted, and kept alive.
+	OCF_ERR_GENERIC       = 1 // OCF_ERR_GENERIC means the action failed, or the disk is in a state that needs recovery.
+	OCF_ERR_UNIMPLEMENTED = 3 // OCF_ERR_UNIMPLEMENTED means the action is not supported.
+	OCF_ERR_INSTALLED     = 5 // OCF_ERR_INSTALLED means the disk is not present on this computer.
+	OCF_ERR_CONFIGURED    = 6 // OCF_ERR_CONFIGURED means the UUID or the client configuration is invalid.
+	OCF_NOT_RUNNING       = 7 // OCF_NOT_RUNNING means the disk is closed.
+
+	OCF_START_TIMEOUT_ENV = "OCF_RESKEY_CRM_meta_timeout" // OCF_START_TIMEOUT_ENV tells the timeout of an action in milliseconds.
+	OCF_START_RETRY_SEC   = 60                            // OCF_START_RETRY_SEC is the time to keep retrieving the key if the timeout is not told.
+	OCF_START_MARGIN_SEC  = 10                            // OCF_START_MARGIN_SEC is left of the timeout for unlocking and mounting the disk.
+)
+
+// OCF_META_DATA describes the resource agent to cluster resource manager.
+const OCF_META_DATA = `<?xml version="1.0"?>
+<!DOCTYPE resource-agent SYSTEM "ra-api-1.dtd">
+<resource-agent name="cryptctl" version="1.0">
+  <version>1.0</version>
+  <longdesc lang="en">
+Unlock and mount a shared disk encrypted by cryptctl using the key retrieved from key server, keep it alive on key server,
+and close it and release its key on stop. Key server hands the key to as many computers as the key's maximum number of
+computers, and the cryptctl-client service must run on all nodes to keep the disk alive.
+  </longdesc>
+  <shortdesc lang="en">Shared disk encrypted by cryptctl</shortdesc>
+  <parameters>
+    <parameter name="uuid" unique="1" required="1">
+      <longdesc lang="en">UUID of the encrypted disk.</longdesc>
+      <shortdesc lang="en">Disk UUID</shortdesc>
+      <content type="string"/>
+    </parameter>
+  </parameters>
+  <actions>
+    <action name="start" timeout="120s"/>
+    <action name="stop" timeout="60s"/>
+    <action name="monitor" timeout="30s" interval="30s" depth="0"/>
+    <action name="validate-all" timeout="30s"/>
+    <action name="meta-data" timeout="5s"/>
+  </actions>
+</resource-agent>
+`
+
+/*
+Sub-command: act as OCF resource agent of an encrypted disk so that a Pacemaker cluster unlocks, closes, and monitors
+the disk as a cluster resource. Return the exit status of the action.
+*/
+func OCFResourceAgent(action, uuid string) int {
+	switch action {
+	case "meta-data":
+		fmt.Print(OCF_META_DATA)
+		return OCF_SUCCESS
+	case "start", "stop", "monitor", "validate-all":
+	default:
+		log.Printf("OCF action \"%s\" is not supported", action)
+		return OCF_ERR_UNIMPLEMENTED
+	}
+	if err := keydb.ValidateUUID(uuid); err != nil {
+		log.Print(err)
+		return OCF_ERR_CONFIGURED
+	}
+	switch action {
+	case "start":
+		return ocfStart(uuid)
+	case "stop":
+		return ocfStop(uuid)
+	case "monitor":
+		return ocfMonitor(uuid)
+	default:
+		return ocfValidate(uuid)
+	}
+}
+
+// Make sure that the disk is present on this computer and the client configuration names a key server.
+func ocfValidate(uuid string) int {
+	if _, found := fs.GetBlockDevices().GetByCriteria(uuid, "", "", "", "", "", ""); !found {
+		log.Printf("The disk \"%s\" is not present on this computer", uuid)
+		return OCF_ERR_INSTALLED
+	}
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		log.Print(err)
+		return OCF_ERR_CONFIGURED
+	} else if sysconf.GetString(keyserv.CLIENT_CONF_HOST, "") == "" {
+		log.Print(MSG_UNLOCK_IS_NOP)
+		return OCF_ERR_CONFIGURED
+	}
+	return OCF_SUCCESS
+}
+
+/*
+The disk is running if its crypt device is active and mounted, and it is kept alive on key server. A disk that is
+unlocked but no longer kept alive has been rejected by key server, e.g. fenced, and must be recovered.
+*/
+func ocfMonitor(uuid string) int {
+	unlockedDev, found := routine.GetUnlockedDevice(uuid)
+	if !found {
+		return OCF_NOT_RUNNING
+	}
+	if _, err := fs.CryptStatus(unlockedDev.Name); err != nil {
+		log.Print(err)
+		return OCF_ERR_GENERIC
+	} else if unlockedDev.MountPoint == "" {
+		log.Printf("The disk \"%s\" is unlocked as \"%s\" but it is not mounted", uuid, unlockedDev.Path)
+		return OCF_ERR_GENERIC
+	} else if !isKeptAlive(uuid) {
+		log.Printf("The disk \"%s\" is no longer kept alive, key server may have rejected this computer", uuid)
+		return OCF_ERR_GENERIC
+	}
+	return OCF_SUCCESS
+}
+
+// Retrieve the key, unlock and mount the disk, then let client daemon keep it alive.
+func ocfStart(uuid string) int {
+	if ocfMonitor(uuid) == OCF_SUCCESS {
+		return OCF_SUCCESS
+	}
+	if status := ocfValidate(uuid); status != OCF_SUCCESS {
+		return status
+	}
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, false)
+	if err != nil {
+		log.Print(err)
+		return OCF_ERR_CONFIGURED
+	}
+	client, err := keyserv.NewCryptClientFromSysconfig(sysconf)
+	if err != nil {
+		log.Print(err)
+		return OCF_ERR_CONFIGURED
+	}
+	// Without heartbeat the lease expires and another node may take over the disk
+	if !sys.SystemctlIsRunning(CLIENT_DAEMON) {
+		if err := sys.SystemctlStart(CLIENT_DAEMON); err != nil {
+			log.Printf("Failed to start %s that keeps the disk alive - %v", CLIENT_DAEMON, err)
+			return OCF_ERR_GENERIC
+		}
+	}
+	if _, err := routine.AutoOnlineUnlockFS(os.Stderr, client, uuid, getOCFStartRetrySec()); err != nil {
+		log.Print(err)
+		return OCF_ERR_GENERIC
+	}
+	if err := routine.RegisterAliveDisk(uuid); err != nil {
+		log.Print(err)
+		return OCF_ERR_GENERIC
+	}
+	if ocfMonitor(uuid) != OCF_SUCCESS {
+		return OCF_ERR_GENERIC
+	}
+	return OCF_SUCCESS
+}
+
+/*
+Umount and close the disk, then release its key so that another node may take over the disk right away. Once the disk
+is closed the stop succeeds even if key server cannot be reached, the key is then released when its lease expires.
+*/
+func ocfStop(uuid string) int {
+	if _, found := routine.GetUnlockedDevice(uuid); found {
+		if _, _, err := routine.CloseDisk(os.Stderr, uuid, keydb.ON_BUSY_FAIL); err != nil {
+			log.Printf("Failed to close disk \"%s\" - %v", uuid, err)
+			return OCF_ERR_GENERIC
+		}
+	}
+	if err := releaseClosedDisk(uuid); err != nil {
+		log.Printf("The key of disk \"%s\" will be released after its lease expires - %v", uuid, err)
+	}
+	return OCF_SUCCESS
+}
+
+// Keep retrieving the key until shortly before cluster gives up on the start action.
+func getOCFStartRetrySec() int64 {
+	timeoutMS, err := strconv.ParseInt(os.Getenv(OCF_START_TIMEOUT_ENV), 10, 64)
+	if err != nil || timeoutMS/1000 <= 2*OCF_START_MARGIN_SEC {
+		return OCF_START_RETRY_SEC
+	}
+	return timeoutMS/1000 - OCF_START_MARGIN_SEC
+}
@@ -12,23 +12,51 @@ import (
 	"github.com/HouzuoGuo/cryptctl/sys"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	SERVER_DAEMON      = "cryptctl-server"
-	SERVER_CONFIG_PATH = "/etc/sysconfig/cryptctl-server"
-	SERVER_GENTLS_PATH = "/etc/cryptctl/servertls"
-	TIME_OUTPUT_FORMAT = "2006-01-02 15:04:05"
-	MIN_PASSWORD_LEN   = 10
-
-	PendingCommandMount  = "mount"  // PendingCommandMount is the content of a pending command that tells client computer to mount that disk.
-	PendingCommandUmount = "umount" // PendingCommandUmount is the content of a pending command that tells client computer to umount that disk.
+	SERVER_DAEMON       = "cryptctl-server"
+	SERVER_CONFIG_PATH  = "/etc/sysconfig/cryptctl-server"
+	SERVER_GENTLS_PATH  = "/etc/cryptctl/servertls"
+	SERVER_CA_CERT_FILE = "ca.crt"
+	SERVER_CA_KEY_FILE  = "ca.key"
+	SERVER_CRL_FILE     = "revoked.crl"
+	TIME_OUTPUT_FORMAT  = "2006-01-02 15:04:05"
+	MIN_PASSWORD_LEN    = 10
+	MSG_NEW_TOKEN       = "New enrolment token is %s\nPlace it into file %s on the computers that should unlock the disk.\n"
+	MSG_API_TOKEN_DONE  = `New HTTP API token of %s role is:
+  %s
+Present it in header "Authorization: Bearer TOKEN". The token is not shown again, key server only keeps its hash in
+%s as "%s". Restart key server to accept the token.
+`
+
+	MSG_ASK_SELECTOR           = "Which disks and computers should receive the command? (%s=TAG %s=TAG %s=NAME %s=ADDRESS %s=UUID, space-separated)"
+	MSG_ASK_TAGS               = "Tags that group disks for fleet-wide commands (comma-separated), or \"none\""
+	MSG_ASK_DUAL_CONTROL_UUIDS = "A second administrator has to confirm the command, which disks does it apply to? (comma-separated UUIDs)"
+
+	MSG_ASK_NOT_BEFORE = "The key may not be used without password before (YYYY-MM-DD HH:MM), or \"none\""
+	MSG_ASK_NOT_AFTER  = "The key may not be used without password after (YYYY-MM-DD HH:MM), or \"none\""
+	MSG_ASK_WINDOWS    = "Times of the week the key may be used, such as \"mon-fri 08:00-18:00\" (semicolon-separated), or \"any\""
+	MSG_ASK_NETWORKS   = "Networks the computers must be in, such as 10.0.0.0/8 (comma-separated), or \"any\""
+	MSG_ASK_APPROVAL   = "Should an administrator approve each computer before it retrieves the key?"
+	POLICY_TIME_FORMAT = "2006-01-02 15:04"
+
+	MSG_ASK_SELF_LOCK       = "What should a computer do to the disk once key server no longer considers it alive (%s, %s, %s, %s)"
+	MSG_ASK_SELF_LOCK_GRACE = "How many seconds should the computer try to re-acquire the key before locking the disk"
+	MSG_ASK_DENY_REACQUIRE  = "Should a computer rejected by key server be approved before it retrieves the key again?"
+	MSG_ASK_MAX_OFFLINE     = "How many seconds may a computer stay unable to reach key server before locking the disk (0 for no limit)"
+
+	PendingCommandMount  = keydb.CMD_MOUNT  // PendingCommandMount is the content of a pending command that tells client computer to mount that disk.
+	PendingCommandUmount = keydb.CMD_UMOUNT // PendingCommandUmount is the content of a pending command that tells client computer to umount that disk.
 )
 
 /*
@@ -165,7 +193,7 @@ Would you like to re-configure it?`) {
 	} else {
 		// Propose to generate a self-signed certificate
 		if tlsCert := sys.InputAbsFilePath(false, "", `PEM-encoded TLS certificate or a certificate chain file
-(leave blank to auto-generate self-signed certificate)`); tlsCert == "" {
+(leave blank to auto-generate a certificate authority and server certificate)`); tlsCert == "" {
 			generateCert = true
 		} else {
 			sysconf.Set(keyserv.SRV_CONF_TLS_CERT, tlsCert)
@@ -180,42 +208,70 @@ Would you like to re-configure it?`) {
 		if preferredHostName := sys.Input(false, certCommonName, "Host name for the generated certificate"); preferredHostName != "" {
 			certCommonName = preferredHostName
 		}
+		// Ask for the subject and validity of certificate authority, which issues server and client certificates.
+		caSubject := keyserv.CertSubject{CommonName: certCommonName + " cryptctl CA"}
+		caSubject.CommonName = sys.Input(false, caSubject.CommonName, "Common name of the certificate authority")
+		if caSubject.CommonName == "" {
+			caSubject.CommonName = certCommonName + " cryptctl CA"
+		}
+		caSubject.Organisation = sys.Input(false, "", "(Optional) Organisation name")
+		caSubject.OrganisationalUnit = sys.Input(false, "", "(Optional) Organisational unit")
+		caSubject.Locality = sys.Input(false, "", "(Optional) City or locality")
+		caSubject.Province = sys.Input(false, "", "(Optional) State or province")
+		caSubject.Country = sys.Input(false, "", "(Optional) Two-letter country code")
+		caSubject.Email = sys.Input(false, "", "(Optional) Email address of certificate authority administrator")
+		caDays := sys.InputInt(false, keyserv.CA_DEFAULT_VALIDITY_DAYS, 1, 36500, "Validity of the certificate authority in days")
+		if caDays == 0 {
+			caDays = keyserv.CA_DEFAULT_VALIDITY_DAYS
+		}
+		serverDays := sys.InputInt(false, keyserv.SERVER_CERT_DEFAULT_VALIDITY_DAYS, 1, 36500, "Validity of the server certificate in days")
+		if serverDays == 0 {
+			serverDays = keyserv.SERVER_CERT_DEFAULT_VALIDITY_DAYS
+		}
+		clientDays := sys.InputInt(false, sysconf.GetInt(keyserv.SRV_CONF_CLIENT_CERT_DAYS, keyserv.CLIENT_CERT_DEFAULT_VALIDITY_DAYS),
+			1, 36500, "Validity of client certificates issued upon enrolment in days")
+		if clientDays == 0 {
+			clientDays = sysconf.GetInt(keyserv.SRV_CONF_CLIENT_CERT_DAYS, keyserv.CLIENT_CERT_DEFAULT_VALIDITY_DAYS)
+		}
 		if err := os.MkdirAll(SERVER_GENTLS_PATH, 0700); err != nil {
 			return fmt.Errorf("Failed to create directory \"%s\" for storing generated certificates - %v", SERVER_GENTLS_PATH, err)
 		}
-		// While openssl generates the certificate, print dots to stdout to show that program is busy.
-		fmt.Println("Generating certificate...")
-		opensslDone := make(chan bool, 1)
-		go func() {
-			for {
-				select {
-				case <-opensslDone:
-					return
-				case <-time.After(1 * time.Second):
-					fmt.Print(".")
-					os.Stdout.Sync()
-				}
-			}
-		}()
+		caCertPath := path.Join(SERVER_GENTLS_PATH, SERVER_CA_CERT_FILE)
+		caKeyPath := path.Join(SERVER_GENTLS_PATH, SERVER_CA_KEY_FILE)
+		crlPath := path.Join(SERVER_GENTLS_PATH, SERVER_CRL_FILE)
+		if err := keyserv.GenerateCertAuthority(caSubject, caDays, caCertPath, caKeyPath); err != nil {
+			return err
+		}
+		ca, err := keyserv.LoadCertAuthority(caCertPath, caKeyPath, crlPath)
+		if err != nil {
+			return err
+		}
 		certPath := path.Join(SERVER_GENTLS_PATH, certCommonName+".crt")
 		keyPath := path.Join(SERVER_GENTLS_PATH, certCommonName+".key")
-		err := routine.GenerateSelfSignedCertificate(certCommonName, certPath, keyPath)
-		opensslDone <- true
-		if err != nil {
+		if err := ca.IssueServerCert(certCommonName, serverDays, certPath, keyPath); err != nil {
 			return err
 		}
 		fmt.Printf(`
-Self-signed certificate has been generated for host name "%s":
+Certificate authority has been generated:
+%s
+%s
+
+Server certificate has been issued by the authority for host name "%s":
 %s
 %s
 
 Important notes for client computers:
-- They must have a copy of certificate file "%s" to communicate securely with this server.
+- They must have a copy of certificate authority file "%s" to communicate securely with this server.
 - In cryptctl commands, the key server's host name must use "%s".
 - When cryptctl commands ask for key server's CA, they must be given "/path/to/%s".
+- "cryptctl enrol-client" obtains a client certificate along with a copy of the authority file.
 - Consult manual page cryptctl(8) section Communication Security for more information.
 
-`, certCommonName, certPath, keyPath, path.Base(certPath), certCommonName, path.Base(certPath))
+`, caCertPath, caKeyPath, certCommonName, certPath, keyPath, path.Base(caCertPath), certCommonName, path.Base(caCertPath))
+		sysconf.Set(keyserv.SRV_CONF_CA_CERT, caCertPath)
+		sysconf.Set(keyserv.SRV_CONF_CA_KEY, caKeyPath)
+		sysconf.Set(keyserv.SRV_CONF_TLS_CRL, crlPath)
+		sysconf.Set(keyserv.SRV_CONF_CLIENT_CERT_DAYS, clientDays)
 		// Point sysconfig values to the generated certificate
 		sysconf.Set(keyserv.SRV_CONF_TLS_CERT, certPath)
 		sysconf.Set(keyserv.SRV_CONF_TLS_KEY, keyPath)
@@ -245,14 +301,20 @@ Important notes for client computers:
 		sysconf.Set(keyserv.SRV_CONF_KEYDB_DIR, keyDBDir)
 	}
 	// Walk through client certificate verification settings
-	validateClient := sys.InputBool(sysconf.GetString(keyserv.SRV_CONF_TLS_CA, "") != "",
+	hasBuiltInCA := sysconf.GetString(keyserv.SRV_CONF_CA_CERT, "") != ""
+	validateClient := sys.InputBool(sysconf.GetString(keyserv.SRV_CONF_TLS_CA, "") != "" || hasBuiltInCA,
 		"Should clients present their certificate in order to access this server?")
 	sysconf.Set(keyserv.SRV_CONF_TLS_VALIDATE_CLIENT, validateClient)
 	if validateClient {
+		// Built-in certificate authority issues client certificates upon enrolment, hence another authority is optional.
+		caPrompt := "PEM-encoded TLS certificate authority that will issue client certificates"
+		if hasBuiltInCA {
+			caPrompt = "(Optional) PEM-encoded TLS certificate authority that issues client certificates in addition to the built-in authority"
+		}
 		sysconf.Set(keyserv.SRV_CONF_TLS_CA,
-			sys.InputAbsFilePath(true,
+			sys.InputAbsFilePath(!hasBuiltInCA,
 				sysconf.GetString(keyserv.SRV_CONF_TLS_CA, ""),
-				"PEM-encoded TLS certificate authority that will issue client certificates"))
+				caPrompt))
 	}
 	// Walk through KMIP settings
 	useExternalKMIPServer := sys.InputBool(sysconf.GetString(keyserv.SRV_CONF_KMIP_SERVER_ADDRS, "") != "",
@@ -389,6 +451,23 @@ func KeyRPCDaemon() error {
 		return fmt.Errorf("KeyRPCDaemon: failed to listen for domain socket connections - %v", err)
 	}
 	go srv.HandleUnixConnections()
+	if srvConf.APIPort != 0 {
+		if err := srv.ListenAPI(); err != nil {
+			return fmt.Errorf("KeyRPCDaemon: failed to listen for HTTP API connections - %v", err)
+		}
+		go srv.HandleAPIConnections()
+	}
+	// TLS material is reloaded upon file changes and SIGHUP
+	go srv.MonitorTLS()
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for range reloadSignal {
+			if err := srv.ReloadTLS(); err != nil {
+				log.Printf("KeyRPCDaemon: failed to reload TLS certificate, keep using the previous one - %v", err)
+			}
+		}
+	}()
 	srv.HandleTCPConnections() // intentionally block here
 	return nil
 }
@@ -407,10 +486,9 @@ func ListKeys() error {
 	fmt.Println("Used By         When                ID           UUID                                 Max.Users Num.Users Mount Point")
 	for _, rec := range recList {
 		outputTime := time.Unix(rec.LastRetrieval.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
-		rec.RemoveDeadHosts()
 		fmt.Printf("%-15s %-19s %-12s %-36s %-9s %-9s %s\n", rec.LastRetrieval.IP, outputTime,
 			rec.ID, rec.UUID,
-			strconv.Itoa(rec.MaxActive), strconv.Itoa(len(rec.AliveMessages)), rec.MountPoint)
+			strconv.Itoa(rec.MaxActive), strconv.Itoa(len(db.ListLeases(rec.UUID))), rec.MountPoint)
 	}
 	return nil
 }
@@ -439,6 +517,40 @@ func EditKey(uuid string) error {
 	if newMaxActive != 0 {
 		rec.MaxActive = newMaxActive
 	}
+	allowedClients := "any"
+	if len(rec.AllowedClients) > 0 {
+		allowedClients = strings.Join(rec.AllowedClients, ",")
+	}
+	newAllowedClients, err := InputAllowedClients(allowedClients, true)
+	if err != nil {
+		return err
+	}
+	rec.AllowedClients = make([]string, 0, len(newAllowedClients))
+	var newToken string
+	for _, entry := range newAllowedClients {
+		if entry == keydb.CLIENT_ID_NEW_TOKEN {
+			var tokenEntry string
+			if newToken, tokenEntry, err = keydb.NewClientToken(); err != nil {
+				return err
+			}
+			entry = tokenEntry
+		}
+		rec.AllowedClients = append(rec.AllowedClients, entry)
+	}
+	tags := "none"
+	if len(rec.Tags) > 0 {
+		tags = strings.Join(rec.Tags, ",")
+	}
+	if newTags := sys.Input(false, tags, MSG_ASK_TAGS); newTags == "none" {
+		rec.Tags = []string{}
+	} else if newTags != "" {
+		if rec.Tags, err = keydb.NormaliseTags(strings.Split(newTags, ",")); err != nil {
+			return err
+		}
+	}
+	if rec.Policy, err = inputPolicy(rec.Policy); err != nil {
+		return err
+	}
 	newAliveTimeout := sys.InputInt(false, rec.AliveIntervalSec*rec.AliveCount, DEFUALT_ALIVE_TIMEOUT, 3600*24*7, MSG_ASK_ALIVE_TIMEOUT)
 	if newAliveTimeout != 0 {
 		roundedAliveTimeout := newAliveTimeout / routine.REPORT_ALIVE_INTERVAL_SEC * routine.REPORT_ALIVE_INTERVAL_SEC
@@ -452,6 +564,9 @@ func EditKey(uuid string) error {
 		return fmt.Errorf("Failed to update database record - %v", err)
 	}
 	fmt.Println("Record has been updated successfully.")
+	if newToken != "" {
+		fmt.Printf(MSG_NEW_TOKEN, newToken, routine.GetClientTokenFile(uuid))
+	}
 	if sys.SystemctlIsRunning(SERVER_DAEMON) {
 		fmt.Println("Restarting key server...")
 		if err := sys.SystemctlEnableRestart(SERVER_DAEMON); err != nil {
@@ -462,6 +577,75 @@ func EditKey(uuid string) error {
 	return nil
 }
 
+// Interactively gather the usage policy of a key, the current policy serves as default answers.
+func inputPolicy(pol keydb.Policy) (keydb.Policy, error) {
+	inputMoment := func(current time.Time, format string) (time.Time, error) {
+		hint := "none"
+		if !current.IsZero() {
+			hint = current.Format(POLICY_TIME_FORMAT)
+		}
+		answer := sys.Input(false, hint, format)
+		if answer == "" {
+			return current, nil
+		} else if answer == "none" {
+			return time.Time{}, nil
+		}
+		moment, err := time.ParseInLocation(POLICY_TIME_FORMAT, answer, time.Local)
+		if err != nil {
+			return current, fmt.Errorf("\"%s\" should look like YYYY-MM-DD HH:MM", answer)
+		}
+		return moment, nil
+	}
+	var err error
+	if pol.NotBefore, err = inputMoment(pol.NotBefore, MSG_ASK_NOT_BEFORE); err != nil {
+		return pol, err
+	}
+	if pol.NotAfter, err = inputMoment(pol.NotAfter, MSG_ASK_NOT_AFTER); err != nil {
+		return pol, err
+	}
+	windows := make([]string, 0, len(pol.Windows))
+	for _, window := range pol.Windows {
+		windows = append(windows, window.String())
+	}
+	if len(windows) == 0 {
+		windows = []string{"any"}
+	}
+	if answer := sys.Input(false, strings.Join(windows, ";"), MSG_ASK_WINDOWS); answer == "any" {
+		pol.Windows = nil
+	} else if answer != "" {
+		pol.Windows = nil
+		for _, windowStr := range strings.Split(answer, ";") {
+			window, err := keydb.ParseTimeWindow(windowStr)
+			if err != nil {
+				return pol, err
+			}
+			pol.Windows = append(pol.Windows, window)
+		}
+	}
+	networks := "any"
+	if len(pol.Networks) > 0 {
+		networks = strings.Join(pol.Networks, ",")
+	}
+	if answer := sys.Input(false, networks, MSG_ASK_NETWORKS); answer == "any" {
+		pol.Networks = nil
+	} else if answer != "" {
+		pol.Networks = strings.Split(strings.Replace(answer, " ", "", -1), ",")
+	}
+	pol.RequireApproval = sys.InputBool(pol.RequireApproval, MSG_ASK_APPROVAL)
+	action, graceSec := pol.GetSelfLock()
+	pol.SelfLock = sys.Input(false, action, MSG_ASK_SELF_LOCK,
+		keydb.SELF_LOCK_LOG, keydb.SELF_LOCK_NOTIFY, keydb.SELF_LOCK_REMOUNT_RO, keydb.SELF_LOCK_LOCK)
+	if pol.SelfLock == "" {
+		pol.SelfLock = action
+	}
+	if pol.SelfLock == keydb.SELF_LOCK_LOCK {
+		pol.SelfLockGraceSec = sys.InputInt(false, graceSec, 0, 86400, MSG_ASK_SELF_LOCK_GRACE)
+	}
+	pol.DenyReacquire = sys.InputBool(pol.DenyReacquire, MSG_ASK_DENY_REACQUIRE)
+	pol.MaxOfflineSec = sys.InputInt(false, pol.MaxOfflineSec, 0, 31536000, MSG_ASK_MAX_OFFLINE)
+	return pol, pol.Validate()
+}
+
 // Server - show key record details but hide key content
 func ShowKey(uuid string) error {
 	sys.LockMem()
@@ -473,24 +657,41 @@ func ShowKey(uuid string) error {
 	if !found {
 		return fmt.Errorf("Cannot find record for UUID %s", uuid)
 	}
-	rec.RemoveDeadHosts()
 	fmt.Printf("%-34s%s\n", "UUID", rec.UUID)
 	fmt.Printf("%-34s%s\n", "Mount Point", rec.MountPoint)
 	fmt.Printf("%-34s%s\n", "Mount Options", rec.GetMountOptionStr())
 	fmt.Printf("%-34s%d\n", "Maximum Computers", rec.MaxActive)
 	fmt.Printf("%-34s%d\n", "Computer Keep-Alive Timeout (sec)", rec.AliveCount*rec.AliveIntervalSec)
+	if len(rec.AllowedClients) == 0 {
+		fmt.Printf("%-34s%s\n", "Allowed Computers", "any")
+	} else {
+		for i, entry := range rec.AllowedClients {
+			label := ""
+			if i == 0 {
+				label = "Allowed Computers"
+			}
+			fmt.Printf("%-34s%s\n", label, entry)
+		}
+	}
+	fmt.Printf("%-34s%s\n", "Tags", strings.Join(rec.Tags, ","))
+	fmt.Printf("%-34s%s\n", "Usage Policy", rec.Policy)
+	for ip, until := range rec.Approvals {
+		if time.Now().Before(until) {
+			fmt.Printf("%-34s%s until %s\n", "Approved Computer", ip, until.Format(TIME_OUTPUT_FORMAT))
+		}
+	}
+	for ip, moment := range rec.Rejected {
+		fmt.Printf("%-34s%s since %s\n", "Rejected Computer", ip, moment.Format(TIME_OUTPUT_FORMAT))
+	}
 	fmt.Printf("%-34s%s (%s)\n", "Last Retrieved By", rec.LastRetrieval.IP, rec.LastRetrieval.Hostname)
 	outputTime := time.Unix(rec.LastRetrieval.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
 	fmt.Printf("%-34s%s\n", "Last Retrieved On", outputTime)
-	fmt.Printf("%-34s%d\n", "Current Active Computers", len(rec.AliveMessages))
-	if len(rec.AliveMessages) > 0 {
-		// Print alive message's details from each computer
-		for _, msgs := range rec.AliveMessages {
-			for _, msg := range msgs {
-				outputTime := time.Unix(msg.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
-				fmt.Printf("%-34s%s %s (%s)\n", "", outputTime, msg.IP, msg.Hostname)
-			}
-		}
+	leases := db.ListLeases(rec.UUID)
+	fmt.Printf("%-34s%d\n", "Current Active Computers", len(leases))
+	// Print the lease held by each computer
+	for _, lease := range leases {
+		fmt.Printf("%-34s%s %s (%s) lease %s until %s\n", "", lease.Granted.Format(TIME_OUTPUT_FORMAT), lease.IP, lease.Hostname,
+			lease.ID, lease.Expiry.Format(TIME_OUTPUT_FORMAT))
 	}
 	fmt.Printf("%-34s%d\n", "Pending Commands", len(rec.PendingCommands))
 	if len(rec.PendingCommands) > 0 {
@@ -498,8 +699,12 @@ func ShowKey(uuid string) error {
 			for _, cmd := range cmds {
 				validFromStr := cmd.ValidFrom.Format(TIME_OUTPUT_FORMAT)
 				validTillStr := cmd.ValidFrom.Add(cmd.Validity).Format(TIME_OUTPUT_FORMAT)
-				fmt.Printf("%45s\tValidFrom=\"%s\"\tValidTo=\"%s\"\tContent=\"%v\"\tFetched? %v\tResult=\"%v\"\n",
-					ip, validFromStr, validTillStr, cmd.Content, cmd.SeenByClient, cmd.ClientResult)
+				typed := cmd.GetCommand()
+				fmt.Printf("%45s\tValidFrom=\"%s\"\tValidTo=\"%s\"\tAction=\"%s\"\tParams=%v\tFetched? %v\tResult=\"%v\"\n",
+					ip, validFromStr, validTillStr, typed.Action, typed.Params, cmd.SeenByClient, cmd.ClientResult)
+				for name, value := range cmd.Result.Details {
+					fmt.Printf("%45s\t%s=\"%s\"\n", "", name, value)
+				}
 			}
 		}
 	}
@@ -507,56 +712,299 @@ func ShowKey(uuid string) error {
 	return nil
 }
 
-// SendCommand is a server routine that saves a new pending command to database record.
+/*
+SendCommand is a server routine that issues a new pending command to a computer for a disk. Under dual control, a
+self-destruct command waits for a second administrator to confirm it.
+*/
 func SendCommand() error {
 	sys.LockMem()
-	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	client, password, err := connectToLocalServer()
 	if err != nil {
 		return err
 	}
+	// Interactively gather pending command details
+	uuid := sys.Input(true, "", "What is the UUID of disk affected by this command?")
+	if _, err := OpenKeyDB(uuid); err != nil {
+		return err
+	}
+	ip := sys.Input(true, "", "What is the IP address of computer who will receive this command?")
+	action, params, validity := inputCommand()
+	req := keyserv.SendCommandReq{
+		Password: password,
+		UUID:     uuid,
+		IP:       ip,
+		Action:   action,
+		Params:   params,
+		Validity: validity,
+		Admin:    routine.GetAdminName(),
+	}
+	if dualAction := keyserv.GetCommandDualControlAction(action); dualAction != "" {
+		if req.DualControlID, err = routine.WaitDualControl(os.Stdout, client, password, req.Admin, dualAction, []string{uuid}, askAdminToken); err != nil {
+			return err
+		}
+	}
+	if err := client.SendCommand(req); err != nil {
+		return err
+	}
+	fmt.Printf("All done! Computer %s will be informed of the command right away if it is connected, or when it comes online.\n", ip)
+	return nil
+}
+
+// Interactively gather the action, parameters, and validity of a pending command.
+func inputCommand() (action string, params map[string]string, validity time.Duration) {
+	actions := keydb.GetCommandActions()
+	for {
+		if action = sys.Input(false, PendingCommandUmount, "What should the computer do? (%s)", strings.Join(actions, "|")); action == "" {
+			action = PendingCommandUmount // default action is "umount"
+		}
+		if _, found := keydb.CommandParams[action]; found {
+			break
+		}
+	}
+	params = make(map[string]string)
+	for _, name := range keydb.CommandParams[action] {
+		params[name] = sys.Input(true, "", "Parameter \"%s\" of %s", name, action)
+	}
+	for _, name := range keydb.CommandOptionalParams[action] {
+		if val := sys.Input(false, "", "Optional parameter \"%s\" of %s", name, action); val != "" {
+			params[name] = val
+		}
+	}
+	expireMin := sys.InputInt(true, 10, 1, 10080, "In how many minutes does the command expire (including the result)?")
+	return action, params, time.Duration(expireMin) * time.Minute
+}
+
+// Connect to key server running on this computer via its domain socket, and check the password entered by user.
+func connectToLocalServer() (*keyserv.CryptClient, keyserv.HashedPassword, error) {
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return nil, keyserv.HashedPassword{}, err
+	}
 	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
-	// Test the connection and password
 	salt, err := client.GetSalt()
+	if err != nil {
+		return nil, keyserv.HashedPassword{}, err
+	}
+	hashedPassword := keyserv.HashPassword(salt, password)
+	if err := client.Ping(keyserv.PingRequest{Password: hashedPassword}); err != nil {
+		return nil, keyserv.HashedPassword{}, err
+	}
+	return client, hashedPassword, nil
+}
+
+/*
+SendFleetCommand is a server routine that issues a pending command to every disk and computer picked by a selector,
+such as all disks held by computers tagged "prod-hana".
+*/
+func SendFleetCommand() error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
 	if err != nil {
 		return err
 	}
-	if err := client.Ping(keyserv.PingRequest{Password: keyserv.HashPassword(salt, password)}); err != nil {
+	sel, err := keydb.ParseSelector(sys.Input(true, "", MSG_ASK_SELECTOR,
+		keydb.SELECTOR_HOST_TAG, keydb.SELECTOR_TAG, keydb.SELECTOR_HOSTNAME, keydb.SELECTOR_IP, keydb.SELECTOR_UUID))
+	if err != nil {
 		return err
 	}
-	// Interactively gather pending command details
-	uuid := sys.Input(true, "", "What is the UUID of disk affected by this command?")
-	db, err := OpenKeyDB(uuid)
+	action, params, validity := inputCommand()
+	req := keyserv.SendFleetCommandReq{
+		Password: password,
+		Selector: sel,
+		Action:   action,
+		Params:   params,
+		Validity: validity,
+		Admin:    routine.GetAdminName(),
+	}
+	if dualAction := keyserv.GetCommandDualControlAction(action); dualAction != "" {
+		var uuids []string
+		if action == keydb.CMD_SELF_DESTRUCT {
+			// Self-destruct only applies to the disk that its parameter names
+			uuids = []string{params[keydb.CMD_PARAM_CONFIRM_UUID]}
+		} else {
+			uuids = strings.Split(sys.Input(true, "", MSG_ASK_DUAL_CONTROL_UUIDS), ",")
+		}
+		if req.DualControlID, err = routine.WaitDualControl(os.Stdout, client, password, req.Admin, dualAction, uuids, askAdminToken); err != nil {
+			return err
+		}
+	}
+	resp, err := client.SendFleetCommand(req)
 	if err != nil {
 		return err
 	}
-	ip := sys.Input(true, "", "What is the IP address of computer who will receive this command?")
-	var cmd string
-	for {
-		if cmd = sys.Input(false, "umount", "What should the computer do? (%s|%s)", PendingCommandMount, PendingCommandUmount); cmd == "" {
-			cmd = "umount" // default action is "umount"
+	fmt.Printf("Command %s has been issued to %d disks:\n", action, len(resp.Targets))
+	for _, target := range resp.Targets {
+		fmt.Printf("%-30s %-45s %s\n", target.Hostname, target.IP, target.UUID)
+	}
+	fmt.Printf("Run \"cryptctl show-batch %s\" to see the outcome.\n", resp.Batch)
+	return nil
+}
+
+// ShowBatch is a server routine that prints the aggregated outcome of the commands issued by SendFleetCommand.
+func ShowBatch(batch string) error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
+	if err != nil {
+		return err
+	}
+	summary, err := client.GetBatch(keyserv.GetBatchReq{Password: password, Batch: batch})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Action %s: %d waiting, %d running, %d succeeded, %d failed\n",
+		summary.Action, summary.Waiting, summary.Running, summary.Succeeded, summary.Failed)
+	for _, entry := range summary.Entries {
+		state := "waiting"
+		if finished, success := entry.GetOutcome(); finished && success {
+			state = "succeeded"
+		} else if finished {
+			state = "failed: " + entry.Command.ClientResult
+		} else if entry.Command.SeenByClient {
+			state = "running"
 		}
-		if cmd == PendingCommandUmount {
-			break
-		} else if cmd == PendingCommandMount {
-			break
-		} else {
-			continue
+		fmt.Printf("%-30s %-45s %-36s %s\n", entry.Hostname, entry.IP, entry.UUID, state)
+	}
+	return nil
+}
+
+// TagHost is a server routine that replaces the tags of a computer, so that fleet-wide commands may select it.
+func TagHost(ip string, tags []string) error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
+	if err != nil {
+		return err
+	}
+	if err := client.TagHost(keyserv.TagHostReq{Password: password, IP: ip, Tags: tags}); err != nil {
+		return err
+	}
+	fmt.Printf("Computer %s is now tagged %v.\n", ip, tags)
+	return nil
+}
+
+/*
+ApproveRetrieval is a server routine that lets a computer retrieve a key once, despite the key's policy requiring
+approval. The computer has to retrieve the key within the validity.
+*/
+func ApproveRetrieval(uuid, ip string) error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
+	if err != nil {
+		return err
+	}
+	validityMin := sys.InputInt(true, 60, 1, int(keyserv.APPROVAL_MAX_VALIDITY.Minutes()), "In how many minutes does the approval expire?")
+	validity := time.Duration(validityMin) * time.Minute
+	if err := client.ApproveRetrieval(keyserv.ApproveRetrievalReq{Password: password, UUID: uuid, IP: ip, Validity: validity}); err != nil {
+		return err
+	}
+	fmt.Printf("Computer %s may retrieve the key of %s once within %d minutes.\n", ip, uuid, validityMin)
+	return nil
+}
+
+// ListLeases is a server routine that prints the leases of a key held by computers, or the leases of all keys.
+func ListLeases(uuid string) error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
+	if err != nil {
+		return err
+	}
+	leases, err := client.ListLeases(keyserv.ListLeasesReq{Password: password, UUID: uuid})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Total: %d leases (date and time are in zone %s)\n", len(leases), time.Now().Format("MST"))
+	// Max field length: 32 (ID), 36 (UUID), 15 (IP), 19 (Renewed), 19 (Expiry), last field (host name)
+	fmt.Printf("%-32s %-36s %-15s %-19s %-19s %s\n", "ID", "UUID", "IP", "Renewed", "Expiry", "Hostname")
+	for _, lease := range leases {
+		fmt.Printf("%-32s %-36s %-15s %-19s %-19s %s\n", lease.ID, lease.UUID, lease.IP,
+			lease.Renewed.Format(TIME_OUTPUT_FORMAT), lease.Expiry.Format(TIME_OUTPUT_FORMAT), lease.Hostname)
+	}
+	return nil
+}
+
+// RevokeLease is a server routine that revokes the lease of a key held by a computer.
+func RevokeLease(id string) error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
+	if err != nil {
+		return err
+	}
+	if err := client.RevokeLease(keyserv.RevokeLeaseReq{Password: password, ID: id}); err != nil {
+		return err
+	}
+	fmt.Printf("Lease %s has been revoked, the computer holding it will be told to let go of the key in its next heartbeat.\n", id)
+	return nil
+}
+
+// FenceHost is a server routine that takes away all keys from a computer fenced by a cluster.
+func FenceHost(host string) error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
+	if err != nil {
+		return err
+	}
+	fenced, err := client.FenceHost(keyserv.FenceHostReq{Password: password, Host: host})
+	if err != nil {
+		return err
+	}
+	if len(fenced) == 0 {
+		fmt.Printf("%s does not hold any key.\n", host)
+		return nil
+	}
+	fmt.Printf("%s no longer holds the keys of: %s\n", host, strings.Join(fenced, ", "))
+	return nil
+}
+
+// ListDualControl is a server routine that prints the requests that await confirmation by a second administrator.
+func ListDualControl() error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
+	if err != nil {
+		return err
+	}
+	reqs, err := client.ListDualControl(keyserv.DualControlReq{Password: password})
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		state := "awaiting confirmation"
+		if req.IsApproved() {
+			state = "confirmed by " + req.Approver.String()
 		}
+		fmt.Printf("%-16s %-12s %-40s %s, requested by %s, expires %s\n", req.ID, req.Action, strings.Join(req.UUIDs, ","),
+			state, req.Requester, req.Expiry.Format(TIME_OUTPUT_FORMAT))
 	}
-	expireMin := sys.InputInt(true, 10, 1, 10080, "In how many minutes does the command expire (including the result)?")
-	// Place the new pending command into database record
-	rec, _ := db.GetByUUID(uuid)
-	rec.AddPendingCommand(ip, keydb.PendingCommand{
-		ValidFrom: time.Now(),
-		Validity:  time.Duration(expireMin) * time.Minute,
-		Content:   cmd,
-	})
-	if _, err := db.Upsert(rec); err != nil {
-		return fmt.Errorf("Failed to update database record - %v", err)
+	return nil
+}
+
+// Ask the administrator for their own admin API token, which tells them apart from other administrators under dual control.
+func askAdminToken() string {
+	return sys.InputPassword(false, "", "Enter your admin API token (no echo), or leave empty if your client certificate is granted the admin role")
+}
+
+/*
+ConfirmDualControl is a server routine that confirms a request to retrieve or erase keys, or to issue self-destruct, as
+the second administrator, who must not be the administrator who made the request and must hold an admin API token.
+*/
+func ConfirmDualControl(id string) error {
+	sys.LockMem()
+	client, password, err := connectToLocalServer()
+	if err != nil {
+		return err
 	}
-	// Ask server to reload the record from disk
-	client.ReloadRecord(keyserv.ReloadRecordReq{Password: keyserv.HashPassword(salt, password), UUID: uuid})
-	fmt.Printf("All done! Computer %s will be informed of the command when it comes online and polls from this server.\n", ip)
+	req, err := client.GetDualControl(keyserv.DualControlReq{Password: password, ID: id})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s asks to %s of %s.\n", req.Requester, req.Action, strings.Join(req.UUIDs, ", "))
+	if !sys.InputBool(false, "Do you confirm the request?") {
+		fmt.Println("OK, the request is left unconfirmed.")
+		return nil
+	}
+	// Key server password is shared among administrators, the second administrator proves who they are by their own token.
+	if _, err := client.ConfirmDualControl(keyserv.DualControlReq{Password: password, Admin: routine.GetAdminName(), ID: id, APIToken: askAdminToken()}); err != nil {
+		return err
+	}
+	fmt.Printf("Request %s has been confirmed.\n", id)
 	return nil
 }
 
@@ -591,3 +1039,71 @@ func ClearPendingCommands() error {
 	fmt.Printf("All of %s's pending commands have been successfully cleared.\n", uuid)
 	return nil
 }
+
+/*
+Server - revoke a client certificate issued by the built-in certificate authority. The certificate is identified by its
+file or by its serial number (decimal, or hexadecimal with optional colons). Key server picks up the revocation
+without restarting.
+*/
+func RevokeClientCert(certFileOrSerial string) error {
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, false)
+	if err != nil {
+		return fmt.Errorf("RevokeClientCert: failed to read %s - %v", SERVER_CONFIG_PATH, err)
+	}
+	caCertPath := sysconf.GetString(keyserv.SRV_CONF_CA_CERT, "")
+	crlPath := sysconf.GetString(keyserv.SRV_CONF_TLS_CRL, "")
+	if caCertPath == "" || crlPath == "" {
+		return fmt.Errorf("Key server does not have a built-in certificate authority and revocation list, consider running \"cryptctl init-server\".")
+	}
+	ca, err := keyserv.LoadCertAuthority(caCertPath, sysconf.GetString(keyserv.SRV_CONF_CA_KEY, ""), crlPath)
+	if err != nil {
+		return err
+	}
+	var serial *big.Int
+	if certPEM, err := ioutil.ReadFile(certFileOrSerial); err == nil {
+		cert, err := keyserv.ParseCertPEM(certPEM)
+		if err != nil {
+			return fmt.Errorf("Failed to parse certificate \"%s\" - %v", certFileOrSerial, err)
+		} else if !ca.IsIssuerOf(cert) {
+			return fmt.Errorf("Certificate \"%s\" was not issued by the built-in certificate authority", certFileOrSerial)
+		}
+		serial = cert.SerialNumber
+	} else if decimal, ok := new(big.Int).SetString(certFileOrSerial, 10); ok {
+		serial = decimal
+	} else if hexadecimal, ok := new(big.Int).SetString(strings.Replace(certFileOrSerial, ":", "", -1), 16); ok {
+		serial = hexadecimal
+	} else {
+		return fmt.Errorf("\"%s\" is neither a certificate file nor a serial number", certFileOrSerial)
+	}
+	if err := ca.Revoke(serial); err != nil {
+		return err
+	}
+	fmt.Printf("Certificate of serial number %s has been revoked, key server will refuse it from now on.\n", serial)
+	return nil
+}
+
+/*
+Server - generate a new HTTP API token and grant it the role. The token is printed only once, key server only keeps
+its hash. Key server must be restarted to accept the new token.
+*/
+func NewAPIToken(roleName string) error {
+	role, err := keyserv.ParseRole(roleName)
+	if err != nil {
+		return err
+	}
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, false)
+	if err != nil {
+		return fmt.Errorf("NewAPIToken: failed to read %s - %v", SERVER_CONFIG_PATH, err)
+	}
+	token, entry, err := keydb.NewClientToken()
+	if err != nil {
+		return err
+	}
+	grants := sysconf.GetStringArray(keyserv.SRV_CONF_API_GRANTS, []string{})
+	sysconf.SetStrArray(keyserv.SRV_CONF_API_GRANTS, append(grants, role.String()+":"+entry))
+	if err := ioutil.WriteFile(SERVER_CONFIG_PATH, []byte(sysconf.ToText()), 0600); err != nil {
+		return fmt.Errorf(MSG_E_SAVE_SYSCONF, SERVER_CONFIG_PATH, err)
+	}
+	fmt.Printf(MSG_API_TOKEN_DONE, role, token, keyserv.SRV_CONF_API_GRANTS, entry)
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/HouzuoGuo/cryptctl/sys"
 	"os"
+	"os/exec"
 	"path"
 	"strconv"
 	"strings"
@@ -14,6 +15,7 @@ import (
 
 const (
 	BIN_CRYPTSETUP  = "/sbin/cryptsetup"
+	BIN_DMSETUP     = "/sbin/dmsetup"
 	LUKS_CIPHER     = "aes-xts-plain64:PBKDF2-sha512"
 	LUKS_HASH       = "sha512"
 	LUKS_KEY_SIZE_S = "512"
@@ -51,6 +53,25 @@ func CryptOpen(key []byte, blockDev, name string) error {
 	return nil
 }
 
+/*
+Call cryptsetup luksOpen on the block device node and let cryptsetup ask for a passphrase on the console. This is only
+useful if system administrator has added a passphrase to the encrypted disk as a fallback to the key server.
+*/
+func CryptOpenInteractive(blockDev, name string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	_, err := os.Stat(path.Join("/dev/mapper", name))
+	if err == nil {
+		return fmt.Errorf("CryptOpenInteractive: \"%s\" appears to have already been unlocked as \"%s\"", blockDev, name)
+	}
+	_, _, _, err = sys.Exec(os.Stdin, os.Stdout, os.Stderr, BIN_CRYPTSETUP, "luksOpen", blockDev, name)
+	if err != nil {
+		return fmt.Errorf("CryptOpenInteractive: failed to open \"%s\" as \"%s\" - %v", blockDev, name, err)
+	}
+	return nil
+}
+
 // Call cryptsetup erase on the block device node.
 func CryptErase(blockDev string) error {
 	if err := CheckBlockDevice(blockDev); err != nil {
@@ -80,6 +101,45 @@ func CryptErase(blockDev string) error {
 	return nil
 }
 
+/*
+Call cryptsetup luksAddKey to add the new key to the block device, the existing key authorises the operation. The new
+key is handed to cryptsetup via a pipe, so that it is never written to a file.
+*/
+func CryptAddKey(key, newKey []byte, blockDev string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	newKeyIn, newKeyOut, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("CryptAddKey: failed to create pipe - %v", err)
+	}
+	defer newKeyIn.Close()
+	go func() {
+		newKeyOut.Write(newKey)
+		newKeyOut.Close()
+	}()
+	cmd := exec.Command(BIN_CRYPTSETUP, "--batch-mode", "luksAddKey", "--key-file=-", blockDev, "/dev/fd/3")
+	cmd.Stdin = bytes.NewReader(key)
+	cmd.ExtraFiles = []*os.File{newKeyIn}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("CryptAddKey: failed to add key to \"%s\" - %v %s", blockDev, err, out)
+	}
+	return nil
+}
+
+// Call cryptsetup luksRemoveKey to remove the key slot of the key from the block device.
+func CryptRemoveKey(key []byte, blockDev string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	_, stdout, stderr, err := sys.Exec(bytes.NewReader(key), nil, nil,
+		BIN_CRYPTSETUP, "--batch-mode", "luksRemoveKey", "--key-file=-", blockDev)
+	if err != nil {
+		return fmt.Errorf("CryptRemoveKey: failed to remove key from \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return nil
+}
+
 // Call cryptsetup luksClose on the mapped device node.
 func CryptClose(name string) error {
 	_, stdout, stderr, err := sys.Exec(nil, nil, nil,
@@ -90,6 +150,25 @@ func CryptClose(name string) error {
 	return nil
 }
 
+// Return the open count of a device mapper device from the output of "dmsetup info -c --noheadings -o open".
+func ParseDMOpenCount(txt string) (int, error) {
+	count, err := strconv.Atoi(strings.TrimSpace(txt))
+	if err != nil {
+		return 0, fmt.Errorf("ParseDMOpenCount: malformed open count \"%s\"", strings.TrimSpace(txt))
+	}
+	return count, nil
+}
+
+// Return the number of times the mapped device node is held open, such as by a lazily umounted file system.
+func DMOpenCount(name string) (int, error) {
+	_, stdout, stderr, err := sys.Exec(nil, nil, nil,
+		BIN_DMSETUP, "info", "-c", "--noheadings", "-o", "open", name)
+	if err != nil {
+		return 0, fmt.Errorf("DMOpenCount: failed to read open count of \"%s\" - %v %s %s", name, err, stdout, stderr)
+	}
+	return ParseDMOpenCount(stdout)
+}
+
 // Represent a cryptsetup mapping currently effective on the system.
 type CryptMapping struct {
 	Type    string
@@ -65,3 +65,15 @@ Oops, secure memory pool already initialized
 		t.Fatalf("%+v", parsed)
 	}
 }
+
+func TestParseDMOpenCount(t *testing.T) {
+	if count, err := ParseDMOpenCount("    1\n"); err != nil || count != 1 {
+		t.Fatal(count, err)
+	}
+	if count, err := ParseDMOpenCount("0"); err != nil || count != 0 {
+		t.Fatal(count, err)
+	}
+	if _, err := ParseDMOpenCount("Device does not exist.\n"); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,144 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	CRYPTTAB_PATH = "/etc/crypttab"
+)
+
+// Represent an entry in /etc/crypttab.
+type CrypttabEntry struct {
+	Name    string   // Name is the name of the device mapper device to be created.
+	Device  string   // Device is the underlying block device, such as "UUID=xxx" or a device node path.
+	KeyFile string   // KeyFile is the path to key file, or "none" to ask for a password.
+	Options []string // Options are the comma-separated crypttab options such as "luks" and "_netdev".
+}
+
+// Convert the entry into a crypttab line.
+func (entry CrypttabEntry) ToText() string {
+	keyFile := entry.KeyFile
+	if keyFile == "" {
+		keyFile = "none"
+	}
+	line := fmt.Sprintf("%s %s %s", entry.Name, entry.Device, keyFile)
+	if len(entry.Options) > 0 {
+		line += " " + strings.Join(entry.Options, ",")
+	}
+	return line
+}
+
+/*
+Crypttab is the content of /etc/crypttab. It is able to convert back to original text, comments and the order of
+entries are retained.
+*/
+type Crypttab struct {
+	Lines   []string                  // Lines are all lines of the original text, an entry is kept in place as its name.
+	Entries map[string]*CrypttabEntry // Entries are the crypttab entries in name - entry pairs.
+}
+
+// Read crypttab text and parse the text into memory structures.
+func ParseCrypttab(txt string) *Crypttab {
+	tab := &Crypttab{
+		Lines:   make([]string, 0, 8),
+		Entries: make(map[string]*CrypttabEntry),
+	}
+	for _, line := range strings.Split(strings.TrimRight(txt, "\n"), "\n") {
+		fields := consecutiveSpaces.Split(strings.TrimSpace(line), -1)
+		if len(fields) < 2 || len(fields[0]) == 0 || fields[0][0] == '#' {
+			// Retain comments and empty lines
+			tab.Lines = append(tab.Lines, line)
+			continue
+		}
+		entry := &CrypttabEntry{Name: fields[0], Device: fields[1], Options: []string{}}
+		if len(fields) > 2 {
+			entry.KeyFile = fields[2]
+		}
+		if len(fields) > 3 {
+			entry.Options = mountOptionSeparator.Split(fields[3], -1)
+		}
+		tab.Lines = append(tab.Lines, entry.Name)
+		tab.Entries[entry.Name] = entry
+	}
+	return tab
+}
+
+// Read crypttab file and parse the file content into memory structures. A missing file is considered to be empty.
+func ParseCrypttabFile(filePath string) (*Crypttab, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("ParseCrypttabFile: failed to read \"%s\" - %v", filePath, err)
+	}
+	return ParseCrypttab(string(content)), nil
+}
+
+// Find the first entry that uses the underlying block device, such as "UUID=xxx".
+func (tab *Crypttab) GetByDevice(device string) (CrypttabEntry, bool) {
+	for _, entry := range tab.Entries {
+		if entry.Device == device {
+			return *entry, true
+		}
+	}
+	return CrypttabEntry{}, false
+}
+
+// Create or replace the entry by its name. A new entry is appended to the end.
+func (tab *Crypttab) Set(entry CrypttabEntry) {
+	if _, exists := tab.Entries[entry.Name]; !exists {
+		tab.Lines = append(tab.Lines, entry.Name)
+	}
+	tab.Entries[entry.Name] = &entry
+}
+
+// Remove the entry by its name. Return true only if the entry existed.
+func (tab *Crypttab) Remove(name string) bool {
+	if _, exists := tab.Entries[name]; !exists {
+		return false
+	}
+	delete(tab.Entries, name)
+	remainingLines := make([]string, 0, len(tab.Lines))
+	for _, line := range tab.Lines {
+		if line != name {
+			remainingLines = append(remainingLines, line)
+		}
+	}
+	tab.Lines = remainingLines
+	return true
+}
+
+// Convert comments and entries back into text.
+func (tab *Crypttab) ToText() string {
+	var ret bytes.Buffer
+	for _, line := range tab.Lines {
+		if entry, isEntry := tab.Entries[line]; isEntry {
+			ret.WriteString(entry.ToText())
+		} else {
+			ret.WriteString(line)
+		}
+		ret.WriteRune('\n')
+	}
+	return ret.String()
+}
+
+/*
+Write the crypttab into the file. The file is replaced in one go, so that a crash does not leave a partially written
+crypttab behind for systemd to read at boot.
+*/
+func (tab *Crypttab) WriteFile(filePath string, perm os.FileMode) error {
+	tmpFile := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(tab.ToText()), perm); err != nil {
+		return fmt.Errorf("Crypttab.WriteFile: failed to write \"%s\" - %v", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, filePath); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("Crypttab.WriteFile: failed to replace \"%s\" - %v", filePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestCrypttab(t *testing.T) {
+	sample := `# comment
+cr_home   UUID=aaaa-bbbb   none  luks
+
+cr_swap /dev/sda2 /dev/urandom swap,cipher=aes-xts-plain64
+cr_data /dev/sdc`
+	tab := ParseCrypttab(sample)
+	if len(tab.Entries) != 3 || len(tab.Lines) != 5 {
+		t.Fatalf("%+v", tab)
+	}
+	if !reflect.DeepEqual(*tab.Entries["cr_swap"], CrypttabEntry{Name: "cr_swap", Device: "/dev/sda2", KeyFile: "/dev/urandom", Options: []string{"swap", "cipher=aes-xts-plain64"}}) {
+		t.Fatalf("%+v", tab.Entries["cr_swap"])
+	}
+	if entry, found := tab.GetByDevice("UUID=aaaa-bbbb"); !found || entry.Name != "cr_home" {
+		t.Fatal(entry, found)
+	}
+	if _, found := tab.GetByDevice("UUID=does-not-exist"); found {
+		t.Fatal("should not have found it")
+	}
+	// Replace an entry, add an entry, and remove an entry
+	tab.Set(CrypttabEntry{Name: "cr_home", Device: "UUID=aaaa-bbbb", KeyFile: "/run/key", Options: []string{"luks", "_netdev"}})
+	tab.Set(CrypttabEntry{Name: "cr_new", Device: "UUID=cccc"})
+	if !tab.Remove("cr_data") || tab.Remove("cr_data") {
+		t.Fatal("wrong removal result")
+	}
+	expected := `# comment
+cr_home UUID=aaaa-bbbb /run/key luks,_netdev
+
+cr_swap /dev/sda2 /dev/urandom swap,cipher=aes-xts-plain64
+cr_new UUID=cccc none
+`
+	if txt := tab.ToText(); txt != expected {
+		t.Fatal(txt)
+	}
+	if tab := ParseCrypttab(""); len(tab.Entries) != 0 || tab.ToText() != "\n" {
+		t.Fatalf("%+v", tab)
+	}
+}
+
+func TestCrypttabWriteFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-crypttabtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tabFile := path.Join(tmpDir, "crypttab")
+	if err := ioutil.WriteFile(tabFile, []byte("# comment\ncr_old UUID=aaaa none\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tab, err := ParseCrypttabFile(tabFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab.Set(CrypttabEntry{Name: "cr_new", Device: "UUID=bbbb"})
+	if err := tab.WriteFile(tabFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(tabFile); err != nil || string(content) != tab.ToText() {
+		t.Fatal(string(content), err)
+	}
+	if _, err := os.Stat(tabFile + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary file is left behind", err)
+	}
+	if err := tab.WriteFile(path.Join(tmpDir, "does-not-exist", "crypttab"), 0644); err == nil {
+		t.Fatal("did not error")
+	}
+}
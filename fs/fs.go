@@ -66,6 +66,8 @@ The input text is presumed to be obtained from the following command's output:
 */
 func ParseBlockDevs(txt string) BlockDevices {
 	ret := make([]BlockDevice, 0, 8)
+	// lsblk lists a parent device ahead of its children, remember the names of device mapper parents
+	mapperNames := make(map[string]bool)
 	for _, line := range strings.Split(txt, "\n") {
 		fields := lsblkFields.FindAllString(line, -1)
 		if len(fields) < 7 {
@@ -77,8 +79,17 @@ func ParseBlockDevs(txt string) BlockDevices {
 		}
 		devPath := "/dev/" + fields[1]
 		devType := fields[2]
-		if devType == "crypt" {
+		switch devType {
+		case "crypt", "lvm", "mpath", "dm":
+			// Device mapper devices are listed under their mapper names
 			devPath = "/dev/mapper/" + fields[1]
+			mapperNames[fields[1]] = true
+		case "part":
+			// Partitions of multipath and LVM devices (e.g. mpatha-part1) are device mapper devices too
+			if mapperNames[fields[6]] || strings.HasPrefix(fields[6], "dm-") {
+				devPath = "/dev/mapper/" + fields[1]
+				mapperNames[fields[1]] = true
+			}
 		}
 		blkDev := BlockDevice{
 			UUID:       fields[0],
@@ -187,21 +198,37 @@ func Mount(blockDev, fsType string, fsOptions []string, mountPoint string) error
 	return nil
 }
 
+// Call mount to remount a mounted file system read-only.
+func RemountReadOnly(mountPoint string) error {
+	if out, err := exec.Command(BIN_MOUNT, "-o", "remount,ro", mountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("RemountReadOnly: failed to remount \"%s\" - %v %s", mountPoint, err, out)
+	}
+	return nil
+}
+
 // GetSystemdMountNameForDir returns systemd's mount unit associated with the directory, supposedly a mount point.
 func GetSystemdMountNameForDir(dirPath string) string {
+	return systemdEscape(strings.TrimPrefix(dirPath, "/"), true) + ".mount"
+}
+
+// SystemdEscape escapes a string in the same way as "systemd-escape", so that it can be used as unit instance name.
+func SystemdEscape(str string) string {
+	return systemdEscape(str, false)
+}
+
+// Escape all characters except letters, digits, and few others. If the string is a path, slashes become dashes.
+func systemdEscape(str string, isPath bool) string {
 	var ret bytes.Buffer
-	for i, ch := range dirPath {
-		if i == 0 && ch == '/' {
-			continue
-		} else if ch == '/' {
+	for i, ch := range str {
+		if isPath && ch == '/' {
 			ret.WriteRune('-')
-		} else if ch >= 48 && ch <= 57 || ch >= 65 && ch <= 90 || ch >= 97 && ch <= 122 {
+		} else if ch >= 48 && ch <= 57 || ch >= 65 && ch <= 90 || ch >= 97 && ch <= 122 || ch == '_' || ch == ':' || ch == '.' && i > 0 {
 			ret.WriteRune(ch)
 		} else {
 			ret.WriteString(fmt.Sprintf("\\x%x", ch))
 		}
 	}
-	return ret.String() + ".mount"
+	return ret.String()
 }
 
 // Umount un-mounts a file system by interacting with systemd.
@@ -215,6 +242,17 @@ func Umount(mountPoint string) error {
 	return fmt.Errorf("Umount: first attempt failed with error \"%v\", and second attempt failed with output \"%s\" and error \"%v\"", err1, out, err2)
 }
 
+/*
+UmountLazy detaches a file system that is still busy right away, the kernel cleans up the mount once the file system is
+no longer in use.
+*/
+func UmountLazy(mountPoint string) error {
+	if out, err := exec.Command(BIN_UMOUNT, "--lazy", mountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("UmountLazy: failed to umount \"%s\" - %v %s", mountPoint, err, out)
+	}
+	return nil
+}
+
 // Return amount of free space available on the disk where input paths is mounted on.
 func FreeSpace(paths string) (int64, error) {
 	var stats syscall.Statfs_t
@@ -112,3 +112,31 @@ func TestGetSystemdMountNameForDir(t *testing.T) {
 		t.Fatal(ret)
 	}
 }
+
+func TestParseBlockDevsMapper(t *testing.T) {
+	sample := `
+UUID="" NAME="sdb" TYPE="disk" FSTYPE="LVM2_member" MOUNTPOINT="" SIZE="8589934592" PKNAME=""
+UUID="0b1d8bd2-3b5d-4bdf-8ae6-5f3b2a2dcb0a" NAME="vg-lv" TYPE="lvm" FSTYPE="crypto_LUKS" MOUNTPOINT="" SIZE="4294967296" PKNAME="sdb"
+UUID="" NAME="mpatha" TYPE="mpath" FSTYPE="" MOUNTPOINT="" SIZE="8589934592" PKNAME="sdc"
+UUID="" NAME="md127" TYPE="raid1" FSTYPE="" MOUNTPOINT="" SIZE="8589934592" PKNAME="sdd"
+UUID="c3f0f4a4-52d4-4a55-9ac3-8f6c1d1b2e10" NAME="mpatha-part1" TYPE="part" FSTYPE="crypto_LUKS" MOUNTPOINT="" SIZE="4294967296" PKNAME="mpatha"
+UUID="" NAME="md127p1" TYPE="part" FSTYPE="crypto_LUKS" MOUNTPOINT="" SIZE="4294967296" PKNAME="md127"
+UUID="" NAME="mpathb1" TYPE="part" FSTYPE="crypto_LUKS" MOUNTPOINT="" SIZE="4294967296" PKNAME="dm-3"
+`
+	ret := ParseBlockDevs(sample)
+	if len(ret) != 7 || ret[0].Path != "/dev/sdb" || ret[1].Path != "/dev/mapper/vg-lv" || ret[2].Path != "/dev/mapper/mpatha" || ret[3].Path != "/dev/md127" {
+		t.Fatalf("%+v", ret)
+	}
+	if ret[4].Path != "/dev/mapper/mpatha-part1" || ret[5].Path != "/dev/md127p1" || ret[6].Path != "/dev/mapper/mpathb1" {
+		t.Fatalf("%+v", ret)
+	}
+}
+
+func TestSystemdEscape(t *testing.T) {
+	if ret := SystemdEscape("cryptctl-unlocked-a1_b.c"); ret != `cryptctl\x2dunlocked\x2da1_b.c` {
+		t.Fatal(ret)
+	}
+	if ret := GetSystemdMountNameForDir("/srv/sap_data/.hana"); ret != `srv-sap_data-.hana.mount` {
+		t.Fatal(ret)
+	}
+}
@@ -42,6 +42,16 @@ func (mount MountPoint) GetFileSystemSizeByte() (int64, error) {
 	return fs.Bsize * int64(fs.Blocks), nil
 }
 
+// Return the amount of space in Bytes available to unprivileged users.
+func (mount MountPoint) GetFileSystemAvailableByte() (int64, error) {
+	fs := syscall.Statfs_t{}
+	err := syscall.Statfs(mount.MountPoint, &fs)
+	if err != nil {
+		return 0, err
+	}
+	return fs.Bsize * int64(fs.Bavail), nil
+}
+
 // Remove btrfs subvolume among mount options. The MountPoint is modified in-place.
 func (mount *MountPoint) DiscardBtrfsSubvolume() {
 	newOptions := make([]string, 0, len(mount.Options))
@@ -82,6 +92,16 @@ func (mounts MountPoints) GetManyByCriteria(deviceNode, mountPoint, fileSystem s
 	return
 }
 
+// Find the first mount point of the block device, regardless of which device node path leads to the device.
+func (mounts MountPoints) GetByBlockDevice(devPath string) (MountPoint, bool) {
+	for _, mount := range mounts {
+		if strings.HasPrefix(mount.DeviceNode, "/dev/") && SameBlockDevice(mount.DeviceNode, devPath) {
+			return mount, true
+		}
+	}
+	return MountPoint{}, false
+}
+
 // Find mount point for an arbitrary directory or file specified by an absolute path.
 func (mounts MountPoints) GetMountPointOfPath(fileOrDirPath string) (MountPoint, bool) {
 	if !filepath.IsAbs(fileOrDirPath) {
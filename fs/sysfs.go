@@ -0,0 +1,238 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var SysfsRoot = "/sys" // SysfsRoot is the mount point of sysfs, test cases may point it to a fabricated directory tree.
+
+/*
+SysfsBlockDevice is a block device identified by its major:minor numbers and located in sysfs.
+Unlike a device node path, the identification remains accurate for device mapper (LVM, multipath, crypt), MD RAID,
+and for symbolic links such as those found under /dev/disk/by-id.
+*/
+type SysfsBlockDevice struct {
+	Major      int    // Major is the major device number.
+	Minor      int    // Minor is the minor device number.
+	KernelName string // KernelName is the kernel's name of the device, such as "sda1", "dm-3", or "md127".
+	SysfsDir   string // SysfsDir is the fully resolved sysfs directory of the device.
+}
+
+// Decode major and minor device numbers from a device ID in the way glibc does.
+func splitDevNum(rdev uint64) (major, minor int) {
+	major = int((rdev>>8)&0xfff | (rdev>>32)&^0xfff)
+	minor = int(rdev&0xff | (rdev>>12)&^0xff)
+	return
+}
+
+// Read a sysfs attribute file and return its content without the trailing new-line.
+func readSysfsAttr(dir, name string) string {
+	content, err := ioutil.ReadFile(path.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// Return the block device located in the sysfs directory, which may be a symbolic link.
+func getSysfsBlockDeviceByDir(sysfsDir string) (dev SysfsBlockDevice, err error) {
+	resolvedDir, err := filepath.EvalSymlinks(sysfsDir)
+	if err != nil {
+		return dev, fmt.Errorf("getSysfsBlockDeviceByDir: failed to resolve \"%s\" - %v", sysfsDir, err)
+	}
+	majorMinor := strings.Split(readSysfsAttr(resolvedDir, "dev"), ":")
+	if len(majorMinor) != 2 {
+		return dev, fmt.Errorf("getSysfsBlockDeviceByDir: \"%s\" does not look like a block device", resolvedDir)
+	}
+	if dev.Major, err = strconv.Atoi(majorMinor[0]); err != nil {
+		return dev, fmt.Errorf("getSysfsBlockDeviceByDir: malformed major number in \"%s\"", resolvedDir)
+	}
+	if dev.Minor, err = strconv.Atoi(majorMinor[1]); err != nil {
+		return dev, fmt.Errorf("getSysfsBlockDeviceByDir: malformed minor number in \"%s\"", resolvedDir)
+	}
+	dev.KernelName = path.Base(resolvedDir)
+	dev.SysfsDir = resolvedDir
+	return
+}
+
+// GetSysfsBlockDeviceByName returns the block device that carries the kernel name, such as "sda1" or "dm-0".
+func GetSysfsBlockDeviceByName(kernelName string) (SysfsBlockDevice, error) {
+	return getSysfsBlockDeviceByDir(path.Join(SysfsRoot, "class", "block", kernelName))
+}
+
+// GetSysfsBlockDeviceByNumber returns the block device identified by major and minor numbers.
+func GetSysfsBlockDeviceByNumber(major, minor int) (SysfsBlockDevice, error) {
+	return getSysfsBlockDeviceByDir(path.Join(SysfsRoot, "dev", "block", fmt.Sprintf("%d:%d", major, minor)))
+}
+
+/*
+GetSysfsBlockDevice returns the block device behind a device node path. The path may be a symbolic link, such as
+/dev/mapper/vg-lv, /dev/vg/lv, /dev/md/name, or /dev/disk/by-id/xxx.
+*/
+func GetSysfsBlockDevice(devPath string) (dev SysfsBlockDevice, err error) {
+	var st syscall.Stat_t
+	if err = syscall.Stat(devPath, &st); err != nil {
+		return dev, fmt.Errorf("GetSysfsBlockDevice: cannot read \"%s\" - %v", devPath, err)
+	} else if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return dev, fmt.Errorf("GetSysfsBlockDevice: \"%s\" is not a block device", devPath)
+	}
+	major, minor := splitDevNum(uint64(st.Rdev))
+	return GetSysfsBlockDeviceByNumber(major, minor)
+}
+
+// SameBlockDevice returns true only if both device node paths lead to the same block device.
+func SameBlockDevice(devPath1, devPath2 string) bool {
+	if devPath1 == devPath2 {
+		return true
+	}
+	dev1, err := GetSysfsBlockDevice(devPath1)
+	if err != nil {
+		return false
+	}
+	dev2, err := GetSysfsBlockDevice(devPath2)
+	if err != nil {
+		return false
+	}
+	return dev1.Equals(dev2)
+}
+
+// Equals returns true only if both block devices carry identical major and minor numbers.
+func (dev SysfsBlockDevice) Equals(other SysfsBlockDevice) bool {
+	return dev.Major == other.Major && dev.Minor == other.Minor
+}
+
+// IsPartition returns true only if the block device is a partition of a disk.
+func (dev SysfsBlockDevice) IsPartition() bool {
+	_, err := os.Stat(path.Join(dev.SysfsDir, "partition"))
+	return err == nil
+}
+
+// DMName returns the device mapper name (e.g. "vg-lv" or "mpatha"), or an empty string if it is not a mapper device.
+func (dev SysfsBlockDevice) DMName() string {
+	return readSysfsAttr(path.Join(dev.SysfsDir, "dm"), "name")
+}
+
+/*
+DMUUID returns the device mapper UUID, or an empty string if it is not a mapper device.
+The UUID is prefixed by its owner, for example "LVM-", "mpath-", "CRYPT-".
+*/
+func (dev SysfsBlockDevice) DMUUID() string {
+	return readSysfsAttr(path.Join(dev.SysfsDir, "dm"), "uuid")
+}
+
+// IsCrypt returns true only if the block device is an opened dm-crypt mapping.
+func (dev SysfsBlockDevice) IsCrypt() bool {
+	return strings.HasPrefix(dev.DMUUID(), "CRYPT-")
+}
+
+// MDLevel returns the RAID level (e.g. "raid1") of an MD array, or an empty string if it is not an MD array.
+func (dev SysfsBlockDevice) MDLevel() string {
+	return readSysfsAttr(path.Join(dev.SysfsDir, "md"), "level")
+}
+
+/*
+StableName returns a name that is unique among all block devices and remains the same for the device across reboots
+as far as the underlying storage layer permits it. Device mapper devices are named after their mapper name, other
+devices carry their kernel name.
+*/
+func (dev SysfsBlockDevice) StableName() string {
+	if dmName := dev.DMName(); dmName != "" {
+		return dmName
+	}
+	return dev.KernelName
+}
+
+// Return block devices named in the sub-directory of device's sysfs directory.
+func (dev SysfsBlockDevice) listDevicesInDir(subDir string) (ret []SysfsBlockDevice) {
+	ret = make([]SysfsBlockDevice, 0, 4)
+	entries, err := ioutil.ReadDir(path.Join(dev.SysfsDir, subDir))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if member, err := GetSysfsBlockDeviceByName(entry.Name()); err == nil {
+			ret = append(ret, member)
+		}
+	}
+	return
+}
+
+// Holders returns block devices that are built directly on top of this device, such as LVM volumes and crypt mappings.
+func (dev SysfsBlockDevice) Holders() []SysfsBlockDevice {
+	return dev.listDevicesInDir("holders")
+}
+
+// Slaves returns block devices that this device is built directly on top of, such as LVM physical volumes.
+func (dev SysfsBlockDevice) Slaves() []SysfsBlockDevice {
+	return dev.listDevicesInDir("slaves")
+}
+
+// Partitions returns the partitions of a disk.
+func (dev SysfsBlockDevice) Partitions() (ret []SysfsBlockDevice) {
+	ret = make([]SysfsBlockDevice, 0, 4)
+	entries, err := ioutil.ReadDir(dev.SysfsDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(path.Join(dev.SysfsDir, entry.Name(), "partition")); err == nil {
+			if part, err := getSysfsBlockDeviceByDir(path.Join(dev.SysfsDir, entry.Name())); err == nil {
+				ret = append(ret, part)
+			}
+		}
+	}
+	return
+}
+
+// Descendants returns all partitions and holders of the device, and recursively their partitions and holders.
+func (dev SysfsBlockDevice) Descendants() []SysfsBlockDevice {
+	ret := make([]SysfsBlockDevice, 0, 8)
+	seen := map[string]bool{dev.KernelName: true}
+	queue := []SysfsBlockDevice{dev}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, child := range append(next.Partitions(), next.Holders()...) {
+			if !seen[child.KernelName] {
+				seen[child.KernelName] = true
+				ret = append(ret, child)
+				queue = append(queue, child)
+			}
+		}
+	}
+	return ret
+}
+
+// Ancestors returns the disk of a partition and all slaves of the device, and recursively their disks and slaves.
+func (dev SysfsBlockDevice) Ancestors() []SysfsBlockDevice {
+	ret := make([]SysfsBlockDevice, 0, 8)
+	seen := map[string]bool{dev.KernelName: true}
+	queue := []SysfsBlockDevice{dev}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		parents := next.Slaves()
+		if next.IsPartition() {
+			if disk, err := getSysfsBlockDeviceByDir(path.Dir(next.SysfsDir)); err == nil {
+				parents = append(parents, disk)
+			}
+		}
+		for _, parent := range parents {
+			if !seen[parent.KernelName] {
+				seen[parent.KernelName] = true
+				ret = append(ret, parent)
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,120 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+// Fabricate a sysfs tree of a disk "sdb" with partition "sdb1", which is an LVM physical volume holding "vg-lv" (dm-0).
+func makeTestSysfs(t *testing.T) string {
+	root, err := ioutil.TempDir("", "cryptctl-sysfstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(file, content string) {
+		if err := os.MkdirAll(path.Dir(path.Join(root, file)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(root, file), []byte(content+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(target, name string) {
+		if err := os.MkdirAll(path.Dir(path.Join(root, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("devices/pci0/block/sdb/dev", "8:16")
+	write("devices/pci0/block/sdb/sdb1/dev", "8:17")
+	write("devices/pci0/block/sdb/sdb1/partition", "1")
+	write("devices/pci0/block/sdb/sdb1/holders/dm-0", "")
+	write("devices/virtual/block/dm-0/dev", "254:0")
+	write("devices/virtual/block/dm-0/dm/name", "vg-lv")
+	write("devices/virtual/block/dm-0/dm/uuid", "LVM-abcdef")
+	write("devices/virtual/block/dm-0/slaves/sdb1", "")
+	link("../../devices/pci0/block/sdb", "class/block/sdb")
+	link("../../devices/pci0/block/sdb/sdb1", "class/block/sdb1")
+	link("../../devices/virtual/block/dm-0", "class/block/dm-0")
+	link("../../devices/pci0/block/sdb", "dev/block/8:16")
+	link("../../devices/pci0/block/sdb/sdb1", "dev/block/8:17")
+	link("../../devices/virtual/block/dm-0", "dev/block/254:0")
+	return root
+}
+
+func kernelNames(devs []SysfsBlockDevice) []string {
+	ret := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		ret = append(ret, dev.KernelName)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestSysfsBlockDevice(t *testing.T) {
+	root := makeTestSysfs(t)
+	defer os.RemoveAll(root)
+	origRoot := SysfsRoot
+	SysfsRoot = root
+	defer func() {
+		SysfsRoot = origRoot
+	}()
+
+	disk, err := GetSysfsBlockDeviceByName("sdb")
+	if err != nil || disk.Major != 8 || disk.Minor != 16 || disk.IsPartition() || disk.DMName() != "" {
+		t.Fatal(disk, err)
+	}
+	part, err := GetSysfsBlockDeviceByNumber(8, 17)
+	if err != nil || part.KernelName != "sdb1" || !part.IsPartition() || part.StableName() != "sdb1" {
+		t.Fatal(part, err)
+	}
+	lv, err := GetSysfsBlockDeviceByName("dm-0")
+	if err != nil || lv.DMName() != "vg-lv" || lv.DMUUID() != "LVM-abcdef" || lv.IsCrypt() || lv.StableName() != "vg-lv" {
+		t.Fatal(lv, err)
+	}
+	if _, err := GetSysfsBlockDeviceByName("sdz"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Walk down the device stack
+	if names := kernelNames(disk.Partitions()); len(names) != 1 || names[0] != "sdb1" {
+		t.Fatal(names)
+	}
+	if names := kernelNames(part.Holders()); len(names) != 1 || names[0] != "dm-0" {
+		t.Fatal(names)
+	}
+	if names := kernelNames(disk.Descendants()); len(names) != 2 || names[0] != "dm-0" || names[1] != "sdb1" {
+		t.Fatal(names)
+	}
+	// Walk up the device stack
+	if names := kernelNames(lv.Slaves()); len(names) != 1 || names[0] != "sdb1" {
+		t.Fatal(names)
+	}
+	if names := kernelNames(lv.Ancestors()); len(names) != 2 || names[0] != "sdb" || names[1] != "sdb1" {
+		t.Fatal(names)
+	}
+	if names := kernelNames(disk.Ancestors()); len(names) != 0 {
+		t.Fatal(names)
+	}
+	if !lv.Equals(lv) || lv.Equals(part) {
+		t.Fatal("wrong equality")
+	}
+}
+
+func TestSplitDevNum(t *testing.T) {
+	if major, minor := splitDevNum(0x811); major != 8 || minor != 17 {
+		t.Fatal(major, minor)
+	}
+	if major, minor := splitDevNum(0xfe00); major != 254 || minor != 0 {
+		t.Fatal(major, minor)
+	}
+	if major, minor := splitDevNum(0x110300); major != 259 || minor != 256 {
+		t.Fatal(major, minor)
+	}
+}
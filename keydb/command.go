@@ -0,0 +1,157 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	CMD_MOUNT         = "mount"         // CMD_MOUNT unlocks and mounts the disk, then keeps it alive.
+	CMD_UMOUNT        = "umount"        // CMD_UMOUNT umounts and closes the disk, then stops keeping it alive.
+	CMD_REMOUNT_RO    = "remount-ro"    // CMD_REMOUNT_RO remounts the file system read-only.
+	CMD_LOCK          = "lock"          // CMD_LOCK umounts and closes the disk, and erases any copy of the key on the computer.
+	CMD_RUN_HOOK      = "run-hook"      // CMD_RUN_HOOK runs a hook script that the computer's administrator has put in place.
+	CMD_REPORT_STATUS = "report-status" // CMD_REPORT_STATUS reports encryption status, mount options, and free space.
+	CMD_ROTATE_KEY    = "rotate-key"    // CMD_ROTATE_KEY replaces the disk key by a new key from key server.
+	CMD_SELF_DESTRUCT = "self-destruct" // CMD_SELF_DESTRUCT erases encryption headers, rendering all data irreversibly lost.
+
+	CMD_PARAM_HOOK         = "hook"         // CMD_PARAM_HOOK is the name of the hook script to run.
+	CMD_PARAM_CONFIRM_UUID = "confirm-uuid" // CMD_PARAM_CONFIRM_UUID must repeat the disk UUID to self-destruct.
+	CMD_PARAM_ON_BUSY      = "on-busy"      // CMD_PARAM_ON_BUSY is one of ON_BUSY_*, it tells what to do if processes keep the file system busy.
+
+	ON_BUSY_FAIL      = "fail"      // ON_BUSY_FAIL leaves the processes alone and fails the umount, this is the default.
+	ON_BUSY_LAZY      = "lazy"      // ON_BUSY_LAZY detaches the file system right away and cleans up once it is no longer busy.
+	ON_BUSY_TERMINATE = "terminate" // ON_BUSY_TERMINATE sends SIGTERM to the processes and tries the umount again.
+
+	LEN_COMMAND_ID = 16 // LEN_COMMAND_ID is the number of random bytes in a command ID.
+)
+
+var RegexHookName = regexp.MustCompile("^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$") // RegexHookName matches the names of hook scripts
+
+// CommandParams lists every action along with the parameters it requires.
+var CommandParams = map[string][]string{
+	CMD_MOUNT:         {},
+	CMD_UMOUNT:        {},
+	CMD_REMOUNT_RO:    {},
+	CMD_LOCK:          {},
+	CMD_RUN_HOOK:      {CMD_PARAM_HOOK},
+	CMD_REPORT_STATUS: {},
+	CMD_ROTATE_KEY:    {},
+	CMD_SELF_DESTRUCT: {CMD_PARAM_CONFIRM_UUID},
+}
+
+// CommandOptionalParams lists the actions that take optional parameters, along with the parameters.
+var CommandOptionalParams = map[string][]string{
+	CMD_UMOUNT: {CMD_PARAM_ON_BUSY},
+	CMD_LOCK:   {CMD_PARAM_ON_BUSY},
+}
+
+// Return all command actions in alphabetical order.
+func GetCommandActions() []string {
+	ret := make([]string, 0, len(CommandParams))
+	for action := range CommandParams {
+		ret = append(ret, action)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Command is an action that a computer is told to carry out on an encrypted disk, along with its parameters.
+type Command struct {
+	ID     string            // ID uniquely identifies the command, results are matched to the command by ID.
+	Action string            // Action is one of CMD_* actions.
+	Params map[string]string // Params are the parameters of the action, see CommandParams.
+	Batch  string            // Batch identifies the fleet-wide dispatch that issued the command, empty if issued individually.
+}
+
+// Return a command of a random ID. Return an error if the action is unknown or the parameters do not make sense.
+func NewCommand(uuid, action string, params map[string]string) (cmd Command, err error) {
+	cmd = Command{Action: action, Params: params}
+	if cmd.Params == nil {
+		cmd.Params = map[string]string{}
+	}
+	if err = cmd.Validate(uuid); err != nil {
+		return
+	}
+	cmd.ID, err = newRandomID()
+	return
+}
+
+// Return a random ID for a command, a batch of commands, or a lease.
+func newRandomID() (string, error) {
+	randBytes := make([]byte, LEN_COMMAND_ID)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", fmt.Errorf("newRandomID: failed to generate random ID - %v", err)
+	}
+	return hex.EncodeToString(randBytes), nil
+}
+
+/*
+Return a pending command of the action for the computer of the IP, valid from now on. The content carries the action
+for clients of earlier versions.
+*/
+func NewPendingCommand(uuid, ip, action string, params map[string]string, validity time.Duration) (PendingCommand, error) {
+	cmd, err := NewCommand(uuid, action, params)
+	if err != nil {
+		return PendingCommand{}, err
+	}
+	return PendingCommand{ValidFrom: time.Now(), Validity: validity, IP: ip, Content: action, Command: cmd}, nil
+}
+
+// Return an error if the action is unknown, or if the parameters are missing, superfluous, or malformed.
+func (cmd Command) Validate(uuid string) error {
+	required, found := CommandParams[cmd.Action]
+	if !found {
+		return fmt.Errorf("Command.Validate: unknown action \"%s\"", cmd.Action)
+	}
+	for _, name := range required {
+		if cmd.Params[name] == "" {
+			return fmt.Errorf("Command.Validate: action \"%s\" requires parameter \"%s\"", cmd.Action, name)
+		}
+	}
+	accepted := append(append([]string{}, required...), CommandOptionalParams[cmd.Action]...)
+	for name := range cmd.Params {
+		known := false
+		for _, acceptedName := range accepted {
+			known = known || name == acceptedName
+		}
+		if !known {
+			return fmt.Errorf("Command.Validate: action \"%s\" only takes parameters %v", cmd.Action, accepted)
+		}
+	}
+	if hook, found := cmd.Params[CMD_PARAM_HOOK]; found && !RegexHookName.MatchString(hook) {
+		return fmt.Errorf("Command.Validate: \"%s\" is not a valid hook name", hook)
+	}
+	if confirm, found := cmd.Params[CMD_PARAM_CONFIRM_UUID]; found && confirm != uuid {
+		return fmt.Errorf("Command.Validate: parameter \"%s\" does not match disk UUID \"%s\"", CMD_PARAM_CONFIRM_UUID, uuid)
+	}
+	switch cmd.Params[CMD_PARAM_ON_BUSY] {
+	case "", ON_BUSY_FAIL, ON_BUSY_LAZY, ON_BUSY_TERMINATE:
+	default:
+		return fmt.Errorf("Command.Validate: parameter \"%s\" must be one of %s, %s, %s",
+			CMD_PARAM_ON_BUSY, ON_BUSY_FAIL, ON_BUSY_LAZY, ON_BUSY_TERMINATE)
+	}
+	return nil
+}
+
+// CommandResult is the outcome of a command reported by the computer that carried it out.
+type CommandResult struct {
+	Success  bool              // Success is true only if the command was carried out in its entirety.
+	Message  string            // Message describes the outcome in a sentence.
+	Details  map[string]string // Details are the structured outcome specific to the action, such as disk status.
+	Finished time.Time         // Finished is the moment the computer finished carrying out the command.
+}
+
+// Return the command carried by a pending command. A command issued by an earlier version only has its content.
+func (cmd PendingCommand) GetCommand() Command {
+	if cmd.Command.Action != "" {
+		return cmd.Command
+	}
+	return Command{Action: fmt.Sprint(cmd.Content), Params: map[string]string{}}
+}
@@ -0,0 +1,105 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewCommand(t *testing.T) {
+	for _, bad := range []Command{
+		{Action: "format"},
+		{Action: CMD_RUN_HOOK},
+		{Action: CMD_RUN_HOOK, Params: map[string]string{CMD_PARAM_HOOK: "../../bin/sh"}},
+		{Action: CMD_RUN_HOOK, Params: map[string]string{CMD_PARAM_HOOK: ".hidden"}},
+		{Action: CMD_UMOUNT, Params: map[string]string{CMD_PARAM_HOOK: "a"}},
+		{Action: CMD_SELF_DESTRUCT, Params: map[string]string{CMD_PARAM_CONFIRM_UUID: "b"}},
+		{Action: CMD_UMOUNT, Params: map[string]string{CMD_PARAM_ON_BUSY: "kill"}},
+		{Action: CMD_REMOUNT_RO, Params: map[string]string{CMD_PARAM_ON_BUSY: ON_BUSY_LAZY}},
+	} {
+		if _, err := NewCommand("a", bad.Action, bad.Params); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	cmd1, err := NewCommand("a", CMD_RUN_HOOK, map[string]string{CMD_PARAM_HOOK: "flush-cache.sh"})
+	if err != nil || len(cmd1.ID) != 2*LEN_COMMAND_ID {
+		t.Fatal(err, cmd1)
+	}
+	cmd2, err := NewCommand("a", CMD_SELF_DESTRUCT, map[string]string{CMD_PARAM_CONFIRM_UUID: "a"})
+	if err != nil || cmd2.ID == cmd1.ID {
+		t.Fatal(err, cmd2)
+	}
+	if cmd, err := NewCommand("a", CMD_LOCK, nil); err != nil || cmd.Params == nil {
+		t.Fatal(err, cmd)
+	}
+	// Optional parameters may be left out
+	if cmd, err := NewCommand("a", CMD_UMOUNT, map[string]string{CMD_PARAM_ON_BUSY: ON_BUSY_TERMINATE}); err != nil || cmd.Params[CMD_PARAM_ON_BUSY] != ON_BUSY_TERMINATE {
+		t.Fatal(err, cmd)
+	}
+	// A command issued by an earlier version only has its content
+	legacy := PendingCommand{Content: "umount"}
+	if cmd := legacy.GetCommand(); cmd.Action != CMD_UMOUNT || cmd.ID != "" {
+		t.Fatal(cmd)
+	}
+	typed := PendingCommand{Content: CMD_RUN_HOOK, Command: cmd1}
+	if cmd := typed.GetCommand(); !reflect.DeepEqual(cmd, cmd1) {
+		t.Fatal(cmd)
+	}
+	if actions := GetCommandActions(); len(actions) != 8 || actions[0] != CMD_LOCK {
+		t.Fatal(actions)
+	}
+}
+
+func TestDB_UpdateCommandOutcome(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{ID: "id1", UUID: "a", Key: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{CMD_REPORT_STATUS, CMD_REPORT_STATUS} {
+		cmd, err := NewCommand("a", action, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddPendingCommand("a", "1.1.1.1", PendingCommand{ValidFrom: time.Now(), Validity: time.Hour, IP: "1.1.1.1", Content: action, Command: cmd}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec, _ := db.GetByUUID("a")
+	second := rec.PendingCommands["1.1.1.1"][1].Command.ID
+	// Commands of the same action are told apart by ID
+	db.UpdateSeenFlagByID("a", "1.1.1.1", second)
+	result := CommandResult{Success: true, Message: "ok", Details: map[string]string{"free": "1"}, Finished: time.Now()}
+	db.UpdateCommandOutcome("a", "1.1.1.1", second, result)
+	db.UpdateCommandOutcome("a", "1.1.1.1", "does-not-exist", result)
+	rec, _ = db.GetByUUID("a")
+	if cmds := rec.PendingCommands["1.1.1.1"]; cmds[0].SeenByClient || !cmds[1].SeenByClient || cmds[1].ClientResult != "ok" || !reflect.DeepEqual(cmds[1].Result, result) {
+		t.Fatal(cmds)
+	}
+	// Rotated key
+	if err := db.ReplaceKey("does-not-exist", "id2", nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := db.ReplaceKey("a", "id1", []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByID("id1"); !reflect.DeepEqual(rec.Key, []byte{2}) {
+		t.Fatal(rec)
+	}
+	if err := db.ReplaceKey("a", "id2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := db.GetByID("id1"); found {
+		t.Fatal("old ID is still there")
+	}
+	if rec, _ := db.GetByID("id2"); rec.UUID != "a" || !reflect.DeepEqual(rec.Key, []byte{2}) {
+		t.Fatal(rec)
+	}
+}
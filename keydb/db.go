@@ -13,6 +13,7 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -32,7 +33,11 @@ type DB struct {
 	RecordsByUUID   map[string]Record // key is record UUID string
 	RecordsByID     map[string]Record // when saved by built-in KMIP server, the ID is a sequence number; otherwise it can be anything.
 	LastSequenceNum int64             // the last sequence number currently in-use
+	Hosts           map[string]Host   // key is host IP, liveness of the hosts that hold encrypted disks online
+	Leases          map[string]Lease  // key is lease ID, permissions of the hosts to hold encrypted disks online
 	Lock            *sync.RWMutex     // prevent concurrent access to records
+	hostsSavedAt    time.Time         // the moment hosts file was last written, heartbeats in between may stay in memory
+	leasesSavedAt   time.Time         // the moment leases file was last written, renewals in between may stay in memory
 }
 
 // Open a key database directory and read all key records into memory. Caller should consider to lock memory.
@@ -57,7 +62,10 @@ func OpenDBOneRecord(dir, recordUUID string) (db *DB, err error) {
 	if err := os.MkdirAll(dir, DB_DIR_FILE_MODE); err != nil {
 		return nil, fmt.Errorf("OpenDBOneRecord: failed to make db directory \"%s\" - %v", dir, err)
 	}
-	db = &DB{Dir: dir, Lock: new(sync.RWMutex), RecordsByUUID: map[string]Record{}, RecordsByID: map[string]Record{}}
+	db = &DB{Dir: dir, Lock: new(sync.RWMutex), RecordsByUUID: map[string]Record{}, RecordsByID: map[string]Record{}, Hosts: map[string]Host{}}
+	if err := db.loadLeases(); err != nil {
+		log.Printf("OpenDBOneRecord: non-fatal failure occured when reading leases - %v", err)
+	}
 	keyRecord, err := db.ReadRecord(path.Join(dir, recordUUID))
 	if err == nil {
 		db.RecordsByUUID[recordUUID] = keyRecord
@@ -109,6 +117,10 @@ func (db *DB) ReloadDB() error {
 	recordsToUpgrade := make([]Record, 0, 0)
 	// Read and deserialise each record file while finding out the last sequence number
 	for _, fileInfo := range keyFiles {
+		if strings.HasPrefix(fileInfo.Name(), HOSTS_FILE_NAME) || strings.HasPrefix(fileInfo.Name(), LEASES_FILE_NAME) {
+			// Liveness and leases of hosts are loaded after all records
+			continue
+		}
 		filePath := path.Join(db.Dir, fileInfo.Name())
 		if keyRecord, err := db.ReadRecord(filePath); err == nil {
 			if keyRecord.Version == CurrentRecordVersion {
@@ -140,6 +152,12 @@ func (db *DB) ReloadDB() error {
 			return err
 		}
 	}
+	if err := db.loadHosts(); err != nil {
+		log.Printf("DB.ReloadDB: non-fatal failure occured when reading liveness of hosts - %v", err)
+	}
+	if err := db.loadLeases(); err != nil {
+		log.Printf("DB.ReloadDB: non-fatal failure occured when reading leases - %v", err)
+	}
 	log.Printf("DB.ReloadDB: successfully loaded database of %d records", len(db.RecordsByUUID))
 	return nil
 }
@@ -247,52 +265,88 @@ func (db *DB) GetByUUID(uuid string) (rec Record, found bool) {
 	return
 }
 
-// Record and immediately persist alive message that came from a host.
+/*
+Record and immediately persist alive message that came from a host. The UUIDs are added to the disks that the host
+reported earlier, as the host may report each disk separately.
+*/
 func (db *DB) UpdateAliveMessage(latest AliveMessage, uuids ...string) (rejected []string) {
-	rejected = make([]string, 0, 8)
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
+	return db.UpdateHost(latest, false, uuids...)
+}
+
+// Retrieve key records that belong to those UUIDs, and immediately persist last-retrieval information on those records.
+func (db *DB) Select(aliveMessage AliveMessage, checkMaxActive bool, uuids ...string) (found map[string]Record, rejected, missing []string) {
+	found, _, reasons, missing := db.SelectWithReasons(aliveMessage, checkMaxActive, uuids...)
+	rejected = make([]string, 0, len(reasons))
 	for _, uuid := range uuids {
-		if record, exists := db.RecordsByUUID[uuid]; exists {
-			if record.UpdateAliveMessage(latest) {
-				db.upsert(record, false) // IO error is logged
-			} else {
-				// Host is no longer considered to be alive
-				rejected = append(rejected, uuid)
-			}
-		} else {
-			// UUID record disappeared
+		if _, isRejected := reasons[uuid]; isRejected {
 			rejected = append(rejected, uuid)
 		}
 	}
 	return
 }
 
-// Retrieve key records that belong to those UUIDs, and immediately persist last-retrieval information on those records.
-func (db *DB) Select(aliveMessage AliveMessage, checkMaxActive bool, uuids ...string) (found map[string]Record, rejected, missing []string) {
+/*
+Retrieve key records that belong to those UUIDs, and immediately persist last-retrieval information on those records.
+Each retrieved key comes with a new lease in UUID - lease pairs, the leases are immediately persisted as well.
+If enforcePolicy is true, the records' MaxActive and usage policy apply, and rejected records come with the reason
+(REJECT_*) in UUID - reason pairs. MaxActive limits the number of valid leases. An approval is used up by the retrieval
+it allows.
+*/
+func (db *DB) SelectWithReasons(aliveMessage AliveMessage, enforcePolicy bool, uuids ...string) (found map[string]Record, leases map[string]Lease, rejected map[string]string, missing []string) {
+	return db.SelectWithClaim(aliveMessage, LeaseClaim{}, enforcePolicy, uuids...)
+}
+
+/*
+Retrieve key records the same way as SelectWithReasons. A computer retrieving the key again gets a new lease in place of
+the old one that it claims by lease ID or client certificate, the old lease does not count towards MaxActive.
+*/
+func (db *DB) SelectWithClaim(aliveMessage AliveMessage, claim LeaseClaim, enforcePolicy bool, uuids ...string) (found map[string]Record, leases map[string]Lease, rejected map[string]string, missing []string) {
 	found = make(map[string]Record)
-	rejected = make([]string, 0, 8)
+	leases = make(map[string]Lease)
+	rejected = make(map[string]string)
 	missing = make([]string, 0, 8)
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
 	for _, uuid := range uuids {
 		if record, exists := db.RecordsByUUID[uuid]; exists {
+			if enforcePolicy {
+				if reason := record.CheckPolicy(aliveMessage.IP, time.Unix(aliveMessage.Timestamp, 0)); reason != "" {
+					rejected[uuid] = reason
+					continue
+				}
+			}
+			if enforcePolicy && record.MaxActive > 0 && db.countActive(record, aliveMessage, claim) >= record.MaxActive {
+				// Too many active hosts
+				rejected[uuid] = REJECT_MAX_ACTIVE
+				continue
+			}
+			lease, err := db.grantLease(record, aliveMessage, claim)
+			if err != nil {
+				log.Printf("DB.Select: failed to grant lease of %s - %v", uuid, err)
+				rejected[uuid] = REJECT_MAX_ACTIVE
+				continue
+			}
 			// Log dead hosts
-			ok, deadFinalMessage := record.UpdateLastRetrieval(aliveMessage, checkMaxActive)
+			_, deadFinalMessage := record.UpdateLastRetrieval(aliveMessage, false)
 			if len(deadFinalMessage) > 0 {
 				log.Printf("DB.Select: record %s has not heard %d from these hosts: %+v", uuid, time.Now().Unix(), deadFinalMessage)
 			}
-			if ok {
-				db.upsert(record, true) // IO error is logged
-				found[record.UUID] = record
-			} else {
-				// Too many active hosts
-				rejected = append(rejected, uuid)
+			if _, approved := record.Approvals[aliveMessage.IP]; approved && enforcePolicy {
+				delete(record.Approvals, aliveMessage.IP)
 			}
+			delete(record.Rejected, aliveMessage.IP)
+			db.upsert(record, true) // IO error is logged
+			found[record.UUID] = record
+			leases[record.UUID] = lease
 		} else {
 			missing = append(missing, uuid)
 		}
 	}
+	if len(leases) > 0 {
+		if err := db.saveLeases(); err != nil {
+			log.Printf("DB.Select: failed to save leases - %v", err)
+		}
+	}
 	return
 }
 
@@ -320,12 +374,85 @@ func (db *DB) Erase(uuid string) error {
 	}
 	delete(db.RecordsByUUID, uuid)
 	delete(db.RecordsByID, rec.ID)
+	for id, lease := range db.Leases {
+		if lease.UUID == uuid {
+			delete(db.Leases, id)
+		}
+	}
+	if err := db.saveLeases(); err != nil {
+		log.Printf("DB.Erase: failed to save leases - %v", err)
+	}
 	if err := fs.SecureErase(path.Join(db.Dir, uuid), true); err != nil {
 		return fmt.Errorf("DB.Erase: failed to delete db record for %s - %v", uuid, err)
 	}
 	return nil
 }
 
+// AddPendingCommand stores and immediately persists a command for the computer of the IP address to poll.
+func (db *DB) AddPendingCommand(uuid, ip string, cmd PendingCommand) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return fmt.Errorf("AddPendingCommand: record \"%s\" does not exist", uuid)
+	}
+	rec.AddPendingCommand(ip, cmd)
+	if _, err := db.upsert(rec, true); err != nil {
+		// The in-memory record shares its pending commands with the one that failed to be saved
+		rec.RemovePendingCommand(ip, cmd.Command.ID)
+		return err
+	}
+	return nil
+}
+
+// removePendingCommand takes back and immediately persists the command of the ID issued to the computer of the IP address.
+func (db *DB) removePendingCommand(uuid, ip, id string) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return fmt.Errorf("removePendingCommand: record \"%s\" does not exist", uuid)
+	}
+	rec.RemovePendingCommand(ip, id)
+	_, err := db.upsert(rec, true)
+	return err
+}
+
+/*
+ReplaceKey updates and immediately persists the key of a record after the key has been rotated. If the key is kept by
+an external KMIP server, the new KMIP ID refers to the new key and the key itself is nil.
+*/
+func (db *DB) ReplaceKey(uuid, kmipID string, key []byte) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return fmt.Errorf("ReplaceKey: record \"%s\" does not exist", uuid)
+	}
+	if kmipID != rec.ID {
+		delete(db.RecordsByID, rec.ID)
+		rec.ID = kmipID
+	}
+	if key != nil {
+		rec.Key = key
+	}
+	_, err := db.upsert(rec, true)
+	return err
+}
+
+// SetMaxActive updates and immediately persists the maximum number of computers that may use the key simultaneously.
+func (db *DB) SetMaxActive(uuid string, maxActive int) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return fmt.Errorf("SetMaxActive: record \"%s\" does not exist", uuid)
+	}
+	rec.MaxActive = maxActive
+	_, err := db.upsert(rec, true)
+	return err
+}
+
 /*
 UpdateSeenFlag updates "seen" flag of a pending command to true.
 The flag is updated by looking for a command record matched to the specified IP, array index, and content.
@@ -370,3 +497,44 @@ func (db *DB) UpdateCommandResult(uuid, ip string, content interface{}, result s
 	}
 	db.upsert(rec, false)
 }
+
+/*
+UpdateCommandOutcome marks the pending command of the ID seen by client and stores its structured result, along with
+the result message for those who only read ClientResult. If the command is not found, the function will do nothing.
+*/
+func (db *DB) UpdateCommandOutcome(uuid, ip, id string, result CommandResult) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return
+	}
+	cmds := rec.PendingCommands[ip]
+	for i, cmd := range cmds {
+		if cmd.Command.ID == id {
+			cmds[i].SeenByClient = true
+			cmds[i].Result = result
+			cmds[i].ClientResult = result.Message
+			break
+		}
+	}
+	db.upsert(rec, false)
+}
+
+// UpdateSeenFlagByID updates "seen" flag of the pending command of the ID to true.
+func (db *DB) UpdateSeenFlagByID(uuid, ip, id string) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return
+	}
+	cmds := rec.PendingCommands[ip]
+	for i, cmd := range cmds {
+		if cmd.Command.ID == id {
+			cmds[i].SeenByClient = true
+			break
+		}
+	}
+	db.upsert(rec, false)
+}
@@ -69,6 +69,14 @@ func TestRecordCRUD(t *testing.T) {
 		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
 		t.Fatalf("\n%+v\n%+v\n%+v\n%+v\n", found, map[string]Record{rec1.UUID: rec1Alive}, rejected, missing)
 	}
+	// Another computer may not hold the key of 1 at the same time
+	otherAliveMsg := AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: aliveMsg.Timestamp}
+	if found, rejected, missing := db.Select(otherAliveMsg, true, "1", "doesnotexist"); len(found) != 0 ||
+		!reflect.DeepEqual(rejected, []string{"1"}) ||
+		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
+		t.Fatal(found, rejected, missing)
+	}
+	// Neither may the same computer without presenting the lease of 1
 	if found, rejected, missing := db.Select(aliveMsg, true, "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec2.UUID: rec2Alive}) ||
 		!reflect.DeepEqual(rejected, []string{"1"}) ||
 		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
@@ -106,12 +114,12 @@ func TestRecordCRUD(t *testing.T) {
 		!reflect.DeepEqual(missing, []string{"1"}) {
 		t.Fatal(found, rejected, missing)
 	}
-	// Reload database and test query once more (2 is already retrieved and hence it shall be rejected)
+	// Reload database and test query once more (2 is already retrieved by another computer and hence it shall be rejected)
 	db, err = OpenDB(TestDBDir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, true, "1", "2"); len(found) != 0 ||
+	if found, rejected, missing := db.Select(otherAliveMsg, true, "1", "2"); len(found) != 0 ||
 		!reflect.DeepEqual(rejected, []string{"2"}) ||
 		!reflect.DeepEqual(missing, []string{"1"}) {
 		t.Fatal(found, missing)
@@ -344,3 +352,43 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 		t.Fatalf("\n%+v\n%+v\n", expected, db.RecordsByID["id1"].PendingCommands)
 	}
 }
+
+func TestDB_AddPendingCommand(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{ID: "id1", UUID: "a", Key: []byte{}}); err != nil {
+		t.Fatal(err)
+	}
+	cmd := PendingCommand{ValidFrom: time.Now(), Validity: time.Hour, IP: "1.1.1.1", Content: "umount"}
+	if err := db.AddPendingCommand("doesnotexist", "1.1.1.1", cmd); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := db.AddPendingCommand("a", "1.1.1.1", cmd); err != nil {
+		t.Fatal(err)
+	}
+	// The command is persisted
+	db2, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := db2.GetByUUID("a")
+	if cmds := rec.PendingCommands["1.1.1.1"]; len(cmds) != 1 || cmds[0].Content != "umount" {
+		t.Fatal(rec.PendingCommands)
+	}
+	// Update maximum active users
+	if err := db.SetMaxActive("doesnotexist", 3); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := db.SetMaxActive("a", 3); err != nil {
+		t.Fatal(err)
+	}
+	if db3, err := OpenDB(TestDBDir); err != nil {
+		t.Fatal(err)
+	} else if rec, _ := db3.GetByUUID("a"); rec.MaxActive != 3 || len(rec.PendingCommands["1.1.1.1"]) != 1 {
+		t.Fatal(rec)
+	}
+}
@@ -0,0 +1,312 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SELECTOR_UUID     = "uuid"     // SELECTOR_UUID selects disks by UUID.
+	SELECTOR_TAG      = "tag"      // SELECTOR_TAG selects disks by record tag.
+	SELECTOR_HOST_TAG = "host-tag" // SELECTOR_HOST_TAG selects computers by host tag.
+	SELECTOR_HOSTNAME = "hostname" // SELECTOR_HOSTNAME selects computers by host name, shell wildcards are allowed.
+	SELECTOR_IP       = "ip"       // SELECTOR_IP selects computers by IP.
+
+	RESULT_SUCCESS = "Success" // RESULT_SUCCESS is the result message of a successful command, also used by earlier versions.
+)
+
+var RegexTag = RegexHookName // RegexTag matches tags of records and hosts
+
+// Return the tags sorted and without duplicates. Return an error if a tag is malformed.
+func NormaliseTags(tags []string) ([]string, error) {
+	unique := make(map[string]bool)
+	for _, tag := range tags {
+		if !RegexTag.MatchString(tag) {
+			return nil, fmt.Errorf("NormaliseTags: \"%s\" is not a valid tag", tag)
+		}
+		unique[tag] = true
+	}
+	ret := make([]string, 0, len(unique))
+	for tag := range unique {
+		ret = append(ret, tag)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+/*
+Selector picks disks and the alive computers holding them. A disk is selected if it matches any of the UUIDs or any of
+the tags, a computer is selected if it matches any of the host tags, any of the host names, or any of the IPs. Empty
+criteria match everything, but a selector must have at least one criterion.
+*/
+type Selector struct {
+	UUIDs     []string // UUIDs select disks by UUID.
+	Tags      []string // Tags select disks by record tag.
+	HostTags  []string // HostTags select computers by host tag.
+	Hostnames []string // Hostnames select computers by host name, shell wildcards are allowed.
+	IPs       []string // IPs select computers by IP.
+}
+
+/*
+Parse a selector from KEY=VALUE terms separated by space or comma, such as "host-tag=prod-hana hostname=db*". Keys
+are uuid, tag, host-tag, hostname, and ip.
+*/
+func ParseSelector(in string) (sel Selector, err error) {
+	terms := strings.FieldsFunc(in, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	for _, term := range terms {
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return sel, fmt.Errorf("ParseSelector: \"%s\" should look like KEY=VALUE", term)
+		}
+		switch kv[0] {
+		case SELECTOR_UUID:
+			sel.UUIDs = append(sel.UUIDs, kv[1])
+		case SELECTOR_TAG:
+			sel.Tags = append(sel.Tags, kv[1])
+		case SELECTOR_HOST_TAG:
+			sel.HostTags = append(sel.HostTags, kv[1])
+		case SELECTOR_HOSTNAME:
+			if _, err := path.Match(kv[1], ""); err != nil {
+				return sel, fmt.Errorf("ParseSelector: \"%s\" is not a valid host name pattern", kv[1])
+			}
+			sel.Hostnames = append(sel.Hostnames, kv[1])
+		case SELECTOR_IP:
+			sel.IPs = append(sel.IPs, kv[1])
+		default:
+			return sel, fmt.Errorf("ParseSelector: unknown key \"%s\"", kv[0])
+		}
+	}
+	if sel.IsEmpty() {
+		return sel, fmt.Errorf("ParseSelector: selector must have at least one criterion")
+	}
+	return sel, nil
+}
+
+// Return true if the selector does not have any criterion.
+func (sel Selector) IsEmpty() bool {
+	return len(sel.UUIDs)+len(sel.Tags)+len(sel.HostTags)+len(sel.Hostnames)+len(sel.IPs) == 0
+}
+
+// Format the selector in the form understood by ParseSelector.
+func (sel Selector) String() string {
+	terms := make([]string, 0, 8)
+	for _, criteria := range []struct {
+		key    string
+		values []string
+	}{
+		{SELECTOR_UUID, sel.UUIDs},
+		{SELECTOR_TAG, sel.Tags},
+		{SELECTOR_HOST_TAG, sel.HostTags},
+		{SELECTOR_HOSTNAME, sel.Hostnames},
+		{SELECTOR_IP, sel.IPs},
+	} {
+		for _, value := range criteria.values {
+			terms = append(terms, criteria.key+"="+value)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// Return true if the criteria are empty or any of the values is among the criteria.
+func matchAny(criteria []string, values ...string) bool {
+	if len(criteria) == 0 {
+		return true
+	}
+	for _, criterion := range criteria {
+		for _, value := range values {
+			if criterion == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return true if the disk of the record is selected.
+func (sel Selector) matchDisk(rec Record) bool {
+	if len(sel.UUIDs) == 0 && len(sel.Tags) == 0 {
+		return true
+	}
+	return len(sel.UUIDs) > 0 && matchAny(sel.UUIDs, rec.UUID) || len(sel.Tags) > 0 && matchAny(sel.Tags, rec.Tags...)
+}
+
+// Return true if the computer is selected.
+func (sel Selector) matchHost(ip, hostname string, tags []string) bool {
+	if len(sel.HostTags) == 0 && len(sel.Hostnames) == 0 && len(sel.IPs) == 0 {
+		return true
+	}
+	if len(sel.HostTags) > 0 && matchAny(sel.HostTags, tags...) || len(sel.IPs) > 0 && matchAny(sel.IPs, ip) {
+		return true
+	}
+	for _, pattern := range sel.Hostnames {
+		if matched, _ := path.Match(pattern, hostname); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Target is a disk held online by a computer.
+type Target struct {
+	UUID     string // UUID is the disk.
+	IP       string // IP is the computer holding the disk.
+	Hostname string // Hostname is the host name reported by the computer itself.
+}
+
+// Return the disks selected by the selector along with the selected alive computers holding them, sorted by host name.
+func (db *DB) SelectTargets(sel Selector) []Target {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	targets := make([]Target, 0, 16)
+	for uuid, rec := range db.RecordsByUUID {
+		if !sel.matchDisk(rec) {
+			continue
+		}
+		for ip := range rec.AliveMessages {
+			if alive, final := rec.IsHostAlive(ip); alive && sel.matchHost(ip, final.Hostname, db.Hosts[ip].Tags) {
+				targets = append(targets, Target{UUID: uuid, IP: ip, Hostname: final.Hostname})
+			}
+		}
+	}
+	sortTargets(targets)
+	return targets
+}
+
+// Sort targets by host name, IP, and then UUID.
+func sortTargets(targets []Target) {
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Hostname != targets[j].Hostname {
+			return targets[i].Hostname < targets[j].Hostname
+		} else if targets[i].IP != targets[j].IP {
+			return targets[i].IP < targets[j].IP
+		}
+		return targets[i].UUID < targets[j].UUID
+	})
+}
+
+/*
+Issue a command to each of the targets selected by the selector, all commands share a new batch ID. Either all commands
+are issued, or, if the action or parameters do not suit any of the disks, none of them. If a command cannot be saved,
+the commands saved so far are taken back, though a computer may have already picked one of them up in the meantime.
+*/
+func (db *DB) DispatchCommand(sel Selector, action string, params map[string]string, validity time.Duration) (batch string, targets []Target, err error) {
+	if sel.IsEmpty() {
+		return "", nil, fmt.Errorf("DispatchCommand: selector must have at least one criterion")
+	}
+	targets = db.SelectTargets(sel)
+	if len(targets) == 0 {
+		return "", nil, fmt.Errorf("DispatchCommand: \"%s\" does not select any disk held by an alive computer", sel)
+	}
+	if batch, err = newRandomID(); err != nil {
+		return "", nil, err
+	}
+	cmds := make([]PendingCommand, len(targets))
+	for i, target := range targets {
+		if cmds[i], err = NewPendingCommand(target.UUID, target.IP, action, params, validity); err != nil {
+			return "", nil, err
+		}
+		cmds[i].Command.Batch = batch
+	}
+	for i, target := range targets {
+		if err = db.AddPendingCommand(target.UUID, target.IP, cmds[i]); err != nil {
+			for j := 0; j < i; j++ {
+				if rollbackErr := db.removePendingCommand(targets[j].UUID, targets[j].IP, cmds[j].Command.ID); rollbackErr != nil {
+					log.Printf("DB.DispatchCommand: failed to take back command of batch %s from %s - %v", batch, targets[j].IP, rollbackErr)
+				}
+			}
+			return "", nil, err
+		}
+	}
+	return
+}
+
+// BatchEntry is a command of a batch issued to a target.
+type BatchEntry struct {
+	Target
+	Command PendingCommand // Command is the pending command along with its result.
+}
+
+// Return true if the computer has reported a result, and true if the result is a success.
+func (entry BatchEntry) GetOutcome() (finished, success bool) {
+	if !entry.Command.Result.Finished.IsZero() {
+		return true, entry.Command.Result.Success
+	}
+	// Clients of earlier versions only report the result message
+	return entry.Command.ClientResult != "", entry.Command.ClientResult == RESULT_SUCCESS
+}
+
+// BatchSummary aggregates the outcome of the commands of a fleet-wide dispatch.
+type BatchSummary struct {
+	Batch     string       // Batch is the batch ID shared by the commands.
+	Action    string       // Action is the action of the commands.
+	Waiting   int          // Waiting is the number of commands not yet picked up by their computers.
+	Running   int          // Running is the number of commands picked up but not yet finished.
+	Succeeded int          // Succeeded is the number of commands finished successfully.
+	Failed    int          // Failed is the number of commands finished unsuccessfully.
+	Entries   []BatchEntry // Entries are the commands sorted by host name.
+}
+
+// Return the summary of the batch. Commands that have expired no longer count.
+func (db *DB) SummariseBatch(batch string) (summary BatchSummary, found bool) {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	summary = BatchSummary{Batch: batch, Entries: make([]BatchEntry, 0, 16)}
+	targets := make([]Target, 0, 16)
+	byTarget := make(map[Target]PendingCommand)
+	for uuid, rec := range db.RecordsByUUID {
+		for ip, cmds := range rec.PendingCommands {
+			for _, cmd := range cmds {
+				if cmd.Command.Batch != batch || batch == "" || !cmd.IsValid() {
+					continue
+				}
+				target := Target{UUID: uuid, IP: ip, Hostname: db.Hosts[ip].Hostname}
+				if _, final := rec.IsHostAlive(ip); final.Hostname != "" {
+					target.Hostname = final.Hostname
+				}
+				summary.Action = cmd.Command.Action
+				targets = append(targets, target)
+				byTarget[target] = cmd
+			}
+		}
+	}
+	sortTargets(targets)
+	for _, target := range targets {
+		entry := BatchEntry{Target: target, Command: byTarget[target]}
+		if finished, success := entry.GetOutcome(); finished && success {
+			summary.Succeeded++
+		} else if finished {
+			summary.Failed++
+		} else if entry.Command.SeenByClient {
+			summary.Running++
+		} else {
+			summary.Waiting++
+		}
+		summary.Entries = append(summary.Entries, entry)
+	}
+	return summary, len(summary.Entries) > 0
+}
+
+// SetTags replaces the tags of the record and immediately persists them.
+func (db *DB) SetTags(uuid string, tags []string) error {
+	tags, err := NormaliseTags(tags)
+	if err != nil {
+		return err
+	}
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return fmt.Errorf("SetTags: record \"%s\" does not exist", uuid)
+	}
+	rec.Tags = tags
+	_, err = db.upsert(rec, true)
+	return err
+}
@@ -0,0 +1,141 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, bad := range []string{"", " , ", "prod-hana", "tag=", "colour=red", "hostname=[db"} {
+		if _, err := ParseSelector(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	sel, err := ParseSelector("host-tag=prod-hana, hostname=db* ip=10.0.0.1\ttag=sap uuid=a,uuid=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Selector{UUIDs: []string{"a", "b"}, Tags: []string{"sap"}, HostTags: []string{"prod-hana"}, Hostnames: []string{"db*"}, IPs: []string{"10.0.0.1"}}
+	if !reflect.DeepEqual(sel, want) || sel.String() != "uuid=a uuid=b tag=sap host-tag=prod-hana hostname=db* ip=10.0.0.1" {
+		t.Fatal(sel, sel.String())
+	}
+	if tags, err := NormaliseTags([]string{"b", "a", "b"}); err != nil || !reflect.DeepEqual(tags, []string{"a", "b"}) {
+		t.Fatal(tags, err)
+	}
+	if _, err := NormaliseTags([]string{"a=b"}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestDB_DispatchCommand(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"disk1", "disk2", "disk3"} {
+		if _, err := db.Upsert(Record{UUID: uuid, Key: []byte{1}, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetTags("disk1", []string{"sap", "sap"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTags("does-not-exist", nil); err == nil {
+		t.Fatal("did not error")
+	}
+	// db1 holds disk1 and disk2, db2 holds disk1, app1 holds disk3
+	now := time.Now().Unix()
+	for _, held := range []struct {
+		ip, hostname string
+		uuids        []string
+	}{{"ip1", "db1", []string{"disk1", "disk2"}}, {"ip2", "db2", []string{"disk1"}}, {"ip3", "app1", []string{"disk3"}}} {
+		db.Select(AliveMessage{IP: held.ip, Hostname: held.hostname, Timestamp: now}, false, held.uuids...)
+	}
+	if err := db.SetHostTags("ip1", []string{"prod-hana"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetHostTags("ip3", []string{"prod-hana"}); err != nil {
+		t.Fatal(err)
+	}
+	for selStr, want := range map[string][]Target{
+		"host-tag=prod-hana": {{"disk3", "ip3", "app1"}, {"disk1", "ip1", "db1"}, {"disk2", "ip1", "db1"}},
+		"uuid=disk1":         {{"disk1", "ip1", "db1"}, {"disk1", "ip2", "db2"}},
+		"tag=sap uuid=disk3": {{"disk3", "ip3", "app1"}, {"disk1", "ip1", "db1"}, {"disk1", "ip2", "db2"}},
+		"tag=sap hostname=db2 host-tag=prod-hana": {{"disk1", "ip1", "db1"}, {"disk1", "ip2", "db2"}},
+		"hostname=db* ip=ip3":                     {{"disk3", "ip3", "app1"}, {"disk1", "ip1", "db1"}, {"disk2", "ip1", "db1"}, {"disk1", "ip2", "db2"}},
+		"host-tag=dev":                            {},
+	} {
+		sel, err := ParseSelector(selStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if targets := db.SelectTargets(sel); !reflect.DeepEqual(targets, want) {
+			t.Fatal(selStr, targets)
+		}
+	}
+	// Host tags survive reloading
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	sel, _ := ParseSelector("host-tag=prod-hana")
+	// The command must suit every disk, otherwise nothing is issued
+	if _, _, err := db.DispatchCommand(sel, CMD_SELF_DESTRUCT, map[string]string{CMD_PARAM_CONFIRM_UUID: "disk1"}, time.Hour); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, _, err := db.DispatchCommand(Selector{HostTags: []string{"dev"}}, CMD_UMOUNT, nil, time.Hour); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, _, err := db.DispatchCommand(Selector{}, CMD_UMOUNT, nil, time.Hour); err == nil {
+		t.Fatal("did not error")
+	}
+	// Commands saved before a failure are taken back
+	disk2File := path.Join(TestDBDir, "disk2")
+	if err := os.Remove(disk2File); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(disk2File, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.DispatchCommand(sel, CMD_UMOUNT, nil, time.Hour); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := os.Remove(disk2File); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range db.List() {
+		if len(rec.PendingCommands) != 0 {
+			t.Fatal(rec.UUID, rec.PendingCommands)
+		}
+	}
+	batch, targets, err := db.DispatchCommand(sel, CMD_UMOUNT, nil, time.Hour)
+	if err != nil || len(batch) != 2*LEN_COMMAND_ID || len(targets) != 3 {
+		t.Fatal(batch, targets, err)
+	}
+	// db1 has finished umounting disk1, picked up disk2, and app1 has not yet picked up disk3
+	rec, _ := db.GetByUUID("disk1")
+	db.UpdateCommandOutcome("disk1", "ip1", rec.PendingCommands["ip1"][0].Command.ID, CommandResult{Success: true, Message: RESULT_SUCCESS, Finished: time.Now()})
+	rec, _ = db.GetByUUID("disk2")
+	db.UpdateSeenFlagByID("disk2", "ip1", rec.PendingCommands["ip1"][0].Command.ID)
+	summary, found := db.SummariseBatch(batch)
+	if !found || summary.Action != CMD_UMOUNT || summary.Succeeded != 1 || summary.Running != 1 || summary.Waiting != 1 || summary.Failed != 0 {
+		t.Fatal(found, summary)
+	}
+	if len(summary.Entries) != 3 || summary.Entries[0].Target != targets[0] || summary.Entries[1].Command.Command.Batch != batch {
+		t.Fatal(summary.Entries)
+	}
+	// A client of an earlier version only reports the result message
+	db.UpdateCommandResult("disk3", "ip3", CMD_UMOUNT, "device is busy")
+	if summary, _ = db.SummariseBatch(batch); summary.Failed != 1 || summary.Waiting != 0 {
+		t.Fatal(summary)
+	}
+	if _, found := db.SummariseBatch("does-not-exist"); found {
+		t.Fatal("should not have found")
+	}
+}
@@ -0,0 +1,232 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	HOSTS_FILE_NAME = ".hosts"      // HOSTS_FILE_NAME is the file in database directory that stores liveness of hosts.
+	HOST_EXPIRY_SEC = 7 * 24 * 3600 // HOST_EXPIRY_SEC is the duration after which a silent host is forgotten.
+
+	HOSTS_SAVE_INTERVAL_SEC = 300 // HOSTS_SAVE_INTERVAL_SEC is for how long heartbeats that change nothing but LastSeen stay in memory only.
+)
+
+/*
+Host is the liveness state of a computer that holds encrypted disks online. A single heartbeat from the computer keeps
+all of its disks alive, instead of each disk sending its own alive reports.
+*/
+type Host struct {
+	IP       string   `json:"ip"`        // IP is the computer's IP as seen by cryptctl server.
+	Hostname string   `json:"hostname"`  // Hostname is the host name reported by the computer itself.
+	UUIDs    []string `json:"uuids"`     // UUIDs are the encrypted disks that the computer holds online.
+	LastSeen int64    `json:"last_seen"` // LastSeen is the moment the latest heartbeat arrived at cryptctl server.
+	Tags     []string `json:"tags"`      // Tags group computers together so that fleet-wide commands may select them.
+}
+
+// Read liveness of hosts from the hosts file. A missing file is not an error.
+func (db *DB) loadHosts() error {
+	db.Hosts = make(map[string]Host)
+	content, err := ioutil.ReadFile(path.Join(db.Dir, HOSTS_FILE_NAME))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("DB.loadHosts: failed to read hosts file - %v", err)
+	}
+	var hosts []Host
+	if err := json.Unmarshal(content, &hosts); err != nil {
+		return fmt.Errorf("DB.loadHosts: failed to parse hosts file - %v", err)
+	}
+	for _, host := range hosts {
+		db.Hosts[host.IP] = host
+		// Key records do not persist every heartbeat, bring their alive messages up to date.
+		for _, uuid := range host.UUIDs {
+			if rec, found := db.RecordsByUUID[uuid]; found {
+				if _, final := rec.IsHostAlive(host.IP); final.Timestamp < host.LastSeen {
+					rec.UpdateAliveMessage(AliveMessage{IP: host.IP, Hostname: host.Hostname, Timestamp: host.LastSeen})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Persist liveness of hosts into the hosts file, forget the hosts that have been silent for too long unless they carry
+tags, which are given by the administrator.
+*/
+func (db *DB) saveHosts() error {
+	hosts := make([]Host, 0, len(db.Hosts))
+	for ip, host := range db.Hosts {
+		if host.LastSeen < time.Now().Unix()-HOST_EXPIRY_SEC && len(host.Tags) == 0 {
+			delete(db.Hosts, ip)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].IP < hosts[j].IP
+	})
+	content, err := json.Marshal(hosts)
+	if err != nil {
+		return fmt.Errorf("DB.saveHosts: failed to serialise hosts - %v", err)
+	}
+	// Replace the file in one go, so that a crash does not leave a partially written file behind.
+	hostsFile := path.Join(db.Dir, HOSTS_FILE_NAME)
+	tmpFile := hostsFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, DB_REC_FILE_MODE); err != nil {
+		return fmt.Errorf("DB.saveHosts: failed to write hosts file - %v", err)
+	}
+	if err := os.Rename(tmpFile, hostsFile); err != nil {
+		return fmt.Errorf("DB.saveHosts: failed to replace hosts file - %v", err)
+	}
+	db.hostsSavedAt = time.Now()
+	return nil
+}
+
+/*
+Record a heartbeat from a host that holds the encrypted disks of the UUIDs online, and persist the liveness of the host
+when its disks have changed. If setUUIDs is true, the UUIDs are all of the disks held by the host; otherwise, they are added to
+the disks reported earlier. Return UUIDs of the disks that no longer consider the host eligible to hold them.
+*/
+func (db *DB) UpdateHost(latest AliveMessage, setUUIDs bool, uuids ...string) (rejected []string) {
+	_, rejected = db.RenewLeases(latest, setUUIDs, LeaseClaim{}, uuids...)
+	return
+}
+
+/*
+Record a heartbeat from a host that holds the encrypted disks of the UUIDs online, and renew the host's lease of each
+disk. The liveness of the host is persisted when its disks have changed, and the leases when one of them is granted or
+moves to another host, otherwise both stay in memory for up to HOSTS_SAVE_INTERVAL_SEC. The leases are identified by the
+lease IDs of the claim, or by the host's IP for disks that do not come with a lease ID. If setUUIDs is true, the UUIDs
+are all of the disks held by the host; otherwise, they are added to the disks reported earlier. Return the renewed leases in UUID -
+lease pairs, and UUIDs of the disks that no longer consider the host eligible to hold them.
+*/
+func (db *DB) RenewLeases(latest AliveMessage, setUUIDs bool, claim LeaseClaim, uuids ...string) (leases map[string]Lease, rejected []string) {
+	leases = make(map[string]Lease)
+	rejected = make([]string, 0, 8)
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	alive := make(map[string]bool)
+	leasesChanged := false
+	if !setUUIDs {
+		for _, uuid := range db.Hosts[latest.IP].UUIDs {
+			alive[uuid] = true
+		}
+	}
+	for _, uuid := range uuids {
+		// The record's alive messages are kept up to date in memory, the hosts file persists them.
+		record, exists := db.RecordsByUUID[uuid]
+		if !exists {
+			// UUID record disappeared
+			delete(alive, uuid)
+			rejected = append(rejected, uuid)
+			continue
+		}
+		if lease, ok, changed := db.renewLease(record, latest, claim); ok {
+			alive[uuid] = true
+			leases[uuid] = lease
+			leasesChanged = leasesChanged || changed
+		} else {
+			// Host is no longer considered to be alive, or its lease has been revoked
+			delete(alive, uuid)
+			rejected = append(rejected, uuid)
+			if record.RejectHost(latest.IP, time.Unix(latest.Timestamp, 0)) {
+				db.upsert(record, true) // IO error is logged
+			}
+		}
+	}
+	previous, seen := db.Hosts[latest.IP]
+	host := previous
+	host.IP = latest.IP
+	host.Hostname = latest.Hostname
+	host.LastSeen = latest.Timestamp
+	host.UUIDs = make([]string, 0, len(alive))
+	for uuid := range alive {
+		host.UUIDs = append(host.UUIDs, uuid)
+	}
+	sort.Strings(host.UUIDs)
+	db.Hosts[host.IP] = host
+	// Heartbeats arrive every few seconds from every host, rewriting the hosts file for each of them would be wasteful.
+	if !seen || previous.Hostname != host.Hostname || !isSameUUIDs(previous.UUIDs, host.UUIDs) ||
+		time.Since(db.hostsSavedAt) > HOSTS_SAVE_INTERVAL_SEC*time.Second {
+		if err := db.saveHosts(); err != nil {
+			log.Printf("DB.RenewLeases: failed to save heartbeat of %s - %v", host.IP, err)
+		}
+	}
+	// Likewise for leases, a renewal that only pushes out the expiry is recomputed on load should it be lost.
+	if leasesChanged || time.Since(db.leasesSavedAt) > HOSTS_SAVE_INTERVAL_SEC*time.Second {
+		if err := db.saveLeases(); err != nil {
+			log.Printf("DB.RenewLeases: failed to save leases of %s - %v", host.IP, err)
+		}
+	}
+	return
+}
+
+// Return true only if both sorted lists carry the same UUIDs.
+func isSameUUIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove the disk from those held by the host, after the host's lease has moved to another IP. Caller must hold the lock.
+func (db *DB) forgetHostDisk(ip, uuid string) {
+	host, found := db.Hosts[ip]
+	if !found {
+		return
+	}
+	remaining := make([]string, 0, len(host.UUIDs))
+	for _, held := range host.UUIDs {
+		if held != uuid {
+			remaining = append(remaining, held)
+		}
+	}
+	host.UUIDs = remaining
+	db.Hosts[ip] = host
+}
+
+// Return liveness of all hosts sorted by IP.
+func (db *DB) ListHosts() []Host {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	hosts := make([]Host, 0, len(db.Hosts))
+	for _, host := range db.Hosts {
+		host.UUIDs = append([]string{}, host.UUIDs...)
+		host.Tags = append([]string(nil), host.Tags...)
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].IP < hosts[j].IP
+	})
+	return hosts
+}
+
+// Replace the tags of the host of the IP and immediately persist them. The host does not have to be seen yet.
+func (db *DB) SetHostTags(ip string, tags []string) error {
+	tags, err := NormaliseTags(tags)
+	if err != nil {
+		return err
+	}
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	host := db.Hosts[ip]
+	host.IP = ip
+	host.Tags = tags
+	db.Hosts[ip] = host
+	return db.saveHosts()
+}
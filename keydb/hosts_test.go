@@ -0,0 +1,90 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDB_UpdateHost(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"1", "2"} {
+		if _, err := db.Upsert(Record{UUID: uuid, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The host retrieves both keys
+	retrieval := AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: time.Now().Unix() - 1}
+	if found, rejected, missing := db.Select(retrieval, true, "1", "2"); len(found) != 2 || len(rejected) != 0 || len(missing) != 0 {
+		t.Fatal(found, rejected, missing)
+	}
+	// A single heartbeat keeps both disks alive
+	beat := AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: time.Now().Unix()}
+	if rejected := db.UpdateHost(beat, true, "1", "2", "does-not-exist"); !reflect.DeepEqual(rejected, []string{"does-not-exist"}) {
+		t.Fatal(rejected)
+	}
+	if hosts := db.ListHosts(); !reflect.DeepEqual(hosts, []Host{{IP: "ip1", Hostname: "host1", UUIDs: []string{"1", "2"}, LastSeen: beat.Timestamp}}) {
+		t.Fatal(hosts)
+	}
+	// Host that has not retrieved the key is rejected
+	if rejected := db.UpdateHost(AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: beat.Timestamp}, true, "1"); !reflect.DeepEqual(rejected, []string{"1"}) {
+		t.Fatal(rejected)
+	}
+	// Liveness survives reloading, although the records were not rewritten by the heartbeat
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"1", "2"} {
+		rec, _ := db.GetByUUID(uuid)
+		if alive, final := rec.IsHostAlive("ip1"); !alive || final != beat {
+			t.Fatal(uuid, alive, final)
+		}
+	}
+	if hosts := db.ListHosts(); len(hosts) != 2 || !reflect.DeepEqual(hosts[0].UUIDs, []string{"1", "2"}) || len(hosts[1].UUIDs) != 0 {
+		t.Fatal(hosts)
+	}
+	// Alive reports of individual disks add to the disks reported earlier, whereas heartbeat replaces them
+	if rejected := db.UpdateAliveMessage(beat, "1"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	if hosts := db.ListHosts(); !reflect.DeepEqual(hosts[0].UUIDs, []string{"1", "2"}) {
+		t.Fatal(hosts)
+	}
+	if rejected := db.UpdateHost(beat, true, "2"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	if hosts := db.ListHosts(); !reflect.DeepEqual(hosts[0].UUIDs, []string{"2"}) {
+		t.Fatal(hosts)
+	}
+	// Heartbeat that changes nothing but the moment of last contact is kept in memory
+	hostsFile := path.Join(TestDBDir, HOSTS_FILE_NAME)
+	if err := os.Remove(hostsFile); err != nil {
+		t.Fatal(err)
+	}
+	beat.Timestamp++
+	if rejected := db.UpdateHost(beat, true, "2"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	if _, err := os.Stat(hostsFile); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if hosts := db.ListHosts(); hosts[0].LastSeen != beat.Timestamp {
+		t.Fatal(hosts)
+	}
+	// Change of the disks is persisted right away
+	if rejected := db.UpdateHost(beat, true, "1", "2"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	if _, err := os.Stat(hostsFile); err != nil {
+		t.Fatal(err)
+	}
+}
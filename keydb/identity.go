@@ -0,0 +1,136 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	CLIENT_ID_CERT      = "cert:"  // CLIENT_ID_CERT prefixes SHA-256 fingerprint (hex) of a client certificate.
+	CLIENT_ID_NAME      = "cn:"    // CLIENT_ID_NAME prefixes common name or DNS name of a verified client certificate.
+	CLIENT_ID_IP        = "ip:"    // CLIENT_ID_IP prefixes an IP address or CIDR block.
+	CLIENT_ID_TOKEN     = "token:" // CLIENT_ID_TOKEN prefixes SHA-256 hash (hex) of an enrolment token.
+	CLIENT_ID_NEW_TOKEN = "token"  // CLIENT_ID_NEW_TOKEN asks for a new enrolment token to be issued.
+	LEN_CLIENT_TOKEN    = 32       // LEN_CLIENT_TOKEN is the number of random bytes in an enrolment token.
+)
+
+// ClientIdentity describes a client computer as far as the key server can tell.
+type ClientIdentity struct {
+	IP              string   // IP is the client computer's IP as seen by cryptctl server.
+	CertFingerprint string   // CertFingerprint is the SHA-256 fingerprint (hex) of client certificate, or empty.
+	CertNames       []string // CertNames are common name and DNS names of client certificate, only if the certificate is verified.
+	Token           string   // Token is the enrolment token presented by client for the record in question.
+}
+
+// Return the identity entry of a certificate fingerprint, the fingerprint may be written in upper case and with colons.
+func normaliseFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+	if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("normaliseFingerprint: \"%s\" is not a SHA-256 fingerprint", fingerprint)
+	}
+	return fingerprint, nil
+}
+
+/*
+NormaliseAllowedClient validates an entry of Record.AllowedClients and returns it in canonical form. The entry must
+look like one of "cert:FINGERPRINT", "cn:NAME", "ip:ADDRESS", "ip:ADDRESS/PREFIX", or "token:HASH".
+*/
+func NormaliseAllowedClient(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	switch {
+	case strings.HasPrefix(entry, CLIENT_ID_CERT):
+		fingerprint, err := normaliseFingerprint(strings.TrimPrefix(entry, CLIENT_ID_CERT))
+		if err != nil {
+			return "", err
+		}
+		return CLIENT_ID_CERT + fingerprint, nil
+	case strings.HasPrefix(entry, CLIENT_ID_NAME):
+		if name := strings.TrimPrefix(entry, CLIENT_ID_NAME); name != "" {
+			return CLIENT_ID_NAME + strings.ToLower(name), nil
+		}
+	case strings.HasPrefix(entry, CLIENT_ID_IP):
+		addr := strings.TrimPrefix(entry, CLIENT_ID_IP)
+		if _, block, err := net.ParseCIDR(addr); err == nil {
+			return CLIENT_ID_IP + block.String(), nil
+		} else if ip := net.ParseIP(addr); ip != nil {
+			return CLIENT_ID_IP + ip.String(), nil
+		}
+	case strings.HasPrefix(entry, CLIENT_ID_TOKEN):
+		hash := strings.ToLower(strings.TrimPrefix(entry, CLIENT_ID_TOKEN))
+		if decoded, err := hex.DecodeString(hash); err == nil && len(decoded) == sha256.Size {
+			return CLIENT_ID_TOKEN + hash, nil
+		}
+	}
+	return "", fmt.Errorf("NormaliseAllowedClient: \"%s\" should look like cert:FINGERPRINT, cn:NAME, ip:ADDRESS[/PREFIX], or token:HASH", entry)
+}
+
+// Return the hash of an enrolment token, the hash is stored in record and the token is kept by client.
+func HashClientToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a new random enrolment token. Return the token for client and its entry for Record.AllowedClients.
+func NewClientToken() (token, entry string, err error) {
+	randBytes := make([]byte, LEN_CLIENT_TOKEN)
+	if _, err = rand.Read(randBytes); err != nil {
+		return "", "", fmt.Errorf("NewClientToken: failed to generate random token - %v", err)
+	}
+	token = hex.EncodeToString(randBytes)
+	return token, CLIENT_ID_TOKEN + HashClientToken(token), nil
+}
+
+// Return true only if the client identity satisfies the entry of Record.AllowedClients.
+func (id ClientIdentity) matches(entry string) bool {
+	switch {
+	case strings.HasPrefix(entry, CLIENT_ID_CERT):
+		return id.CertFingerprint != "" && id.CertFingerprint == strings.TrimPrefix(entry, CLIENT_ID_CERT)
+	case strings.HasPrefix(entry, CLIENT_ID_NAME):
+		for _, name := range id.CertNames {
+			if strings.ToLower(name) == strings.TrimPrefix(entry, CLIENT_ID_NAME) {
+				return true
+			}
+		}
+	case strings.HasPrefix(entry, CLIENT_ID_IP):
+		ip := net.ParseIP(id.IP)
+		if ip == nil {
+			return false
+		}
+		addr := strings.TrimPrefix(entry, CLIENT_ID_IP)
+		if _, block, err := net.ParseCIDR(addr); err == nil {
+			return block.Contains(ip)
+		}
+		return ip.Equal(net.ParseIP(addr))
+	case strings.HasPrefix(entry, CLIENT_ID_TOKEN):
+		if id.Token == "" {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(HashClientToken(id.Token)), []byte(strings.TrimPrefix(entry, CLIENT_ID_TOKEN))) == 1
+	}
+	return false
+}
+
+/*
+IsClientAllowed returns true only if the client may retrieve the key without a password, that is when the record does
+not restrict its clients, or when the client satisfies any of the allowed identities.
+*/
+func (rec *Record) IsClientAllowed(id ClientIdentity) bool {
+	return len(rec.AllowedClients) == 0 || id.MatchesAny(rec.AllowedClients)
+}
+
+// MatchesAny returns true only if the client identity satisfies any of the entries in the form of Record.AllowedClients.
+func (id ClientIdentity) MatchesAny(entries []string) bool {
+	for _, entry := range entries {
+		if id.matches(entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormaliseAllowedClient(t *testing.T) {
+	fingerprint := strings.Repeat("AB:", 31) + "AB"
+	for input, expected := range map[string]string{
+		"cert:" + fingerprint:              "cert:" + strings.Repeat("ab", 32),
+		"cn:Host1.Example.com":             "cn:host1.example.com",
+		"ip:10.0.0.1":                      "ip:10.0.0.1",
+		" ip:10.1.2.3/16 ":                 "ip:10.1.0.0/16",
+		"ip:fe80::1":                       "ip:fe80::1",
+		"token:" + strings.Repeat("0", 64): "token:" + strings.Repeat("0", 64),
+	} {
+		if normalised, err := NormaliseAllowedClient(input); err != nil || normalised != expected {
+			t.Fatal(input, normalised, err)
+		}
+	}
+	for _, input := range []string{"", "token", "cert:abc", "cn:", "ip:10.0.0", "token:xyz", "host1"} {
+		if _, err := NormaliseAllowedClient(input); err == nil {
+			t.Fatal("did not error", input)
+		}
+	}
+}
+
+func TestIsClientAllowed(t *testing.T) {
+	token, tokenEntry, err := NewClientToken()
+	if err != nil || len(token) != LEN_CLIENT_TOKEN*2 || tokenEntry != CLIENT_ID_TOKEN+HashClientToken(token) {
+		t.Fatal(token, tokenEntry, err)
+	}
+	rec := Record{}
+	// Any client is allowed if the record does not restrict its clients
+	if !rec.IsClientAllowed(ClientIdentity{IP: "10.0.0.1"}) {
+		t.Fatal("should have been allowed")
+	}
+	rec.AllowedClients = []string{"cert:" + strings.Repeat("ab", 32), "cn:host1", "ip:10.1.0.0/16", "ip:192.168.0.1", tokenEntry}
+	for _, id := range []ClientIdentity{
+		{IP: "1.1.1.1", CertFingerprint: strings.Repeat("ab", 32)},
+		{IP: "1.1.1.1", CertNames: []string{"other", "HOST1"}},
+		{IP: "10.1.200.3"},
+		{IP: "192.168.0.1"},
+		{IP: "1.1.1.1", Token: token},
+	} {
+		if !rec.IsClientAllowed(id) {
+			t.Fatal("should have been allowed", id)
+		}
+	}
+	for _, id := range []ClientIdentity{
+		{IP: "1.1.1.1"},
+		{IP: "1.1.1.1", CertFingerprint: strings.Repeat("cd", 32)},
+		{IP: "1.1.1.1", CertNames: []string{"host2"}},
+		{IP: "10.2.0.1"},
+		{IP: "192.168.0.2"},
+		{IP: "1.1.1.1", Token: "wrong"},
+		{IP: "not an ip"},
+	} {
+		if rec.IsClientAllowed(id) {
+			t.Fatal("should not have been allowed", id)
+		}
+	}
+}
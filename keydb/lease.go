@@ -0,0 +1,488 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	LEASES_FILE_NAME = ".leases" // LEASES_FILE_NAME is the file in database directory that stores leases of keys.
+)
+
+/*
+Lease is the permission of a computer to hold an encryption key online, it is granted along with the key and renewed by
+heartbeats that carry its ID. The lease stays with the computer when the computer changes its IP, and it expires if the
+computer misses too many heartbeats.
+*/
+type Lease struct {
+	ID       string    `json:"id"`       // ID is the random identifier handed to the computer along with the key.
+	UUID     string    `json:"uuid"`     // UUID is the disk of the key.
+	IP       string    `json:"ip"`       // IP is the computer's IP as seen by cryptctl server in the latest renewal.
+	Hostname string    `json:"hostname"` // Hostname is the host name reported by the computer itself.
+	Granted  time.Time `json:"granted"`  // Granted is the moment the key was retrieved.
+	Renewed  time.Time `json:"renewed"`  // Renewed is the moment the latest heartbeat arrived.
+	Expiry   time.Time `json:"expiry"`   // Expiry is the moment the lease is lost unless renewed again.
+	ByIP     bool      `json:"by_ip"`    // ByIP is true if the computer was never told the lease ID, it is then identified by IP.
+	Cert     string    `json:"cert"`     // Cert is the fingerprint of the client certificate that retrieved the key, or empty.
+	Token    string    `json:"token"`    // Token is the hash of the enrolment token presented on retrieval, or empty.
+}
+
+/*
+LeaseClaim is what a retrieving computer presents to prove that it already holds leases, so that its retrieval replaces
+them instead of counting as another active holder. IP and host name prove nothing, as computers may share both. The claim is also what a computer presents to renew or
+release its leases.
+*/
+type LeaseClaim struct {
+	LeaseIDs map[string]string // LeaseIDs are the leases handed to the computer earlier, in UUID - lease ID pairs.
+	Cert     string            // Cert is the fingerprint of the computer's client certificate, or empty.
+	Tokens   map[string]string // Tokens are the enrolment tokens presented by the computer, in UUID - token pairs.
+}
+
+// IsValid returns true only if the lease has not expired by the moment.
+func (lease Lease) IsValid(now time.Time) bool {
+	return now.Before(lease.Expiry)
+}
+
+// IsHeldBy returns true only if the lease was last renewed by the computer of the IP and host name.
+func (lease Lease) IsHeldBy(ip, hostname string) bool {
+	return lease.IP == ip && lease.Hostname == hostname
+}
+
+// IsClaimedBy returns true only if the claim presents the lease ID, or the client certificate that retrieved the key.
+func (lease Lease) IsClaimedBy(claim LeaseClaim) bool {
+	return claim.LeaseIDs[lease.UUID] == lease.ID || (lease.Cert != "" && lease.Cert == claim.Cert)
+}
+
+/*
+IsHolder returns true only if the computer of the IP and claim is the one holding the lease: the lease was last renewed
+from the IP, or the computer presents the client certificate or enrolment token that retrieved the key. The lease ID
+alone does not prove it, because the ID travels along with the heartbeats.
+*/
+func (lease Lease) IsHolder(ip string, claim LeaseClaim) bool {
+	if lease.IP == ip || (lease.Cert != "" && lease.Cert == claim.Cert) {
+		return true
+	}
+	token := claim.Tokens[lease.UUID]
+	return lease.Token != "" && token != "" && subtle.ConstantTimeCompare([]byte(HashClientToken(token)), []byte(lease.Token)) == 1
+}
+
+// Digest returns a short digest of the lease ID that tells leases apart without revealing the ID.
+func (lease Lease) Digest() string {
+	sum := sha256.Sum256([]byte(lease.ID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Return the duration a lease of the key lasts without renewal, i.e. the time it takes to miss all alive reports.
+func (rec *Record) GetLeaseDuration() time.Duration {
+	return time.Duration(rec.AliveIntervalSec*rec.AliveCount) * time.Second
+}
+
+/*
+Read leases from the leases file. A missing file is not an error. Renewals may have stayed in memory for up to
+HOSTS_SAVE_INTERVAL_SEC before the file was last written, hence the leases expire that much later than the file says.
+*/
+func (db *DB) loadLeases() error {
+	db.Leases = make(map[string]Lease)
+	content, err := ioutil.ReadFile(path.Join(db.Dir, LEASES_FILE_NAME))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("DB.loadLeases: failed to read leases file - %v", err)
+	}
+	var leases []Lease
+	if err := json.Unmarshal(content, &leases); err != nil {
+		return fmt.Errorf("DB.loadLeases: failed to parse leases file - %v", err)
+	}
+	for _, lease := range leases {
+		lease.Expiry = lease.Expiry.Add(HOSTS_SAVE_INTERVAL_SEC * time.Second)
+		db.Leases[lease.ID] = lease
+	}
+	return nil
+}
+
+// Persist leases into the leases file, forget the leases that have expired.
+func (db *DB) saveLeases() error {
+	now := time.Now()
+	leases := make([]Lease, 0, len(db.Leases))
+	for id, lease := range db.Leases {
+		if !lease.IsValid(now) {
+			delete(db.Leases, id)
+			continue
+		}
+		leases = append(leases, lease)
+	}
+	sortLeases(leases)
+	content, err := json.Marshal(leases)
+	if err != nil {
+		return fmt.Errorf("DB.saveLeases: failed to serialise leases - %v", err)
+	}
+	// Replace the file in one go, so that a crash does not leave a partially written file behind.
+	leasesFile := path.Join(db.Dir, LEASES_FILE_NAME)
+	tmpFile := leasesFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, DB_REC_FILE_MODE); err != nil {
+		return fmt.Errorf("DB.saveLeases: failed to write leases file - %v", err)
+	}
+	if err := os.Rename(tmpFile, leasesFile); err != nil {
+		return fmt.Errorf("DB.saveLeases: failed to replace leases file - %v", err)
+	}
+	db.leasesSavedAt = time.Now()
+	return nil
+}
+
+// Sort leases by UUID, and then by the moment they were granted.
+func sortLeases(leases []Lease) {
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].UUID != leases[j].UUID {
+			return leases[i].UUID < leases[j].UUID
+		}
+		return leases[i].Granted.Before(leases[j].Granted)
+	})
+}
+
+// Return true only if a computer of the IP holds a valid lease of the disk, other than the lease of the ID.
+func (db *DB) isLeased(uuid, ip, exceptID string, now time.Time) bool {
+	for _, lease := range db.Leases {
+		if lease.UUID == uuid && lease.IP == ip && lease.ID != exceptID && lease.IsValid(now) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Return the number of computers other than the retrieving one that hold the key online, that is the number of valid
+leases. The lease claimed by the retrieving computer does not count, because the retrieval replaces it. Computers that retrieved the key before leases were introduced count as well, as long as they are alive and have
+not yet been given a lease.
+*/
+func (db *DB) countActive(rec Record, retrieval AliveMessage, claim LeaseClaim) (count int) {
+	now := time.Unix(retrieval.Timestamp, 0)
+	leasedIPs := make(map[string]bool)
+	for _, lease := range db.Leases {
+		if lease.UUID == rec.UUID && lease.IsValid(now) {
+			leasedIPs[lease.IP] = true
+			if !lease.IsClaimedBy(claim) {
+				count++
+			}
+		}
+	}
+	for ip := range rec.AliveMessages {
+		if alive, _ := rec.IsHostAlive(ip); alive && !leasedIPs[ip] {
+			count++
+		}
+	}
+	return
+}
+
+/*
+Grant a new lease of the key to the computer who has just retrieved it. The new lease replaces the valid lease that the
+computer claims by its lease ID or client certificate, such as when the computer retrieves the key again after the disk
+is reopened, so that the computer does not hold two leases of one key. Caller must hold the lock.
+*/
+func (db *DB) grantLease(rec Record, retrieval AliveMessage, claim LeaseClaim) (Lease, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return Lease{}, err
+	}
+	now := time.Unix(retrieval.Timestamp, 0)
+	for existingID, existing := range db.Leases {
+		if existing.UUID == rec.UUID && existing.IsClaimedBy(claim) && existing.IsValid(now) {
+			delete(db.Leases, existingID)
+		}
+	}
+	lease := Lease{
+		ID:       id,
+		UUID:     rec.UUID,
+		IP:       retrieval.IP,
+		Hostname: retrieval.Hostname,
+		Granted:  now,
+		Renewed:  now,
+		Expiry:   now.Add(rec.GetLeaseDuration()),
+		Cert:     claim.Cert,
+	}
+	if token := claim.Tokens[rec.UUID]; token != "" {
+		lease.Token = HashClientToken(token)
+	}
+	db.Leases[id] = lease
+	return lease, nil
+}
+
+/*
+Renew the lease of the key held by the computer who sent the heartbeat, return false if the computer no longer holds a
+lease. The lease is identified by its ID regardless of the computer's IP, and the alive messages follow the lease to the
+new IP, as long as the computer proves to be the holder by the client certificate or enrolment token that retrieved the
+key. A computer of an earlier version does not know its lease ID, in which case the lease is identified by IP. Also
+return true if the lease was granted or has moved to another computer, rather than merely renewed. Caller must hold the
+lock.
+*/
+func (db *DB) renewLease(rec Record, beat AliveMessage, claim LeaseClaim) (lease Lease, ok, changed bool) {
+	now := time.Unix(beat.Timestamp, 0)
+	if id := claim.LeaseIDs[rec.UUID]; id != "" {
+		if lease, ok = db.Leases[id]; !ok || lease.UUID != rec.UUID || !lease.IsValid(now) || !lease.IsHolder(beat.IP, claim) {
+			return Lease{}, false, false
+		}
+	} else {
+		for _, candidate := range db.Leases {
+			if candidate.UUID == rec.UUID && candidate.IP == beat.IP && candidate.IsValid(now) &&
+				(!ok || candidate.Expiry.After(lease.Expiry)) {
+				lease, ok = candidate, true
+			}
+		}
+		if !ok {
+			// The computer retrieved the key before leases were introduced
+			if alive, _ := rec.IsHostAlive(beat.IP); !alive {
+				return Lease{}, false, false
+			}
+			var err error
+			if lease, err = db.grantLease(rec, beat, LeaseClaim{}); err != nil {
+				return Lease{}, false, false
+			}
+			lease.ByIP = true
+			changed = true
+		}
+	}
+	changed = changed || !lease.IsHeldBy(beat.IP, beat.Hostname)
+	if lease.IP != beat.IP {
+		history := rec.AliveMessages[lease.IP]
+		if !db.isLeased(rec.UUID, lease.IP, lease.ID, now) {
+			delete(rec.AliveMessages, lease.IP)
+			db.forgetHostDisk(lease.IP, rec.UUID)
+		}
+		if _, exists := rec.AliveMessages[beat.IP]; !exists && len(history) > 0 {
+			rec.AliveMessages[beat.IP] = history
+		}
+	}
+	if !rec.UpdateAliveMessage(beat) {
+		rec.AliveMessages[beat.IP] = []AliveMessage{beat}
+	}
+	if lease.IP != beat.IP {
+		// Heartbeats are not persisted in the record, but the move to another IP has to be.
+		db.upsert(rec, true) // IO error is logged
+	}
+	lease.IP = beat.IP
+	lease.Hostname = beat.Hostname
+	lease.Renewed = now
+	lease.Expiry = now.Add(rec.GetLeaseDuration())
+	db.Leases[lease.ID] = lease
+	return lease, true, changed
+}
+
+// Return valid leases of the disk sorted by the moment they were granted, or leases of all disks if UUID is empty.
+func (db *DB) ListLeases(uuid string) []Lease {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	now := time.Now()
+	leases := make([]Lease, 0, 8)
+	for _, lease := range db.Leases {
+		if (uuid == "" || lease.UUID == uuid) && lease.IsValid(now) {
+			leases = append(leases, lease)
+		}
+	}
+	sortLeases(leases)
+	return leases
+}
+
+/*
+Return true only if the computer of the IP currently holds the key of the disk, either by a valid lease or by alive
+messages that are recent enough.
+*/
+func (db *DB) IsHeldByIP(uuid, ip string) bool {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	now := time.Now()
+	for _, lease := range db.Leases {
+		if lease.UUID == uuid && lease.IP == ip && lease.IsValid(now) {
+			return true
+		}
+	}
+	if rec, found := db.RecordsByUUID[uuid]; found {
+		alive, _ := rec.IsHostAlive(ip)
+		return alive
+	}
+	return false
+}
+
+/*
+Revoke a lease and immediately persist the leases, the computer holding it will be told to let go of the key in its
+next heartbeat.
+*/
+func (db *DB) RevokeLease(id string) (Lease, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	lease, found := db.Leases[id]
+	if !found || !lease.IsValid(time.Now()) {
+		return Lease{}, fmt.Errorf("RevokeLease: lease \"%s\" does not exist or has expired", id)
+	}
+	delete(db.Leases, id)
+	// Otherwise a computer of an earlier version would keep holding the key by its IP
+	if rec, found := db.RecordsByUUID[lease.UUID]; found && !db.isLeased(lease.UUID, lease.IP, "", time.Now()) {
+		delete(rec.AliveMessages, lease.IP)
+		db.upsert(rec, true) // IO error is logged
+	}
+	return lease, db.saveLeases()
+}
+
+/*
+Release the leases of the disks held by the computer who is letting go of them, so that they immediately stop counting
+towards MaxActive, and immediately persist the leases and liveness of the computer. A lease handed out along with a key
+is only released by its ID, because other computers may share the IP and even the host name, and only by its holder (see
+Lease.IsHolder). Only for a disk retrieved before leases were introduced, the computer is identified
+by both its IP and host name instead. Return UUIDs of the disks that have been released.
+*/
+func (db *DB) ReleaseLeases(latest AliveMessage, claim LeaseClaim, uuids ...string) (released []string) {
+	released = make([]string, 0, len(uuids))
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	now := time.Unix(latest.Timestamp, 0)
+	for _, uuid := range uuids {
+		rec, found := db.RecordsByUUID[uuid]
+		if !found {
+			continue
+		}
+		// The computer may have changed its IP since it was given the lease
+		ips := make(map[string]bool)
+		isReleased := false
+		if id := claim.LeaseIDs[uuid]; id != "" {
+			if lease, found := db.Leases[id]; found && lease.UUID == uuid && lease.IsHolder(latest.IP, claim) {
+				delete(db.Leases, id)
+				ips[lease.IP] = true
+				isReleased = true
+			}
+		} else {
+			matchedIDs := make([]string, 0, 1)
+			for id, lease := range db.Leases {
+				if lease.UUID == uuid && lease.ByIP && lease.IsHeldBy(latest.IP, latest.Hostname) && lease.IsValid(now) {
+					matchedIDs = append(matchedIDs, id)
+				}
+			}
+			if len(matchedIDs) == 1 {
+				delete(db.Leases, matchedIDs[0])
+				ips[latest.IP] = true
+				isReleased = true
+			}
+		}
+		// The computer may hold the key by its liveness alone, if it has not sent a heartbeat since leases were introduced
+		if msgs := rec.AliveMessages[latest.IP]; len(msgs) > 0 && msgs[len(msgs)-1].Hostname == latest.Hostname {
+			ips[latest.IP] = true
+		}
+		for ip := range ips {
+			if _, alive := rec.AliveMessages[ip]; alive && !db.isLeased(uuid, ip, "", now) {
+				delete(rec.AliveMessages, ip)
+				db.forgetHostDisk(ip, uuid)
+				isReleased = true
+			}
+		}
+		if isReleased {
+			db.upsert(rec, true) // IO error is logged
+			released = append(released, uuid)
+		}
+	}
+	if err := db.saveHosts(); err != nil {
+		log.Printf("DB.ReleaseLeases: failed to save liveness of %s - %v", latest.IP, err)
+	}
+	if err := db.saveLeases(); err != nil {
+		log.Printf("DB.ReleaseLeases: failed to save leases of %s - %v", latest.IP, err)
+	}
+	return
+}
+
+/*
+Return the IP of the computer to fence. The host is taken as an IP if a computer of the IP holds a key. Otherwise it is
+taken as the host name that the computer reported, which is only good if the keys under the name are held by a single
+IP, because computers may share a host name. Return an empty IP if no computer holds a key. Caller must hold the lock.
+*/
+func (db *DB) getFencedIP(host string, now time.Time) (string, error) {
+	ipsOfName := make(map[string]bool)
+	for _, lease := range db.Leases {
+		if lease.IP == host {
+			return host, nil
+		} else if lease.Hostname == host && lease.IsValid(now) {
+			ipsOfName[lease.IP] = true
+		}
+	}
+	for _, rec := range db.RecordsByUUID {
+		for ip, msgs := range rec.AliveMessages {
+			if ip == host {
+				return host, nil
+			} else if len(msgs) > 0 && msgs[len(msgs)-1].Hostname == host {
+				ipsOfName[ip] = true
+			}
+		}
+	}
+	ips := make([]string, 0, len(ipsOfName))
+	for ip := range ipsOfName {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	switch len(ips) {
+	case 0:
+		return "", nil
+	case 1:
+		return ips[0], nil
+	default:
+		return "", fmt.Errorf("host name \"%s\" is shared by computers of IPs %s, fence one of them by IP instead", host, strings.Join(ips, ", "))
+	}
+}
+
+/*
+Forcibly take away all keys from a computer that has been fenced by a cluster, so that the surviving computers may
+retrieve the keys right away. The computer is identified by its IP, or by the host name it reported as long as the name
+leads to a single IP. The computer loses both its leases and its liveness, including the keys retrieved before leases
+were introduced. Immediately persist the leases and liveness of the computer. Return the sorted UUIDs of the disks that
+the computer no longer holds.
+*/
+func (db *DB) FenceHost(host string) (fenced []string, err error) {
+	fenced = make([]string, 0, 8)
+	if host == "" {
+		return
+	}
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	ip, err := db.getFencedIP(host, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("FenceHost: %v", err)
+	} else if ip == "" {
+		return
+	}
+	// UUIDs of the disks that the computer held
+	held := make(map[string]bool)
+	for id, lease := range db.Leases {
+		if lease.IP == ip {
+			delete(db.Leases, id)
+			held[lease.UUID] = true
+		}
+	}
+	for uuid, rec := range db.RecordsByUUID {
+		if _, alive := rec.AliveMessages[ip]; alive {
+			held[uuid] = true
+		}
+	}
+	for uuid := range held {
+		if rec, found := db.RecordsByUUID[uuid]; found {
+			delete(rec.AliveMessages, ip)
+			rec.RejectHost(ip, time.Now())
+			db.upsert(rec, true) // IO error is logged
+		}
+		db.forgetHostDisk(ip, uuid)
+		fenced = append(fenced, uuid)
+	}
+	sort.Strings(fenced)
+	if err := db.saveHosts(); err != nil {
+		log.Printf("DB.FenceHost: failed to save liveness of %s - %v", host, err)
+	}
+	if err := db.saveLeases(); err != nil {
+		log.Printf("DB.FenceHost: failed to save leases of %s - %v", host, err)
+	}
+	return
+}
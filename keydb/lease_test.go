@@ -0,0 +1,354 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDB_Leases(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{UUID: "a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	// Each retrieval comes with a lease that expires after the computer misses all alive reports
+	found, leases, rejected, _ := db.SelectWithReasons(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now}, true, "a")
+	lease := leases["a"]
+	if len(found) != 1 || len(rejected) != 0 || lease.ID == "" || lease.IP != "ip1" || lease.Expiry.Unix() != now+4 {
+		t.Fatal(found, leases, rejected)
+	}
+	if !db.IsHeldByIP("a", "ip1") || db.IsHeldByIP("a", "ip2") || db.IsHeldByIP("b", "ip1") {
+		t.Fatal("wrong holder")
+	}
+	// MaxActive counts valid leases
+	if _, _, rejected, _ := db.SelectWithReasons(AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: now}, true, "a"); rejected["a"] != REJECT_MAX_ACTIVE {
+		t.Fatal(rejected)
+	}
+	// The same IP and host name do not prove that it is the same computer
+	if _, _, rejected, _ := db.SelectWithReasons(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now}, true, "a"); rejected["a"] != REJECT_MAX_ACTIVE {
+		t.Fatal(rejected)
+	}
+	// The computer retrieving the key again with its lease ID gets a new lease in place of its old one
+	claim := LeaseClaim{LeaseIDs: map[string]string{"a": lease.ID}, Cert: "cert1"}
+	found, leases, rejected, _ = db.SelectWithClaim(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now}, claim, true, "a")
+	if len(found) != 1 || len(rejected) != 0 || leases["a"].ID == lease.ID {
+		t.Fatal(found, leases, rejected)
+	}
+	if list := db.ListLeases("a"); len(list) != 1 || list[0].ID != leases["a"].ID {
+		t.Fatal(list)
+	}
+	if _, rejectedUUIDs := db.RenewLeases(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now}, true, LeaseClaim{LeaseIDs: map[string]string{"a": lease.ID}}, "a"); !reflect.DeepEqual(rejectedUUIDs, []string{"a"}) {
+		t.Fatal(rejectedUUIDs)
+	}
+	lease = leases["a"]
+	// A different computer behind the same IP does not replace the lease
+	if _, _, rejected, _ := db.SelectWithReasons(AliveMessage{Hostname: "host2", IP: "ip1", Timestamp: now}, true, "a"); rejected["a"] != REJECT_MAX_ACTIVE {
+		t.Fatal(rejected)
+	}
+	if _, rejectedUUIDs := db.RenewLeases(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now}, true, LeaseClaim{LeaseIDs: map[string]string{"a": lease.ID}}, "a"); len(rejectedUUIDs) != 0 {
+		t.Fatal(rejectedUUIDs)
+	}
+	// The lease ID alone does not move the lease to another IP
+	if _, rejectedUUIDs := db.RenewLeases(AliveMessage{Hostname: "host1", IP: "ip4", Timestamp: now}, true, LeaseClaim{LeaseIDs: map[string]string{"a": lease.ID}}, "a"); !reflect.DeepEqual(rejectedUUIDs, []string{"a"}) {
+		t.Fatal(rejectedUUIDs)
+	}
+	if !db.IsHeldByIP("a", "ip1") || db.IsHeldByIP("a", "ip4") {
+		t.Fatal("wrong holder")
+	}
+	// The lease is renewed by its ID even though the computer has changed its IP, the computer proves to be the holder by its certificate
+	beat := AliveMessage{Hostname: "host1", IP: "ip3", Timestamp: now + 1}
+	renewed, rejectedUUIDs := db.RenewLeases(beat, true, LeaseClaim{LeaseIDs: map[string]string{"a": lease.ID}, Cert: "cert1"}, "a")
+	if len(rejectedUUIDs) != 0 || renewed["a"].ID != lease.ID || renewed["a"].IP != "ip3" || renewed["a"].Expiry.Unix() != now+5 {
+		t.Fatal(renewed, rejectedUUIDs)
+	}
+	rec, _ := db.GetByUUID("a")
+	if _, found := rec.AliveMessages["ip1"]; found {
+		t.Fatal(rec.AliveMessages)
+	}
+	if alive, final := rec.IsHostAlive("ip3"); !alive || final != beat {
+		t.Fatal(alive, final)
+	}
+	if hosts := db.ListHosts(); len(hosts) != 3 || len(hosts[0].UUIDs) != 0 || !reflect.DeepEqual(hosts[1].UUIDs, []string{"a"}) || len(hosts[2].UUIDs) != 0 {
+		t.Fatal(hosts)
+	}
+	// Computer of an earlier version renews the lease by its IP
+	if renewed, rejectedUUIDs := db.RenewLeases(beat, true, LeaseClaim{}, "a"); len(rejectedUUIDs) != 0 || renewed["a"].ID != lease.ID {
+		t.Fatal(renewed, rejectedUUIDs)
+	}
+	// Unknown lease ID and computer without a lease are rejected
+	if _, rejectedUUIDs := db.RenewLeases(beat, true, LeaseClaim{LeaseIDs: map[string]string{"a": "does-not-exist"}}, "a"); !reflect.DeepEqual(rejectedUUIDs, []string{"a"}) {
+		t.Fatal(rejectedUUIDs)
+	}
+	if _, rejectedUUIDs := db.RenewLeases(AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: now + 1}, true, LeaseClaim{}, "a"); !reflect.DeepEqual(rejectedUUIDs, []string{"a"}) {
+		t.Fatal(rejectedUUIDs)
+	}
+	// Leases survive reloading
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if list := db.ListLeases(""); len(list) != 1 || list[0].ID != lease.ID || list[0].IP != "ip3" {
+		t.Fatal(list)
+	}
+	if list := db.ListLeases("b"); len(list) != 0 {
+		t.Fatal(list)
+	}
+	// Revoked lease is no longer renewed by either its ID or IP, and it no longer counts towards MaxActive
+	if _, err := db.RevokeLease("does-not-exist"); err == nil {
+		t.Fatal("did not error")
+	}
+	if revoked, err := db.RevokeLease(lease.ID); err != nil || revoked.ID != lease.ID {
+		t.Fatal(revoked, err)
+	}
+	if _, rejectedUUIDs := db.RenewLeases(beat, true, LeaseClaim{LeaseIDs: map[string]string{"a": lease.ID}}, "a"); !reflect.DeepEqual(rejectedUUIDs, []string{"a"}) {
+		t.Fatal(rejectedUUIDs)
+	}
+	if _, rejectedUUIDs := db.RenewLeases(beat, true, LeaseClaim{}, "a"); !reflect.DeepEqual(rejectedUUIDs, []string{"a"}) {
+		t.Fatal(rejectedUUIDs)
+	}
+	certClaim := LeaseClaim{Cert: "fingerprint"}
+	found, leases, _, _ = db.SelectWithClaim(AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: now + 1}, certClaim, true, "a")
+	if len(found) != 1 || leases["a"].ID == lease.ID || leases["a"].Cert != "fingerprint" {
+		t.Fatal(found, leases)
+	}
+	// The client certificate that retrieved the key also replaces the lease
+	lease = leases["a"]
+	if _, _, rejected, _ := db.SelectWithClaim(AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: now + 1}, LeaseClaim{Cert: "other"}, true, "a"); rejected["a"] != REJECT_MAX_ACTIVE {
+		t.Fatal(rejected)
+	}
+	found, leases, _, _ = db.SelectWithClaim(AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: now + 1}, certClaim, true, "a")
+	if len(found) != 1 || leases["a"].ID == lease.ID {
+		t.Fatal(found, leases)
+	}
+	if list := db.ListLeases("a"); len(list) != 1 || list[0].ID != leases["a"].ID {
+		t.Fatal(list)
+	}
+	// Erasing the record forgets its leases
+	if err := db.Erase("a"); err != nil {
+		t.Fatal(err)
+	}
+	if list := db.ListLeases(""); len(list) != 0 {
+		t.Fatal(list)
+	}
+}
+
+func TestDB_LeasesSaveInterval(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{UUID: "a", AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	tokens := map[string]string{"a": "token1"}
+	_, leases, _, _ := db.SelectWithClaim(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now}, LeaseClaim{Tokens: tokens}, true, "a")
+	leasesFile := path.Join(TestDBDir, LEASES_FILE_NAME)
+	granted, err := ioutil.ReadFile(leasesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renewals that only push out the expiry stay in memory
+	leaseIDs := map[string]string{"a": leases["a"].ID}
+	if _, rejected := db.RenewLeases(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now + 1}, true, LeaseClaim{LeaseIDs: leaseIDs}, "a"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	if content, err := ioutil.ReadFile(leasesFile); err != nil || !bytes.Equal(content, granted) {
+		t.Fatal(string(content), err)
+	}
+	// Until the interval has passed
+	db.leasesSavedAt = time.Now().Add(-(HOSTS_SAVE_INTERVAL_SEC + 1) * time.Second)
+	if _, rejected := db.RenewLeases(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now + 2}, true, LeaseClaim{LeaseIDs: leaseIDs}, "a"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	renewed, err := ioutil.ReadFile(leasesFile)
+	if err != nil || bytes.Equal(renewed, granted) {
+		t.Fatal(string(renewed), err)
+	}
+	// Moving to another IP is persisted right away, the computer proves to be the holder by its enrolment token
+	if _, rejected := db.RenewLeases(AliveMessage{Hostname: "host1", IP: "ip2", Timestamp: now + 3}, true, LeaseClaim{LeaseIDs: leaseIDs, Tokens: map[string]string{"a": "token2"}}, "a"); len(rejected) != 1 {
+		t.Fatal(rejected)
+	}
+	if _, rejected := db.RenewLeases(AliveMessage{Hostname: "host1", IP: "ip2", Timestamp: now + 3}, true, LeaseClaim{LeaseIDs: leaseIDs, Tokens: tokens}, "a"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	if content, err := ioutil.ReadFile(leasesFile); err != nil || !strings.Contains(string(content), `"ip2"`) {
+		t.Fatal(string(content), err)
+	}
+	// Renewals that did not make it into the file are accounted for on load
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if list := db.ListLeases("a"); len(list) != 1 || list[0].Expiry.Unix() != now+3+4+HOSTS_SAVE_INTERVAL_SEC {
+		t.Fatal(list)
+	}
+}
+
+func TestDB_LeaseOfEarlierRetrieval(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The computer retrieved the key before leases were introduced
+	now := time.Now().Unix()
+	retrieval := AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now}
+	if _, err := db.Upsert(Record{UUID: "a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4,
+		AliveMessages: map[string][]AliveMessage{"ip1": {retrieval}}}); err != nil {
+		t.Fatal(err)
+	}
+	// It still counts towards MaxActive
+	if _, _, rejected, _ := db.SelectWithReasons(AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: now}, true, "a"); rejected["a"] != REJECT_MAX_ACTIVE {
+		t.Fatal(rejected)
+	}
+	// Its next heartbeat gives it a lease
+	renewed, rejected := db.RenewLeases(AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now + 1}, true, LeaseClaim{}, "a")
+	if len(rejected) != 0 || renewed["a"].ID == "" || renewed["a"].IP != "ip1" {
+		t.Fatal(renewed, rejected)
+	}
+	if list := db.ListLeases("a"); len(list) != 1 || list[0].ID != renewed["a"].ID {
+		t.Fatal(list)
+	}
+	if _, _, rejected, _ := db.SelectWithReasons(AliveMessage{Hostname: "host2", IP: "ip2", Timestamp: now + 1}, true, "a"); rejected["a"] != REJECT_MAX_ACTIVE {
+		t.Fatal(rejected)
+	}
+}
+
+func TestDB_ReleaseLeases(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	retrieval := AliveMessage{Hostname: "host1", IP: "ip1", Timestamp: now}
+	for _, uuid := range []string{"a", "b"} {
+		if _, err := db.Upsert(Record{UUID: uuid, MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Disk c was retrieved before leases were introduced
+	if _, err := db.Upsert(Record{UUID: "c", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4,
+		AliveMessages: map[string][]AliveMessage{"ip1": {retrieval}}}); err != nil {
+		t.Fatal(err)
+	}
+	_, leases, _, _ := db.SelectWithClaim(retrieval, LeaseClaim{Cert: "cert1"}, true, "a", "b")
+	if renewed, rejected := db.RenewLeases(retrieval, true, LeaseClaim{}, "a", "b", "c"); len(rejected) != 0 || !renewed["c"].ByIP || renewed["a"].ByIP {
+		t.Fatal(renewed, rejected)
+	}
+	// Disk a is released by its lease ID after the computer has changed its IP, as long as it presents its certificate
+	claim := LeaseClaim{LeaseIDs: map[string]string{"a": leases["a"].ID}}
+	if released := db.ReleaseLeases(AliveMessage{Hostname: "host1", IP: "ip2", Timestamp: now}, claim, "a"); len(released) != 0 {
+		t.Fatal(released)
+	}
+	claim.Cert = "cert1"
+	if released := db.ReleaseLeases(AliveMessage{Hostname: "host1", IP: "ip2", Timestamp: now}, claim, "a"); !reflect.DeepEqual(released, []string{"a"}) {
+		t.Fatal(released)
+	}
+	// Disk b came with a lease ID, another computer sharing the IP and host name must not release it
+	if released := db.ReleaseLeases(retrieval, LeaseClaim{}, "b", "does-not-exist"); len(released) != 0 {
+		t.Fatal(released)
+	}
+	if released := db.ReleaseLeases(retrieval, LeaseClaim{LeaseIDs: map[string]string{"b": leases["b"].ID}}, "b"); !reflect.DeepEqual(released, []string{"b"}) {
+		t.Fatal(released)
+	}
+	// Disk c is released by the computer's IP and host name
+	if released := db.ReleaseLeases(AliveMessage{Hostname: "host2", IP: "ip1", Timestamp: now}, LeaseClaim{}, "c"); len(released) != 0 {
+		t.Fatal(released)
+	}
+	if released := db.ReleaseLeases(retrieval, LeaseClaim{}, "c"); !reflect.DeepEqual(released, []string{"c"}) {
+		t.Fatal(released)
+	}
+	if released := db.ReleaseLeases(retrieval, LeaseClaim{}, "b", "c"); len(released) != 0 {
+		t.Fatal(released)
+	}
+	if list := db.ListLeases(""); len(list) != 0 {
+		t.Fatal(list)
+	}
+	if hosts := db.ListHosts(); len(hosts) != 1 || len(hosts[0].UUIDs) != 0 {
+		t.Fatal(hosts)
+	}
+	// Another computer may retrieve the keys right away
+	if found, _, rejected, _ := db.SelectWithReasons(AliveMessage{Hostname: "host3", IP: "ip3", Timestamp: now}, true, "a", "b", "c"); len(found) != 3 || len(rejected) != 0 {
+		t.Fatal(found, rejected)
+	}
+}
+
+func TestDB_FenceHost(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	// Disk b was retrieved before leases were introduced
+	if _, err := db.Upsert(Record{UUID: "a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(Record{UUID: "b", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4,
+		AliveMessages: map[string][]AliveMessage{"ip1": {{Hostname: "node1", IP: "ip1", Timestamp: now}}}}); err != nil {
+		t.Fatal(err)
+	}
+	node1 := AliveMessage{Hostname: "node1", IP: "ip1", Timestamp: now}
+	if _, _, rejected, _ := db.SelectWithReasons(node1, true, "a"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	if _, rejected := db.RenewLeases(node1, true, LeaseClaim{}, "a", "b"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	node2 := AliveMessage{Hostname: "node2", IP: "ip2", Timestamp: now}
+	if _, _, rejected, _ := db.SelectWithReasons(node2, true, "a", "b"); len(rejected) != 2 {
+		t.Fatal(rejected)
+	}
+	if fenced, err := db.FenceHost("does-not-exist"); err != nil || len(fenced) != 0 {
+		t.Fatal(fenced, err)
+	}
+	// The computer is identified by its host name, as long as the name is held by one IP alone
+	if fenced, err := db.FenceHost("node1"); err != nil || !reflect.DeepEqual(fenced, []string{"a", "b"}) {
+		t.Fatal(fenced, err)
+	}
+	if list := db.ListLeases(""); len(list) != 0 {
+		t.Fatal(list)
+	}
+	// The fenced computer is told to let go of the keys, and the surviving computer may retrieve them right away
+	if _, rejected := db.RenewLeases(node1, true, LeaseClaim{}, "a", "b"); len(rejected) != 2 {
+		t.Fatal(rejected)
+	}
+	if found, _, rejected, _ := db.SelectWithReasons(node2, true, "a", "b"); len(found) != 2 || len(rejected) != 0 {
+		t.Fatal(found, rejected)
+	}
+	// A host name shared by computers of different IPs is ambiguous
+	if _, _, rejected, _ := db.SelectWithReasons(AliveMessage{Hostname: "node2", IP: "ip3", Timestamp: now}, false, "a"); len(rejected) != 0 {
+		t.Fatal(rejected)
+	}
+	if fenced, err := db.FenceHost("node2"); err == nil || !strings.Contains(err.Error(), "ip2, ip3") || len(fenced) != 0 {
+		t.Fatal(fenced, err)
+	}
+	if list := db.ListLeases(""); len(list) != 3 {
+		t.Fatal(list)
+	}
+	// The computer is identified by its IP
+	if fenced, err := db.FenceHost("ip2"); err != nil || !reflect.DeepEqual(fenced, []string{"a", "b"}) {
+		t.Fatal(fenced, err)
+	}
+	if list := db.ListLeases(""); len(list) != 1 || list[0].IP != "ip3" {
+		t.Fatal(list)
+	}
+}
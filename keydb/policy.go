@@ -0,0 +1,358 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Machine-readable reasons of rejecting a key retrieval.
+const (
+	REJECT_MAX_ACTIVE        = "max-active"          // REJECT_MAX_ACTIVE means that MaxActive computers already hold the disk.
+	REJECT_NOT_YET_VALID     = "not-yet-valid"       // REJECT_NOT_YET_VALID means that the key may not be used before Policy.NotBefore.
+	REJECT_EXPIRED           = "expired"             // REJECT_EXPIRED means that the key may no longer be used after Policy.NotAfter.
+	REJECT_OUTSIDE_WINDOW    = "outside-time-window" // REJECT_OUTSIDE_WINDOW means that the key may not be used at this time of the week.
+	REJECT_NETWORK           = "network-not-allowed" // REJECT_NETWORK means that the computer is not in any of the allowed networks.
+	REJECT_APPROVAL_REQUIRED = "approval-required"   // REJECT_APPROVAL_REQUIRED means that an administrator has to approve the computer first.
+	REJECT_HOST_REJECTED     = "host-rejected"       // REJECT_HOST_REJECTED means that the computer was rejected earlier and may not re-acquire the key.
+)
+
+// What a computer does to the unlocked disk on its own after key server has rejected it, i.e. no longer considers it alive.
+const (
+	SELF_LOCK_LOG        = "log"        // SELF_LOCK_LOG only logs the rejection, the disk stays unlocked.
+	SELF_LOCK_NOTIFY     = "notify"     // SELF_LOCK_NOTIFY logs the rejection and notifies the users logged in, the disk stays unlocked.
+	SELF_LOCK_REMOUNT_RO = "remount-ro" // SELF_LOCK_REMOUNT_RO remounts the file system read-only.
+	SELF_LOCK_LOCK       = "lock"       // SELF_LOCK_LOCK umounts and closes the disk, unless the computer re-acquires the key within the grace period.
+)
+
+// RejectReasonText describes the rejection reasons to a human.
+var RejectReasonText = map[string]string{
+	REJECT_MAX_ACTIVE:        "MaxActive is exceeded",
+	REJECT_NOT_YET_VALID:     "the key may not be used yet",
+	REJECT_EXPIRED:           "the key has expired",
+	REJECT_OUTSIDE_WINDOW:    "the key may not be used at this time",
+	REJECT_NETWORK:           "this computer is not in a network allowed to use the key",
+	REJECT_APPROVAL_REQUIRED: "an administrator has to approve this computer first",
+	REJECT_HOST_REJECTED:     "key server rejected this computer earlier, an administrator has to approve it again",
+}
+
+/*
+TimeWindow is a period of the day on some days of the week, in the local time of key server. If End is earlier than
+Begin, the window covers the time from Begin until midnight and from midnight until End on each of the days.
+*/
+type TimeWindow struct {
+	Weekdays []time.Weekday // Weekdays are the days of the window, empty for every day.
+	Begin    int            // Begin is the minute of the day at which the window opens.
+	End      int            // End is the minute of the day at which the window closes, 1440 for midnight.
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} // weekdayNames are indexed by time.Weekday
+
+// Parse "HH:MM" into the minute of the day, "24:00" is midnight at the end of the day.
+func parseMinuteOfDay(in string) (int, error) {
+	hm := strings.Split(in, ":")
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("parseMinuteOfDay: \"%s\" should look like HH:MM", in)
+	}
+	hour, errHour := strconv.Atoi(hm[0])
+	minute, errMinute := strconv.Atoi(hm[1])
+	if errHour != nil || errMinute != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("parseMinuteOfDay: \"%s\" is not a time of the day", in)
+	}
+	return hour*60 + minute, nil
+}
+
+// Parse a day of the week or a range of days, such as "mon" or "mon-fri".
+func parseWeekdays(in string) ([]time.Weekday, error) {
+	indexOf := func(name string) int {
+		for i, weekday := range weekdayNames {
+			if strings.HasPrefix(strings.ToLower(name), weekday) {
+				return i
+			}
+		}
+		return -1
+	}
+	bounds := strings.SplitN(in, "-", 2)
+	first, last := indexOf(bounds[0]), indexOf(bounds[len(bounds)-1])
+	if first < 0 || last < 0 {
+		return nil, fmt.Errorf("parseWeekdays: \"%s\" should look like mon or mon-fri", in)
+	}
+	ret := make([]time.Weekday, 0, 7)
+	for day := first; ; day = (day + 1) % 7 {
+		ret = append(ret, time.Weekday(day))
+		if day == last {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// Parse a time window such as "mon-fri 08:00-18:00", "sat,sun 10:00-14:00", or "22:00-06:00" for every day.
+func ParseTimeWindow(in string) (window TimeWindow, err error) {
+	fields := strings.Fields(in)
+	if len(fields) == 0 || len(fields) > 2 {
+		return window, fmt.Errorf("ParseTimeWindow: \"%s\" should look like mon-fri 08:00-18:00", in)
+	}
+	if len(fields) == 2 {
+		for _, days := range strings.Split(fields[0], ",") {
+			weekdays, err := parseWeekdays(days)
+			if err != nil {
+				return window, err
+			}
+			window.Weekdays = append(window.Weekdays, weekdays...)
+		}
+	}
+	period := strings.Split(fields[len(fields)-1], "-")
+	if len(period) != 2 {
+		return window, fmt.Errorf("ParseTimeWindow: \"%s\" should look like 08:00-18:00", fields[len(fields)-1])
+	}
+	if window.Begin, err = parseMinuteOfDay(period[0]); err != nil {
+		return
+	}
+	if window.End, err = parseMinuteOfDay(period[1]); err != nil {
+		return
+	}
+	if window.Begin == window.End {
+		return window, fmt.Errorf("ParseTimeWindow: \"%s\" does not last any time", in)
+	}
+	return window, nil
+}
+
+// Format the window in the form understood by ParseTimeWindow.
+func (window TimeWindow) String() string {
+	period := fmt.Sprintf("%02d:%02d-%02d:%02d", window.Begin/60, window.Begin%60, window.End/60, window.End%60)
+	if len(window.Weekdays) == 0 {
+		return period
+	}
+	days := make([]string, 0, len(window.Weekdays))
+	for _, day := range window.Weekdays {
+		days = append(days, weekdayNames[day])
+	}
+	return strings.Join(days, ",") + " " + period
+}
+
+// Return true if the moment falls into the window.
+func (window TimeWindow) Contains(moment time.Time) bool {
+	if len(window.Weekdays) > 0 {
+		dayMatched := false
+		for _, day := range window.Weekdays {
+			if day == moment.Weekday() {
+				dayMatched = true
+				break
+			}
+		}
+		if !dayMatched {
+			return false
+		}
+	}
+	minute := moment.Hour()*60 + moment.Minute()
+	if window.Begin < window.End {
+		return minute >= window.Begin && minute < window.End
+	}
+	return minute >= window.Begin || minute < window.End
+}
+
+// Policy restricts the retrieval of a key without password. The zero value does not restrict anything.
+type Policy struct {
+	NotBefore       time.Time    // NotBefore is the moment from which on the key may be used, zero for any moment.
+	NotAfter        time.Time    // NotAfter is the moment after which the key may no longer be used, zero for never.
+	Windows         []TimeWindow // Windows are the times of the week the key may be used, empty for any time.
+	Networks        []string     // Networks are the CIDR blocks the computers must be in, empty for any network.
+	RequireApproval bool         // RequireApproval asks an administrator to approve each computer before it retrieves the key.
+
+	SelfLock         string // SelfLock is one of SELF_LOCK_*, the computer carries it out after key server rejects it, empty for SELF_LOCK_LOG.
+	SelfLockGraceSec int    // SelfLockGraceSec is the time the computer tries to re-acquire the key before SELF_LOCK_LOCK closes the disk.
+	DenyReacquire    bool   // DenyReacquire refuses a rejected computer to retrieve the key again until an administrator approves it.
+	MaxOfflineSec    int    // MaxOfflineSec is the offline tolerance, the computer closes the disk once key server is unreachable for longer, zero for no limit.
+}
+
+// Return an error if a network of the policy is malformed. The networks are normalised along the way.
+func (pol *Policy) Validate() error {
+	for i, network := range pol.Networks {
+		_, block, err := net.ParseCIDR(network)
+		if err != nil {
+			if ip := net.ParseIP(network); ip != nil {
+				pol.Networks[i] = ip.String()
+				continue
+			}
+			return fmt.Errorf("Policy.Validate: \"%s\" is not a network", network)
+		}
+		pol.Networks[i] = block.String()
+	}
+	if !pol.NotBefore.IsZero() && !pol.NotAfter.IsZero() && !pol.NotAfter.After(pol.NotBefore) {
+		return fmt.Errorf("Policy.Validate: the key expires before it becomes valid")
+	}
+	switch pol.SelfLock {
+	case "", SELF_LOCK_LOG, SELF_LOCK_NOTIFY, SELF_LOCK_REMOUNT_RO, SELF_LOCK_LOCK:
+	default:
+		return fmt.Errorf("Policy.Validate: self-lock action must be one of %s, %s, %s, %s",
+			SELF_LOCK_LOG, SELF_LOCK_NOTIFY, SELF_LOCK_REMOUNT_RO, SELF_LOCK_LOCK)
+	}
+	if pol.SelfLockGraceSec < 0 {
+		return fmt.Errorf("Policy.Validate: self-lock grace period must not be negative")
+	}
+	if pol.MaxOfflineSec < 0 {
+		return fmt.Errorf("Policy.Validate: offline tolerance must not be negative")
+	}
+	return nil
+}
+
+// Return the action the computer carries out after key server rejects it, and the grace period of SELF_LOCK_LOCK.
+func (pol Policy) GetSelfLock() (action string, graceSec int) {
+	if pol.SelfLock == "" {
+		return SELF_LOCK_LOG, 0
+	}
+	return pol.SelfLock, pol.SelfLockGraceSec
+}
+
+// Return true if the IP is in any of the networks, or if the policy does not restrict networks.
+func (pol Policy) IsNetworkAllowed(ip string) bool {
+	if len(pol.Networks) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	for _, network := range pol.Networks {
+		if _, block, err := net.ParseCIDR(network); err == nil && addr != nil && block.Contains(addr) {
+			return true
+		} else if network == ip {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Return the reason (REJECT_*) why the computer of the IP may not retrieve the key at the moment, or an empty string if
+the policy allows it. Approval is not considered here, as it is granted per computer in the record.
+*/
+func (pol Policy) Check(ip string, moment time.Time) string {
+	if !pol.NotBefore.IsZero() && moment.Before(pol.NotBefore) {
+		return REJECT_NOT_YET_VALID
+	}
+	if !pol.NotAfter.IsZero() && moment.After(pol.NotAfter) {
+		return REJECT_EXPIRED
+	}
+	if !pol.IsNetworkAllowed(ip) {
+		return REJECT_NETWORK
+	}
+	if len(pol.Windows) > 0 {
+		for _, window := range pol.Windows {
+			if window.Contains(moment) {
+				return ""
+			}
+		}
+		return REJECT_OUTSIDE_WINDOW
+	}
+	return ""
+}
+
+// Return a one-line description of the policy.
+func (pol Policy) String() string {
+	terms := make([]string, 0, 8)
+	if !pol.NotBefore.IsZero() {
+		terms = append(terms, "not before "+pol.NotBefore.Format(time.RFC3339))
+	}
+	if !pol.NotAfter.IsZero() {
+		terms = append(terms, "not after "+pol.NotAfter.Format(time.RFC3339))
+	}
+	for _, window := range pol.Windows {
+		terms = append(terms, "during "+window.String())
+	}
+	if len(pol.Networks) > 0 {
+		terms = append(terms, "from "+strings.Join(pol.Networks, ","))
+	}
+	if pol.RequireApproval {
+		terms = append(terms, "with approval")
+	}
+	if action, graceSec := pol.GetSelfLock(); action == SELF_LOCK_LOCK {
+		terms = append(terms, fmt.Sprintf("self-lock %s after %ds", action, graceSec))
+	} else if action != SELF_LOCK_LOG {
+		terms = append(terms, "self-lock "+action)
+	}
+	if pol.DenyReacquire {
+		terms = append(terms, "no re-acquiring once rejected")
+	}
+	if pol.MaxOfflineSec > 0 {
+		terms = append(terms, fmt.Sprintf("offline for at most %ds", pol.MaxOfflineSec))
+	}
+	if len(terms) == 0 {
+		return "unrestricted"
+	}
+	return strings.Join(terms, ", ")
+}
+
+/*
+Return the reason (REJECT_*) why the computer may not retrieve the key of the record without password at the moment, or
+an empty string if it may.
+*/
+func (rec *Record) CheckPolicy(ip string, moment time.Time) string {
+	if reason := rec.Policy.Check(ip, moment); reason != "" {
+		return reason
+	}
+	if rec.Policy.RequireApproval && !moment.Before(rec.Approvals[ip]) {
+		return REJECT_APPROVAL_REQUIRED
+	}
+	if _, rejected := rec.Rejected[ip]; rejected && rec.Policy.DenyReacquire && !moment.Before(rec.Approvals[ip]) {
+		return REJECT_HOST_REJECTED
+	}
+	return ""
+}
+
+/*
+Remember that key server has rejected the computer of the IP, if the policy denies rejected computers to re-acquire
+the key. Return true only if the record has changed.
+*/
+func (rec *Record) RejectHost(ip string, moment time.Time) bool {
+	if !rec.Policy.DenyReacquire {
+		return false
+	} else if _, rejected := rec.Rejected[ip]; rejected {
+		return false
+	}
+	if rec.Rejected == nil {
+		rec.Rejected = make(map[string]time.Time)
+	}
+	rec.Rejected[ip] = moment
+	return true
+}
+
+// SetPolicy validates, replaces, and immediately persists the usage policy of a record.
+func (db *DB) SetPolicy(uuid string, pol Policy) error {
+	if err := pol.Validate(); err != nil {
+		return err
+	}
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return fmt.Errorf("SetPolicy: record \"%s\" does not exist", uuid)
+	}
+	rec.Policy = pol
+	_, err := db.upsert(rec, true)
+	return err
+}
+
+/*
+Approve the computer of the IP to retrieve the key of the record once without password, before the approval expires.
+Expired approvals are cleared along the way.
+*/
+func (db *DB) ApproveRetrieval(uuid, ip string, validity time.Duration) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.RecordsByUUID[uuid]
+	if !found {
+		return fmt.Errorf("ApproveRetrieval: record \"%s\" does not exist", uuid)
+	}
+	approvals := map[string]time.Time{ip: time.Now().Add(validity)}
+	for approvedIP, until := range rec.Approvals {
+		if approvedIP != ip && time.Now().Before(until) {
+			approvals[approvedIP] = until
+		}
+	}
+	rec.Approvals = approvals
+	_, err := db.upsert(rec, true)
+	return err
+}
@@ -0,0 +1,226 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keydb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	for _, bad := range []string{"", "mon-fri", "xyz 08:00-18:00", "08:00", "08:00-08:00", "25:00-26:00", "08:60-09:00", "mon 1 2"} {
+		if _, err := ParseTimeWindow(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	window, err := ParseTimeWindow("fri-mon,wed 22:00-06:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TimeWindow{Weekdays: []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday, time.Wednesday}, Begin: 22 * 60, End: 6*60 + 30}
+	if !reflect.DeepEqual(window, want) || window.String() != "fri,sat,sun,mon,wed 22:00-06:30" {
+		t.Fatal(window, window.String())
+	}
+	// 2017-06-02 is a Friday
+	for moment, contains := range map[string]bool{
+		"2017-06-02 23:00": true,
+		"2017-06-02 06:00": true,
+		"2017-06-02 12:00": false,
+		"2017-06-06 23:00": false, // Tuesday
+	} {
+		at, _ := time.ParseInLocation("2006-01-02 15:04", moment, time.Local)
+		if window.Contains(at) != contains {
+			t.Fatal(moment)
+		}
+	}
+	if window, err := ParseTimeWindow("00:00-24:00"); err != nil || window.String() != "00:00-24:00" || !window.Contains(time.Now()) {
+		t.Fatal(window, err)
+	}
+}
+
+func TestPolicy_Check(t *testing.T) {
+	pol := Policy{Networks: []string{"10.0.0.1/8", "2001:db8::1"}}
+	if err := pol.Validate(); err != nil || !reflect.DeepEqual(pol.Networks, []string{"10.0.0.0/8", "2001:db8::1"}) {
+		t.Fatal(pol.Networks, err)
+	}
+	if err := (&Policy{Networks: []string{"10.0.0.0/33"}}).Validate(); err == nil {
+		t.Fatal("did not error")
+	}
+	now := time.Now()
+	if err := (&Policy{NotBefore: now, NotAfter: now}).Validate(); err == nil {
+		t.Fatal("did not error")
+	}
+	window, _ := ParseTimeWindow("00:00-00:01")
+	pol.NotBefore = now.Add(-time.Hour)
+	pol.NotAfter = now.Add(time.Hour)
+	for _, check := range []struct {
+		ip     string
+		moment time.Time
+		reason string
+	}{
+		{"10.1.2.3", now, ""},
+		{"2001:db8::1", now, ""},
+		{"192.168.0.1", now, REJECT_NETWORK},
+		{"10.1.2.3", now.Add(-2 * time.Hour), REJECT_NOT_YET_VALID},
+		{"10.1.2.3", now.Add(2 * time.Hour), REJECT_EXPIRED},
+	} {
+		if reason := pol.Check(check.ip, check.moment); reason != check.reason {
+			t.Fatal(check, reason)
+		}
+	}
+	pol.Windows = []TimeWindow{window}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 30, 0, time.Local)
+	if reason := (Policy{Windows: pol.Windows}).Check("1.1.1.1", midnight.Add(time.Minute)); reason != REJECT_OUTSIDE_WINDOW {
+		t.Fatal(reason)
+	}
+	if reason := (Policy{Windows: pol.Windows}).Check("1.1.1.1", midnight); reason != "" {
+		t.Fatal(reason)
+	}
+	if (Policy{}).String() != "unrestricted" || (Policy{RequireApproval: true, Networks: []string{"10.0.0.0/8"}}).String() != "from 10.0.0.0/8, with approval" {
+		t.Fatal("wrong description")
+	}
+}
+
+func TestDB_SelectWithReasons(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"open", "approval", "network"} {
+		if _, err := db.Upsert(Record{UUID: uuid, Key: []byte{1}, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetPolicy("approval", Policy{RequireApproval: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetPolicy("network", Policy{Networks: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetPolicy("does-not-exist", Policy{}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := db.SetPolicy("open", Policy{Networks: []string{"bad"}}); err == nil {
+		t.Fatal("did not error")
+	}
+	msg := AliveMessage{IP: "192.168.0.1", Hostname: "a", Timestamp: time.Now().Unix()}
+	found, _, rejected, missing := db.SelectWithReasons(msg, true, "open", "approval", "network", "does-not-exist")
+	if len(found) != 1 || !reflect.DeepEqual(rejected, map[string]string{"approval": REJECT_APPROVAL_REQUIRED, "network": REJECT_NETWORK}) || !reflect.DeepEqual(missing, []string{"does-not-exist"}) {
+		t.Fatal(found, rejected, missing)
+	}
+	// Policy does not apply to retrieval with password
+	if found, _, _ := db.Select(msg, false, "approval", "network"); len(found) != 2 {
+		t.Fatal(found)
+	}
+	// Approval survives reloading, and is used up by one retrieval
+	if err := db.ApproveRetrieval("approval", "192.168.0.1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if found, _, rejected, _ := db.SelectWithReasons(msg, true, "approval"); len(found) != 1 || len(rejected) != 0 {
+		t.Fatal(found, rejected)
+	}
+	if _, _, rejected, _ := db.SelectWithReasons(msg, true, "approval"); rejected["approval"] != REJECT_APPROVAL_REQUIRED {
+		t.Fatal(rejected)
+	}
+	// Expired approval does not count
+	if err := db.ApproveRetrieval("approval", "192.168.0.1", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, rejected, _ := db.SelectWithReasons(msg, true, "approval"); rejected["approval"] != REJECT_APPROVAL_REQUIRED {
+		t.Fatal(rejected)
+	}
+	if err := db.ApproveRetrieval("does-not-exist", "192.168.0.1", time.Minute); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestPolicy_SelfLock(t *testing.T) {
+	if action, graceSec := (Policy{}).GetSelfLock(); action != SELF_LOCK_LOG || graceSec != 0 {
+		t.Fatal(action, graceSec)
+	}
+	pol := Policy{SelfLock: SELF_LOCK_LOCK, SelfLockGraceSec: 30, DenyReacquire: true}
+	if err := pol.Validate(); err != nil || pol.String() != "self-lock lock after 30s, no re-acquiring once rejected" {
+		t.Fatal(err, pol.String())
+	}
+	if err := (&Policy{SelfLock: "explode"}).Validate(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := (&Policy{SelfLock: SELF_LOCK_LOCK, SelfLockGraceSec: -1}).Validate(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestPolicy_MaxOffline(t *testing.T) {
+	pol := Policy{MaxOfflineSec: 600}
+	if err := pol.Validate(); err != nil || pol.String() != "offline for at most 600s" {
+		t.Fatal(err, pol.String())
+	}
+	if err := (&Policy{MaxOfflineSec: -1}).Validate(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestDB_DenyReacquire(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"deny", "allow"} {
+		if _, err := db.Upsert(Record{UUID: uuid, Key: []byte{1}, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetPolicy("deny", Policy{DenyReacquire: true}); err != nil {
+		t.Fatal(err)
+	}
+	msg := AliveMessage{IP: "192.168.0.1", Hostname: "a", Timestamp: time.Now().Unix()}
+	_, leases, _, _ := db.SelectWithReasons(msg, true, "deny", "allow")
+	for _, lease := range leases {
+		if _, err := db.RevokeLease(lease.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the record that denies re-acquiring remembers the rejection
+	if _, rejected := db.RenewLeases(msg, true, LeaseClaim{}, "deny", "allow"); len(rejected) != 2 {
+		t.Fatal(rejected)
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("deny"); len(rec.Rejected) != 1 {
+		t.Fatal(rec.Rejected)
+	}
+	if rec, _ := db.GetByUUID("allow"); len(rec.Rejected) != 0 {
+		t.Fatal(rec.Rejected)
+	}
+	found, _, rejected, _ := db.SelectWithReasons(msg, true, "deny", "allow")
+	if len(found) != 1 || !reflect.DeepEqual(rejected, map[string]string{"deny": REJECT_HOST_REJECTED}) {
+		t.Fatal(found, rejected)
+	}
+	// Approval lets the computer re-acquire the key, after which it is no longer considered rejected
+	if err := db.ApproveRetrieval("deny", msg.IP, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if found, _, rejected, _ := db.SelectWithReasons(msg, true, "deny"); len(found) != 1 || len(rejected) != 0 {
+		t.Fatal(found, rejected)
+	}
+	if rec, _ := db.GetByUUID("deny"); len(rec.Rejected) != 0 {
+		t.Fatal(rec.Rejected)
+	}
+	// Fenced computer is rejected too
+	if fenced, err := db.FenceHost(msg.IP); err != nil || len(fenced) != 2 {
+		t.Fatal(fenced, err)
+	}
+	if _, _, rejected, _ := db.SelectWithReasons(msg, true, "deny"); rejected["deny"] != REJECT_HOST_REJECTED {
+		t.Fatal(rejected)
+	}
+}
@@ -46,9 +46,11 @@ type PendingCommand struct {
 	ValidFrom    time.Time     // ValidFrom is the timestamp at which moment the command was created.
 	Validity     time.Duration // Validity determines the point in time the command expires. Expired commands disappear almost immediately.
 	IP           string        // IP is the client computer's IP the command is issued to.
-	Content      interface{}   // Content is the command content, serialised and transmitted between server and client.
+	Content      interface{}   // Content is the command action for clients of earlier versions, which only understand mount and umount.
 	SeenByClient bool          // SeenByClient is updated to true via RPC once the client has seen this command.
 	ClientResult string        // ClientResult is updated via RPC once client has finished executing this command.
+	Command      Command       // Command is the action and parameters, empty if the command was issued by an earlier version.
+	Result       CommandResult // Result is the structured outcome reported by a client of this version.
 }
 
 // IsValid returns true only if the command has not expired.
@@ -75,6 +77,13 @@ type Record struct {
 	AliveIntervalSec int // AliveIntervalSec is interval in seconds that all key users (computers) should report they're online.
 	AliveCount       int // AliveCount is number of times a key user (computer) can miss regular report and be considered offline.
 
+	AllowedClients []string // AllowedClients restrict the computers that may retrieve the key without password, see ClientIdentity.
+	Tags           []string // Tags group disks together so that fleet-wide commands may select them, e.g. "prod-hana".
+
+	Policy    Policy               // Policy restricts retrieval of the key without password, in addition to MaxActive.
+	Approvals map[string]time.Time // Approvals let computers retrieve the key once despite Policy.RequireApproval, in IP - expiry pairs.
+	Rejected  map[string]time.Time // Rejected are the computers that may not re-acquire the key due to Policy.DenyReacquire, in IP - moment pairs.
+
 	LastRetrieval   AliveMessage                // LastRetrieval is the computer who most recently successfully retrieved the key.
 	AliveMessages   map[string][]AliveMessage   // AliveMessages are the most recent alive reports in IP - message array pairs.
 	PendingCommands map[string][]PendingCommand // PendingCommands are some command to be periodcally polled by clients carrying the IP address (keys).
@@ -145,6 +154,21 @@ func (rec *Record) AddPendingCommand(ip string, cmd PendingCommand) {
 	rec.PendingCommands[ip] = append(rec.PendingCommands[ip], cmd)
 }
 
+// RemovePendingCommand removes the command of the ID that was issued to the input IP address.
+func (rec *Record) RemovePendingCommand(ip, id string) {
+	remainingCommands := make([]PendingCommand, 0, len(rec.PendingCommands[ip]))
+	for _, cmd := range rec.PendingCommands[ip] {
+		if cmd.Command.ID != id {
+			remainingCommands = append(remainingCommands, cmd)
+		}
+	}
+	if len(remainingCommands) > 0 {
+		rec.PendingCommands[ip] = remainingCommands
+	} else {
+		delete(rec.PendingCommands, ip)
+	}
+}
+
 // ClearPendingCommands removes all pending commands, and clears expired pending commands along the way.
 func (rec *Record) ClearPendingCommands() {
 	rec.PendingCommands = make(map[string][]PendingCommand)
@@ -415,4 +415,14 @@ func TestRecord_RemoveExpiredPendingCommands(t *testing.T) {
 	if len(rec.PendingCommands) != 1 || len(rec.PendingCommands["1.1.1.1"]) != 2 {
 		t.Fatalf("%+v", rec.PendingCommands)
 	}
+	// A command may be taken back by its ID
+	rec.AddPendingCommand("2.2.2.2", PendingCommand{ValidFrom: time.Now(), Validity: time.Hour, Command: Command{ID: "a"}})
+	rec.RemovePendingCommand("2.2.2.2", "b")
+	if len(rec.PendingCommands["2.2.2.2"]) != 1 {
+		t.Fatalf("%+v", rec.PendingCommands)
+	}
+	rec.RemovePendingCommand("2.2.2.2", "a")
+	if _, found := rec.PendingCommands["2.2.2.2"]; found || len(rec.PendingCommands) != 1 {
+		t.Fatalf("%+v", rec.PendingCommands)
+	}
 }
@@ -0,0 +1,119 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"strings"
+)
+
+// Role determines what an authenticated RPC caller or API user may do.
+type Role int
+
+const (
+	ROLE_NONE   Role = iota // ROLE_NONE may only use the functions that do not require authentication.
+	ROLE_READER             // ROLE_READER may query key records, alive hosts, pending commands, and events.
+	ROLE_ADMIN              // ROLE_ADMIN may do everything, including saving, retrieving, and erasing keys.
+)
+
+var roleNames = map[Role]string{ROLE_NONE: "none", ROLE_READER: "reader", ROLE_ADMIN: "admin"}
+
+// Return the role name as used in configuration.
+func (role Role) String() string {
+	return roleNames[role]
+}
+
+// Parse a role name, only reader and admin may be granted.
+func ParseRole(name string) (Role, error) {
+	switch strings.ToLower(name) {
+	case ROLE_READER.String():
+		return ROLE_READER, nil
+	case ROLE_ADMIN.String():
+		return ROLE_ADMIN, nil
+	}
+	return ROLE_NONE, fmt.Errorf("ParseRole: role \"%s\" should be either %s or %s", name, ROLE_READER, ROLE_ADMIN)
+}
+
+/*
+Parse an API grant in the form of ROLE:IDENTITY, the identity is in the form of keydb.Record.AllowedClients. API tokens
+are granted via ROLE:token:HASH, and verified client certificates are granted via ROLE:cn:NAME or ROLE:cert:FINGERPRINT.
+*/
+func ParseAPIGrant(grant string) (role Role, identity string, err error) {
+	fields := strings.SplitN(strings.TrimSpace(grant), ":", 2)
+	if len(fields) != 2 {
+		return ROLE_NONE, "", fmt.Errorf("ParseAPIGrant: \"%s\" should look like ROLE:IDENTITY", grant)
+	}
+	if role, err = ParseRole(fields[0]); err != nil {
+		return
+	}
+	if identity, err = keydb.NormaliseAllowedClient(fields[1]); err != nil {
+		return
+	}
+	return
+}
+
+// Credential is presented by an RPC caller or API user to prove its role.
+type Credential struct {
+	Password *HashedPassword      // Password is the server password presented by RPC caller, it grants admin role.
+	APIToken string               // APIToken is presented by API user, the role is granted in configuration.
+	Identity keydb.ClientIdentity // Identity is the IP and certificate of the caller, the role is granted in configuration.
+}
+
+/*
+Return the most powerful role that the credential grants. An error is returned only if the credential is incorrect,
+for example an incorrect password or an unknown token, absence of credential grants ROLE_NONE.
+*/
+func (srv *CryptServer) GetRole(cred Credential) (Role, error) {
+	if cred.Password != nil {
+		// Fail straight away if server setup is missing
+		if err := srv.CheckInitialSetup(); err != nil {
+			return ROLE_NONE, err
+		}
+		if subtle.ConstantTimeCompare(cred.Password[:], srv.Config.PasswordHash[:]) != 1 {
+			return ROLE_NONE, errors.New("ValidatePassword: password is incorrect")
+		}
+		return ROLE_ADMIN, nil
+	}
+	best, _ := srv.matchAPIGrant(cred)
+	if cred.APIToken != "" && best == ROLE_NONE {
+		return ROLE_NONE, errors.New("GetRole: API token is incorrect")
+	}
+	return best, nil
+}
+
+// Return the most powerful role granted to the API token or client certificate, along with the identity of the grant.
+func (srv *CryptServer) matchAPIGrant(cred Credential) (best Role, bestEntry string) {
+	identity := cred.Identity
+	identity.Token = cred.APIToken
+	for _, grant := range srv.Config.APIGrants {
+		role, entry, err := ParseAPIGrant(grant)
+		if err == nil && role > best && identity.MatchesAny([]string{entry}) {
+			best, bestEntry = role, entry
+		}
+	}
+	return
+}
+
+/*
+Return the identity of the administrator using the API, named after the grant of the token or client certificate, such
+as "cn:alice".
+*/
+func (srv *CryptServer) GetAPIAdmin(cred Credential) AdminIdentity {
+	_, entry := srv.matchAPIGrant(cred)
+	return AdminIdentity{Name: entry, IP: cred.Identity.IP, Cert: cred.Identity.CertFingerprint, Grant: entry}
+}
+
+// Return an error if the credential does not grant the required role.
+func (srv *CryptServer) Authorise(cred Credential, required Role) error {
+	role, err := srv.GetRole(cred)
+	if err != nil {
+		return err
+	}
+	if role < required {
+		return fmt.Errorf("Authorise: the function requires %s role", required)
+	}
+	return nil
+}
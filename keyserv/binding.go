@@ -0,0 +1,184 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+)
+
+/*
+Network-bound disk keys are computed via McCallum-Relyea exchange, the same method used by Clevis and Tang:
+
+  - Server holds binding key pair (s, S = sG).
+  - At encryption time, client picks random c, computes disk key from K = cS, and remembers only C = cG.
+  - To recover, client picks random e, sends X = C + eG to server, server responds Y = sX.
+  - Client computes K = Y - eS = sC.
+
+The server never learns the disk key or C, and it does not keep any per-disk state. The client cannot compute the disk
+key without the server's help.
+*/
+
+const (
+	BINDING_KEY_PEM_TYPE = "EC PRIVATE KEY" // BINDING_KEY_PEM_TYPE is the PEM block type of binding key file.
+	BINDING_KEY_MODE     = 0600             // BINDING_KEY_MODE is the permission of binding key file.
+	BINDING_DISK_KEY_LEN = sha512.Size      // BINDING_DISK_KEY_LEN is the length of disk key derived from exchange, 512 bits.
+)
+
+var bindingCurve = elliptic.P256() // bindingCurve is the elliptic curve of binding key and exchange.
+
+// BindingKey is the server's private key for McCallum-Relyea exchange.
+type BindingKey struct {
+	Private *ecdsa.PrivateKey
+}
+
+// Read binding key from a PEM file. If the file does not yet exist, generate a new key and save it.
+func LoadOrCreateBindingKey(filePath string) (*BindingKey, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		priv, err := ecdsa.GenerateKey(bindingCurve, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("LoadOrCreateBindingKey: failed to generate key - %v", err)
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, fmt.Errorf("LoadOrCreateBindingKey: failed to serialise key - %v", err)
+		}
+		if err := os.MkdirAll(path.Dir(filePath), 0700); err != nil {
+			return nil, fmt.Errorf("LoadOrCreateBindingKey: failed to make directory for \"%s\" - %v", filePath, err)
+		}
+		content = pem.EncodeToMemory(&pem.Block{Type: BINDING_KEY_PEM_TYPE, Bytes: der})
+		if err := ioutil.WriteFile(filePath, content, BINDING_KEY_MODE); err != nil {
+			return nil, fmt.Errorf("LoadOrCreateBindingKey: failed to write \"%s\" - %v", filePath, err)
+		}
+		return &BindingKey{Private: priv}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("LoadOrCreateBindingKey: failed to read \"%s\" - %v", filePath, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != BINDING_KEY_PEM_TYPE {
+		return nil, fmt.Errorf("LoadOrCreateBindingKey: \"%s\" does not contain an %s", filePath, BINDING_KEY_PEM_TYPE)
+	}
+	priv, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("LoadOrCreateBindingKey: failed to parse \"%s\" - %v", filePath, err)
+	}
+	if priv.Curve != bindingCurve {
+		return nil, fmt.Errorf("LoadOrCreateBindingKey: key in \"%s\" is not on curve P-256", filePath)
+	}
+	return &BindingKey{Private: priv}, nil
+}
+
+// Return the public key S in uncompressed point form.
+func (key *BindingKey) PublicKey() []byte {
+	return elliptic.Marshal(bindingCurve, key.Private.X, key.Private.Y)
+}
+
+// Return an identifier of the key, which is derived from its public key.
+func (key *BindingKey) ID() string {
+	return GetBindingKeyID(key.PublicKey())
+}
+
+// Calculate Y = sX for a client recovering its disk key.
+func (key *BindingKey) Exchange(blinded []byte) ([]byte, error) {
+	x, y, err := unmarshalPoint(blinded)
+	if err != nil {
+		return nil, err
+	}
+	rx, ry := bindingCurve.ScalarMult(x, y, key.Private.D.Bytes())
+	return elliptic.Marshal(bindingCurve, rx, ry), nil
+}
+
+// Return an identifier of the binding public key.
+func GetBindingKeyID(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Decode a point and make sure it is on the curve.
+func unmarshalPoint(point []byte) (x, y *big.Int, err error) {
+	x, y = elliptic.Unmarshal(bindingCurve, point)
+	if x == nil {
+		return nil, nil, errors.New("unmarshalPoint: malformed point or the point is not on curve")
+	}
+	return
+}
+
+// Derive a disk key from the exchanged point K.
+func deriveBindingDiskKey(kx *big.Int) []byte {
+	// Left-pad the coordinate to the curve size so that the key does not depend on leading zeros
+	coordinate := make([]byte, (bindingCurve.Params().BitSize+7)/8)
+	kxBytes := kx.Bytes()
+	copy(coordinate[len(coordinate)-len(kxBytes):], kxBytes)
+	sum := sha512.Sum512(coordinate)
+	return sum[:]
+}
+
+// Return a random scalar and its point on curve.
+func randomScalar() (scalar []byte, x, y *big.Int, err error) {
+	scalar, x, y, err = elliptic.GenerateKey(bindingCurve, rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("randomScalar: failed to generate random number - %v", err)
+	}
+	return
+}
+
+/*
+Compute a new disk key bound to server's binding public key S. Return C that must be kept alongside the disk for
+recovering the key later, and the disk key itself.
+*/
+func BindDiskKey(serverPublicKey []byte) (clientPoint, diskKey []byte, err error) {
+	sx, sy, err := unmarshalPoint(serverPublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("BindDiskKey: server public key - %v", err)
+	}
+	c, cx, cy, err := randomScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	kx, _ := bindingCurve.ScalarMult(sx, sy, c)
+	return elliptic.Marshal(bindingCurve, cx, cy), deriveBindingDiskKey(kx), nil
+}
+
+// Blind C with a random e. Return X = C + eG to be sent to server, and e to be kept by client until the response.
+func BlindBindingRequest(clientPoint []byte) (blinded, ephemeral []byte, err error) {
+	cx, cy, err := unmarshalPoint(clientPoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("BlindBindingRequest: client point - %v", err)
+	}
+	e, ex, ey, err := randomScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	xx, xy := bindingCurve.Add(cx, cy, ex, ey)
+	return elliptic.Marshal(bindingCurve, xx, xy), e, nil
+}
+
+// Recover the disk key from server response Y, by computing K = Y - eS.
+func UnblindBindingResponse(serverPublicKey, ephemeral, response []byte) ([]byte, error) {
+	sx, sy, err := unmarshalPoint(serverPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("UnblindBindingResponse: server public key - %v", err)
+	}
+	yx, yy, err := unmarshalPoint(response)
+	if err != nil {
+		return nil, fmt.Errorf("UnblindBindingResponse: server response - %v", err)
+	}
+	esx, esy := bindingCurve.ScalarMult(sx, sy, ephemeral)
+	// Subtraction is addition of the negated point (x, p - y)
+	negESY := new(big.Int).Sub(bindingCurve.Params().P, esy)
+	kx, _ := bindingCurve.Add(yx, yy, esx, negESY)
+	return deriveBindingDiskKey(kx), nil
+}
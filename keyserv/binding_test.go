@@ -0,0 +1,74 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBindingExchange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-bindingtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keyFile := path.Join(tmpDir, "binding-key.pem")
+	// The key is generated upon first use and remains the same afterwards
+	key, err := LoadOrCreateBindingKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedKey, err := LoadOrCreateBindingKey(keyFile)
+	if err != nil || reloadedKey.ID() != key.ID() || len(key.ID()) != 32 {
+		t.Fatal(err, key.ID(), reloadedKey.ID())
+	}
+	// Bind a disk key and then recover it via the exchange
+	clientPoint, diskKey, err := BindDiskKey(key.PublicKey())
+	if err != nil || len(diskKey) != BINDING_DISK_KEY_LEN {
+		t.Fatal(err, diskKey)
+	}
+	for i := 0; i < 3; i++ {
+		blinded, ephemeral, err := BlindBindingRequest(clientPoint)
+		if err != nil || bytes.Equal(blinded, clientPoint) {
+			t.Fatal(err)
+		}
+		response, err := key.Exchange(blinded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recovered, err := UnblindBindingResponse(key.PublicKey(), ephemeral, response)
+		if err != nil || !bytes.Equal(recovered, diskKey) {
+			t.Fatal(err, recovered, diskKey)
+		}
+	}
+	// Another server key cannot recover the disk key
+	otherKey, err := LoadOrCreateBindingKey(path.Join(tmpDir, "other-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blinded, ephemeral, err := BlindBindingRequest(clientPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := otherKey.Exchange(blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered, err := UnblindBindingResponse(key.PublicKey(), ephemeral, response); err != nil || bytes.Equal(recovered, diskKey) {
+		t.Fatal(err, recovered)
+	}
+	// Malformed points are rejected
+	if _, err := key.Exchange([]byte{4, 1, 2, 3}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "bad.pem"), []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateBindingKey(path.Join(tmpDir, "bad.pem")); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,585 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	CA_DEFAULT_VALIDITY_DAYS          = 3650 // CA_DEFAULT_VALIDITY_DAYS is the default validity of a newly generated CA.
+	SERVER_CERT_DEFAULT_VALIDITY_DAYS = 825  // SERVER_CERT_DEFAULT_VALIDITY_DAYS is the default validity of key server's own certificate.
+	CLIENT_CERT_DEFAULT_VALIDITY_DAYS = 7    // CLIENT_CERT_DEFAULT_VALIDITY_DAYS is the default validity of an enrolled client certificate.
+	CLIENT_CERT_RENEW_FRACTION        = 3    // A client certificate is renewed when less than 1/CLIENT_CERT_RENEW_FRACTION of its validity remains.
+	CRL_VALIDITY_DAYS                 = 365  // CRL_VALIDITY_DAYS is the validity of a revocation list, it is re-signed upon every revocation.
+	CERT_FILE_MODE                    = 0644 // CERT_FILE_MODE is the permission of generated certificate and revocation list files.
+	CERT_KEY_FILE_MODE                = 0600 // CERT_KEY_FILE_MODE is the permission of generated private key files.
+	PEM_TYPE_CERT                     = "CERTIFICATE"
+	PEM_TYPE_CSR                      = "CERTIFICATE REQUEST"
+	PEM_TYPE_EC_KEY                   = "EC PRIVATE KEY"
+	PEM_TYPE_CRL                      = "X509 CRL"
+)
+
+// CertSubject describes the subject of a certificate generated by the built-in certificate authority.
+type CertSubject struct {
+	CommonName         string
+	Organisation       string
+	OrganisationalUnit string
+	Locality           string
+	Province           string
+	Country            string
+	Email              string
+}
+
+// Return the subject in X.509 name form, empty attributes are left out.
+func (subj CertSubject) ToName() (name pkix.Name) {
+	name.CommonName = subj.CommonName
+	for _, attr := range []struct {
+		dest  *[]string
+		value string
+	}{
+		{&name.Organization, subj.Organisation},
+		{&name.OrganizationalUnit, subj.OrganisationalUnit},
+		{&name.Locality, subj.Locality},
+		{&name.Province, subj.Province},
+		{&name.Country, subj.Country},
+	} {
+		if attr.value != "" {
+			*attr.dest = []string{attr.value}
+		}
+	}
+	return
+}
+
+// Return a random serial number of 128 bits.
+func newSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("newSerialNumber: failed to generate random number - %v", err)
+	}
+	return serial, nil
+}
+
+// Generate a new private key for certificates.
+func newCertKey() (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("newCertKey: failed to generate key - %v", err)
+	}
+	return key, nil
+}
+
+// Return private key in PEM encoding.
+func encodeCertKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("encodeCertKey: failed to serialise key - %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEM_TYPE_EC_KEY, Bytes: der}), nil
+}
+
+/*
+Write PEM content into a file. If overwrite is false, the file must not yet exist. If overwrite is true, the file is
+replaced atomically so that a reader never sees partial content.
+*/
+func writePEMFile(filePath string, content []byte, mode os.FileMode, overwrite bool) error {
+	if err := os.MkdirAll(path.Dir(filePath), 0700); err != nil {
+		return fmt.Errorf("writePEMFile: failed to make directory for \"%s\" - %v", filePath, err)
+	}
+	if !overwrite {
+		fh, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return fmt.Errorf("writePEMFile: failed to create \"%s\" (does it already exist?) - %v", filePath, err)
+		}
+		defer fh.Close()
+		if _, err := fh.Write(content); err != nil {
+			return fmt.Errorf("writePEMFile: failed to write \"%s\" - %v", filePath, err)
+		}
+		return nil
+	}
+	tmpPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, mode); err != nil {
+		return fmt.Errorf("writePEMFile: failed to write \"%s\" - %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("writePEMFile: failed to replace \"%s\" - %v", filePath, err)
+	}
+	return nil
+}
+
+// Decode the first PEM block of the specified type.
+func decodePEM(content []byte, pemType string) ([]byte, error) {
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("decodePEM: cannot find %s in PEM content", pemType)
+		} else if block.Type == pemType {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// Parse the first certificate from PEM content.
+func ParseCertPEM(content []byte) (*x509.Certificate, error) {
+	der, err := decodePEM(content, PEM_TYPE_CERT)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+/*
+Generate a new certificate authority with a self-signed certificate, and write the certificate and its private key
+into files. Neither file may exist beforehand.
+*/
+func GenerateCertAuthority(subject CertSubject, validityDays int, certPath, keyPath string) error {
+	if subject.CommonName == "" {
+		return errors.New("GenerateCertAuthority: common name must not be empty")
+	} else if validityDays < 1 {
+		return fmt.Errorf("GenerateCertAuthority: validity (%d days) must be at least one day", validityDays)
+	}
+	for _, filePath := range []string{certPath, keyPath} {
+		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+			return fmt.Errorf("GenerateCertAuthority: file \"%s\" probably already exists", filePath)
+		}
+	}
+	key, err := newCertKey()
+	if err != nil {
+		return err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject.ToName(),
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.AddDate(0, 0, validityDays),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	if subject.Email != "" {
+		template.EmailAddresses = []string{subject.Email}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("GenerateCertAuthority: failed to create certificate - %v", err)
+	}
+	keyPEM, err := encodeCertKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEMFile(keyPath, keyPEM, CERT_KEY_FILE_MODE, false); err != nil {
+		return err
+	}
+	return writePEMFile(certPath, pem.EncodeToMemory(&pem.Block{Type: PEM_TYPE_CERT, Bytes: der}), CERT_FILE_MODE, false)
+}
+
+// CertAuthority is the built-in certificate authority that issues certificates to key server and its clients.
+type CertAuthority struct {
+	Cert    *x509.Certificate // Cert is the CA certificate.
+	CertPEM []byte            // CertPEM is the CA certificate in PEM encoding, as handed over to enrolled clients.
+	Key     crypto.Signer     // Key is the CA private key.
+	CRLPath string            // CRLPath is the revocation list file maintained by the CA, or empty if revocation is unsupported.
+	mutex   *sync.Mutex       // mutex serialises revocations
+}
+
+// Load CA certificate and key from files.
+func LoadCertAuthority(certPath, keyPath, crlPath string) (*CertAuthority, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to read \"%s\" - %v", certPath, err)
+	}
+	cert, err := ParseCertPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to parse \"%s\" - %v", certPath, err)
+	} else if !cert.IsCA {
+		return nil, fmt.Errorf("LoadCertAuthority: \"%s\" is not a CA certificate", certPath)
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to read \"%s\" - %v", keyPath, err)
+	}
+	keyDER, err := decodePEM(keyPEM, PEM_TYPE_EC_KEY)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to decode \"%s\" - %v", keyPath, err)
+	}
+	key, err := x509.ParseECPrivateKey(keyDER)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to parse \"%s\" - %v", keyPath, err)
+	}
+	if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok || pub.X.Cmp(key.X) != 0 || pub.Y.Cmp(key.Y) != 0 {
+		return nil, fmt.Errorf("LoadCertAuthority: key \"%s\" does not belong to certificate \"%s\"", keyPath, certPath)
+	}
+	return &CertAuthority{Cert: cert, CertPEM: certPEM, Key: key, CRLPath: crlPath, mutex: new(sync.Mutex)}, nil
+}
+
+// Sign a certificate from the template and return it in PEM encoding.
+func (ca *CertAuthority) sign(template *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.BasicConstraintsValid = true
+	// Certificate must not outlive its CA
+	if template.NotAfter.After(ca.Cert.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, pub, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("sign: failed to create certificate - %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEM_TYPE_CERT, Bytes: der}), nil
+}
+
+// Issue a TLS server certificate for the host name (or IP address), and write the certificate and key into files.
+func (ca *CertAuthority) IssueServerCert(hostname string, validityDays int, certPath, keyPath string) error {
+	if hostname == "" {
+		return errors.New("IssueServerCert: host name must not be empty")
+	}
+	key, err := newCertKey()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hostname},
+		NotBefore:   now.Add(-1 * time.Hour),
+		NotAfter:    now.AddDate(0, 0, validityDays),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{hostname}
+	}
+	certPEM, err := ca.sign(template, key.Public())
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeCertKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEMFile(keyPath, keyPEM, CERT_KEY_FILE_MODE, false); err != nil {
+		return err
+	}
+	return writePEMFile(certPath, certPEM, CERT_FILE_MODE, false)
+}
+
+// Decode a PEM-encoded certificate signing request and verify its signature and common name.
+func parseClientCSR(csrPEM []byte) (*x509.CertificateRequest, error) {
+	csrDER, err := decodePEM(csrPEM, PEM_TYPE_CSR)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request - %v", err)
+	} else if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("request signature is invalid - %v", err)
+	} else if csr.Subject.CommonName == "" {
+		return nil, errors.New("request does not have a common name")
+	}
+	return csr, nil
+}
+
+// Issue a TLS client certificate of the subject and names for the public key, valid for the specified duration.
+func (ca *CertAuthority) signClientCert(subject pkix.Name, dnsNames []string, ipAddresses []net.IP, pub crypto.PublicKey, validity time.Duration) (certPEM []byte, cert *x509.Certificate, err error) {
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     subject,
+		DNSNames:    dnsNames,
+		IPAddresses: ipAddresses,
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if certPEM, err = ca.sign(template, pub); err != nil {
+		return nil, nil, err
+	}
+	cert, err = ParseCertPEM(certPEM)
+	return
+}
+
+/*
+Issue a TLS client certificate from a PEM-encoded certificate signing request. The certificate carries the common name
+and DNS names of the request, it is valid for the specified duration. Return the certificate in PEM encoding.
+*/
+func (ca *CertAuthority) SignClientCSR(csrPEM []byte, validity time.Duration) (certPEM []byte, cert *x509.Certificate, err error) {
+	csr, err := parseClientCSR(csrPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SignClientCSR: %v", err)
+	}
+	return ca.signClientCert(pkix.Name{CommonName: csr.Subject.CommonName}, csr.DNSNames, nil, csr.PublicKey, validity)
+}
+
+/*
+Issue a fresh TLS client certificate in place of the current one for the key of a PEM-encoded certificate signing
+request. The names identify the client to key records and API grants, hence the fresh certificate carries the subject
+and names of the current certificate, and the request must not ask for a different common name or DNS names. Only the
+public key is taken from the request.
+*/
+func (ca *CertAuthority) RenewClientCSR(csrPEM []byte, current *x509.Certificate, validity time.Duration) (certPEM []byte, cert *x509.Certificate, err error) {
+	csr, err := parseClientCSR(csrPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("RenewClientCSR: %v", err)
+	} else if csr.Subject.CommonName != current.Subject.CommonName {
+		return nil, nil, fmt.Errorf("RenewClientCSR: request's common name \"%s\" does not match certificate \"%s\"",
+			csr.Subject.CommonName, current.Subject.CommonName)
+	} else if !sameNames(csr.DNSNames, current.DNSNames) {
+		return nil, nil, fmt.Errorf("RenewClientCSR: request's DNS names %v do not match certificate %v", csr.DNSNames, current.DNSNames)
+	}
+	return ca.signClientCert(current.Subject, current.DNSNames, current.IPAddresses, csr.PublicKey, validity)
+}
+
+// Return true only if both lists carry the same names regardless of their order.
+func sameNames(names1, names2 []string) bool {
+	if len(names1) != len(names2) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, name := range names1 {
+		count[name]++
+	}
+	for _, name := range names2 {
+		if count[name] == 0 {
+			return false
+		}
+		count[name]--
+	}
+	return true
+}
+
+// Return true only if the certificate was issued by this CA.
+func (ca *CertAuthority) IsIssuerOf(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, ca.Cert.RawSubject) && cert.CheckSignatureFrom(ca.Cert) == nil
+}
+
+// Read revocation list from file, return nil list if the file does not yet exist.
+func readCRLFile(crlPath string) (*x509.RevocationList, error) {
+	content, err := ioutil.ReadFile(crlPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("readCRLFile: failed to read \"%s\" - %v", crlPath, err)
+	}
+	der, err := decodePEM(content, PEM_TYPE_CRL)
+	if err != nil {
+		return nil, fmt.Errorf("readCRLFile: failed to decode \"%s\" - %v", crlPath, err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, fmt.Errorf("readCRLFile: failed to parse \"%s\" - %v", crlPath, err)
+	}
+	return crl, nil
+}
+
+// Add certificate serial numbers to the revocation list and re-sign the list. Already revoked serials are ignored.
+func (ca *CertAuthority) Revoke(serials ...*big.Int) error {
+	if ca.CRLPath == "" {
+		return errors.New("Revoke: revocation list file is not configured")
+	}
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	template := &x509.RevocationList{Number: big.NewInt(1)}
+	existing, err := readCRLFile(ca.CRLPath)
+	if err != nil {
+		return fmt.Errorf("Revoke: %v", err)
+	}
+	revoked := make(map[string]bool)
+	if existing != nil {
+		if err := existing.CheckSignatureFrom(ca.Cert); err != nil {
+			return fmt.Errorf("Revoke: existing revocation list \"%s\" was not signed by this CA - %v", ca.CRLPath, err)
+		}
+		template.RevokedCertificateEntries = existing.RevokedCertificateEntries
+		template.Number = new(big.Int).Add(existing.Number, big.NewInt(1))
+		for _, entry := range existing.RevokedCertificateEntries {
+			revoked[entry.SerialNumber.String()] = true
+		}
+	}
+	now := time.Now()
+	for _, serial := range serials {
+		if revoked[serial.String()] {
+			continue
+		}
+		revoked[serial.String()] = true
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: now,
+		})
+	}
+	template.ThisUpdate = now
+	template.NextUpdate = now.AddDate(0, 0, CRL_VALIDITY_DAYS)
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.Cert, ca.Key)
+	if err != nil {
+		return fmt.Errorf("Revoke: failed to create revocation list - %v", err)
+	}
+	return writePEMFile(ca.CRLPath, pem.EncodeToMemory(&pem.Block{Type: PEM_TYPE_CRL, Bytes: der}), CERT_FILE_MODE, true)
+}
+
+/*
+RevocationList enforces a certificate revocation list on TLS clients. The list file is re-read whenever it changes, so
+that revocations take effect without restarting key server. The list must be signed by one of the trusted issuers.
+*/
+type RevocationList struct {
+	FilePath string              // FilePath is the PEM-encoded revocation list file.
+	Issuers  []*x509.Certificate // Issuers are the certificate authorities that may sign the list.
+	mutex    *sync.Mutex
+	modTime  time.Time
+	issuer   []byte          // issuer is the raw subject of the list's issuer
+	revoked  map[string]bool // revoked are the serial numbers (decimal) of revoked certificates
+	loadErr  error
+}
+
+// Initialise a revocation list that reads from the file and trusts lists signed by the issuers.
+func NewRevocationList(filePath string, issuers []*x509.Certificate) *RevocationList {
+	return &RevocationList{
+		FilePath: filePath,
+		Issuers:  issuers,
+		mutex:    new(sync.Mutex),
+		revoked:  make(map[string]bool),
+	}
+}
+
+// Re-read the list file if it has changed since last read. Caller must hold the mutex.
+func (list *RevocationList) reload() {
+	stat, err := os.Stat(list.FilePath)
+	if os.IsNotExist(err) {
+		// Nothing has been revoked yet
+		list.modTime = time.Time{}
+		list.issuer = nil
+		list.revoked = make(map[string]bool)
+		list.loadErr = nil
+		return
+	} else if err != nil {
+		list.loadErr = fmt.Errorf("RevocationList: failed to read \"%s\" - %v", list.FilePath, err)
+		return
+	}
+	if stat.ModTime().Equal(list.modTime) && list.loadErr == nil {
+		return
+	}
+	list.modTime = stat.ModTime()
+	crl, err := readCRLFile(list.FilePath)
+	if err != nil {
+		list.loadErr = fmt.Errorf("RevocationList: %v", err)
+		return
+	}
+	var signedBy *x509.Certificate
+	for _, issuer := range list.Issuers {
+		if bytes.Equal(issuer.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(issuer) == nil {
+			signedBy = issuer
+			break
+		}
+	}
+	if signedBy == nil {
+		list.loadErr = fmt.Errorf("RevocationList: \"%s\" was not signed by a trusted certificate authority", list.FilePath)
+		return
+	}
+	list.issuer = crl.RawIssuer
+	list.revoked = make(map[string]bool)
+	for _, entry := range crl.RevokedCertificateEntries {
+		list.revoked[entry.SerialNumber.String()] = true
+	}
+	list.loadErr = nil
+}
+
+// Replace the certificate authorities that may sign the list, the list is read again upon next check.
+func (list *RevocationList) SetIssuers(issuers []*x509.Certificate) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.Issuers = issuers
+	list.modTime = time.Time{}
+}
+
+// Return an error if the certificate has been revoked, or if the revocation list cannot be read.
+func (list *RevocationList) Check(cert *x509.Certificate) error {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.reload()
+	if list.loadErr != nil {
+		// Fail closed, a damaged list must not let revoked certificates in.
+		return list.loadErr
+	}
+	if bytes.Equal(cert.RawIssuer, list.issuer) && list.revoked[cert.SerialNumber.String()] {
+		return fmt.Errorf("RevocationList: certificate \"%s\" (serial %s) has been revoked", cert.Subject.CommonName, cert.SerialNumber)
+	}
+	return nil
+}
+
+// Reject revoked client certificates, the function signature is compatible with tls.Config.VerifyPeerCertificate.
+func (list *RevocationList) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("VerifyPeerCertificate: failed to parse client certificate - %v", err)
+	}
+	return list.Check(cert)
+}
+
+// Generate a new private key and certificate signing request for a client. Return both in PEM encoding.
+func NewClientCSR(commonName string) (csrPEM, keyPEM []byte, err error) {
+	if commonName == "" {
+		return nil, nil, errors.New("NewClientCSR: common name must not be empty")
+	}
+	key, err := newCertKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}
+	if net.ParseIP(commonName) == nil {
+		template.DNSNames = []string{commonName}
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("NewClientCSR: failed to create request - %v", err)
+	}
+	if keyPEM, err = encodeCertKey(key); err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEM_TYPE_CSR, Bytes: der}), keyPEM, nil
+}
+
+// Return true if less than 1/CLIENT_CERT_RENEW_FRACTION of the certificate's validity remains.
+func CertNeedsRenewal(cert *x509.Certificate, now time.Time) bool {
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Sub(now) < validity/CLIENT_CERT_RENEW_FRACTION
+}
+
+// Replace client certificate and key files with newly issued ones.
+func SaveClientCert(certPath, keyPath string, certPEM, keyPEM []byte) error {
+	if err := writePEMFile(keyPath, keyPEM, CERT_KEY_FILE_MODE, true); err != nil {
+		return fmt.Errorf("SaveClientCert: %v", err)
+	}
+	if err := writePEMFile(certPath, certPEM, CERT_FILE_MODE, true); err != nil {
+		return fmt.Errorf("SaveClientCert: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Make a PEM-encoded certificate signing request that carries the common name and DNS names of choice.
+func newTestCSR(t *testing.T, commonName string, dnsNames ...string) []byte {
+	key, err := newCertKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEM_TYPE_CSR, Bytes: der})
+}
+
+func TestCertAuthority(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-catest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	caCert := path.Join(tmpDir, "ca.crt")
+	caKey := path.Join(tmpDir, "ca.key")
+	crlFile := path.Join(tmpDir, "revoked.crl")
+	subject := CertSubject{CommonName: "cryptctl CA", Organisation: "Example", Country: "DE", Email: "admin@example.com"}
+	if err := GenerateCertAuthority(CertSubject{}, 10, caCert, caKey); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := GenerateCertAuthority(subject, 10, caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+	// Existing CA must not be overwritten
+	if err := GenerateCertAuthority(subject, 10, caCert, caKey); err == nil {
+		t.Fatal("did not error")
+	}
+	ca, err := LoadCertAuthority(caCert, caKey, crlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Cert.IsCA || ca.Cert.Subject.Organization[0] != "Example" || ca.Cert.EmailAddresses[0] != "admin@example.com" ||
+		ca.Cert.NotAfter.Sub(ca.Cert.NotBefore) < 10*24*time.Hour {
+		t.Fatalf("%+v", ca.Cert)
+	}
+	// Server certificate is verified by the CA
+	srvCert := path.Join(tmpDir, "srv.crt")
+	srvKey := path.Join(tmpDir, "srv.key")
+	if err := ca.IssueServerCert("keyserver.example.com", 5, srvCert, srvKey); err != nil {
+		t.Fatal(err)
+	}
+	srvPair, err := tls.LoadX509KeyPair(srvCert, srvKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	srvParsed, _ := x509.ParseCertificate(srvPair.Certificate[0])
+	if _, err := srvParsed.Verify(x509.VerifyOptions{DNSName: "keyserver.example.com", Roots: roots}); err != nil {
+		t.Fatal(err)
+	}
+	// Client certificate is issued from CSR
+	csr, _, err := NewClientCSR("client.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, cert, err := ca.SignClientCSR(csr, time.Hour)
+	if err != nil || len(certPEM) == 0 || !ca.IsIssuerOf(cert) {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "client.example.com" || cert.DNSNames[0] != "client.example.com" {
+		t.Fatalf("%+v", cert)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ca.SignClientCSR([]byte("garbage"), time.Hour); err == nil {
+		t.Fatal("did not error")
+	}
+	// Renewal keeps the names of the current certificate and takes only the key from request
+	renewCSR := newTestCSR(t, "client.example.com", "client.example.com")
+	_, renewed, err := ca.RenewClientCSR(renewCSR, cert, time.Hour)
+	if err != nil || renewed.Subject.CommonName != "client.example.com" || !sameNames(renewed.DNSNames, cert.DNSNames) {
+		t.Fatal(renewed, err)
+	}
+	if renewed.SerialNumber.Cmp(cert.SerialNumber) == 0 || bytes.Equal(renewed.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo) {
+		t.Fatal("renewed certificate must carry the new key")
+	}
+	for _, badCSR := range [][]byte{
+		newTestCSR(t, "client.example.com", "client.example.com", "other-host"),
+		newTestCSR(t, "client.example.com", "other-host"),
+		newTestCSR(t, "client.example.com"),
+		newTestCSR(t, "other-host", "client.example.com"),
+		[]byte("garbage"),
+	} {
+		if _, _, err := ca.RenewClientCSR(badCSR, cert, time.Hour); err == nil {
+			t.Fatal("did not error", string(badCSR))
+		}
+	}
+	// Renewal is due when less than a third of validity remains
+	if CertNeedsRenewal(cert, time.Now()) || !CertNeedsRenewal(cert, time.Now().Add(45*time.Minute)) {
+		t.Fatal("wrong renewal decision")
+	}
+	// Revocation takes effect without re-creating the list
+	list := NewRevocationList(crlFile, []*x509.Certificate{ca.Cert})
+	if err := list.Check(cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Revoke(cert.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Check(cert); err == nil {
+		t.Fatal("did not reject revoked certificate")
+	}
+	// Revoking more certificates keeps earlier revocations
+	_, otherCert, err := ca.SignClientCSR(csr, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Check(otherCert); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Revoke(otherCert.SerialNumber, cert.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure modification time differs on file systems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(crlFile, later, later)
+	if err := list.Check(cert); err == nil {
+		t.Fatal("did not reject revoked certificate")
+	}
+	if err := list.Check(otherCert); err == nil {
+		t.Fatal("did not reject revoked certificate")
+	}
+	// List signed by an untrusted CA is refused
+	untrusted := NewRevocationList(crlFile, []*x509.Certificate{srvParsed})
+	if err := untrusted.Check(srvParsed); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,222 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+'use strict';
+
+const API = '/api/v1';
+const TOKEN_KEY = 'cryptctl-api-token';
+const REFRESH_MS = 10000;
+const MAX_EVENTS = 200;
+
+let events = [];
+let lastEventSeq = 0;
+
+// Call an API endpoint and return the decoded response. Throw an error carrying HTTP status if the call fails.
+async function call(method, path, body) {
+  const headers = {};
+  const token = sessionStorage.getItem(TOKEN_KEY);
+  if (token) {
+    headers['Authorization'] = 'Bearer ' + token;
+  }
+  if (body !== undefined) {
+    headers['Content-Type'] = 'application/json';
+  }
+  const resp = await fetch(API + path, {method: method, headers: headers, body: body === undefined ? undefined : JSON.stringify(body)});
+  const content = await resp.json().catch(() => ({}));
+  if (!resp.ok) {
+    const err = new Error(content.error || resp.statusText);
+    err.status = resp.status;
+    throw err;
+  }
+  return content;
+}
+
+// Create an element with text content. Text from API is never interpreted as HTML.
+function el(tag, text, className) {
+  const elem = document.createElement(tag);
+  if (text !== undefined && text !== null) {
+    elem.textContent = String(text);
+  }
+  if (className) {
+    elem.className = className;
+  }
+  return elem;
+}
+
+function formatTime(ts) {
+  if (!ts || ts.startsWith('0001-')) {
+    return '-';
+  }
+  return new Date(ts).toLocaleString();
+}
+
+function setStatus(text, isError) {
+  const status = document.getElementById('status');
+  status.textContent = text;
+  status.className = isError ? 'error' : '';
+}
+
+function showLogin() {
+  document.getElementById('login').hidden = false;
+  document.getElementById('dashboard').hidden = true;
+  document.getElementById('logout').hidden = !sessionStorage.getItem(TOKEN_KEY);
+}
+
+function showDashboard() {
+  document.getElementById('login').hidden = true;
+  document.getElementById('dashboard').hidden = false;
+  document.getElementById('logout').hidden = !sessionStorage.getItem(TOKEN_KEY);
+}
+
+// Run an administrative action and report its outcome.
+async function act(description, method, path, body) {
+  try {
+    await call(method, path, body);
+    setStatus(description + ' - done');
+    await refresh();
+  } catch (err) {
+    setStatus(description + ' - ' + (err.status === 403 ? 'administrator role is required' : err.message), true);
+  }
+}
+
+function sendCommand(uuid, ip, action) {
+  if (confirm('Tell ' + ip + ' to ' + action + ' ' + uuid + '?')) {
+    act(action + ' ' + uuid + ' on ' + ip, 'POST', '/records/' + encodeURIComponent(uuid) + '/commands', {ip: ip, action: action});
+  }
+}
+
+function raiseMaxActive(rec) {
+  const input = prompt('Maximum number of computers that may actively use ' + rec.uuid + ' (0 means unlimited):', String(rec.max_active + 1));
+  if (input === null) {
+    return;
+  }
+  const maxActive = parseInt(input, 10);
+  if (isNaN(maxActive) || maxActive < 0) {
+    setStatus('Maximum active users must be 0 or greater', true);
+    return;
+  }
+  act('Set maximum active users of ' + rec.uuid + ' to ' + maxActive, 'PATCH', '/records/' + encodeURIComponent(rec.uuid), {max_active: maxActive});
+}
+
+function renderHosts(rec) {
+  const cell = el('td');
+  const list = el('ul');
+  (rec.hosts || []).forEach(host => {
+    const item = el('li');
+    item.appendChild(el('span', host.alive ? 'alive' : 'dead', host.alive ? 'alive' : 'dead'));
+    item.appendChild(document.createTextNode(' ' + host.ip + ' (' + host.hostname + ') '));
+    const history = el('details');
+    history.appendChild(el('summary', 'last seen ' + formatTime(host.last_seen), 'seen'));
+    const times = el('ul');
+    (host.history || []).slice().reverse().forEach(ts => times.appendChild(el('li', formatTime(ts))));
+    history.appendChild(times);
+    item.appendChild(history);
+    // Commands that take parameters, such as run-hook and self-destruct, are issued from the command line.
+    ['mount', 'umount', 'remount-ro', 'lock', 'report-status', 'rotate-key'].forEach(action => {
+      const button = el('button', action);
+      button.addEventListener('click', () => sendCommand(rec.uuid, host.ip, action));
+      item.appendChild(button);
+    });
+    list.appendChild(item);
+  });
+  cell.appendChild(list);
+  return cell;
+}
+
+function renderCommands(rec) {
+  const cell = el('td');
+  const list = el('ul');
+  (rec.pending_commands || []).forEach(cmd => {
+    let state = 'waiting';
+    if (cmd.result) {
+      state = (cmd.result.success ? 'succeeded: ' : 'failed: ') + cmd.result.message;
+    } else if (cmd.client_result) {
+      state = 'result: ' + cmd.client_result;
+    } else if (cmd.seen_by_client) {
+      state = 'delivered';
+    }
+    const params = Object.keys(cmd.params || {}).map(name => name + '=' + cmd.params[name]).join(' ');
+    const item = el('li', cmd.ip + ' ' + cmd.action + (params ? ' ' + params : '') + ' - ' + state + ', expires ' + formatTime(cmd.valid_until));
+    const details = Object.keys((cmd.result && cmd.result.details) || {});
+    if (details.length > 0) {
+      const detailList = el('ul');
+      details.sort().forEach(name => detailList.appendChild(el('li', name + ': ' + cmd.result.details[name])));
+      item.appendChild(detailList);
+    }
+    list.appendChild(item);
+  });
+  cell.appendChild(list);
+  return cell;
+}
+
+function renderRecords(records) {
+  const tbody = document.querySelector('#records tbody');
+  tbody.replaceChildren();
+  records.forEach(rec => {
+    const row = el('tr');
+    const alive = (rec.hosts || []).filter(host => host.alive).length;
+    row.appendChild(el('td', rec.uuid));
+    row.appendChild(el('td', rec.mount_point));
+    row.appendChild(el('td', (rec.tags || []).join(', ')));
+    row.appendChild(el('td', formatTime(rec.creation_time)));
+    row.appendChild(el('td', alive + ' / ' + (rec.max_active === 0 ? 'unlimited' : rec.max_active)));
+    row.appendChild(el('td', rec.last_retrieval.ip ? rec.last_retrieval.ip + ' (' + rec.last_retrieval.hostname + ') ' + formatTime(rec.last_retrieval.last_seen) : '-'));
+    row.appendChild(renderHosts(rec));
+    row.appendChild(renderCommands(rec));
+    const actions = el('td');
+    const raise = el('button', 'Change maximum');
+    raise.addEventListener('click', () => raiseMaxActive(rec));
+    actions.appendChild(raise);
+    row.appendChild(actions);
+    tbody.appendChild(row);
+  });
+}
+
+function renderEvents() {
+  const tbody = document.querySelector('#events tbody');
+  tbody.replaceChildren();
+  events.slice().reverse().forEach(event => {
+    const row = el('tr');
+    [event.seq, formatTime(event.time), event.type, event.host, event.uuid, event.detail].forEach(text => row.appendChild(el('td', text)));
+    tbody.appendChild(row);
+  });
+}
+
+async function refresh() {
+  try {
+    const records = await call('GET', '/records');
+    const newEvents = await call('GET', '/events?since=' + lastEventSeq);
+    if (newEvents.length > 0) {
+      lastEventSeq = newEvents[newEvents.length - 1].seq;
+      events = events.concat(newEvents).slice(-MAX_EVENTS);
+    }
+    renderRecords(records);
+    renderEvents();
+    showDashboard();
+    setStatus('Updated ' + new Date().toLocaleTimeString());
+  } catch (err) {
+    if (err.status === 401 || err.status === 403) {
+      showLogin();
+      setStatus(err.status === 401 ? 'Please authenticate' : 'Reader role is required', true);
+    } else {
+      setStatus('Failed to contact key server - ' + err.message, true);
+    }
+  }
+}
+
+document.getElementById('login-form').addEventListener('submit', event => {
+  event.preventDefault();
+  const input = document.getElementById('token');
+  sessionStorage.setItem(TOKEN_KEY, input.value.trim());
+  input.value = '';
+  refresh();
+});
+
+document.getElementById('logout').addEventListener('click', () => {
+  sessionStorage.removeItem(TOKEN_KEY);
+  events = [];
+  lastEventSeq = 0;
+  showLogin();
+});
+
+refresh();
+setInterval(refresh, REFRESH_MS);
@@ -0,0 +1,385 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DUAL_CONTROL_RETRIEVE           = "retrieve-key" // DUAL_CONTROL_RETRIEVE is the action of retrieving keys with password.
+	DUAL_CONTROL_ERASE              = "erase-key"    // DUAL_CONTROL_ERASE is the action of erasing a key.
+	DUAL_CONTROL_DEFAULT_WINDOW_SEC = 3600           // DUAL_CONTROL_DEFAULT_WINDOW_SEC is the default time to confirm and carry out a request.
+	LEN_DUAL_CONTROL_ID             = 8              // LEN_DUAL_CONTROL_ID is the number of random bytes in a request ID.
+
+	DUAL_CONTROL_SELF_DESTRUCT = "self-destruct" // DUAL_CONTROL_SELF_DESTRUCT is the action of issuing self-destruct commands.
+)
+
+/*
+AdminIdentity tells who an administrator is. Administrators using the key server password declare their own name,
+API users are named after the token or certificate that grants them the admin role.
+*/
+type AdminIdentity struct {
+	Name  string // Name is the administrator's name, such as "alice@host1" or "cn:alice".
+	IP    string // IP is the address the administrator connected from.
+	Cert  string // Cert is the fingerprint of the administrator's client certificate, or empty.
+	Grant string // Grant is the API grant of the token or certificate that authenticated the administrator, or empty.
+}
+
+// Return the name and IP of the administrator.
+func (admin AdminIdentity) String() string {
+	return fmt.Sprintf("%s (%s)", admin.Name, admin.IP)
+}
+
+// Return true if the identities belong to the same administrator.
+func (admin AdminIdentity) IsSameAdmin(other AdminIdentity) bool {
+	return strings.EqualFold(admin.Name, other.Name) || admin.Cert != "" && admin.Cert == other.Cert ||
+		admin.Grant != "" && admin.Grant == other.Grant
+}
+
+/*
+Return true if the administrator proved who they are by an API token or client certificate of their own. The key server
+password is shared among administrators, and IP addresses are shared among the users of a computer.
+*/
+func (admin AdminIdentity) IsAuthenticated() bool {
+	return strings.HasPrefix(admin.Grant, keydb.CLIENT_ID_TOKEN) || strings.HasPrefix(admin.Grant, keydb.CLIENT_ID_NAME) ||
+		strings.HasPrefix(admin.Grant, keydb.CLIENT_ID_CERT)
+}
+
+/*
+DualControlRequest is an action on keys that one administrator has asked for, and that a second, different
+administrator has to confirm before the first administrator may carry it out.
+*/
+type DualControlRequest struct {
+	ID        string        // ID identifies the request.
+	Action    string        // Action is one of DUAL_CONTROL_* actions.
+	UUIDs     []string      // UUIDs are the disks the action applies to.
+	Requester AdminIdentity // Requester is the administrator who asked for the action.
+	Requested time.Time     // Requested is the moment the action was asked for.
+	Approver  AdminIdentity // Approver is the administrator who confirmed the action, or empty.
+	Approved  time.Time     // Approved is the moment the action was confirmed, or zero.
+	Expiry    time.Time     // Expiry is the moment by which the action has to be confirmed and carried out.
+}
+
+// Return true if a second administrator has confirmed the request.
+func (req DualControlRequest) IsApproved() bool {
+	return !req.Approved.IsZero()
+}
+
+// Return a one-line description of the request.
+func (req DualControlRequest) String() string {
+	ret := fmt.Sprintf("%s %s of %s requested by %s", req.ID, req.Action, strings.Join(req.UUIDs, ","), req.Requester)
+	if req.IsApproved() {
+		ret += " confirmed by " + req.Approver.String()
+	}
+	return ret
+}
+
+// DualControl keeps the requests that await confirmation or are yet to be carried out, in memory.
+type DualControl struct {
+	window   time.Duration
+	mutex    *sync.Mutex
+	requests map[string]DualControlRequest
+}
+
+// Return an empty request book, requests have to be confirmed and carried out within the window.
+func NewDualControl(window time.Duration) *DualControl {
+	return &DualControl{window: window, mutex: new(sync.Mutex), requests: make(map[string]DualControlRequest)}
+}
+
+// Remove expired requests. Caller must hold the mutex.
+func (dc *DualControl) removeExpired() {
+	for id, req := range dc.requests {
+		if time.Now().After(req.Expiry) {
+			delete(dc.requests, id)
+		}
+	}
+}
+
+/*
+Save a new request of the action and return it. The requester must have authenticated with an API token or client
+certificate granted the admin role, just like the approver, so that the approver can tell the requester apart from
+themselves.
+*/
+func (dc *DualControl) Request(action string, uuids []string, requester AdminIdentity) (DualControlRequest, error) {
+	if action != DUAL_CONTROL_RETRIEVE && action != DUAL_CONTROL_ERASE && action != DUAL_CONTROL_SELF_DESTRUCT {
+		return DualControlRequest{}, fmt.Errorf("DualControl.Request: unknown action \"%s\"", action)
+	} else if len(uuids) == 0 {
+		return DualControlRequest{}, errors.New("DualControl.Request: the request must name at least one disk")
+	} else if requester.Name == "" {
+		return DualControlRequest{}, errors.New("DualControl.Request: administrator name must not be empty")
+	} else if !requester.IsAuthenticated() {
+		return DualControlRequest{}, fmt.Errorf("DualControl.Request: %s must ask with an admin API token or client certificate rather than key server password", requester)
+	}
+	randBytes := make([]byte, LEN_DUAL_CONTROL_ID)
+	if _, err := rand.Read(randBytes); err != nil {
+		return DualControlRequest{}, fmt.Errorf("DualControl.Request: failed to generate random ID - %v", err)
+	}
+	now := time.Now()
+	req := DualControlRequest{
+		ID:        hex.EncodeToString(randBytes),
+		Action:    action,
+		UUIDs:     append([]string{}, uuids...),
+		Requester: requester,
+		Requested: now,
+		Expiry:    now.Add(dc.window),
+	}
+	sort.Strings(req.UUIDs)
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.removeExpired()
+	dc.requests[req.ID] = req
+	return req, nil
+}
+
+// Return the request of the ID if it has not expired or been carried out.
+func (dc *DualControl) Get(id string) (req DualControlRequest, found bool) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.removeExpired()
+	req, found = dc.requests[id]
+	return
+}
+
+// Return the requests that have not expired or been carried out, oldest first.
+func (dc *DualControl) List() []DualControlRequest {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.removeExpired()
+	ret := make([]DualControlRequest, 0, len(dc.requests))
+	for _, req := range dc.requests {
+		ret = append(ret, req)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Requested.Before(ret[j].Requested)
+	})
+	return ret
+}
+
+/*
+Confirm the request on behalf of the approver, who must not be the administrator who made the request. The approver
+must have authenticated with an API token or client certificate granted the admin role, as anyone knowing the key
+server password could otherwise claim to be a second administrator.
+*/
+func (dc *DualControl) Confirm(id string, approver AdminIdentity) (DualControlRequest, error) {
+	if approver.Name == "" {
+		return DualControlRequest{}, errors.New("DualControl.Confirm: administrator name must not be empty")
+	} else if !approver.IsAuthenticated() {
+		return DualControlRequest{}, fmt.Errorf("DualControl.Confirm: %s must confirm with an admin API token or client certificate rather than key server password", approver)
+	}
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.removeExpired()
+	req, found := dc.requests[id]
+	if !found {
+		return req, fmt.Errorf("DualControl.Confirm: request \"%s\" does not exist or has expired", id)
+	} else if req.IsApproved() {
+		return req, fmt.Errorf("DualControl.Confirm: request \"%s\" has already been confirmed by %s", id, req.Approver)
+	} else if req.Requester.IsSameAdmin(approver) {
+		return req, fmt.Errorf("DualControl.Confirm: request \"%s\" must be confirmed by a different administrator than %s", id, req.Requester)
+	}
+	req.Approver = approver
+	req.Approved = time.Now()
+	dc.requests[id] = req
+	return req, nil
+}
+
+/*
+Use up the confirmed request to carry out the action on the disks. The administrator carrying out the action must be
+the one who made the request, and the disks must have been named in the request.
+*/
+func (dc *DualControl) Use(id, action string, uuids []string, admin AdminIdentity) (DualControlRequest, error) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.removeExpired()
+	req, found := dc.requests[id]
+	if id == "" || !found {
+		return req, fmt.Errorf("DualControl.Use: %s requires confirmation by a second administrator, request \"%s\" does not exist or has expired", action, id)
+	} else if !req.IsApproved() {
+		return req, fmt.Errorf("DualControl.Use: request \"%s\" has not yet been confirmed by a second administrator", id)
+	} else if req.Action != action || !req.Requester.IsSameAdmin(admin) || req.Requester.IP != admin.IP {
+		return req, fmt.Errorf("DualControl.Use: request \"%s\" was made for a different action or by a different administrator", id)
+	}
+	covered := make(map[string]bool)
+	for _, uuid := range req.UUIDs {
+		covered[uuid] = true
+	}
+	for _, uuid := range uuids {
+		if !covered[uuid] {
+			return req, fmt.Errorf("DualControl.Use: request \"%s\" does not cover disk \"%s\"", id, uuid)
+		}
+	}
+	delete(dc.requests, id)
+	return req, nil
+}
+
+// Return the identity of the administrator using the RPC connection under the declared name.
+func (rpcConn *CryptServiceConn) getAdminIdentity(name string) AdminIdentity {
+	return AdminIdentity{Name: name, IP: rpcConn.RemoteHost, Cert: rpcConn.Identity.CertFingerprint}
+}
+
+// Use up the confirmed request to carry out the action, and record who asked for and confirmed the action.
+func (rpcConn *CryptServiceConn) useDualControl(id, action string, uuids []string, admin string) (DualControlRequest, error) {
+	return rpcConn.Svc.UseDualControl(id, action, uuids, rpcConn.getAdminIdentity(admin))
+}
+
+// Use up the confirmed request to carry out the action on behalf of the administrator, and record who asked for and confirmed the action.
+func (srv *CryptServer) UseDualControl(id, action string, uuids []string, admin AdminIdentity) (DualControlRequest, error) {
+	req, err := srv.DualControl.Use(id, action, uuids, admin)
+	if err != nil {
+		return req, err
+	}
+	log.Printf("CryptServer.UseDualControl: carrying out %s", req)
+	return req, nil
+}
+
+/*
+Return the dual control action (DUAL_CONTROL_*) that a command (keydb.CMD_*) requires, or an empty string if the command
+does not require confirmation. Self-destruct destroys the disk, and rotate-key hands out the disk key to the computer.
+*/
+func GetCommandDualControlAction(cmdAction string) string {
+	switch cmdAction {
+	case keydb.CMD_SELF_DESTRUCT:
+		return DUAL_CONTROL_SELF_DESTRUCT
+	case keydb.CMD_ROTATE_KEY:
+		return DUAL_CONTROL_RETRIEVE
+	}
+	return ""
+}
+
+/*
+Use up the confirmed request to issue the command to the disks on behalf of the administrator, if dual control is
+enabled and the command requires confirmation. Other commands go ahead right away.
+*/
+func (srv *CryptServer) useCommandDualControl(id, action string, uuids []string, admin AdminIdentity) error {
+	dualAction := GetCommandDualControlAction(action)
+	if !srv.Config.DualControl || dualAction == "" {
+		return nil
+	}
+	_, err := srv.UseDualControl(id, dualAction, uuids, admin)
+	return err
+}
+
+// Confirm a request on behalf of the approver, and record who confirmed the request.
+func (srv *CryptServer) ConfirmDualControl(id string, approver AdminIdentity) (DualControlRequest, error) {
+	req, err := srv.DualControl.Confirm(id, approver)
+	if err != nil {
+		return req, err
+	}
+	log.Printf("CryptServer.ConfirmDualControl: %s", req)
+	for _, uuid := range req.UUIDs {
+		srv.Events.Add(EVENT_DUAL_CONFIRMED, approver.IP, uuid, fmt.Sprintf("%s %s by %s", req.ID, req.Action, approver.Name))
+	}
+	return req, nil
+}
+
+// A request to ask a second administrator to confirm an action on keys.
+type RequestDualControlReq struct {
+	Password HashedPassword // Password is provided by client and validated to grant access to this function.
+	Admin    string         // Admin is the name of the administrator asking for the action.
+	Action   string         // Action is one of DUAL_CONTROL_* actions.
+	UUIDs    []string       // UUIDs are the disks the action applies to.
+	APIToken string         // APIToken identifies the administrator asking for the action, it must be granted admin role.
+}
+
+// The response to a request that asks for a second administrator.
+type RequestDualControlResp struct {
+	Required bool               // Required is false if dual control is disabled, the action may go ahead right away.
+	Request  DualControlRequest // Request awaits confirmation by a second administrator.
+}
+
+/*
+Ask a second administrator to confirm retrieving keys with password, erasing a key, or issuing self-destruct, if dual
+control is enabled. The administrator asking proves who they are by an API token or client certificate granted the admin
+role. Without either, the response only tells whether confirmation is required.
+*/
+func (rpcConn *CryptServiceConn) RequestDualControl(req RequestDualControlReq, resp *RequestDualControlResp) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	if resp.Required = rpcConn.Svc.Config.DualControl; !resp.Required {
+		return nil
+	}
+	cred := Credential{APIToken: req.APIToken, Identity: rpcConn.Identity}
+	if err := rpcConn.Svc.Authorise(cred, ROLE_ADMIN); err != nil {
+		if req.APIToken == "" {
+			return nil
+		}
+		return fmt.Errorf("RequestDualControl: the administrator must present an admin API token or client certificate - %v", err)
+	}
+	requester := rpcConn.Svc.GetAPIAdmin(cred)
+	if req.Admin != "" {
+		requester.Name = req.Admin
+	}
+	var err error
+	resp.Request, err = rpcConn.Svc.RequestDualControl(req.Action, req.UUIDs, requester)
+	return err
+}
+
+// Save a new request of the action on behalf of the requester, and record who asked for the action.
+func (srv *CryptServer) RequestDualControl(action string, uuids []string, requester AdminIdentity) (DualControlRequest, error) {
+	req, err := srv.DualControl.Request(action, uuids, requester)
+	if err != nil {
+		return req, err
+	}
+	log.Printf("CryptServer.RequestDualControl: %s", req)
+	for _, uuid := range req.UUIDs {
+		srv.Events.Add(EVENT_DUAL_REQUESTED, requester.IP, uuid, fmt.Sprintf("%s %s by %s", req.ID, action, requester.Name))
+	}
+	return req, nil
+}
+
+// A request to list, look up, or confirm dual control requests.
+type DualControlReq struct {
+	Password HashedPassword // Password is provided by client and validated to grant access to this function.
+	Admin    string         // Admin is the name of the administrator confirming the request.
+	ID       string         // ID identifies the request.
+	APIToken string         // APIToken identifies the administrator confirming the request, it must be granted admin role.
+}
+
+// Return a request that has not expired or been carried out.
+func (rpcConn *CryptServiceConn) GetDualControl(req DualControlReq, resp *DualControlRequest) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	found := false
+	if *resp, found = rpcConn.Svc.DualControl.Get(req.ID); !found {
+		return fmt.Errorf("GetDualControl: request \"%s\" does not exist or has expired", req.ID)
+	}
+	return nil
+}
+
+/*
+Confirm a request as the second administrator, who must not be the administrator who made the request. The
+administrator is named after the API token or client certificate that grants them the admin role.
+*/
+func (rpcConn *CryptServiceConn) ConfirmDualControl(req DualControlReq, resp *DualControlRequest) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	cred := Credential{APIToken: req.APIToken, Identity: rpcConn.Identity}
+	if err := rpcConn.Svc.Authorise(cred, ROLE_ADMIN); err != nil {
+		return fmt.Errorf("ConfirmDualControl: the second administrator must present an admin API token or client certificate - %v", err)
+	}
+	var err error
+	*resp, err = rpcConn.Svc.ConfirmDualControl(req.ID, rpcConn.Svc.GetAPIAdmin(cred))
+	return err
+}
+
+// Return the requests that have not expired or been carried out, oldest first.
+func (rpcConn *CryptServiceConn) ListDualControl(req DualControlReq, resp *[]DualControlRequest) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	*resp = rpcConn.Svc.DualControl.List()
+	return nil
+}
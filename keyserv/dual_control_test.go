@@ -0,0 +1,94 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDualControl(t *testing.T) {
+	dc := NewDualControl(time.Minute)
+	alice := AdminIdentity{Name: "alice@host1", IP: "10.0.0.1", Grant: "token:alice"}
+	bob := AdminIdentity{Name: "bob@host2", IP: "10.0.0.2", Cert: "abc", Grant: "cn:bob"}
+	if _, err := dc.Request("format", []string{"a"}, alice); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := dc.Request(DUAL_CONTROL_ERASE, nil, alice); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := dc.Request(DUAL_CONTROL_ERASE, []string{"a"}, AdminIdentity{IP: "10.0.0.1", Grant: "token:alice"}); err == nil {
+		t.Fatal("did not error")
+	}
+	// The requester has to prove who they are too, otherwise the approver could make the request under any name
+	for _, requester := range []AdminIdentity{{Name: "alice@host1", IP: "10.0.0.1"}, {Name: "10.0.0.1", IP: "10.0.0.1", Grant: "ip:10.0.0.1"}} {
+		if _, err := dc.Request(DUAL_CONTROL_ERASE, []string{"a"}, requester); err == nil {
+			t.Fatal("did not error", requester)
+		}
+	}
+	req, err := dc.Request(DUAL_CONTROL_RETRIEVE, []string{"b", "a"}, alice)
+	if err != nil || len(req.ID) != 2*LEN_DUAL_CONTROL_ID || req.IsApproved() {
+		t.Fatal(req, err)
+	}
+	// The request cannot be carried out until confirmed
+	if _, err := dc.Use(req.ID, DUAL_CONTROL_RETRIEVE, []string{"a"}, alice); err == nil {
+		t.Fatal("did not error")
+	}
+	// The requester may not confirm it, not even with the name spelt in a different case
+	for _, approver := range []AdminIdentity{alice, {Name: "ALICE@host1", IP: "10.0.0.3", Grant: "token:abc"}, {Name: "bob@host2", IP: "10.0.0.3", Grant: "token:alice"}} {
+		if _, err := dc.Confirm(req.ID, approver); err == nil {
+			t.Fatal("did not error")
+		}
+	}
+	// The approver has to prove who they are rather than use the shared password or address
+	for _, approver := range []AdminIdentity{{Name: "bob@host2", IP: "10.0.0.2"}, {Name: "10.0.0.2", IP: "10.0.0.2", Grant: "ip:10.0.0.2"}} {
+		if _, err := dc.Confirm(req.ID, approver); err == nil {
+			t.Fatal("did not error")
+		}
+	}
+	if _, err := dc.Confirm("does-not-exist", bob); err == nil {
+		t.Fatal("did not error")
+	}
+	if req, err = dc.Confirm(req.ID, bob); err != nil || !req.IsApproved() || req.Approver != bob {
+		t.Fatal(req, err)
+	}
+	if _, err := dc.Confirm(req.ID, AdminIdentity{Name: "carol@host3"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if list := dc.List(); len(list) != 1 || list[0].ID != req.ID {
+		t.Fatal(list)
+	}
+	// Only the requester may carry out the confirmed action on the disks named in the request
+	for _, misuse := range []struct {
+		action string
+		uuids  []string
+		admin  AdminIdentity
+	}{
+		{DUAL_CONTROL_ERASE, []string{"a"}, alice},
+		{DUAL_CONTROL_RETRIEVE, []string{"a", "c"}, alice},
+		{DUAL_CONTROL_RETRIEVE, []string{"a"}, bob},
+		{DUAL_CONTROL_RETRIEVE, []string{"a"}, AdminIdentity{Name: "alice@host1", IP: "10.0.0.9", Grant: "token:alice"}},
+	} {
+		if _, err := dc.Use(req.ID, misuse.action, misuse.uuids, misuse.admin); err == nil {
+			t.Fatal("did not error", misuse)
+		}
+	}
+	if _, err := dc.Use(req.ID, DUAL_CONTROL_RETRIEVE, []string{"a", "b"}, alice); err != nil {
+		t.Fatal(err)
+	}
+	// The request is used up
+	if _, err := dc.Use(req.ID, DUAL_CONTROL_RETRIEVE, []string{"a", "b"}, alice); err == nil {
+		t.Fatal("did not error")
+	}
+	// Nor may the requester confirm under a different name by using the same API grant
+	req, _ = dc.Request(DUAL_CONTROL_SELF_DESTRUCT, []string{"a"}, alice)
+	if _, err := dc.Confirm(req.ID, AdminIdentity{Name: "token:alice", IP: "10.0.0.3", Grant: "token:alice"}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Requests expire
+	dc = NewDualControl(-time.Second)
+	req, _ = dc.Request(DUAL_CONTROL_ERASE, []string{"a"}, alice)
+	if _, found := dc.Get(req.ID); found || len(dc.List()) != 0 {
+		t.Fatal("did not expire")
+	}
+}
@@ -0,0 +1,112 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_LOG_CAPACITY    = 10000              // EVENT_LOG_CAPACITY is the number of most recent events kept in memory.
+	EVENT_KEY_CREATED     = "key-created"      // EVENT_KEY_CREATED is recorded when a client saves a new key.
+	EVENT_KEY_GRANTED     = "key-granted"      // EVENT_KEY_GRANTED is recorded when a client is handed a key.
+	EVENT_KEY_REJECTED    = "key-rejected"     // EVENT_KEY_REJECTED is recorded when a client is refused a key, along with the reason.
+	EVENT_KEY_ERASED      = "key-erased"       // EVENT_KEY_ERASED is recorded when a key is erased.
+	EVENT_KEY_APPROVED    = "key-approved"     // EVENT_KEY_APPROVED is recorded when a computer is approved to retrieve a key.
+	EVENT_LEASE_REVOKED   = "lease-revoked"    // EVENT_LEASE_REVOKED is recorded when an administrator revokes the lease of a key.
+	EVENT_KEY_RELEASED    = "key-released"     // EVENT_KEY_RELEASED is recorded when a client lets go of a key after closing its disk.
+	EVENT_HOST_FENCED     = "host-fenced"      // EVENT_HOST_FENCED is recorded when keys are taken away from a computer fenced by a cluster.
+	EVENT_DUAL_REQUESTED  = "dual-requested"   // EVENT_DUAL_REQUESTED is recorded when an administrator asks for a second administrator.
+	EVENT_DUAL_CONFIRMED  = "dual-confirmed"   // EVENT_DUAL_CONFIRMED is recorded when a second administrator confirms a request.
+	EVENT_KEY_ROTATED     = "key-rotated"      // EVENT_KEY_ROTATED is recorded when a client has replaced the key of a disk.
+	EVENT_BINDING_USED    = "binding-used"     // EVENT_BINDING_USED is recorded when a client recovers a network-bound key.
+	EVENT_CERT_ISSUED     = "cert-issued"      // EVENT_CERT_ISSUED is recorded when the built-in CA issues a client certificate.
+	EVENT_COMMAND_ADDED   = "command-added"    // EVENT_COMMAND_ADDED is recorded when a pending command is issued via API.
+	EVENT_RECORD_UPDATED  = "record-updated"   // EVENT_RECORD_UPDATED is recorded when a record is updated via API.
+	EVENT_HOST_UPDATED    = "host-updated"     // EVENT_HOST_UPDATED is recorded when the tags of a host are updated.
+	EVENT_COMMAND_RESULT  = "command-result"   // EVENT_COMMAND_RESULT is recorded when a client reports result of a pending command.
+	EVENT_API_AUTH_FAILED = "api-auth-failure" // EVENT_API_AUTH_FAILED is recorded when an API request fails authentication.
+)
+
+// Event is a noteworthy action taken by key server upon request from client or API user.
+type Event struct {
+	Seq    int64     `json:"seq"`    // Seq is the sequence number of the event, it starts at 1 every time server starts.
+	Time   time.Time `json:"time"`   // Time is the moment the event took place.
+	Type   string    `json:"type"`   // Type is one of the EVENT_* constants.
+	Host   string    `json:"host"`   // Host is the IP address of the client or API user who caused the event.
+	UUID   string    `json:"uuid"`   // UUID is the disk UUID involved in the event, or empty.
+	Detail string    `json:"detail"` // Detail is a human readable description.
+}
+
+// EventLog keeps the most recent events in memory. The system journal remains the complete record.
+type EventLog struct {
+	mutex   *sync.Mutex
+	lastSeq int64
+	events  []Event
+}
+
+// Return an empty event log.
+func NewEventLog() *EventLog {
+	return &EventLog{mutex: new(sync.Mutex), events: make([]Event, 0, 64)}
+}
+
+// Record an event, the oldest events are discarded when the log is full.
+func (eventLog *EventLog) Add(eventType, host, uuid, detail string) {
+	eventLog.mutex.Lock()
+	defer eventLog.mutex.Unlock()
+	eventLog.lastSeq++
+	if len(eventLog.events) >= EVENT_LOG_CAPACITY {
+		eventLog.events = append(eventLog.events[:0], eventLog.events[len(eventLog.events)-EVENT_LOG_CAPACITY+1:]...)
+	}
+	eventLog.events = append(eventLog.events, Event{
+		Seq:    eventLog.lastSeq,
+		Time:   time.Now(),
+		Type:   eventType,
+		Host:   host,
+		UUID:   uuid,
+		Detail: detail,
+	})
+}
+
+// Return events of sequence number greater than the input, in chronological order.
+func (eventLog *EventLog) Since(seq int64) []Event {
+	eventLog.mutex.Lock()
+	defer eventLog.mutex.Unlock()
+	ret := make([]Event, 0, 16)
+	for _, event := range eventLog.events {
+		if event.Seq > seq {
+			ret = append(ret, event)
+		}
+	}
+	return ret
+}
+
+// CommandSignal wakes up clients that are waiting for pending commands, as soon as a command is issued to any of them.
+type CommandSignal struct {
+	mutex  *sync.Mutex
+	issued chan struct{}
+}
+
+// Return a command signal that nobody has raised yet.
+func NewCommandSignal() *CommandSignal {
+	return &CommandSignal{mutex: new(sync.Mutex), issued: make(chan struct{})}
+}
+
+// Wake up all clients that are currently waiting. They look for their own commands, and wait again if there are none.
+func (signal *CommandSignal) Raise() {
+	signal.mutex.Lock()
+	defer signal.mutex.Unlock()
+	close(signal.issued)
+	signal.issued = make(chan struct{})
+}
+
+/*
+Return a channel that will be closed when the signal is raised next time. Obtain the channel before looking for
+commands, so that a command issued in the meantime is not missed.
+*/
+func (signal *CommandSignal) Wait() <-chan struct{} {
+	signal.mutex.Lock()
+	defer signal.mutex.Unlock()
+	return signal.issued
+}
@@ -0,0 +1,149 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+Issue a command to the disks and computers picked by the selector on behalf of the administrator, and wake up the
+computers waiting for commands. Under dual control, self-destruct commands require the ID of a confirmed request that
+covers all of the selected disks.
+*/
+func (srv *CryptServer) DispatchCommand(admin AdminIdentity, dualControlID string, sel keydb.Selector, action string, params map[string]string,
+	validity time.Duration) (batch string, targets []keydb.Target, err error) {
+	remoteHost := admin.IP
+	uuids := make([]string, 0, 8)
+	for _, target := range srv.KeyDB.SelectTargets(sel) {
+		uuids = append(uuids, target.UUID)
+	}
+	if err = srv.useCommandDualControl(dualControlID, action, uuids, admin); err != nil {
+		return
+	}
+	if batch, targets, err = srv.KeyDB.DispatchCommand(sel, action, params, validity); err != nil {
+		return
+	}
+	log.Printf("CryptServer.DispatchCommand: %s has issued command %s %v to %d disks selected by \"%s\" in batch %s",
+		remoteHost, action, params, len(targets), sel, batch)
+	for _, target := range targets {
+		srv.Events.Add(EVENT_COMMAND_ADDED, remoteHost, target.UUID, fmt.Sprintf("%s to %s in batch %s", action, target.IP, batch))
+	}
+	srv.CommandIssued.Raise()
+	return
+}
+
+// SendFleetCommandReq issues a command to the disks and computers picked by a selector.
+type SendFleetCommandReq struct {
+	Password HashedPassword    // Password is provided by client and validated to grant access to this function.
+	Selector keydb.Selector    // Selector picks the disks and the alive computers holding them.
+	Action   string            // Action is one of keydb.CMD_* actions.
+	Params   map[string]string // Params are the parameters of the action.
+	Validity time.Duration     // Validity determines the point in time the commands expire.
+
+	Admin         string // Admin is the name of the administrator, required by dual control.
+	DualControlID string // DualControlID is the request confirmed by a second administrator, required by dual control of self-destruct.
+}
+
+// SendFleetCommandResp tells the batch ID shared by the commands, and where the commands went.
+type SendFleetCommandResp struct {
+	Batch   string         // Batch identifies the commands in GetBatch.
+	Targets []keydb.Target // Targets are the disks and computers that received the command.
+}
+
+// SendFleetCommand issues a command to each of the disks and computers picked by the selector.
+func (rpcConn *CryptServiceConn) SendFleetCommand(req SendFleetCommandReq, resp *SendFleetCommandResp) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	var err error
+	resp.Batch, resp.Targets, err = rpcConn.Svc.DispatchCommand(rpcConn.getAdminIdentity(req.Admin), req.DualControlID, req.Selector, req.Action, req.Params, req.Validity)
+	return err
+}
+
+/*
+Issue a command to the computer of the IP for a disk on behalf of the administrator at remoteHost, and wake up the
+computer if it is waiting for commands.
+*/
+func (srv *CryptServer) AddCommand(remoteHost, uuid, ip string, cmd keydb.PendingCommand) error {
+	if err := srv.KeyDB.AddPendingCommand(uuid, ip, cmd); err != nil {
+		return err
+	}
+	log.Printf("CryptServer.AddCommand: %s has issued command %s %v to %s for %s", remoteHost, cmd.Command.Action, cmd.Command.Params, ip, uuid)
+	srv.Events.Add(EVENT_COMMAND_ADDED, remoteHost, uuid, fmt.Sprintf("%s to %s", cmd.Command.Action, ip))
+	srv.CommandIssued.Raise()
+	return nil
+}
+
+// SendCommandReq issues a command to a computer for a disk.
+type SendCommandReq struct {
+	Password HashedPassword    // Password is provided by client and validated to grant access to this function.
+	UUID     string            // UUID is the disk the command applies to.
+	IP       string            // IP is the computer that carries out the command, it does not have to be online.
+	Action   string            // Action is one of keydb.CMD_* actions.
+	Params   map[string]string // Params are the parameters of the action.
+	Validity time.Duration     // Validity determines the point in time the command expires.
+
+	Admin         string // Admin is the name of the administrator, required by dual control.
+	DualControlID string // DualControlID is the request confirmed by a second administrator, required by dual control of self-destruct.
+}
+
+/*
+SendCommand issues a command to a computer for a disk, the computer picks it up when it polls. Under dual control,
+self-destruct commands require the ID of a confirmed request.
+*/
+func (rpcConn *CryptServiceConn) SendCommand(req SendCommandReq, _ *DummyAttr) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	cmd, err := keydb.NewPendingCommand(req.UUID, req.IP, req.Action, req.Params, req.Validity)
+	if err != nil {
+		return err
+	}
+	if err := rpcConn.Svc.useCommandDualControl(req.DualControlID, req.Action, []string{req.UUID}, rpcConn.getAdminIdentity(req.Admin)); err != nil {
+		return err
+	}
+	return rpcConn.Svc.AddCommand(rpcConn.RemoteHost, req.UUID, req.IP, cmd)
+}
+
+// GetBatchReq asks for the outcome of the commands issued by SendFleetCommand.
+type GetBatchReq struct {
+	Password HashedPassword // Password is provided by client and validated to grant access to this function.
+	Batch    string         // Batch is the batch ID returned by SendFleetCommand.
+}
+
+// GetBatch returns the aggregated outcome of the commands of a batch.
+func (rpcConn *CryptServiceConn) GetBatch(req GetBatchReq, resp *keydb.BatchSummary) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	summary, found := rpcConn.Svc.KeyDB.SummariseBatch(req.Batch)
+	if !found {
+		return fmt.Errorf("CryptServiceConn.GetBatch: batch \"%s\" does not exist or has expired", req.Batch)
+	}
+	*resp = summary
+	return nil
+}
+
+// TagHostReq replaces the tags of a computer.
+type TagHostReq struct {
+	Password HashedPassword // Password is provided by client and validated to grant access to this function.
+	IP       string         // IP is the computer's IP as seen by key server.
+	Tags     []string       // Tags replace the existing tags of the computer, empty to remove all tags.
+}
+
+// TagHost replaces the tags of a computer, the computer does not have to be seen by key server yet.
+func (rpcConn *CryptServiceConn) TagHost(req TagHostReq, _ *DummyAttr) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	if err := rpcConn.Svc.KeyDB.SetHostTags(req.IP, req.Tags); err != nil {
+		return err
+	}
+	rpcConn.Svc.Events.Add(EVENT_HOST_UPDATED, rpcConn.RemoteHost, "", fmt.Sprintf("%s tags=%s", req.IP, strings.Join(req.Tags, ",")))
+	return nil
+}
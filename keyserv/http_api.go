@@ -0,0 +1,949 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	API_PATH_PREFIX        = "/api/v1"                 // API_PATH_PREFIX is the path prefix of all API endpoints.
+	API_AUTH_BEARER        = "Bearer "                 // API_AUTH_BEARER prefixes the API token in Authorization header.
+	API_MAX_BODY_SIZE      = 64 * 1024                 // API_MAX_BODY_SIZE is the maximum size of request body in bytes.
+	API_MAX_CMD_VALIDITY   = 7 * 24 * time.Hour        // API_MAX_CMD_VALIDITY is the longest validity of a pending command.
+	API_READ_TIMEOUT_SEC   = 30                        // API_READ_TIMEOUT_SEC is the timeout of reading an API request.
+	API_WRITE_TIMEOUT_SEC  = 60                        // API_WRITE_TIMEOUT_SEC is the timeout of writing an API response.
+	API_CONTENT_TYPE_JSON  = "application/json"        // API_CONTENT_TYPE_JSON is the content type of API requests and responses.
+	API_DEFAULT_CMD_EXPIRY = 10 * time.Minute          // API_DEFAULT_CMD_EXPIRY is the validity of a pending command if not specified.
+	API_ALPN_HTTP1         = "http/1.1"                // API_ALPN_HTTP1 is the application protocol served by API.
+	API_OPENAPI_PATH       = "/openapi.json"           // API_OPENAPI_PATH serves the OpenAPI description without authentication.
+	API_REALM              = `Bearer realm="cryptctl"` // API_REALM is sent along with authentication failure.
+)
+
+// API_DASHBOARD_CSP restricts dashboard pages to resources of the key server.
+const API_DASHBOARD_CSP = "default-src 'self'; frame-ancestors 'none'; form-action 'self'"
+
+//go:embed openapi.json
+var OpenAPIDescription []byte // OpenAPIDescription describes the HTTP API in OpenAPI 3 format.
+
+//go:embed dashboard
+var dashboardFiles embed.FS // dashboardFiles are the static web pages of operator dashboard.
+
+// RecordSummary describes a key record without its key.
+type RecordSummary struct {
+	UUID             string              `json:"uuid"`
+	ID               string              `json:"id"`
+	CreationTime     time.Time           `json:"creation_time"`
+	MountPoint       string              `json:"mount_point"`
+	MountOptions     []string            `json:"mount_options"`
+	MaxActive        int                 `json:"max_active"`
+	AliveIntervalSec int                 `json:"alive_interval_sec"`
+	AliveCount       int                 `json:"alive_count"`
+	AllowedClients   []string            `json:"allowed_clients"`
+	Tags             []string            `json:"tags"`
+	Policy           APIPolicy           `json:"policy"`
+	Approvals        []APIApproval       `json:"approvals"`
+	RejectedHosts    []APIRejection      `json:"rejected_hosts"`
+	LastRetrieval    APIHost             `json:"last_retrieval"`
+	AliveHosts       []APIHost           `json:"alive_hosts"`
+	Hosts            []APIHostState      `json:"hosts"`
+	PendingCommands  []APIPendingCommand `json:"pending_commands"`
+}
+
+// APIPolicy restricts the retrieval of a key without password, absent or empty attributes do not restrict anything.
+type APIPolicy struct {
+	NotBefore       *time.Time `json:"not_before"`
+	NotAfter        *time.Time `json:"not_after"`
+	Windows         []string   `json:"windows"`
+	Networks        []string   `json:"networks"`
+	RequireApproval bool       `json:"require_approval"`
+
+	SelfLock         string `json:"self_lock"`
+	SelfLockGraceSec int    `json:"self_lock_grace_sec"`
+	DenyReacquire    bool   `json:"deny_reacquire"`
+	MaxOfflineSec    int    `json:"max_offline_sec"`
+}
+
+// APIRejection is a computer that may not re-acquire a key on its own, because key server has rejected it.
+type APIRejection struct {
+	IP       string    `json:"ip"`
+	Rejected time.Time `json:"rejected"`
+}
+
+// APIApproval lets a computer retrieve a key once, despite the key's policy requiring approval.
+type APIApproval struct {
+	IP         string    `json:"ip"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// APINewApproval is the request body of approving a computer to retrieve a key.
+type APINewApproval struct {
+	IP          string `json:"ip"`
+	ValiditySec int    `json:"validity_sec"`
+}
+
+// APIHost is a computer that has retrieved a key or reported being alive.
+type APIHost struct {
+	UUID     string    `json:"uuid"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// APIHostState is a computer that has reported being alive, along with its recent reports.
+type APIHostState struct {
+	IP       string      `json:"ip"`
+	Hostname string      `json:"hostname"`
+	Alive    bool        `json:"alive"`
+	LastSeen time.Time   `json:"last_seen"`
+	History  []time.Time `json:"history"`
+}
+
+/*
+APILease is the permission of a computer to hold a key online, renewed by the computer's heartbeats. The lease ID is what
+the computer presents to renew and release the lease, hence only administrators are told the ID.
+*/
+type APILease struct {
+	ID       string    `json:"id,omitempty"`
+	Digest   string    `json:"digest"`
+	UUID     string    `json:"uuid"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname"`
+	Granted  time.Time `json:"granted"`
+	Renewed  time.Time `json:"renewed"`
+	Expiry   time.Time `json:"expiry"`
+	ByIP     bool      `json:"by_ip,omitempty"`
+	Cert     string    `json:"cert,omitempty"`
+}
+
+// APIPendingCommand is a pending command issued to a computer.
+type APIPendingCommand struct {
+	UUID         string            `json:"uuid"`
+	IP           string            `json:"ip"`
+	ID           string            `json:"id"`
+	Action       string            `json:"action"`
+	Params       map[string]string `json:"params"`
+	ValidFrom    time.Time         `json:"valid_from"`
+	ValidUntil   time.Time         `json:"valid_until"`
+	Content      interface{}       `json:"content"`
+	SeenByClient bool              `json:"seen_by_client"`
+	ClientResult string            `json:"client_result"`
+	Result       *APICommandResult `json:"result"`
+}
+
+// APICommandResult is the structured outcome of a command, reported by the computer that carried it out.
+type APICommandResult struct {
+	Success  bool              `json:"success"`
+	Message  string            `json:"message"`
+	Details  map[string]string `json:"details"`
+	Finished time.Time         `json:"finished"`
+}
+
+// APINewCommand is the request body of issuing a pending command. Content is the action of earlier API versions.
+type APINewCommand struct {
+	IP          string            `json:"ip"`
+	Action      string            `json:"action"`
+	Params      map[string]string `json:"params"`
+	Content     interface{}       `json:"content"`
+	ValiditySec int               `json:"validity_sec"`
+
+	DualControlID string `json:"dual_control_id"`
+}
+
+// APIRecordUpdate is the request body of updating a record, absent attributes are left unchanged.
+type APIRecordUpdate struct {
+	MaxActive *int      `json:"max_active"`
+	Tags      *[]string `json:"tags"`
+
+	Policy *APIPolicy `json:"policy"`
+}
+
+// APIFleetCommand is the request body of issuing a command to the disks and computers picked by a selector.
+type APIFleetCommand struct {
+	Selector    string            `json:"selector"`
+	Action      string            `json:"action"`
+	Params      map[string]string `json:"params"`
+	ValiditySec int               `json:"validity_sec"`
+
+	DualControlID string `json:"dual_control_id"`
+}
+
+// APIBatch is the aggregated outcome of the commands issued to a fleet.
+type APIBatch struct {
+	Batch     string          `json:"batch"`
+	Action    string          `json:"action"`
+	Waiting   int             `json:"waiting"`
+	Running   int             `json:"running"`
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Commands  []APIBatchEntry `json:"commands"`
+}
+
+// APIBatchEntry is a command of a batch, along with the host name of the computer it went to.
+type APIBatchEntry struct {
+	Hostname string `json:"hostname"`
+	APIPendingCommand
+}
+
+// APIHostTags is a computer that holds encrypted disks online, along with its tags.
+type APIHostTags struct {
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname"`
+	UUIDs    []string  `json:"uuids"`
+	LastSeen time.Time `json:"last_seen"`
+	Tags     []string  `json:"tags"`
+}
+
+// APIHostUpdate is the request body of updating a computer.
+type APIHostUpdate struct {
+	Tags []string `json:"tags"`
+}
+
+// APIFencedHost is a computer fenced by a cluster, along with the disks it no longer holds.
+type APIFencedHost struct {
+	Host  string   `json:"host"`
+	UUIDs []string `json:"uuids"`
+}
+
+// APIAdmin is an administrator who asked for or confirmed a dual control request.
+type APIAdmin struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+// APIDualControl is a request to retrieve or erase keys, or to issue self-destruct, that a second administrator has to confirm.
+type APIDualControl struct {
+	ID        string     `json:"id"`
+	Action    string     `json:"action"`
+	UUIDs     []string   `json:"uuids"`
+	Requester APIAdmin   `json:"requester"`
+	Requested time.Time  `json:"requested"`
+	Approver  *APIAdmin  `json:"approver"`
+	Approved  *time.Time `json:"approved"`
+	Expiry    time.Time  `json:"expiry"`
+}
+
+// APINewDualControl is the request body of asking a second administrator to confirm an action.
+type APINewDualControl struct {
+	Action string   `json:"action"`
+	UUIDs  []string `json:"uuids"`
+}
+
+// APIError is the response body of a failed API request.
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// Return the policy in API representation.
+func SummarisePolicy(pol keydb.Policy) APIPolicy {
+	ret := APIPolicy{
+		Windows:         make([]string, 0, len(pol.Windows)),
+		Networks:        append([]string{}, pol.Networks...),
+		RequireApproval: pol.RequireApproval,
+
+		SelfLock:         pol.SelfLock,
+		SelfLockGraceSec: pol.SelfLockGraceSec,
+		DenyReacquire:    pol.DenyReacquire,
+		MaxOfflineSec:    pol.MaxOfflineSec,
+	}
+	if !pol.NotBefore.IsZero() {
+		ret.NotBefore = &pol.NotBefore
+	}
+	if !pol.NotAfter.IsZero() {
+		ret.NotAfter = &pol.NotAfter
+	}
+	for _, window := range pol.Windows {
+		ret.Windows = append(ret.Windows, window.String())
+	}
+	return ret
+}
+
+// Return the policy described by API representation, or an error if a time window is malformed.
+func (pol APIPolicy) ToPolicy() (ret keydb.Policy, err error) {
+	if pol.NotBefore != nil {
+		ret.NotBefore = *pol.NotBefore
+	}
+	if pol.NotAfter != nil {
+		ret.NotAfter = *pol.NotAfter
+	}
+	for _, windowStr := range pol.Windows {
+		window, err := keydb.ParseTimeWindow(windowStr)
+		if err != nil {
+			return ret, err
+		}
+		ret.Windows = append(ret.Windows, window)
+	}
+	ret.Networks = pol.Networks
+	ret.RequireApproval = pol.RequireApproval
+	ret.SelfLock = pol.SelfLock
+	ret.SelfLockGraceSec = pol.SelfLockGraceSec
+	ret.DenyReacquire = pol.DenyReacquire
+	ret.MaxOfflineSec = pol.MaxOfflineSec
+	return ret, nil
+}
+
+// Return the dual control request in API representation.
+func SummariseDualControl(req DualControlRequest) APIDualControl {
+	ret := APIDualControl{
+		ID:        req.ID,
+		Action:    req.Action,
+		UUIDs:     req.UUIDs,
+		Requester: APIAdmin{Name: req.Requester.Name, IP: req.Requester.IP},
+		Requested: req.Requested,
+		Expiry:    req.Expiry,
+	}
+	if req.IsApproved() {
+		ret.Approver = &APIAdmin{Name: req.Approver.Name, IP: req.Approver.IP}
+		ret.Approved = &req.Approved
+	}
+	return ret
+}
+
+// Return the API representation of a lease, the lease ID is left out unless showID is true.
+func SummariseLease(lease keydb.Lease, showID bool) APILease {
+	ret := APILease{
+		Digest:   lease.Digest(),
+		UUID:     lease.UUID,
+		IP:       lease.IP,
+		Hostname: lease.Hostname,
+		Granted:  lease.Granted,
+		Renewed:  lease.Renewed,
+		Expiry:   lease.Expiry,
+		ByIP:     lease.ByIP,
+		Cert:     lease.Cert,
+	}
+	if showID {
+		ret.ID = lease.ID
+	}
+	return ret
+}
+
+// Return the summary of a record, sorted by host IP.
+func SummariseRecord(rec keydb.Record) RecordSummary {
+	summary := RecordSummary{
+		UUID:             rec.UUID,
+		ID:               rec.ID,
+		CreationTime:     rec.CreationTime,
+		MountPoint:       rec.MountPoint,
+		MountOptions:     rec.MountOptions,
+		MaxActive:        rec.MaxActive,
+		AliveIntervalSec: rec.AliveIntervalSec,
+		AliveCount:       rec.AliveCount,
+		AllowedClients:   rec.AllowedClients,
+		Tags:             rec.Tags,
+		AliveHosts:       make([]APIHost, 0, len(rec.AliveMessages)),
+		Hosts:            make([]APIHostState, 0, len(rec.AliveMessages)),
+		PendingCommands:  make([]APIPendingCommand, 0, len(rec.PendingCommands)),
+	}
+	if summary.Tags == nil {
+		summary.Tags = []string{}
+	}
+	summary.Policy = SummarisePolicy(rec.Policy)
+	summary.Approvals = make([]APIApproval, 0, len(rec.Approvals))
+	for ip, until := range rec.Approvals {
+		if time.Now().Before(until) {
+			summary.Approvals = append(summary.Approvals, APIApproval{IP: ip, ValidUntil: until})
+		}
+	}
+	sort.Slice(summary.Approvals, func(i, j int) bool {
+		return summary.Approvals[i].IP < summary.Approvals[j].IP
+	})
+	summary.RejectedHosts = make([]APIRejection, 0, len(rec.Rejected))
+	for ip, moment := range rec.Rejected {
+		summary.RejectedHosts = append(summary.RejectedHosts, APIRejection{IP: ip, Rejected: moment})
+	}
+	sort.Slice(summary.RejectedHosts, func(i, j int) bool {
+		return summary.RejectedHosts[i].IP < summary.RejectedHosts[j].IP
+	})
+	if rec.LastRetrieval.IP != "" {
+		summary.LastRetrieval = APIHost{
+			UUID:     rec.UUID,
+			IP:       rec.LastRetrieval.IP,
+			Hostname: rec.LastRetrieval.Hostname,
+			LastSeen: time.Unix(rec.LastRetrieval.Timestamp, 0),
+		}
+	}
+	for ip, beats := range rec.AliveMessages {
+		alive, final := rec.IsHostAlive(ip)
+		if alive {
+			summary.AliveHosts = append(summary.AliveHosts, APIHost{
+				UUID:     rec.UUID,
+				IP:       ip,
+				Hostname: final.Hostname,
+				LastSeen: time.Unix(final.Timestamp, 0),
+			})
+		}
+		// A host no longer alive stays listed until key server prunes it, such as on key retrieval or once its lease is gone
+		state := APIHostState{
+			IP:       ip,
+			Hostname: final.Hostname,
+			Alive:    alive,
+			LastSeen: time.Unix(final.Timestamp, 0),
+			History:  make([]time.Time, 0, len(beats)),
+		}
+		for _, beat := range beats {
+			state.History = append(state.History, time.Unix(beat.Timestamp, 0))
+		}
+		summary.Hosts = append(summary.Hosts, state)
+	}
+	sort.Slice(summary.AliveHosts, func(i, j int) bool { return summary.AliveHosts[i].IP < summary.AliveHosts[j].IP })
+	sort.Slice(summary.Hosts, func(i, j int) bool { return summary.Hosts[i].IP < summary.Hosts[j].IP })
+	for ip, cmds := range rec.PendingCommands {
+		for _, cmd := range cmds {
+			if !cmd.IsValid() {
+				continue
+			}
+			summary.PendingCommands = append(summary.PendingCommands, SummariseCommand(rec.UUID, ip, cmd))
+		}
+	}
+	sort.SliceStable(summary.PendingCommands, func(i, j int) bool {
+		return summary.PendingCommands[i].IP < summary.PendingCommands[j].IP
+	})
+	return summary
+}
+
+// Convert a pending command into its API representation.
+func SummariseCommand(uuid, ip string, cmd keydb.PendingCommand) APIPendingCommand {
+	typed := cmd.GetCommand()
+	ret := APIPendingCommand{
+		UUID:         uuid,
+		IP:           ip,
+		ID:           typed.ID,
+		Action:       typed.Action,
+		Params:       typed.Params,
+		ValidFrom:    cmd.ValidFrom,
+		ValidUntil:   cmd.ValidFrom.Add(cmd.Validity),
+		Content:      cmd.Content,
+		SeenByClient: cmd.SeenByClient,
+		ClientResult: cmd.ClientResult,
+	}
+	if ret.Params == nil {
+		ret.Params = map[string]string{}
+	}
+	if !cmd.Result.Finished.IsZero() {
+		ret.Result = &APICommandResult{
+			Success:  cmd.Result.Success,
+			Message:  cmd.Result.Message,
+			Details:  cmd.Result.Details,
+			Finished: cmd.Result.Finished,
+		}
+	}
+	return ret
+}
+
+// Convert the summary of a batch into its API representation.
+func SummariseBatch(summary keydb.BatchSummary) APIBatch {
+	ret := APIBatch{
+		Batch:     summary.Batch,
+		Action:    summary.Action,
+		Waiting:   summary.Waiting,
+		Running:   summary.Running,
+		Succeeded: summary.Succeeded,
+		Failed:    summary.Failed,
+		Commands:  make([]APIBatchEntry, 0, len(summary.Entries)),
+	}
+	for _, entry := range summary.Entries {
+		ret.Commands = append(ret.Commands, APIBatchEntry{
+			Hostname:          entry.Hostname,
+			APIPendingCommand: SummariseCommand(entry.UUID, entry.IP, entry.Command),
+		})
+	}
+	return ret
+}
+
+// Return the TLS configuration for an incoming API connection, client certificate is optional as token works too.
+func (srv *CryptServer) getAPIConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	conf, err := srv.getConfigForClient(hello)
+	if err != nil {
+		return nil, err
+	}
+	conf.NextProtos = []string{API_ALPN_HTTP1}
+	if clientCAs, _ := srv.TLS.ClientCAs(); len(clientCAs) > 0 {
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	} else {
+		conf.ClientAuth = tls.RequestClientCert
+	}
+	return conf, nil
+}
+
+// Start HTTPS listener of management API. The listener uses the same TLS certificate and policy as RPC server.
+func (srv *CryptServer) ListenAPI() error {
+	apiTLSConfig := srv.TLSConfig.Clone()
+	apiTLSConfig.GetConfigForClient = srv.getAPIConfigForClient
+	listener, err := net.Listen("tcp", net.JoinHostPort(srv.Config.Address, strconv.Itoa(srv.Config.APIPort)))
+	if err != nil {
+		return fmt.Errorf("ListenAPI: failed to listen on %s:%d - %v", srv.Config.Address, srv.Config.APIPort, err)
+	}
+	srv.APIListener = tls.NewListener(listener, apiTLSConfig)
+	log.Printf("CryptServer.ListenAPI: HTTP API listening on %s:%d", srv.Config.Address, srv.Config.APIPort)
+	return nil
+}
+
+// Serve HTTP API requests on the listener. Blocks caller until the listener closes.
+func (srv *CryptServer) HandleAPIConnections() {
+	httpServer := &http.Server{
+		Handler:      srv.APIHandler(),
+		ReadTimeout:  API_READ_TIMEOUT_SEC * time.Second,
+		WriteTimeout: API_WRITE_TIMEOUT_SEC * time.Second,
+		ErrorLog:     log.New(log.Writer(), "CryptServer.HandleAPIConnections: ", log.Flags()),
+	}
+	if err := httpServer.Serve(srv.APIListener); err != nil {
+		log.Printf("CryptServer.HandleAPIConnections: quit now - %v", err)
+	}
+}
+
+/*
+apiEndpoint serves an API request and returns an HTTP status code and response body. The name is taken from URL path,
+it is the UUID of a record, the IP of a host, or the ID of a batch.
+*/
+type apiEndpoint func(r *http.Request, name string) (int, interface{})
+
+// Return HTTP handler of all API endpoints.
+func (srv *CryptServer) APIHandler() http.Handler {
+	return http.HandlerFunc(srv.serveAPI)
+}
+
+/*
+Find the endpoint and the role it requires by request method and path. Return HTTP status 404 or 405 if there is not
+a suitable endpoint.
+*/
+func (srv *CryptServer) routeAPI(method, urlPath string) (endpoint apiEndpoint, required Role, name string, status int) {
+	routes := map[string]map[string]apiEndpoint{
+		"/records":            {http.MethodGet: srv.apiListRecords},
+		"/records/*":          {http.MethodGet: srv.apiGetRecord, http.MethodPatch: srv.apiUpdateRecord},
+		"/records/*/commands": {http.MethodPost: srv.apiAddCommand},
+		"/alive":              {http.MethodGet: srv.apiListAlive},
+		"/hosts":              {http.MethodGet: srv.apiListHosts},
+		"/hosts/*":            {http.MethodPatch: srv.apiUpdateHost},
+		"/hosts/*/fence":      {http.MethodPost: srv.apiFenceHost},
+		"/commands":           {http.MethodGet: srv.apiListCommands, http.MethodPost: srv.apiDispatchCommand},
+		"/batches/*":          {http.MethodGet: srv.apiGetBatch},
+		"/events":             {http.MethodGet: srv.apiListEvents},
+
+		"/records/*/approvals": {http.MethodPost: srv.apiApproveRetrieval},
+		"/dual-control":        {http.MethodGet: srv.apiListDualControl, http.MethodPost: srv.apiRequestDualControl},
+		"/dual-control/*":      {http.MethodPost: srv.apiConfirmDualControl},
+		"/leases":              {http.MethodGet: srv.apiListLeases},
+		"/leases/*":            {http.MethodDelete: srv.apiRevokeLease},
+	}
+	if !strings.HasPrefix(urlPath, API_PATH_PREFIX+"/") {
+		return nil, ROLE_NONE, "", http.StatusNotFound
+	}
+	segments := strings.Split(strings.TrimPrefix(urlPath, API_PATH_PREFIX), "/")
+	if len(segments) > 2 && (segments[1] == "records" || segments[1] == "hosts" || segments[1] == "batches" || segments[1] == "dual-control" || segments[1] == "leases") && segments[2] != "" {
+		// Second segment of the path is the UUID, IP, batch ID, dual control request ID, or lease ID
+		name = segments[2]
+		segments[2] = "*"
+	}
+	methods, found := routes[strings.Join(segments, "/")]
+	if !found {
+		return nil, ROLE_NONE, "", http.StatusNotFound
+	}
+	if endpoint, found = methods[method]; !found {
+		return nil, ROLE_NONE, "", http.StatusMethodNotAllowed
+	}
+	required = ROLE_READER
+	if method != http.MethodGet {
+		required = ROLE_ADMIN
+	}
+	return endpoint, required, name, http.StatusOK
+}
+
+// Return the IP address of API user.
+func getAPIRemoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Return the API token and client certificate presented by API user.
+func getAPICredential(r *http.Request) Credential {
+	remoteHost := getAPIRemoteHost(r)
+	cred := Credential{Identity: keydb.ClientIdentity{IP: remoteHost}}
+	if r.TLS != nil {
+		cred.Identity = GetClientIdentity(remoteHost, *r.TLS)
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, API_AUTH_BEARER) {
+		cred.APIToken = strings.TrimSpace(strings.TrimPrefix(auth, API_AUTH_BEARER))
+	}
+	return cred
+}
+
+/*
+Serve the static pages of operator dashboard. The pages do not carry any data, they call the API with the user's own
+credentials, hence they are served without authentication.
+*/
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	pages, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", API_DASHBOARD_CSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.FileServer(http.FS(pages)).ServeHTTP(w, r)
+}
+
+/*
+Serve an API request after authentication and role check. The user may authenticate via an API token in Authorization
+header, or via a client certificate. Only the OpenAPI description and dashboard pages are served without authentication.
+*/
+func (srv *CryptServer) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !strings.HasPrefix(r.URL.Path, API_PATH_PREFIX+"/") {
+		serveDashboard(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", API_CONTENT_TYPE_JSON)
+	if r.Method == http.MethodGet && r.URL.Path == API_PATH_PREFIX+API_OPENAPI_PATH {
+		w.Write(OpenAPIDescription)
+		return
+	}
+	remoteHost := getAPIRemoteHost(r)
+	cred := getAPICredential(r)
+	var body interface{}
+	endpoint, required, name, status := srv.routeAPI(r.Method, r.URL.Path)
+	if role, err := srv.GetRole(cred); err != nil || role == ROLE_NONE {
+		srv.Events.Add(EVENT_API_AUTH_FAILED, remoteHost, "", r.Method+" "+r.URL.Path)
+		w.Header().Set("WWW-Authenticate", API_REALM)
+		status, body = http.StatusUnauthorized, APIError{Error: "authentication is required"}
+	} else if status != http.StatusOK {
+		body = APIError{Error: http.StatusText(status)}
+	} else if role < required {
+		status, body = http.StatusForbidden, APIError{Error: fmt.Sprintf("the function requires %s role", required)}
+	} else {
+		status, body = endpoint(r, name)
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("CryptServer.serveAPI: failed to respond to %s - %v", remoteHost, err)
+	}
+}
+
+// Return summary of all records sorted by creation time.
+func (srv *CryptServer) apiListRecords(_ *http.Request, _ string) (int, interface{}) {
+	records := srv.KeyDB.List()
+	ret := make([]RecordSummary, 0, len(records))
+	for _, rec := range records {
+		ret = append(ret, SummariseRecord(rec))
+	}
+	return http.StatusOK, ret
+}
+
+// Return summary of a record.
+func (srv *CryptServer) apiGetRecord(_ *http.Request, uuid string) (int, interface{}) {
+	rec, found := srv.KeyDB.GetByUUID(uuid)
+	if !found {
+		return http.StatusNotFound, APIError{Error: "record does not exist"}
+	}
+	return http.StatusOK, SummariseRecord(rec)
+}
+
+// Update attributes of a record, only the maximum number of active users, tags, and policy may be updated at the moment.
+func (srv *CryptServer) apiUpdateRecord(r *http.Request, uuid string) (int, interface{}) {
+	var req APIRecordUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, API_MAX_BODY_SIZE)).Decode(&req); err != nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("malformed request - %v", err)}
+	}
+	if _, found := srv.KeyDB.GetByUUID(uuid); !found {
+		return http.StatusNotFound, APIError{Error: "record does not exist"}
+	}
+	if req.MaxActive != nil {
+		if *req.MaxActive < 0 {
+			return http.StatusBadRequest, APIError{Error: "max_active must be 0 (unlimited) or greater"}
+		}
+		if err := srv.KeyDB.SetMaxActive(uuid, *req.MaxActive); err != nil {
+			return http.StatusInternalServerError, APIError{Error: err.Error()}
+		}
+		remoteHost := getAPIRemoteHost(r)
+		log.Printf("CryptServer.apiUpdateRecord: %s has set maximum active users of %s to %d", remoteHost, uuid, *req.MaxActive)
+		srv.Events.Add(EVENT_RECORD_UPDATED, remoteHost, uuid, fmt.Sprintf("max_active=%d", *req.MaxActive))
+	}
+	if req.Tags != nil {
+		if err := srv.KeyDB.SetTags(uuid, *req.Tags); err != nil {
+			return http.StatusBadRequest, APIError{Error: err.Error()}
+		}
+		remoteHost := getAPIRemoteHost(r)
+		log.Printf("CryptServer.apiUpdateRecord: %s has set tags of %s to %v", remoteHost, uuid, *req.Tags)
+		srv.Events.Add(EVENT_RECORD_UPDATED, remoteHost, uuid, "tags="+strings.Join(*req.Tags, ","))
+	}
+	if req.Policy != nil {
+		pol, err := req.Policy.ToPolicy()
+		if err == nil {
+			err = srv.KeyDB.SetPolicy(uuid, pol)
+		}
+		if err != nil {
+			return http.StatusBadRequest, APIError{Error: err.Error()}
+		}
+		remoteHost := getAPIRemoteHost(r)
+		log.Printf("CryptServer.apiUpdateRecord: %s has set policy of %s to %s", remoteHost, uuid, pol)
+		srv.Events.Add(EVENT_RECORD_UPDATED, remoteHost, uuid, "policy="+pol.String())
+	}
+	rec, _ := srv.KeyDB.GetByUUID(uuid)
+	return http.StatusOK, SummariseRecord(rec)
+}
+
+// Return all hosts that are currently alive, and the records they hold.
+func (srv *CryptServer) apiListAlive(_ *http.Request, _ string) (int, interface{}) {
+	ret := make([]APIHost, 0, 16)
+	for _, rec := range srv.KeyDB.List() {
+		ret = append(ret, SummariseRecord(rec).AliveHosts...)
+	}
+	return http.StatusOK, ret
+}
+
+// Return all pending commands that are still valid.
+func (srv *CryptServer) apiListCommands(_ *http.Request, _ string) (int, interface{}) {
+	ret := make([]APIPendingCommand, 0, 16)
+	for _, rec := range srv.KeyDB.List() {
+		ret = append(ret, SummariseRecord(rec).PendingCommands...)
+	}
+	return http.StatusOK, ret
+}
+
+// Issue a pending command to a computer, the computer picks it up when it polls.
+func (srv *CryptServer) apiAddCommand(r *http.Request, uuid string) (int, interface{}) {
+	var req APINewCommand
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, API_MAX_BODY_SIZE)).Decode(&req); err != nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("malformed request - %v", err)}
+	}
+	if net.ParseIP(req.IP) == nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("\"%s\" is not an IP address", req.IP)}
+	}
+	if req.Action == "" {
+		// Earlier API versions call the action content
+		if content, isStr := req.Content.(string); isStr {
+			req.Action = content
+		}
+	}
+	validity, err := getAPICommandValidity(req.ValiditySec)
+	if err != nil {
+		return http.StatusBadRequest, APIError{Error: err.Error()}
+	}
+	cmd, err := keydb.NewPendingCommand(uuid, req.IP, req.Action, req.Params, validity)
+	if err != nil {
+		return http.StatusBadRequest, APIError{Error: err.Error()}
+	}
+	if _, found := srv.KeyDB.GetByUUID(uuid); !found {
+		return http.StatusNotFound, APIError{Error: "record does not exist"}
+	}
+	if err := srv.useCommandDualControl(req.DualControlID, req.Action, []string{uuid}, srv.GetAPIAdmin(getAPICredential(r))); err != nil {
+		return http.StatusForbidden, APIError{Error: err.Error()}
+	}
+	if err := srv.AddCommand(getAPIRemoteHost(r), uuid, req.IP, cmd); err != nil {
+		return http.StatusInternalServerError, APIError{Error: err.Error()}
+	}
+	return http.StatusCreated, SummariseCommand(uuid, req.IP, cmd)
+}
+
+// Approve a computer to retrieve a key once, despite the key's policy requiring approval.
+func (srv *CryptServer) apiApproveRetrieval(r *http.Request, uuid string) (int, interface{}) {
+	var req APINewApproval
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, API_MAX_BODY_SIZE)).Decode(&req); err != nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("malformed request - %v", err)}
+	}
+	if net.ParseIP(req.IP) == nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("\"%s\" is not an IP address", req.IP)}
+	}
+	if _, found := srv.KeyDB.GetByUUID(uuid); !found {
+		return http.StatusNotFound, APIError{Error: "record does not exist"}
+	}
+	if err := srv.ApproveRetrieval(getAPIRemoteHost(r), uuid, req.IP, time.Duration(req.ValiditySec)*time.Second); err != nil {
+		return http.StatusBadRequest, APIError{Error: err.Error()}
+	}
+	rec, _ := srv.KeyDB.GetByUUID(uuid)
+	return http.StatusCreated, APIApproval{IP: req.IP, ValidUntil: rec.Approvals[req.IP]}
+}
+
+// Return the dual control requests that have not expired or been carried out, oldest first.
+func (srv *CryptServer) apiListDualControl(_ *http.Request, _ string) (int, interface{}) {
+	reqs := srv.DualControl.List()
+	ret := make([]APIDualControl, 0, len(reqs))
+	for _, req := range reqs {
+		ret = append(ret, SummariseDualControl(req))
+	}
+	return http.StatusOK, ret
+}
+
+/*
+Ask a second administrator to confirm an action on keys or a self-destruct command, on behalf of the administrator named
+after the API token or client certificate. It is an error if dual control is disabled.
+*/
+func (srv *CryptServer) apiRequestDualControl(r *http.Request, _ string) (int, interface{}) {
+	var req APINewDualControl
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, API_MAX_BODY_SIZE)).Decode(&req); err != nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("malformed request - %v", err)}
+	}
+	if !srv.Config.DualControl {
+		return http.StatusConflict, APIError{Error: "dual control is disabled, the action may go ahead right away"}
+	}
+	dualReq, err := srv.RequestDualControl(req.Action, req.UUIDs, srv.GetAPIAdmin(getAPICredential(r)))
+	if err != nil {
+		return http.StatusBadRequest, APIError{Error: err.Error()}
+	}
+	return http.StatusCreated, SummariseDualControl(dualReq)
+}
+
+/*
+Confirm a dual control request as the second administrator, who is named after the API token or client certificate.
+The administrator who made the request may not confirm it.
+*/
+func (srv *CryptServer) apiConfirmDualControl(r *http.Request, id string) (int, interface{}) {
+	if _, found := srv.DualControl.Get(id); !found {
+		return http.StatusNotFound, APIError{Error: "request does not exist or has expired"}
+	}
+	req, err := srv.ConfirmDualControl(id, srv.GetAPIAdmin(getAPICredential(r)))
+	if err != nil {
+		return http.StatusConflict, APIError{Error: err.Error()}
+	}
+	return http.StatusOK, SummariseDualControl(req)
+}
+
+/*
+Return the valid leases, or only those of the disk given in parameter "uuid", sorted by UUID and then by grant time.
+Only administrators are told the lease IDs.
+*/
+func (srv *CryptServer) apiListLeases(r *http.Request, _ string) (int, interface{}) {
+	role, _ := srv.GetRole(getAPICredential(r))
+	leases := srv.KeyDB.ListLeases(r.URL.Query().Get("uuid"))
+	ret := make([]APILease, 0, len(leases))
+	for _, lease := range leases {
+		ret = append(ret, SummariseLease(lease, role >= ROLE_ADMIN))
+	}
+	return http.StatusOK, ret
+}
+
+// Revoke a lease, the computer holding it will be told to let go of the key in its next heartbeat.
+func (srv *CryptServer) apiRevokeLease(r *http.Request, id string) (int, interface{}) {
+	lease, err := srv.RevokeLease(getAPIRemoteHost(r), id)
+	if err != nil {
+		return http.StatusNotFound, APIError{Error: err.Error()}
+	}
+	return http.StatusOK, SummariseLease(lease, true)
+}
+
+/*
+Take away all keys from a computer fenced by a cluster, identified by its IP, or by a host name that leads to a single
+IP. It is not an error if the computer holds no key.
+*/
+func (srv *CryptServer) apiFenceHost(r *http.Request, host string) (int, interface{}) {
+	fenced, err := srv.FenceHost(getAPIRemoteHost(r), host)
+	if err != nil {
+		return http.StatusConflict, APIError{Error: err.Error()}
+	}
+	return http.StatusOK, APIFencedHost{Host: host, UUIDs: fenced}
+}
+
+// Return the validity of a command given in seconds, or the default validity if it is not given.
+func getAPICommandValidity(validitySec int) (time.Duration, error) {
+	validity := time.Duration(validitySec) * time.Second
+	if validity <= 0 {
+		return API_DEFAULT_CMD_EXPIRY, nil
+	} else if validity > API_MAX_CMD_VALIDITY {
+		return 0, fmt.Errorf("validity must not exceed %d seconds", int(API_MAX_CMD_VALIDITY.Seconds()))
+	}
+	return validity, nil
+}
+
+// Issue a command to each of the disks and computers picked by a selector, and return the summary of the batch.
+func (srv *CryptServer) apiDispatchCommand(r *http.Request, _ string) (int, interface{}) {
+	var req APIFleetCommand
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, API_MAX_BODY_SIZE)).Decode(&req); err != nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("malformed request - %v", err)}
+	}
+	sel, err := keydb.ParseSelector(req.Selector)
+	if err != nil {
+		return http.StatusBadRequest, APIError{Error: err.Error()}
+	}
+	validity, err := getAPICommandValidity(req.ValiditySec)
+	if err != nil {
+		return http.StatusBadRequest, APIError{Error: err.Error()}
+	}
+	batch, _, err := srv.DispatchCommand(srv.GetAPIAdmin(getAPICredential(r)), req.DualControlID, sel, req.Action, req.Params, validity)
+	if err != nil {
+		return http.StatusBadRequest, APIError{Error: err.Error()}
+	}
+	summary, _ := srv.KeyDB.SummariseBatch(batch)
+	return http.StatusCreated, SummariseBatch(summary)
+}
+
+// Return the aggregated outcome of the commands of a batch.
+func (srv *CryptServer) apiGetBatch(_ *http.Request, batch string) (int, interface{}) {
+	summary, found := srv.KeyDB.SummariseBatch(batch)
+	if !found {
+		return http.StatusNotFound, APIError{Error: "batch does not exist or has expired"}
+	}
+	return http.StatusOK, SummariseBatch(summary)
+}
+
+// Return all computers that have sent a heartbeat or carry tags, sorted by IP.
+func (srv *CryptServer) apiListHosts(_ *http.Request, _ string) (int, interface{}) {
+	hosts := srv.KeyDB.ListHosts()
+	ret := make([]APIHostTags, 0, len(hosts))
+	for _, host := range hosts {
+		ret = append(ret, summariseHost(host))
+	}
+	return http.StatusOK, ret
+}
+
+// Convert a host into its API representation. A host that has only been tagged is never seen.
+func summariseHost(host keydb.Host) APIHostTags {
+	ret := APIHostTags{IP: host.IP, Hostname: host.Hostname, UUIDs: host.UUIDs, Tags: host.Tags}
+	if host.LastSeen > 0 {
+		ret.LastSeen = time.Unix(host.LastSeen, 0)
+	}
+	if ret.Tags == nil {
+		ret.Tags = []string{}
+	}
+	return ret
+}
+
+// Replace the tags of a computer, the computer does not have to be seen by key server yet.
+func (srv *CryptServer) apiUpdateHost(r *http.Request, ip string) (int, interface{}) {
+	var req APIHostUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, API_MAX_BODY_SIZE)).Decode(&req); err != nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("malformed request - %v", err)}
+	}
+	if net.ParseIP(ip) == nil {
+		return http.StatusBadRequest, APIError{Error: fmt.Sprintf("\"%s\" is not an IP address", ip)}
+	}
+	if err := srv.KeyDB.SetHostTags(ip, req.Tags); err != nil {
+		return http.StatusBadRequest, APIError{Error: err.Error()}
+	}
+	remoteHost := getAPIRemoteHost(r)
+	log.Printf("CryptServer.apiUpdateHost: %s has set tags of %s to %v", remoteHost, ip, req.Tags)
+	srv.Events.Add(EVENT_HOST_UPDATED, remoteHost, "", fmt.Sprintf("%s tags=%s", ip, strings.Join(req.Tags, ",")))
+	for _, host := range srv.KeyDB.ListHosts() {
+		if host.IP == ip {
+			return http.StatusOK, summariseHost(host)
+		}
+	}
+	return http.StatusInternalServerError, APIError{Error: "host disappeared"}
+}
+
+// Return the events that took place after the sequence number given in parameter "since".
+func (srv *CryptServer) apiListEvents(r *http.Request, _ string) (int, interface{}) {
+	var since int64
+	if param := r.URL.Query().Get("since"); param != "" {
+		var err error
+		if since, err = strconv.ParseInt(param, 10, 64); err != nil {
+			return http.StatusBadRequest, APIError{Error: "parameter \"since\" must be a sequence number"}
+		}
+	}
+	return http.StatusOK, srv.Events.Since(since)
+}
@@ -0,0 +1,373 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAPIGrant(t *testing.T) {
+	if role, entry, err := ParseAPIGrant("Admin:cn:Client.example.com"); err != nil || role != ROLE_ADMIN || entry != "cn:client.example.com" {
+		t.Fatal(role, entry, err)
+	}
+	if role, entry, err := ParseAPIGrant("reader:ip:10.0.0.0/8"); err != nil || role != ROLE_READER || entry != "ip:10.0.0.0/8" {
+		t.Fatal(role, entry, err)
+	}
+	for _, bad := range []string{"", "admin", "none:cn:a", "root:cn:a", "admin:cn:", "reader:token:abc"} {
+		if _, _, err := ParseAPIGrant(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestHTTPAPI(t *testing.T) {
+	fixture := NewTestTLS(t, "localhost")
+	defer os.RemoveAll(fixture.Dir)
+	ca := fixture.CA
+	readerToken, readerEntry, err := keydb.NewClientToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminToken, adminEntry, err := keydb.NewClientToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysconf := fixture.SysConf()
+	sysconf.Set(SRV_CONF_CA_CERT, fixture.CACert)
+	sysconf.Set(SRV_CONF_CA_KEY, fixture.CAKey)
+	sysconf.Set(SRV_CONF_API_PORT, SRV_DEFAULT_PORT+4)
+	sysconf.SetStrArray(SRV_CONF_API_GRANTS, []string{"reader:" + readerEntry, "admin:" + adminEntry, "admin:cn:cmdb.example.com"})
+	srvConf := CryptServiceConfig{}
+	if err := srvConf.ReadFromSysconfig(sysconf); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewCryptServer(srvConf, Mailer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ListenAPI(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.APIListener.Close()
+	go srv.HandleAPIConnections()
+	if _, err := srv.KeyDB.Upsert(keydb.Record{
+		UUID:             "aaa",
+		Key:              []byte("secret key"),
+		MountPoint:       "/a",
+		AliveIntervalSec: 1,
+		AliveCount:       60,
+		AliveMessages:    map[string][]keydb.AliveMessage{"10.0.0.1": {{Hostname: "host1", IP: "10.0.0.1", Timestamp: time.Now().Unix()}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.CertPEM)
+	baseURL := fmt.Sprintf("https://localhost:%d%s", SRV_DEFAULT_PORT+4, API_PATH_PREFIX)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	call := func(client *http.Client, method, url, token, body string, out interface{}) int {
+		req, err := http.NewRequest(method, baseURL+url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", API_AUTH_BEARER+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(content, []byte("secret key")) || bytes.Contains(content, []byte(`"key"`)) {
+			t.Fatal("key is revealed", string(content))
+		}
+		if out != nil {
+			if err := json.Unmarshal(content, out); err != nil {
+				t.Fatal(err, string(content))
+			}
+		}
+		return resp.StatusCode
+	}
+
+	// OpenAPI description does not require authentication
+	var description map[string]interface{}
+	if status := call(httpClient, "GET", API_OPENAPI_PATH, "", "", &description); status != http.StatusOK || description["openapi"] == nil {
+		t.Fatal(status, description)
+	}
+	// Authentication is required
+	if status := call(httpClient, "GET", "/records", "", "", nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status := call(httpClient, "GET", "/records", "wrong token", "", nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// Reader may query
+	var records []RecordSummary
+	if status := call(httpClient, "GET", "/records", readerToken, "", &records); status != http.StatusOK ||
+		len(records) != 1 || records[0].UUID != "aaa" || records[0].MountPoint != "/a" {
+		t.Fatal(status, records)
+	}
+	var record RecordSummary
+	if status := call(httpClient, "GET", "/records/aaa", readerToken, "", &record); status != http.StatusOK || record.UUID != "aaa" {
+		t.Fatal(status, record)
+	}
+	if len(record.Hosts) != 1 || !record.Hosts[0].Alive || record.Hosts[0].Hostname != "host1" || len(record.Hosts[0].History) != 1 {
+		t.Fatal(record.Hosts)
+	}
+	if status := call(httpClient, "GET", "/records/doesnotexist", readerToken, "", nil); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	// Only admin may update a record
+	if status := call(httpClient, "PATCH", "/records/aaa", readerToken, `{"max_active": 3}`, nil); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	if status := call(httpClient, "PATCH", "/records/aaa", adminToken, `{"max_active": -1}`, nil); status != http.StatusBadRequest {
+		t.Fatal(status)
+	}
+	if status := call(httpClient, "PATCH", "/records/aaa", adminToken, `{"max_active": 3}`, &record); status != http.StatusOK || record.MaxActive != 3 {
+		t.Fatal(status, record)
+	}
+	if rec, _ := srv.KeyDB.GetByUUID("aaa"); rec.MaxActive != 3 {
+		t.Fatal(rec.MaxActive)
+	}
+	var hosts []APIHost
+	if status := call(httpClient, "GET", "/alive", readerToken, "", &hosts); status != http.StatusOK ||
+		len(hosts) != 1 || hosts[0].IP != "10.0.0.1" || hosts[0].Hostname != "host1" {
+		t.Fatal(status, hosts)
+	}
+	// Reader may not issue commands
+	newCmd := `{"ip": "10.0.0.1", "content": "umount", "validity_sec": 60}`
+	if status := call(httpClient, "POST", "/records/aaa/commands", readerToken, newCmd, nil); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	// Admin may issue commands
+	var cmd APIPendingCommand
+	if status := call(httpClient, "POST", "/records/aaa/commands", adminToken, newCmd, &cmd); status != http.StatusCreated ||
+		cmd.Content != "umount" || cmd.ValidUntil.Sub(cmd.ValidFrom) != time.Minute {
+		t.Fatal(status, cmd)
+	}
+	for _, badCmd := range []string{`{"ip": "not ip", "content": "umount"}`, `{"ip": "10.0.0.1", "content": 1}`, `{"ip": "10.0.0.1", "content": "umount", "validity_sec": 99999999}`, `garbage`} {
+		if status := call(httpClient, "POST", "/records/aaa/commands", adminToken, badCmd, nil); status != http.StatusBadRequest {
+			t.Fatal(status, badCmd)
+		}
+	}
+	if status := call(httpClient, "POST", "/records/doesnotexist/commands", adminToken, newCmd, nil); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	// Administrator may also authenticate via client certificate
+	csr, keyPEM, err := NewClientCSR("cmdb.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _, err := ca.SignClientCSR(csr, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}}
+	newCmd = `{"ip": "10.0.0.2", "content": "mount"}`
+	if status := call(certClient, "POST", "/records/aaa/commands", "", newCmd, nil); status != http.StatusCreated {
+		t.Fatal(status)
+	}
+	var cmds []APIPendingCommand
+	if status := call(httpClient, "GET", "/commands", readerToken, "", &cmds); status != http.StatusOK ||
+		len(cmds) != 2 || cmds[0].IP != "10.0.0.1" || cmds[1].IP != "10.0.0.2" || cmds[1].Content != "mount" {
+		t.Fatal(status, cmds)
+	}
+	// Events
+	var events []Event
+	if status := call(httpClient, "GET", "/events?since=2", readerToken, "", &events); status != http.StatusOK ||
+		len(events) != 3 || events[0].Type != EVENT_RECORD_UPDATED || events[1].Type != EVENT_COMMAND_ADDED || events[2].UUID != "aaa" {
+		t.Fatal(status, events)
+	}
+	if status := call(httpClient, "GET", "/events?since=abc", readerToken, "", nil); status != http.StatusBadRequest {
+		t.Fatal(status)
+	}
+	// Fleet-wide commands select computers and disks by tags
+	if status := call(httpClient, "PATCH", "/hosts/10.0.0.1", readerToken, `{"tags": ["prod-hana"]}`, nil); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	for _, badTags := range []string{`{"tags": ["a=b"]}`, `garbage`} {
+		if status := call(httpClient, "PATCH", "/hosts/10.0.0.1", adminToken, badTags, nil); status != http.StatusBadRequest {
+			t.Fatal(status, badTags)
+		}
+	}
+	var tagged APIHostTags
+	if status := call(httpClient, "PATCH", "/hosts/10.0.0.1", adminToken, `{"tags": ["prod-hana"]}`, &tagged); status != http.StatusOK ||
+		!reflect.DeepEqual(tagged.Tags, []string{"prod-hana"}) || !tagged.LastSeen.IsZero() {
+		t.Fatal(status, tagged)
+	}
+	var hostTags []APIHostTags
+	if status := call(httpClient, "GET", "/hosts", readerToken, "", &hostTags); status != http.StatusOK || len(hostTags) != 1 || hostTags[0].IP != "10.0.0.1" {
+		t.Fatal(status, hostTags)
+	}
+	if status := call(httpClient, "PATCH", "/records/aaa", adminToken, `{"tags": ["sap"]}`, &record); status != http.StatusOK ||
+		!reflect.DeepEqual(record.Tags, []string{"sap"}) || record.MaxActive != 3 {
+		t.Fatal(status, record)
+	}
+	for _, badFleetCmd := range []string{`{"selector": "", "action": "umount"}`, `{"selector": "host-tag=dev", "action": "umount"}`, `{"selector": "tag=sap", "action": "format"}`} {
+		if status := call(httpClient, "POST", "/commands", adminToken, badFleetCmd, nil); status != http.StatusBadRequest {
+			t.Fatal(status, badFleetCmd)
+		}
+	}
+	var batch APIBatch
+	if status := call(httpClient, "POST", "/commands", adminToken, `{"selector": "host-tag=prod-hana tag=sap", "action": "report-status"}`, &batch); status != http.StatusCreated ||
+		batch.Action != keydb.CMD_REPORT_STATUS || batch.Waiting != 1 || len(batch.Commands) != 1 || batch.Commands[0].Hostname != "host1" || batch.Commands[0].UUID != "aaa" {
+		t.Fatal(status, batch)
+	}
+	var sameBatch APIBatch
+	if status := call(httpClient, "GET", "/batches/"+batch.Batch, readerToken, "", &sameBatch); status != http.StatusOK || !reflect.DeepEqual(sameBatch, batch) {
+		t.Fatal(status, sameBatch)
+	}
+	if status := call(httpClient, "GET", "/batches/doesnotexist", readerToken, "", nil); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	// Usage policy restricts retrieval without password
+	for _, badPolicy := range []string{`{"policy": {"windows": ["mon-fri"]}}`, `{"policy": {"networks": ["10.0.0.0/33"]}}`, `{"policy": {"self_lock": "explode"}}`} {
+		if status := call(httpClient, "PATCH", "/records/aaa", adminToken, badPolicy, nil); status != http.StatusBadRequest {
+			t.Fatal(status, badPolicy)
+		}
+	}
+	policy := `{"policy": {"not_after": "2099-01-01T00:00:00Z", "windows": ["mon-fri 08:00-18:00"], "networks": ["10.0.0.0/8"], "require_approval": true,
+		"self_lock": "lock", "self_lock_grace_sec": 30, "deny_reacquire": true, "max_offline_sec": 600}}`
+	if status := call(httpClient, "PATCH", "/records/aaa", adminToken, policy, &record); status != http.StatusOK || record.Policy.NotBefore != nil ||
+		record.Policy.SelfLock != keydb.SELF_LOCK_LOCK || record.Policy.SelfLockGraceSec != 30 || !record.Policy.DenyReacquire || len(record.RejectedHosts) != 0 || record.Policy.MaxOfflineSec != 600 ||
+		!record.Policy.NotAfter.Equal(time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)) || !reflect.DeepEqual(record.Policy.Windows, []string{"mon,tue,wed,thu,fri 08:00-18:00"}) ||
+		!reflect.DeepEqual(record.Policy.Networks, []string{"10.0.0.0/8"}) || !record.Policy.RequireApproval || !reflect.DeepEqual(record.Tags, []string{"sap"}) {
+		t.Fatal(status, record)
+	}
+	if status := call(httpClient, "POST", "/records/aaa/approvals", readerToken, `{"ip": "10.0.0.1"}`, nil); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	if status := call(httpClient, "POST", "/records/aaa/approvals", adminToken, `{"ip": "host1"}`, nil); status != http.StatusBadRequest {
+		t.Fatal(status)
+	}
+	var approval APIApproval
+	if status := call(httpClient, "POST", "/records/aaa/approvals", adminToken, `{"ip": "10.0.0.1", "validity_sec": 60}`, &approval); status != http.StatusCreated ||
+		approval.IP != "10.0.0.1" || approval.ValidUntil.Before(time.Now()) {
+		t.Fatal(status, approval)
+	}
+	if status := call(httpClient, "GET", "/records/aaa", readerToken, "", &record); status != http.StatusOK || len(record.Approvals) != 1 || record.Approvals[0].IP != "10.0.0.1" {
+		t.Fatal(status, record)
+	}
+	// A second administrator confirms requests under dual control
+	newDualReq := `{"action": "erase-key", "uuids": ["aaa"]}`
+	if status := call(httpClient, "POST", "/dual-control", adminToken, newDualReq, nil); status != http.StatusConflict {
+		t.Fatal(status)
+	}
+	srv.Config.DualControl = true
+	defer func() {
+		srv.Config.DualControl = false
+	}()
+	var dualReq APIDualControl
+	if status := call(httpClient, "POST", "/dual-control", adminToken, newDualReq, &dualReq); status != http.StatusCreated ||
+		dualReq.Action != DUAL_CONTROL_ERASE || dualReq.Requester.Name != adminEntry {
+		t.Fatal(status, dualReq)
+	}
+	var dualReqs []APIDualControl
+	if status := call(httpClient, "GET", "/dual-control", readerToken, "", &dualReqs); status != http.StatusOK ||
+		len(dualReqs) != 1 || dualReqs[0].ID != dualReq.ID || dualReqs[0].Approver != nil || dualReqs[0].Requester.Name != adminEntry {
+		t.Fatal(status, dualReqs)
+	}
+	if status := call(httpClient, "POST", "/dual-control/"+dualReq.ID, readerToken, "", nil); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	if status := call(httpClient, "POST", "/dual-control/doesnotexist", adminToken, "", nil); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	// The administrator who made the request may not confirm it
+	if status := call(httpClient, "POST", "/dual-control/"+dualReq.ID, adminToken, "", nil); status != http.StatusConflict {
+		t.Fatal(status)
+	}
+	// Self-destruct command requires a confirmed request
+	selfDestruct := `{"ip": "10.0.0.1", "action": "self-destruct", "params": {"confirm-uuid": "aaa"}}`
+	if status := call(httpClient, "POST", "/records/aaa/commands", adminToken, selfDestruct, nil); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	aliceReq, _ := srv.DualControl.Request(DUAL_CONTROL_ERASE, []string{"aaa"}, AdminIdentity{Name: "alice@host1", IP: "10.0.0.2", Grant: "token:alice"})
+	var confirmed APIDualControl
+	if status := call(httpClient, "POST", "/dual-control/"+aliceReq.ID, adminToken, "", &confirmed); status != http.StatusOK ||
+		confirmed.Approver == nil || confirmed.Approver.Name != adminEntry || confirmed.Approved == nil {
+		t.Fatal(status, confirmed)
+	}
+	// Leases of computers that hold keys online
+	_, granted, _, _ := srv.KeyDB.SelectWithReasons(keydb.AliveMessage{Hostname: "host3", IP: "10.0.0.3", Timestamp: time.Now().Unix()}, false, "aaa")
+	var leases []APILease
+	if status := call(httpClient, "GET", "/leases?uuid=aaa", adminToken, "", &leases); status != http.StatusOK ||
+		len(leases) != 1 || leases[0].ID != granted["aaa"].ID || leases[0].Digest != granted["aaa"].Digest() || leases[0].IP != "10.0.0.3" {
+		t.Fatal(status, leases)
+	}
+	// Readers are not told the lease ID, which is the credential of the computer holding the lease
+	leases = nil
+	if status := call(httpClient, "GET", "/leases?uuid=aaa", readerToken, "", &leases); status != http.StatusOK ||
+		len(leases) != 1 || leases[0].ID != "" || leases[0].Digest != granted["aaa"].Digest() || leases[0].IP != "10.0.0.3" {
+		t.Fatal(status, leases)
+	}
+	if status := call(httpClient, "GET", "/leases?uuid=doesnotexist", readerToken, "", &leases); status != http.StatusOK || len(leases) != 0 {
+		t.Fatal(status, leases)
+	}
+	if status := call(httpClient, "DELETE", "/leases/"+granted["aaa"].ID, readerToken, "", nil); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	if status := call(httpClient, "DELETE", "/leases/doesnotexist", adminToken, "", nil); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	var revoked APILease
+	if status := call(httpClient, "DELETE", "/leases/"+granted["aaa"].ID, adminToken, "", &revoked); status != http.StatusOK || revoked.ID != granted["aaa"].ID {
+		t.Fatal(status, revoked)
+	}
+	if status := call(httpClient, "GET", "/leases", readerToken, "", &leases); status != http.StatusOK || len(leases) != 0 {
+		t.Fatal(status, leases)
+	}
+	// Fence a computer that holds a key
+	srv.KeyDB.SelectWithReasons(keydb.AliveMessage{Hostname: "host3", IP: "10.0.0.3", Timestamp: time.Now().Unix()}, false, "aaa")
+	if status := call(httpClient, "POST", "/hosts/host3/fence", readerToken, "", nil); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	var fenced APIFencedHost
+	if status := call(httpClient, "POST", "/hosts/host3/fence", adminToken, "", &fenced); status != http.StatusOK ||
+		fenced.Host != "host3" || !reflect.DeepEqual(fenced.UUIDs, []string{"aaa"}) {
+		t.Fatal(status, fenced)
+	}
+	if status := call(httpClient, "GET", "/leases", readerToken, "", &leases); status != http.StatusOK || len(leases) != 0 {
+		t.Fatal(status, leases)
+	}
+	// Unknown endpoints
+	if status := call(httpClient, "GET", "/records/aaa/commands", adminToken, "", nil); status != http.StatusMethodNotAllowed {
+		t.Fatal(status)
+	}
+	if status := call(httpClient, "GET", "/doesnotexist", adminToken, "", nil); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	// Dashboard pages are served without authentication
+	for page, contentType := range map[string]string{"/": "text/html", "/dashboard.js": "javascript", "/dashboard.css": "text/css"} {
+		resp, err := httpClient.Get(fmt.Sprintf("https://localhost:%d%s", SRV_DEFAULT_PORT+4, page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), contentType) ||
+			resp.Header.Get("Content-Security-Policy") != API_DASHBOARD_CSP {
+			t.Fatal(page, resp.StatusCode, resp.Header)
+		}
+	}
+}
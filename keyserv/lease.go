@@ -0,0 +1,128 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"log"
+	"time"
+)
+
+// ListLeasesReq asks for the leases of a key, or the leases of all keys.
+type ListLeasesReq struct {
+	Password HashedPassword // Password is provided by client and validated to grant access to this function.
+	UUID     string         // UUID is the disk to list leases of, or empty for all disks.
+}
+
+// RevokeLeaseReq revokes the lease a computer holds on a key.
+type RevokeLeaseReq struct {
+	Password HashedPassword // Password is provided by client and validated to grant access to this function.
+	ID       string         // ID is the lease to revoke.
+}
+
+// ReleaseKeyReq tells the server that the requester has closed the disks and no longer holds their keys.
+type ReleaseKeyReq struct {
+	Hostname string            // Hostname is the client's host name, it identifies the requester along with IP if lease ID is absent.
+	UUIDs    []string          // UUIDs are the disks that the requester has closed.
+	Tokens   map[string]string // Tokens are the enrolment tokens in UUID - token pairs.
+	Leases   map[string]string // Leases are the lease IDs in UUID - lease ID pairs, required for the leases handed out with keys.
+}
+
+// FenceHostReq takes away all keys from a computer that has been fenced by a cluster.
+type FenceHostReq struct {
+	Password HashedPassword // Password is provided by client and validated to grant access to this function.
+	Host     string         // Host is the IP of the fenced computer, or its host name if the name leads to a single IP.
+}
+
+/*
+Return what the client presents to prove that it holds the leases: the lease IDs, the client certificate, and the
+enrolment tokens, the latter two are compared with those that retrieved the keys.
+*/
+func (rpcConn *CryptServiceConn) getLeaseClaim(leases, tokens map[string]string) keydb.LeaseClaim {
+	return keydb.LeaseClaim{LeaseIDs: leases, Cert: rpcConn.Identity.CertFingerprint, Tokens: tokens}
+}
+
+/*
+Revoke a lease so that the computer holding it is told to let go of the key in its next heartbeat, and the lease no
+longer counts towards the key's MaxActive.
+*/
+func (srv *CryptServer) RevokeLease(remoteHost, id string) (keydb.Lease, error) {
+	lease, err := srv.KeyDB.RevokeLease(id)
+	if err != nil {
+		return lease, err
+	}
+	log.Printf("CryptServer.RevokeLease: %s has revoked lease %s of %s held by %s (%s)", remoteHost, id, lease.UUID, lease.IP, lease.Hostname)
+	// Readers may see the events, they are not told the lease ID
+	srv.Events.Add(EVENT_LEASE_REVOKED, remoteHost, lease.UUID, fmt.Sprintf("%s held by %s (%s)", lease.Digest(), lease.IP, lease.Hostname))
+	return lease, nil
+}
+
+/*
+Take away all keys from a computer that has been fenced by a cluster, so that the surviving computers may retrieve the
+keys right away instead of waiting for the fenced computer to miss its alive reports. The computer is identified by its
+IP, or by a host name that leads to a single IP. Return UUIDs of the disks that the fenced computer no longer holds.
+*/
+func (srv *CryptServer) FenceHost(remoteHost, host string) ([]string, error) {
+	fenced, err := srv.KeyDB.FenceHost(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, uuid := range fenced {
+		log.Printf("CryptServer.FenceHost: %s has taken away the key of %s from fenced computer %s", remoteHost, uuid, host)
+		srv.Events.Add(EVENT_HOST_FENCED, remoteHost, uuid, host)
+	}
+	return fenced, nil
+}
+
+// ListLeases returns the valid leases of a key, or the valid leases of all keys.
+func (rpcConn *CryptServiceConn) ListLeases(req ListLeasesReq, leases *[]keydb.Lease) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	*leases = rpcConn.Svc.KeyDB.ListLeases(req.UUID)
+	return nil
+}
+
+// RevokeLease revokes the lease a computer holds on a key.
+func (rpcConn *CryptServiceConn) RevokeLease(req RevokeLeaseReq, _ *DummyAttr) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	_, err := rpcConn.Svc.RevokeLease(rpcConn.RemoteHost, req.ID)
+	return err
+}
+
+// FenceHost takes away all keys from a computer that has been fenced by a cluster.
+func (rpcConn *CryptServiceConn) FenceHost(req FenceHostReq, fenced *[]string) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	} else if req.Host == "" {
+		return errors.New("FenceHost: IP or host name of the fenced computer is missing")
+	}
+	var err error
+	*fenced, err = rpcConn.Svc.FenceHost(rpcConn.RemoteHost, req.Host)
+	return err
+}
+
+/*
+ReleaseKey lets go of the requester's leases of the disks it has closed, so that the keys immediately stop counting the
+requester as an active holder, instead of waiting for the requester to miss its alive reports. No password required, but
+the requester has to prove to be the holder of each lease (see keydb.Lease.IsHolder).
+Respond with UUID of the disks that were held by the requester.
+*/
+func (rpcConn *CryptServiceConn) ReleaseKey(req ReleaseKeyReq, released *[]string) error {
+	requester := keydb.AliveMessage{
+		IP:        rpcConn.RemoteHost,
+		Hostname:  req.Hostname,
+		Timestamp: time.Now().Unix(),
+	}
+	permitted, _ := rpcConn.checkClientIdentity(req.UUIDs, req.Tokens)
+	*released = rpcConn.Svc.KeyDB.ReleaseLeases(requester, rpcConn.getLeaseClaim(req.Leases, req.Tokens), permitted...)
+	for _, uuid := range *released {
+		log.Printf("CryptServiceConn.ReleaseKey: %s (%s) has released the key of %s", rpcConn.RemoteHost, req.Hostname, uuid)
+		rpcConn.Svc.Events.Add(EVENT_KEY_RELEASED, rpcConn.RemoteHost, uuid, req.Hostname)
+	}
+	return nil
+}
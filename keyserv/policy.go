@@ -0,0 +1,45 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	APPROVAL_DEFAULT_VALIDITY = time.Hour          // APPROVAL_DEFAULT_VALIDITY is the validity of an approval if not specified.
+	APPROVAL_MAX_VALIDITY     = 7 * 24 * time.Hour // APPROVAL_MAX_VALIDITY is the longest validity of an approval.
+)
+
+// ApproveRetrievalReq approves a computer to retrieve a key that requires approval.
+type ApproveRetrievalReq struct {
+	Password HashedPassword // Password is provided by client and validated to grant access to this function.
+	UUID     string         // UUID is the disk to approve.
+	IP       string         // IP is the computer's IP as seen by key server.
+	Validity time.Duration  // Validity is the duration in which the computer has to retrieve the key.
+}
+
+// Approve a computer to retrieve a key without password once, within a limited time.
+func (srv *CryptServer) ApproveRetrieval(remoteHost, uuid, ip string, validity time.Duration) error {
+	if validity <= 0 {
+		validity = APPROVAL_DEFAULT_VALIDITY
+	} else if validity > APPROVAL_MAX_VALIDITY {
+		return fmt.Errorf("ApproveRetrieval: validity must not exceed %d seconds", int(APPROVAL_MAX_VALIDITY.Seconds()))
+	}
+	if err := srv.KeyDB.ApproveRetrieval(uuid, ip, validity); err != nil {
+		return err
+	}
+	log.Printf("CryptServer.ApproveRetrieval: %s has approved %s to retrieve the key of %s within %s", remoteHost, ip, uuid, validity)
+	srv.Events.Add(EVENT_KEY_APPROVED, remoteHost, uuid, fmt.Sprintf("%s within %s", ip, validity))
+	return nil
+}
+
+// ApproveRetrieval approves a computer to retrieve a key that requires approval.
+func (rpcConn *CryptServiceConn) ApproveRetrieval(req ApproveRetrievalReq, _ *DummyAttr) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	return rpcConn.Svc.ApproveRetrieval(rpcConn.RemoteHost, req.UUID, req.IP, req.Validity)
+}
@@ -0,0 +1,140 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sort"
+)
+
+/*
+The key server speaks two wire protocols on the same port:
+  - Protocol version 2 is JSON-RPC 1.0 (as implemented by net/rpc/jsonrpc): each request is a JSON object
+    {"method": "CryptServiceConn.NAME", "params": [PARAMETER], "id": ID} and each response is a JSON object
+    {"id": ID, "result": RESULT, "error": null or "MESSAGE"}. Byte slices are encoded in base64.
+  - Protocol version 1 is the legacy Go net/rpc with gob encoding, kept for clients of earlier versions.
+
+Server tells them apart by the first byte of the stream, a JSON-RPC request always begins with an opening brace.
+Over TLS, a client announces its support of JSON-RPC via ALPN, server agrees via ALPN only if it supports JSON-RPC too,
+therefore a new client continues to work with a server of earlier version.
+After connecting, a client may call Hello to negotiate the protocol version and learn server capabilities.
+*/
+const (
+	PROTOCOL_VERSION_LEGACY = 1              // PROTOCOL_VERSION_LEGACY is the net/rpc and gob protocol.
+	PROTOCOL_VERSION        = 2              // PROTOCOL_VERSION is the JSON-RPC protocol, the latest version.
+	PROTOCOL_ALPN           = "cryptctl/2"   // PROTOCOL_ALPN is the TLS application protocol name of JSON-RPC.
+	PROTOCOL_JSON_PREFIX    = '{'            // PROTOCOL_JSON_PREFIX is the first byte of any JSON-RPC request.
+	CAPABILITY_JSON_RPC     = "json-rpc"     // CAPABILITY_JSON_RPC means server speaks protocol version 2.
+	CAPABILITY_LEGACY_RPC   = "legacy-rpc"   // CAPABILITY_LEGACY_RPC means server speaks protocol version 1.
+	CAPABILITY_ENROLMENT    = "enrolment"    // CAPABILITY_ENROLMENT means server issues and renews client certificates.
+	CAPABILITY_BOUND_KEYS   = "bound-keys"   // CAPABILITY_BOUND_KEYS means server takes part in network-bound disk keys.
+	CAPABILITY_PENDING_CMDS = "pending-cmds" // CAPABILITY_PENDING_CMDS means server hands out pending commands to clients.
+	CAPABILITY_KMIP         = "kmip"         // CAPABILITY_KMIP means encryption keys are kept by an external KMIP server.
+	CAPABILITY_HEARTBEAT    = "heartbeat"    // CAPABILITY_HEARTBEAT means server takes a single heartbeat for all disks of a client.
+	CAPABILITY_WAIT_COMMAND = "wait-command" // CAPABILITY_WAIT_COMMAND means server delivers pending commands the moment they are issued.
+)
+
+// A request to negotiate protocol version and capabilities.
+type HelloReq struct {
+	ProtocolVersion int      // ProtocolVersion is the latest protocol version the client speaks.
+	Capabilities    []string // Capabilities are those the client supports, for server's information.
+}
+
+// A response that carries the negotiated protocol version and server capabilities.
+type HelloResp struct {
+	ProtocolVersion int      // ProtocolVersion is the latest version spoken by both client and server.
+	Capabilities    []string // Capabilities are those the server supports, in alphabetical order.
+}
+
+// Return true only if the server has the capability.
+func (resp HelloResp) HasCapability(capability string) bool {
+	for _, have := range resp.Capabilities {
+		if have == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the capabilities of this server, in alphabetical order.
+func (srv *CryptServer) GetCapabilities() []string {
+	ret := []string{CAPABILITY_JSON_RPC, CAPABILITY_BOUND_KEYS, CAPABILITY_PENDING_CMDS, CAPABILITY_HEARTBEAT, CAPABILITY_WAIT_COMMAND}
+	if srv.Config.LegacyRPC {
+		ret = append(ret, CAPABILITY_LEGACY_RPC)
+	}
+	if srv.TLS != nil && srv.TLS.CertAuthority() != nil {
+		ret = append(ret, CAPABILITY_ENROLMENT)
+	}
+	if len(srv.Config.KMIPAddresses) > 0 {
+		ret = append(ret, CAPABILITY_KMIP)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Negotiate protocol version and tell client about server capabilities. The function does not require a password.
+func (rpcConn *CryptServiceConn) Hello(req HelloReq, resp *HelloResp) error {
+	resp.ProtocolVersion = PROTOCOL_VERSION
+	if req.ProtocolVersion < PROTOCOL_VERSION {
+		resp.ProtocolVersion = req.ProtocolVersion
+	}
+	if resp.ProtocolVersion < PROTOCOL_VERSION_LEGACY {
+		resp.ProtocolVersion = PROTOCOL_VERSION_LEGACY
+	}
+	resp.Capabilities = rpcConn.Svc.GetCapabilities()
+	return nil
+}
+
+// Negotiate protocol version and tell client about server capabilities.
+func (enrolConn *EnrolmentConn) Hello(req HelloReq, resp *HelloResp) error {
+	return enrolConn.rpcConn.Hello(req, resp)
+}
+
+// sniffConn is a connection that allows peeking into the incoming data before it is read.
+type sniffConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read incoming data, including the data that has been peeked.
+func (conn *sniffConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+/*
+Determine the protocol spoken by the client by peeking into the first byte of its request, then serve RPC on the
+connection until it is closed. Legacy protocol is refused unless enabled in server configuration.
+*/
+func (srv *CryptServer) serveRPC(rpcSvc *rpc.Server, incoming net.Conn, remoteHost string) {
+	conn := &sniffConn{Conn: incoming, reader: bufio.NewReader(incoming)}
+	first, err := conn.reader.Peek(1)
+	if err != nil {
+		// Client disconnected without making a request
+		return
+	}
+	if first[0] == PROTOCOL_JSON_PREFIX {
+		rpcSvc.ServeCodec(jsonrpc.NewServerCodec(conn))
+		return
+	}
+	if !srv.Config.LegacyRPC {
+		log.Printf("CryptServer.serveRPC: refuse legacy RPC from %s because %s is disabled", remoteHost, SRV_CONF_LEGACY_RPC)
+		return
+	}
+	rpcSvc.ServeConn(conn)
+}
+
+/*
+Return an RPC client that speaks the protocol agreed upon during TLS handshake. A connection without TLS (i.e. domain
+socket) is always made to a server of the same version, hence it always speaks the latest protocol.
+*/
+func newRPCClient(conn net.Conn) *rpc.Client {
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS && tlsConn.ConnectionState().NegotiatedProtocol != PROTOCOL_ALPN {
+		return rpc.NewClient(conn)
+	}
+	return jsonrpc.NewClient(conn)
+}
@@ -0,0 +1,93 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestProtocols(t *testing.T) {
+	fixture := NewTestTLS(t, "localhost")
+	salt := NewSalt()
+	passHash := HashPassword(salt, TEST_RPC_PASS)
+	sysconf := fixture.SysConf()
+	sysconf.Set(SRV_CONF_LISTEN_PORT, SRV_DEFAULT_PORT+3)
+	sysconf.Set(SRV_CONF_PASS_SALT, hex.EncodeToString(salt[:]))
+	sysconf.Set(SRV_CONF_PASS_HASH, hex.EncodeToString(passHash[:]))
+	srv, tearDown := fixture.StartServer(t, sysconf)
+	defer tearDown()
+	caPEM := fixture.CA.CertPEM
+	address := fmt.Sprintf("localhost:%d", SRV_DEFAULT_PORT+3)
+	wantCaps := []string{CAPABILITY_BOUND_KEYS, CAPABILITY_HEARTBEAT, CAPABILITY_JSON_RPC, CAPABILITY_LEGACY_RPC, CAPABILITY_PENDING_CMDS, CAPABILITY_WAIT_COMMAND}
+	// Client of this version speaks JSON-RPC
+	client, err := NewCryptClient("tcp", address, caPEM, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.Hello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ProtocolVersion != PROTOCOL_VERSION || !reflect.DeepEqual(hello.Capabilities, wantCaps) || !hello.HasCapability(CAPABILITY_JSON_RPC) {
+		t.Fatalf("%+v", hello)
+	}
+	if err := client.Ping(PingRequest{Password: passHash}); err != nil {
+		t.Fatal(err)
+	}
+	if gotSalt, err := client.GetSalt(); err != nil || gotSalt != salt {
+		t.Fatal(gotSalt, err)
+	}
+	// Client of earlier version does not announce JSON-RPC and speaks gob
+	legacy, err := NewCryptClient("tcp", address, caPEM, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.tlsConfig.NextProtos = nil
+	if err := legacy.Ping(PingRequest{Password: passHash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Ping(PingRequest{Password: HashPassword(salt, "wrong password")}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Other programming languages may speak JSON-RPC without ALPN
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(`{"method": "CryptServiceConn.Hello", "params": [{"ProtocolVersion": 3}], "id": 1}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		ID     int
+		Result HelloResp
+		Error  interface{}
+	}
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 1 || resp.Error != nil || resp.Result.ProtocolVersion != PROTOCOL_VERSION || !reflect.DeepEqual(resp.Result.Capabilities, wantCaps) {
+		t.Fatalf("%+v", resp)
+	}
+	// Legacy protocol may be turned off, which affects new connections
+	srv.Config.LegacyRPC = false
+	legacy.Close()
+	if err := legacy.Ping(PingRequest{Password: passHash}); err == nil {
+		t.Fatal("did not error")
+	}
+	if hello, err := client.Hello(); err != nil || hello.HasCapability(CAPABILITY_LEGACY_RPC) {
+		t.Fatal(hello, err)
+	}
+	if err := client.Ping(PingRequest{Password: passHash}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -8,12 +8,15 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
 	"github.com/HouzuoGuo/cryptctl/sys"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/rpc"
 	"os"
 	"path"
+	"sync"
 	"testing"
 	"time"
 )
@@ -26,6 +29,11 @@ const (
 	CLIENT_CONF_CERT     = "TLS_CERT_PEM"
 	CLIENT_CONF_CERT_KEY = "TLS_CERT_KEY_PEM"
 	TEST_RPC_PASS        = "pass"
+
+	RPC_KEEP_ALIVE_SEC     = 30 // RPC_KEEP_ALIVE_SEC is the interval of TCP keep-alive probes on client connections.
+	RPC_RECONNECT_MIN_SEC  = 1  // RPC_RECONNECT_MIN_SEC is the initial delay before reconnecting after a failed attempt.
+	RPC_RECONNECT_MAX_SEC  = 60 // RPC_RECONNECT_MAX_SEC is the longest delay between reconnection attempts.
+	RPC_SESSION_CACHE_SIZE = 8  // RPC_SESSION_CACHE_SIZE is the number of TLS sessions remembered for resumption.
 )
 
 // CryptClient implements an RPC client for CryptServer.
@@ -35,18 +43,32 @@ type CryptClient struct {
 	TLSCert   string // TLSCert is path to TLS certificate that is presented by client to server.
 	TLSKey    string // TLSKey is path to TLS key corresponding to the certificate.
 	tlsConfig *tls.Config
+
+	mutex      *sync.Mutex   // mutex protects the connection and reconnection state below
+	rpcClient  *rpc.Client   // rpcClient is the persistent connection shared by all calls, or nil if not connected
+	reconnect  time.Time     // reconnect is the earliest time of the next connection attempt after a failure
+	backOff    time.Duration // backOff is the delay after the next failed connection attempt
+	connectErr error         // connectErr is the reason of the last failed connection attempt
 }
 
 /*
 Initialise an RPC client.
-The function does not immediately establish a connection to server, connection is only made along with each RPC call.
+The function does not immediately establish a connection to server, connection is made by the first RPC call and
+then shared by the subsequent calls.
 */
 func NewCryptClient(connType, address string, caCertPEM []byte, certPath, certKeyPath string) (*CryptClient, error) {
 	client := &CryptClient{
 		Type:      connType,
 		Address:   address,
 		tlsConfig: new(tls.Config),
+		mutex:     new(sync.Mutex),
+		backOff:   RPC_RECONNECT_MIN_SEC * time.Second,
 	}
+	DefaultTLSPolicy().Apply(client.tlsConfig)
+	// Reconnection resumes the previous TLS session and skips the expensive part of handshake
+	client.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(RPC_SESSION_CACHE_SIZE)
+	// Server of earlier version does not agree to the protocol, and the client will fall back to legacy protocol.
+	client.tlsConfig.NextProtos = []string{PROTOCOL_ALPN}
 	if caCertPEM != nil && len(caCertPEM) > 0 {
 		// Use custom CA
 		caCertPool := x509.NewCertPool()
@@ -85,37 +107,129 @@ func NewCryptClientFromSysconfig(sysconf *sys.Sysconfig) (*CryptClient, error) {
 			return nil, fmt.Errorf("NewCryptClientFromSysconfig: failed to read CA PEM file at \"%s\" - %v", ca, err)
 		}
 	}
-	return NewCryptClient("tcp", fmt.Sprintf("%s:%d", host, port), caCertPEM, sysconf.GetString(CLIENT_CONF_CERT, ""), sysconf.GetString(CLIENT_CONF_CERT_KEY, ""))
+	policy, err := ReadTLSPolicyFromSysconfig(sysconf)
+	if err != nil {
+		return nil, fmt.Errorf("NewCryptClientFromSysconfig: %v", err)
+	}
+	pins, err := ParseSPKIPins(sysconf.GetString(TLS_CONF_PINNED_KEYS, ""))
+	if err != nil {
+		return nil, fmt.Errorf("NewCryptClientFromSysconfig: %v", err)
+	}
+	client, err := NewCryptClient("tcp", fmt.Sprintf("%s:%d", host, port), caCertPEM, sysconf.GetString(CLIENT_CONF_CERT, ""), sysconf.GetString(CLIENT_CONF_CERT_KEY, ""))
+	if err != nil {
+		return nil, err
+	}
+	client.SetTLSPolicy(policy)
+	client.PinKeys(pins)
+	return client, nil
 }
 
-/*
-Establish a new TLS connection to RPC server and then invoke an RPC on the connection.
-The function deliberately establishes a new connection on each RPC call, in order to reduce complexity in managing
-the client connections, especially in the area of keep-alive. The client is not expected to make high volume of calls
-hence there is absolutely no performance concern.
-*/
-func (client *CryptClient) DoRPC(fun func(*rpc.Client) error) (err error) {
-	var conn net.Conn
+// Restrict TLS versions and algorithms used in connections to key server.
+func (client *CryptClient) SetTLSPolicy(policy TLSPolicy) {
+	client.Close()
+	policy.Apply(client.tlsConfig)
+}
+
+// Accept key server only if it presents any of the pinned public keys, in addition to ordinary certificate verification.
+func (client *CryptClient) PinKeys(pins []string) {
+	client.Close()
+	if len(pins) == 0 {
+		client.tlsConfig.VerifyConnection = nil
+		return
+	}
+	client.tlsConfig.VerifyConnection = VerifyPinnedKeys(pins)
+}
+
+// Establish a new connection to RPC server.
+func (client *CryptClient) dial() (conn net.Conn, err error) {
+	dialer := &net.Dialer{Timeout: RPC_DIAL_TIMEOUT_SEC * time.Second, KeepAlive: RPC_KEEP_ALIVE_SEC * time.Second}
 	if client.Type == "tcp" {
-		conn, err = tls.DialWithDialer(
-			&net.Dialer{Timeout: RPC_DIAL_TIMEOUT_SEC * time.Second},
-			"tcp", client.Address, client.tlsConfig)
+		conn, err = tls.DialWithDialer(dialer, "tcp", client.Address, client.tlsConfig)
 	} else if client.Type == "unix" {
 		// TLS is not involved in domain socket communication
-		conn, err = net.Dial("unix", client.Address)
+		conn, err = dialer.Dial("unix", client.Address)
 	} else {
-		return fmt.Errorf("DoRPC: invalid client type \"%s\"", client.Type)
+		return nil, fmt.Errorf("invalid client type \"%s\"", client.Type)
+	}
+	return
+}
+
+/*
+Return the persistent RPC client, connect to server if there is not a connection yet. After a failed connection
+attempt, the next attempt is only made after a delay that doubles on each consecutive failure, in order to avoid a large
+number of computers overwhelming a key server that has just come back.
+*/
+func (client *CryptClient) getRPCClient() (rpcClient *rpc.Client, reused bool, err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.rpcClient != nil {
+		return client.rpcClient, true, nil
+	}
+	if wait := time.Until(client.reconnect); wait > 0 {
+		return nil, false, fmt.Errorf("DoRPC: will reconnect to %s in %s, the last attempt failed - %v", client.Address, wait.Round(time.Second), client.connectErr)
 	}
+	conn, err := client.dial()
 	if err != nil {
-		return fmt.Errorf("DoRPC: failed to connect to %s via %s - %v", client.Address, client.Type, err)
+		// Spread out reconnection attempts made by computers that lost connection at the same time
+		client.reconnect = time.Now().Add(client.backOff/2 + time.Duration(rand.Int63n(int64(client.backOff/2)+1)))
+		client.connectErr = err
+		if client.backOff *= 2; client.backOff > RPC_RECONNECT_MAX_SEC*time.Second {
+			client.backOff = RPC_RECONNECT_MAX_SEC * time.Second
+		}
+		return nil, false, fmt.Errorf("DoRPC: failed to connect to %s via %s - %v", client.Address, client.Type, err)
 	}
-	defer conn.Close()
-	rpcClient := rpc.NewClient(conn)
-	defer rpcClient.Close()
-	if err := fun(rpcClient); err != nil {
-		return fmt.Errorf("DoRPC: call failed - %v", err)
+	client.backOff = RPC_RECONNECT_MIN_SEC * time.Second
+	client.reconnect = time.Time{}
+	client.connectErr = nil
+	client.rpcClient = newRPCClient(conn)
+	return client.rpcClient, false, nil
+}
+
+// Close the connection if it is still the persistent one, so that the next call will connect again.
+func (client *CryptClient) dropRPCClient(rpcClient *rpc.Client) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.rpcClient == rpcClient {
+		client.rpcClient = nil
+	}
+	rpcClient.Close()
+}
+
+// Close the persistent connection to server. The next RPC call will connect again.
+func (client *CryptClient) Close() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.rpcClient != nil {
+		client.rpcClient.Close()
+		client.rpcClient = nil
+	}
+}
+
+/*
+Invoke RPC on the persistent connection to server, and connect to server if there is not a connection yet.
+The connection multiplexes concurrent calls. If server has closed the connection (e.g. for being idle) before the
+request is sent, the request is sent again over a new connection; if the connection breaks after the request is sent,
+the request is not repeated because server may have already acted upon it.
+*/
+func (client *CryptClient) DoRPC(fun func(*rpc.Client) error) error {
+	for {
+		rpcClient, reused, err := client.getRPCClient()
+		if err != nil {
+			return err
+		}
+		err = fun(rpcClient)
+		if err == nil {
+			return nil
+		}
+		if _, isServerErr := err.(rpc.ServerError); isServerErr {
+			// The connection is still good, server has merely refused the request.
+			return fmt.Errorf("DoRPC: call failed - %v", err)
+		}
+		client.dropRPCClient(rpcClient)
+		if err != rpc.ErrShutdown || !reused {
+			return fmt.Errorf("DoRPC: call failed - %v", err)
+		}
 	}
-	return nil
 }
 
 // Retrieve the salt that was used to hash server's access password.
@@ -127,6 +241,15 @@ func (client *CryptClient) GetSalt() (salt PasswordSalt, err error) {
 	return
 }
 
+// Negotiate protocol version and learn about server capabilities.
+func (client *CryptClient) Hello() (resp HelloResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		req := HelloReq{ProtocolVersion: PROTOCOL_VERSION, Capabilities: []string{CAPABILITY_JSON_RPC, CAPABILITY_LEGACY_RPC}}
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "Hello"), req, &resp)
+	})
+	return
+}
+
 // Ping RPC server. Return an error if there is a communication mishap or server has not undergone the initial setup.
 func (client *CryptClient) Ping(req PingRequest) error {
 	return client.DoRPC(func(rpcClient *rpc.Client) error {
@@ -170,6 +293,58 @@ func (client *CryptClient) ReportAlive(req ReportAliveReq) (rejectedUUIDs []stri
 	return
 }
 
+/*
+Send a single heartbeat on behalf of all encrypted disks held online by this computer, and receive pending commands of
+the polled disks in the same round trip.
+*/
+func (client *CryptClient) Heartbeat(req HeartbeatReq) (resp HeartbeatResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "Heartbeat"), req, &resp)
+	})
+	return
+}
+
+// Tell the server that the disks are closed and their keys are no longer held. Return UUID of the disks that were held.
+func (client *CryptClient) ReleaseKey(req ReleaseKeyReq) (released []string, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ReleaseKey"), req, &released)
+	})
+	return
+}
+
+// Retrieve server's binding public key to compute a network-bound disk key.
+func (client *CryptClient) GetBindingKey() (resp GetBindingKeyResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetBindingKey"), &dummy, &resp)
+	})
+	return
+}
+
+// Ask server to help recovering a network-bound disk key.
+func (client *CryptClient) ExchangeBinding(req ExchangeBindingReq) (resp []byte, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ExchangeBinding"), req, &resp)
+	})
+	return
+}
+
+// Ask server's built-in CA to issue a client certificate.
+func (client *CryptClient) EnrolClient(req EnrolClientReq) (resp EnrolClientResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "EnrolClient"), req, &resp)
+	})
+	return
+}
+
+// Ask server's built-in CA to renew the client certificate that is presented by this client.
+func (client *CryptClient) RenewClientCert(req RenewClientCertReq) (resp EnrolClientResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "RenewClientCert"), req, &resp)
+	})
+	return
+}
+
 // Tell server to delete an encryption key.
 func (client *CryptClient) EraseKey(req EraseKeyReq) error {
 	return client.DoRPC(func(rpcClient *rpc.Client) error {
@@ -201,6 +376,27 @@ func (client *CryptClient) PollCommand(req PollCommandReq) (resp PollCommandResp
 	return
 }
 
+/*
+Wait for pending commands of the UUIDs, and return as soon as server hands out commands or the timeout elapses. If
+server does not respond well after the timeout, the connection is considered broken and is closed.
+*/
+func (client *CryptClient) WaitCommand(req WaitCommandReq) (resp PollCommandResp, err error) {
+	timeoutSec := req.TimeoutSec
+	if timeoutSec <= 0 || timeoutSec > WAIT_COMMAND_MAX_SEC {
+		timeoutSec = WAIT_COMMAND_MAX_SEC
+	}
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		call := rpcClient.Go(fmt.Sprintf(RPCObjNameFmt, "WaitCommand"), req, &resp, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			return call.Error
+		case <-time.After(time.Duration(timeoutSec+RPC_KEEP_ALIVE_SEC) * time.Second):
+			return fmt.Errorf("server did not respond within %d seconds", timeoutSec+RPC_KEEP_ALIVE_SEC)
+		}
+	})
+	return
+}
+
 func (client *CryptClient) SaveCommandResult(req SaveCommandResultReq) error {
 	return client.DoRPC(func(rpcClient *rpc.Client) error {
 		var dummy DummyAttr
@@ -208,6 +404,182 @@ func (client *CryptClient) SaveCommandResult(req SaveCommandResultReq) error {
 	})
 }
 
+// Receive the current and the new key of a disk, in order to carry out a rotate-key command.
+func (client *CryptClient) BeginKeyRotation(req BeginKeyRotationReq) (resp BeginKeyRotationResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "BeginKeyRotation"), req, &resp)
+	})
+	return
+}
+
+// Tell server to put the new key of a disk into effect, after the new key has been installed on the disk.
+func (client *CryptClient) CommitKeyRotation(req CommitKeyRotationReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "CommitKeyRotation"), req, &dummy)
+	})
+}
+
+// Issue a command to a computer for a disk.
+func (client *CryptClient) SendCommand(req SendCommandReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "SendCommand"), req, &dummy)
+	})
+}
+
+// Issue a command to the disks and computers picked by a selector, return the batch ID and the targets.
+func (client *CryptClient) SendFleetCommand(req SendFleetCommandReq) (resp SendFleetCommandResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "SendFleetCommand"), req, &resp)
+	})
+	return
+}
+
+// Return the aggregated outcome of the commands issued by SendFleetCommand.
+func (client *CryptClient) GetBatch(req GetBatchReq) (resp keydb.BatchSummary, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetBatch"), req, &resp)
+	})
+	return
+}
+
+// Replace the tags of a computer.
+func (client *CryptClient) TagHost(req TagHostReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "TagHost"), req, &dummy)
+	})
+}
+
+// Approve a computer to retrieve a key that requires approval.
+func (client *CryptClient) ApproveRetrieval(req ApproveRetrievalReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ApproveRetrieval"), req, &dummy)
+	})
+}
+
+// Return the valid leases of a key, or the valid leases of all keys.
+func (client *CryptClient) ListLeases(req ListLeasesReq) (leases []keydb.Lease, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListLeases"), req, &leases)
+	})
+	return
+}
+
+// Revoke the lease a computer holds on a key.
+func (client *CryptClient) RevokeLease(req RevokeLeaseReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "RevokeLease"), req, &dummy)
+	})
+}
+
+// Take away all keys from a computer fenced by a cluster. Return UUID of the disks that the computer no longer holds.
+func (client *CryptClient) FenceHost(req FenceHostReq) (fenced []string, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "FenceHost"), req, &fenced)
+	})
+	return
+}
+
+// Ask a second administrator to confirm retrieving keys with password or erasing a key, if dual control is enabled.
+func (client *CryptClient) RequestDualControl(req RequestDualControlReq) (resp RequestDualControlResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "RequestDualControl"), req, &resp)
+	})
+	return
+}
+
+// Return a dual control request that has not expired or been carried out.
+func (client *CryptClient) GetDualControl(req DualControlReq) (resp DualControlRequest, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetDualControl"), req, &resp)
+	})
+	return
+}
+
+// Confirm a dual control request as the second administrator.
+func (client *CryptClient) ConfirmDualControl(req DualControlReq) (resp DualControlRequest, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ConfirmDualControl"), req, &resp)
+	})
+	return
+}
+
+// Return the dual control requests that have not expired or been carried out.
+func (client *CryptClient) ListDualControl(req DualControlReq) (resp []DualControlRequest, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListDualControl"), req, &resp)
+	})
+	return
+}
+
+// TestTLS is a certificate authority and a server certificate issued by it, generated in a temporary directory for tests.
+type TestTLS struct {
+	Dir             string         // Dir is the temporary directory that holds the certificates and key database.
+	CACert, CAKey   string         // CACert and CAKey are the paths to the certificate authority.
+	SrvCert, SrvKey string         // SrvCert and SrvKey are the paths to the server certificate.
+	CA              *CertAuthority // CA issues further certificates in a test.
+}
+
+// Generate a certificate authority and a server certificate for the host name, in a new temporary directory.
+func NewTestTLS(tb testing.TB, serverName string) TestTLS {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-tlstest")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	fixture := TestTLS{
+		Dir:     tmpDir,
+		CACert:  path.Join(tmpDir, "ca.crt"),
+		CAKey:   path.Join(tmpDir, "ca.key"),
+		SrvCert: path.Join(tmpDir, "srv.crt"),
+		SrvKey:  path.Join(tmpDir, "srv.key"),
+	}
+	if err := GenerateCertAuthority(CertSubject{CommonName: "test CA"}, 10, fixture.CACert, fixture.CAKey); err != nil {
+		tb.Fatal(err)
+	}
+	if fixture.CA, err = LoadCertAuthority(fixture.CACert, fixture.CAKey, ""); err != nil {
+		tb.Fatal(err)
+	}
+	if err := fixture.CA.IssueServerCert(serverName, 10, fixture.SrvCert, fixture.SrvKey); err != nil {
+		tb.Fatal(err)
+	}
+	return fixture
+}
+
+// Return key server configuration that serves the server certificate and keeps its database in the temporary directory.
+func (fixture TestTLS) SysConf() *sys.Sysconfig {
+	sysconf := GetDefaultKeySvcConf()
+	sysconf.Set(SRV_CONF_KEYDB_DIR, path.Join(fixture.Dir, "keydb"))
+	sysconf.Set(SRV_CONF_TLS_CERT, fixture.SrvCert)
+	sysconf.Set(SRV_CONF_TLS_KEY, fixture.SrvKey)
+	return sysconf
+}
+
+// Start a key server that serves RPC over TLS, return the server and a teardown function that also removes the temporary directory.
+func (fixture TestTLS) StartServer(tb testing.TB, sysconf *sys.Sysconfig) (*CryptServer, func()) {
+	srvConf := CryptServiceConfig{}
+	if err := srvConf.ReadFromSysconfig(sysconf); err != nil {
+		tb.Fatal(err)
+	}
+	srv, err := NewCryptServer(srvConf, Mailer{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := srv.ListenTCP(); err != nil {
+		tb.Fatal(err)
+	}
+	go srv.HandleTCPConnections()
+	tearDown := func() {
+		srv.BuiltInKMIPServer.Shutdown()
+		srv.TCPListener.Close()
+		os.RemoveAll(fixture.Dir)
+	}
+	return srv, tearDown
+}
+
 // Start an RPC server in a testing configuration, return a client connected to the server and a teardown function.
 func StartTestServer(tb testing.TB) (*CryptClient, *CryptServer, func(testing.TB)) {
 	keydbDir, err := ioutil.TempDir("", "cryptctl-rpctest")
@@ -265,6 +637,8 @@ func StartTestServer(tb testing.TB) (*CryptClient, *CryptServer, func(testing.TB
 			t.Fatal(err)
 			return
 		}
+		// Server no longer accepts new connections
+		client.Close()
 		if err := client.Ping(PingRequest{Password: HashPassword(salt, TEST_RPC_PASS)}); err == nil {
 			t.Fatal("server did not shutdown")
 			return
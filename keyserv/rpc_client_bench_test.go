@@ -155,3 +155,56 @@ func BenchmarkReportAlive(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+// Each call establishes a new connection with a full TLS handshake, which is how earlier versions behaved.
+func BenchmarkRPCNewConnection(b *testing.B) {
+	_, client, passHash, tearDown := startConnTestServer(b, SRV_DEFAULT_PORT+5, 0, 0)
+	defer tearDown()
+	client.tlsConfig.ClientSessionCache = nil
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Ping(PingRequest{Password: passHash}); err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+	}
+}
+
+// Each call establishes a new connection that resumes the previous TLS session.
+func BenchmarkRPCResumedSession(b *testing.B) {
+	_, client, passHash, tearDown := startConnTestServer(b, SRV_DEFAULT_PORT+5, 0, 0)
+	defer tearDown()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Ping(PingRequest{Password: passHash}); err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+	}
+}
+
+// All calls share a persistent connection.
+func BenchmarkRPCPersistentConnection(b *testing.B) {
+	_, client, passHash, tearDown := startConnTestServer(b, SRV_DEFAULT_PORT+5, 0, 0)
+	defer tearDown()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Ping(PingRequest{Password: passHash}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Concurrent calls are multiplexed over a persistent connection.
+func BenchmarkRPCPersistentConnectionParallel(b *testing.B) {
+	_, client, passHash, tearDown := startConnTestServer(b, SRV_DEFAULT_PORT+5, 0, 0)
+	defer tearDown()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := client.Ping(PingRequest{Password: passHash}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
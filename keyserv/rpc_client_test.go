@@ -3,6 +3,7 @@
 package keyserv
 
 import (
+	"encoding/hex"
 	"fmt"
 	"github.com/HouzuoGuo/cryptctl/keydb"
 	"github.com/HouzuoGuo/cryptctl/sys"
@@ -10,6 +11,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -329,3 +331,734 @@ func TestPendingCommands(t *testing.T) {
 		t.Fatal(rec.PendingCommands)
 	}
 }
+
+func TestEnrolClient(t *testing.T) {
+	fixture := NewTestTLS(t, "localhost")
+	tmpDir := fixture.Dir
+	salt := NewSalt()
+	passHash := HashPassword(salt, TEST_RPC_PASS)
+	sysconf := fixture.SysConf()
+	sysconf.Set(SRV_CONF_CA_CERT, fixture.CACert)
+	sysconf.Set(SRV_CONF_CA_KEY, fixture.CAKey)
+	sysconf.Set(SRV_CONF_TLS_CRL, path.Join(tmpDir, "revoked.crl"))
+	sysconf.Set(SRV_CONF_TLS_VALIDATE_CLIENT, true)
+	sysconf.Set(SRV_CONF_LISTEN_PORT, SRV_DEFAULT_PORT+1)
+	sysconf.Set(SRV_CONF_PASS_SALT, hex.EncodeToString(salt[:]))
+	sysconf.Set(SRV_CONF_PASS_HASH, hex.EncodeToString(passHash[:]))
+	srv, tearDown := fixture.StartServer(t, sysconf)
+	defer tearDown()
+	caPEM := fixture.CA.CertPEM
+	address := fmt.Sprintf("localhost:%d", SRV_DEFAULT_PORT+1)
+	// Client without certificate may only enrol
+	anonymous, err := NewCryptClient("tcp", address, caPEM, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := anonymous.Ping(PingRequest{Password: passHash}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anonymous.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"aaa"}}); err == nil {
+		t.Fatal("did not error")
+	}
+	csr, keyPEM, err := NewClientCSR("client.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anonymous.EnrolClient(EnrolClientReq{Password: HashPassword(salt, "wrong password"), CSR: csr}); err == nil {
+		t.Fatal("did not error")
+	}
+	enrolResp, err := anonymous.EnrolClient(EnrolClientReq{Password: passHash, Hostname: "client", CSR: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(enrolResp.CACertificate, caPEM) {
+		t.Fatal("wrong CA certificate")
+	}
+	clientCert, clientKey := path.Join(tmpDir, "client.crt"), path.Join(tmpDir, "client.key")
+	if err := SaveClientCert(clientCert, clientKey, enrolResp.Certificate, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	// Enrolled client may use all functions
+	enrolled, err := NewCryptClient("tcp", address, caPEM, clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enrolled.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"aaa"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Renewal must keep the common name
+	otherCSR, _, err := NewClientCSR("other.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enrolled.RenewClientCert(RenewClientCertReq{CSR: otherCSR}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Renewal must not add names that identify another computer or an administrator
+	if _, err := enrolled.RenewClientCert(RenewClientCertReq{CSR: newTestCSR(t, "client.example.com", "client.example.com", "other-host")}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := anonymous.RenewClientCert(RenewClientCertReq{CSR: csr}); err == nil {
+		t.Fatal("did not error")
+	}
+	renewedCSR, renewedKeyPEM, err := NewClientCSR("client.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewResp, err := enrolled.RenewClientCert(RenewClientCertReq{CSR: renewedCSR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Revoked certificate is refused while the renewed one continues to work
+	oldCert, err := ParseCertPEM(enrolResp.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.TLS.CertAuthority().Revoke(oldCert.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+	if err := enrolled.Ping(PingRequest{Password: passHash}); err == nil {
+		t.Fatal("did not refuse revoked certificate")
+	}
+	if err := SaveClientCert(clientCert, clientKey, renewResp.Certificate, renewedKeyPEM); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := NewCryptClient("tcp", address, caPEM, clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renewed.Ping(PingRequest{Password: passHash}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Start a key server with generated certificates and return a client connected to it, along with the password hash.
+func startConnTestServer(tb testing.TB, port, maxConns, idleTimeoutSec int) (*CryptServer, *CryptClient, HashedPassword, func()) {
+	fixture := NewTestTLS(tb, "localhost")
+	salt := NewSalt()
+	passHash := HashPassword(salt, TEST_RPC_PASS)
+	sysconf := fixture.SysConf()
+	sysconf.Set(SRV_CONF_LISTEN_PORT, port)
+	sysconf.Set(SRV_CONF_PASS_SALT, hex.EncodeToString(salt[:]))
+	sysconf.Set(SRV_CONF_PASS_HASH, hex.EncodeToString(passHash[:]))
+	sysconf.Set(SRV_CONF_MAX_CONNS, maxConns)
+	sysconf.Set(SRV_CONF_IDLE_TIMEOUT, idleTimeoutSec)
+	srv, stopServer := fixture.StartServer(tb, sysconf)
+	client, err := NewCryptClient("tcp", fmt.Sprintf("localhost:%d", port), fixture.CA.CertPEM, "", "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tearDown := func() {
+		client.Close()
+		stopServer()
+	}
+	return srv, client, passHash, tearDown
+}
+
+func TestPersistentConnection(t *testing.T) {
+	srv, client, passHash, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+6, 1, 2)
+	defer tearDown()
+	// Calls share the same connection, including concurrent calls
+	if err := client.Ping(PingRequest{Password: passHash}); err != nil {
+		t.Fatal(err)
+	}
+	firstConn := client.rpcClient
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- client.Ping(PingRequest{Password: passHash})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.rpcClient != firstConn {
+		t.Fatal("did not reuse connection")
+	}
+	// Server-side refusal keeps the connection
+	if err := client.Ping(PingRequest{}); err == nil || client.rpcClient != firstConn {
+		t.Fatal(err)
+	}
+	// Server refuses connections beyond the limit, and the client backs off
+	client2, err := NewCryptClient("tcp", client.Address, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2.tlsConfig = client.tlsConfig.Clone()
+	client2.tlsConfig.ClientSessionCache = nil
+	defer client2.Close()
+	if err := client2.Ping(PingRequest{Password: passHash}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client2.Ping(PingRequest{Password: passHash}); err == nil || !strings.Contains(err.Error(), "will reconnect") {
+		t.Fatal(err)
+	}
+	// Server closes idle connection, and then the other client may connect
+	time.Sleep(2500 * time.Millisecond)
+	if err := client2.Ping(PingRequest{Password: passHash}); err != nil {
+		t.Fatal(err)
+	}
+	client2.Close()
+	time.Sleep(100 * time.Millisecond)
+	// The first client notices that its connection was closed, and reconnects
+	if err := client.Ping(PingRequest{Password: passHash}); err != nil {
+		t.Fatal(err)
+	}
+	if client.rpcClient == firstConn {
+		t.Fatal("did not reconnect")
+	}
+	if len(srv.connSlots) != 1 {
+		t.Fatal(len(srv.connSlots))
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	srv, client, _, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+7, 10, 10)
+	defer tearDown()
+	for _, rec := range []keydb.Record{
+		{UUID: "a", AliveIntervalSec: 3, AliveCount: 4},
+		{UUID: "b", AliveIntervalSec: 2, AliveCount: 4},
+	} {
+		if _, err := srv.KeyDB.Upsert(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An empty heartbeat only makes the host known to server
+	resp, err := client.Heartbeat(HeartbeatReq{Hostname: "client"})
+	if err != nil || len(resp.Rejected) != 0 || len(resp.Commands) != 0 || resp.IntervalSec != 0 {
+		t.Fatal(err, resp)
+	}
+	hosts := srv.KeyDB.ListHosts()
+	if len(hosts) != 1 || hosts[0].Hostname != "client" || len(hosts[0].UUIDs) != 0 {
+		t.Fatal(hosts)
+	}
+	clientIP := hosts[0].IP
+	// The client retrieves key "a" but not "b"
+	if found, _, _ := srv.KeyDB.Select(keydb.AliveMessage{IP: clientIP, Hostname: "client", Timestamp: time.Now().Unix()}, true, "a"); len(found) != 1 {
+		t.Fatal(found)
+	}
+	cmd := keydb.PendingCommand{ValidFrom: time.Now(), Validity: time.Hour, IP: clientIP, Content: "umount"}
+	if err := srv.KeyDB.AddPendingCommand("a", clientIP, cmd); err != nil {
+		t.Fatal(err)
+	}
+	// A single heartbeat keeps "a" alive, rejects "b", and carries the pending command of "a"
+	resp, err = client.Heartbeat(HeartbeatReq{Hostname: "client", UUIDs: []string{"a", "b"}, PollUUIDs: []string{"a", "b", "c"}})
+	if err != nil || !reflect.DeepEqual(resp.Rejected, []string{"b"}) || resp.IntervalSec != 3 {
+		t.Fatal(err, resp)
+	}
+	if len(resp.Commands) != 1 || len(resp.Commands["a"]) != 1 || resp.Commands["a"][0].Content != "umount" {
+		t.Fatal(resp.Commands)
+	}
+	if hosts := srv.KeyDB.ListHosts(); !reflect.DeepEqual(hosts[0].UUIDs, []string{"a"}) {
+		t.Fatal(hosts)
+	}
+	// The command has been delivered
+	resp, err = client.Heartbeat(HeartbeatReq{Hostname: "client", UUIDs: []string{"a"}, PollUUIDs: []string{"a"}})
+	if err != nil || len(resp.Rejected) != 0 || len(resp.Commands) != 0 {
+		t.Fatal(err, resp)
+	}
+}
+
+func TestWaitCommand(t *testing.T) {
+	srv, client, _, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+8, 10, 10)
+	defer tearDown()
+	if _, err := srv.KeyDB.Upsert(keydb.Record{UUID: "a", AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Heartbeat(HeartbeatReq{Hostname: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	clientIP := srv.KeyDB.ListHosts()[0].IP
+	// Without a command, the client waits until timeout
+	start := time.Now()
+	resp, err := client.WaitCommand(WaitCommandReq{UUIDs: []string{"a"}, TimeoutSec: 1})
+	if err != nil || len(resp.Commands) != 0 || time.Since(start) < time.Second {
+		t.Fatal(err, resp, time.Since(start))
+	}
+	// The command issued while the client is waiting is delivered right away
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cmd := keydb.PendingCommand{ValidFrom: time.Now(), Validity: time.Hour, IP: clientIP, Content: "umount"}
+		if err := srv.KeyDB.AddPendingCommand("a", clientIP, cmd); err != nil {
+			t.Error(err)
+		}
+		srv.CommandIssued.Raise()
+	}()
+	start = time.Now()
+	resp, err = client.WaitCommand(WaitCommandReq{UUIDs: []string{"a", "b"}, TimeoutSec: 30})
+	if err != nil || len(resp.Commands["a"]) != 1 || resp.Commands["a"][0].Content != "umount" || time.Since(start) > 5*time.Second {
+		t.Fatal(err, resp, time.Since(start))
+	}
+	// The command is not delivered again, neither by waiting nor by polling
+	if resp, err := client.WaitCommand(WaitCommandReq{UUIDs: []string{"a"}, TimeoutSec: 1}); err != nil || len(resp.Commands) != 0 {
+		t.Fatal(err, resp)
+	}
+	if resp, err := client.PollCommand(PollCommandReq{UUIDs: []string{"a"}}); err != nil || len(resp.Commands) != 0 {
+		t.Fatal(err, resp)
+	}
+	// Waiting does not exceed half of the idle timeout, so that the connection is not closed in the meantime.
+	start = time.Now()
+	srv.Config.IdleTimeoutSec = 2
+	if resp, err := client.WaitCommand(WaitCommandReq{UUIDs: []string{"a"}, TimeoutSec: 30}); err != nil || len(resp.Commands) != 0 || time.Since(start) > 5*time.Second {
+		t.Fatal(err, resp, time.Since(start))
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	srv, client, passHash, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+9, 10, 10)
+	defer tearDown()
+	createResp, err := client.CreateKey(CreateKeyReq{
+		Password:         passHash,
+		Hostname:         "localhost",
+		UUID:             "a",
+		MountPoint:       "/a",
+		AliveIntervalSec: 1,
+		AliveCount:       4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Heartbeat(HeartbeatReq{Hostname: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	clientIP := srv.KeyDB.ListHosts()[0].IP
+	// Rotation is refused unless the client has been told to rotate the key
+	if _, err := client.BeginKeyRotation(BeginKeyRotationReq{UUID: "a", CommandID: "does-not-exist"}); err == nil {
+		t.Fatal("did not error")
+	}
+	cmd, err := keydb.NewPendingCommand("a", clientIP, keydb.CMD_ROTATE_KEY, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.KeyDB.AddPendingCommand("a", clientIP, cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CommitKeyRotation(CommitKeyRotationReq{UUID: "a", CommandID: cmd.Command.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	// The command alone does not hand out the key to a client that does not hold it
+	if _, err := client.BeginKeyRotation(BeginKeyRotationReq{UUID: "a", CommandID: cmd.Command.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	if resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client"}); err != nil || len(resp.Granted) != 1 {
+		t.Fatal(err, resp)
+	}
+	// Nor to a client that is no longer allowed to retrieve the key
+	rec, _ := srv.KeyDB.GetByUUID("a")
+	rec.Policy.Networks = []string{"192.0.2.0/24"}
+	if _, err := srv.KeyDB.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BeginKeyRotation(BeginKeyRotationReq{UUID: "a", CommandID: cmd.Command.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	rec, _ = srv.KeyDB.GetByUUID("a")
+	rec.Policy.Networks = nil
+	if _, err := srv.KeyDB.Upsert(rec); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := client.BeginKeyRotation(BeginKeyRotationReq{UUID: "a", CommandID: cmd.Command.ID})
+	if err != nil || !reflect.DeepEqual(keys.CurrentKey, createResp.KeyContent) || len(keys.NewKey) != len(keys.CurrentKey) || reflect.DeepEqual(keys.NewKey, keys.CurrentKey) {
+		t.Fatal(err, keys)
+	}
+	// The current key stays in effect until the rotation is committed
+	retrieve, err := client.ManualRetrieveKey(ManualRetrieveKeyReq{Password: passHash, UUIDs: []string{"a"}})
+	if err != nil || !reflect.DeepEqual(retrieve.Granted["a"].Key, keys.CurrentKey) {
+		t.Fatal(err, retrieve)
+	}
+	if err := client.CommitKeyRotation(CommitKeyRotationReq{UUID: "a", CommandID: cmd.Command.ID}); err != nil {
+		t.Fatal(err)
+	}
+	retrieve, err = client.ManualRetrieveKey(ManualRetrieveKeyReq{Password: passHash, UUIDs: []string{"a"}})
+	if err != nil || !reflect.DeepEqual(retrieve.Granted["a"].Key, keys.NewKey) {
+		t.Fatal(err, retrieve)
+	}
+	// Structured outcome is matched to the command by ID
+	if err := client.SaveCommandResult(SaveCommandResultReq{
+		UUID:           "a",
+		CommandContent: cmd.Content,
+		Result:         "Success",
+		CommandID:      cmd.Command.ID,
+		Outcome:        keydb.CommandResult{Success: true, Message: "Success", Details: map[string]string{"k": "v"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ = srv.KeyDB.GetByUUID("a")
+	if saved := rec.PendingCommands[clientIP][0]; !saved.Result.Success || saved.Result.Details["k"] != "v" || saved.ClientResult != "Success" || saved.Result.Finished.IsZero() {
+		t.Fatal(saved)
+	}
+	// Rotation is abandoned once its command expires
+	shortCmd, err := keydb.NewPendingCommand("a", clientIP, keydb.CMD_ROTATE_KEY, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.KeyDB.AddPendingCommand("a", clientIP, shortCmd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BeginKeyRotation(BeginKeyRotationReq{UUID: "a", CommandID: shortCmd.Command.ID}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := client.CommitKeyRotation(CommitKeyRotationReq{UUID: "a", CommandID: shortCmd.Command.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	retrieve, err = client.ManualRetrieveKey(ManualRetrieveKeyReq{Password: passHash, UUIDs: []string{"a"}})
+	if err != nil || !reflect.DeepEqual(retrieve.Granted["a"].Key, keys.NewKey) {
+		t.Fatal(err, retrieve)
+	}
+}
+
+func TestFleetCommand(t *testing.T) {
+	srv, client, passHash, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+10, 10, 10)
+	defer tearDown()
+	for _, uuid := range []string{"a", "b"} {
+		if _, err := srv.KeyDB.Upsert(keydb.Record{UUID: uuid, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Heartbeat(HeartbeatReq{Hostname: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	clientIP := srv.KeyDB.ListHosts()[0].IP
+	srv.KeyDB.Select(keydb.AliveMessage{IP: clientIP, Hostname: "client", Timestamp: time.Now().Unix()}, false, "a", "b")
+	// Password is required
+	if err := client.TagHost(TagHostReq{IP: clientIP, Tags: []string{"prod-hana"}}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.TagHost(TagHostReq{Password: passHash, IP: clientIP, Tags: []string{"prod-hana"}}); err != nil {
+		t.Fatal(err)
+	}
+	req := SendFleetCommandReq{Selector: keydb.Selector{HostTags: []string{"prod-hana"}}, Action: keydb.CMD_UMOUNT, Validity: time.Hour}
+	if _, err := client.SendFleetCommand(req); err == nil {
+		t.Fatal("did not error")
+	}
+	req.Password = passHash
+	resp, err := client.SendFleetCommand(req)
+	if err != nil || len(resp.Targets) != 2 || resp.Targets[0].UUID != "a" || resp.Targets[1].IP != clientIP {
+		t.Fatal(err, resp)
+	}
+	// The computer picks up the commands and reports the outcome
+	poll, err := client.PollCommand(PollCommandReq{UUIDs: []string{"a", "b"}})
+	if err != nil || len(poll.Commands) != 2 || poll.Commands["a"][0].Command.Batch != resp.Batch {
+		t.Fatal(err, poll)
+	}
+	if err := client.SaveCommandResult(SaveCommandResultReq{
+		UUID:      "a",
+		CommandID: poll.Commands["a"][0].Command.ID,
+		Outcome:   keydb.CommandResult{Success: false, Message: "device is busy"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := client.GetBatch(GetBatchReq{Password: passHash, Batch: resp.Batch})
+	if err != nil || summary.Action != keydb.CMD_UMOUNT || summary.Failed != 1 || summary.Running != 1 || len(summary.Entries) != 2 {
+		t.Fatal(err, summary)
+	}
+	if _, err := client.GetBatch(GetBatchReq{Password: passHash, Batch: "does-not-exist"}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestKeyUsagePolicy(t *testing.T) {
+	srv, client, passHash, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+11, 10, 10)
+	defer tearDown()
+	for _, uuid := range []string{"a", "b"} {
+		if _, err := client.CreateKey(CreateKeyReq{Password: passHash, Hostname: "localhost", UUID: uuid, MountPoint: "/" + uuid, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.KeyDB.SetPolicy("a", keydb.Policy{RequireApproval: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.KeyDB.SetPolicy("b", keydb.Policy{Networks: []string{"192.0.2.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a", "b"}, Hostname: "client"})
+	if err != nil || len(resp.Granted) != 0 || !reflect.DeepEqual(resp.Rejected, []string{"a", "b"}) ||
+		!reflect.DeepEqual(resp.Reasons, map[string]string{"a": keydb.REJECT_APPROVAL_REQUIRED, "b": keydb.REJECT_NETWORK}) {
+		t.Fatal(err, resp)
+	}
+	if _, err := client.Heartbeat(HeartbeatReq{Hostname: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	clientIP := srv.KeyDB.ListHosts()[0].IP
+	// Password is required
+	if err := client.ApproveRetrieval(ApproveRetrievalReq{UUID: "a", IP: clientIP}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.ApproveRetrieval(ApproveRetrievalReq{Password: passHash, UUID: "a", IP: clientIP, Validity: 30 * 24 * time.Hour}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.ApproveRetrieval(ApproveRetrievalReq{Password: passHash, UUID: "a", IP: clientIP}); err != nil {
+		t.Fatal(err)
+	}
+	// The approval lets the computer retrieve the key exactly once
+	resp, err = client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client"})
+	if err != nil || len(resp.Granted["a"].Key) == 0 || len(resp.Rejected) != 0 {
+		t.Fatal(err, resp)
+	}
+	resp, err = client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client"})
+	if err != nil || len(resp.Granted) != 0 || resp.Reasons["a"] != keydb.REJECT_APPROVAL_REQUIRED {
+		t.Fatal(err, resp)
+	}
+}
+
+func TestDualControlRPC(t *testing.T) {
+	srv, client, passHash, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+12, 10, 10)
+	defer tearDown()
+	if _, err := client.CreateKey(CreateKeyReq{Password: passHash, Hostname: "localhost", UUID: "a", MountPoint: "/a", AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// Dual control is disabled by default
+	resp, err := client.RequestDualControl(RequestDualControlReq{Password: passHash, Admin: "alice@host1", Action: DUAL_CONTROL_ERASE, UUIDs: []string{"a"}})
+	if err != nil || resp.Required {
+		t.Fatal(err, resp)
+	}
+	srv.Config.DualControl = true
+	srv.DualControl = NewDualControl(time.Minute)
+	aliceToken, aliceEntry, err := keydb.NewClientToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobToken, bobEntry, err := keydb.NewClientToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.APIGrants = []string{"admin:" + aliceEntry, "admin:" + bobEntry}
+	if _, err := client.ManualRetrieveKey(ManualRetrieveKeyReq{Password: passHash, UUIDs: []string{"a"}, Admin: "alice@host1"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.EraseKey(EraseKeyReq{Password: passHash, UUID: "a", Admin: "alice@host1"}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Retrieval is confirmed by a second administrator
+	if _, err := client.RequestDualControl(RequestDualControlReq{Admin: "alice@host1", Action: DUAL_CONTROL_RETRIEVE, UUIDs: []string{"a"}}); err == nil {
+		t.Fatal("did not error")
+	}
+	// The requester has to prove who they are, without their own token the response only tells confirmation is required
+	resp, err = client.RequestDualControl(RequestDualControlReq{Password: passHash, Admin: "alice@host1", Action: DUAL_CONTROL_RETRIEVE, UUIDs: []string{"a"}})
+	if err != nil || !resp.Required || resp.Request.ID != "" || len(srv.DualControl.List()) != 0 {
+		t.Fatal(err, resp)
+	}
+	if _, err := client.RequestDualControl(RequestDualControlReq{Password: passHash, Admin: "alice@host1", Action: DUAL_CONTROL_RETRIEVE, UUIDs: []string{"a"}, APIToken: "wrong token"}); err == nil {
+		t.Fatal("did not error")
+	}
+	// One administrator holding the password and a token may not ask under another name and confirm by themselves
+	resp, err = client.RequestDualControl(RequestDualControlReq{Password: passHash, Admin: "carol@host3", Action: DUAL_CONTROL_RETRIEVE, UUIDs: []string{"a"}, APIToken: bobToken})
+	if err != nil || resp.Request.ID == "" {
+		t.Fatal(err, resp)
+	}
+	if _, err := client.ConfirmDualControl(DualControlReq{Password: passHash, Admin: "bob@host2", ID: resp.Request.ID, APIToken: bobToken}); err == nil {
+		t.Fatal("did not error")
+	}
+	resp, err = client.RequestDualControl(RequestDualControlReq{Password: passHash, Admin: "alice@host1", Action: DUAL_CONTROL_RETRIEVE, UUIDs: []string{"a"}, APIToken: aliceToken})
+	if err != nil || !resp.Required || resp.Request.ID == "" {
+		t.Fatal(err, resp)
+	}
+	// Anyone knowing the password could claim to be the second administrator
+	if _, err := client.ConfirmDualControl(DualControlReq{Password: passHash, Admin: "bob@host2", ID: resp.Request.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := client.ConfirmDualControl(DualControlReq{Password: passHash, Admin: "bob@host2", ID: resp.Request.ID, APIToken: "wrong token"}); err == nil {
+		t.Fatal("did not error")
+	}
+	confirmed, err := client.ConfirmDualControl(DualControlReq{Password: passHash, Admin: "bob@host2", ID: resp.Request.ID, APIToken: bobToken})
+	if err != nil || confirmed.Approver.Name != bobEntry {
+		t.Fatal(err, confirmed)
+	}
+	if got, err := client.GetDualControl(DualControlReq{Password: passHash, ID: resp.Request.ID}); err != nil || !got.IsApproved() {
+		t.Fatal(err, got)
+	}
+	retrieved, err := client.ManualRetrieveKey(ManualRetrieveKeyReq{Password: passHash, UUIDs: []string{"a"}, Admin: "alice@host1", DualControlID: resp.Request.ID})
+	if err != nil || len(retrieved.Granted["a"].Key) == 0 {
+		t.Fatal(err, retrieved)
+	}
+	// Self-destruct command is confirmed by a second administrator
+	selfDestruct := SendCommandReq{
+		Password: passHash,
+		UUID:     "a",
+		IP:       "10.0.0.1",
+		Action:   keydb.CMD_SELF_DESTRUCT,
+		Params:   map[string]string{keydb.CMD_PARAM_CONFIRM_UUID: "a"},
+		Validity: time.Minute,
+		Admin:    "alice@host1",
+	}
+	if err := client.SendCommand(selfDestruct); err == nil {
+		t.Fatal("did not error")
+	}
+	resp, err = client.RequestDualControl(RequestDualControlReq{Password: passHash, Admin: "alice@host1", Action: DUAL_CONTROL_SELF_DESTRUCT, UUIDs: []string{"a"}, APIToken: aliceToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ConfirmDualControl(DualControlReq{Password: passHash, ID: resp.Request.ID, APIToken: bobToken}); err != nil {
+		t.Fatal(err)
+	}
+	selfDestruct.DualControlID = resp.Request.ID
+	if err := client.SendCommand(selfDestruct); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := srv.KeyDB.GetByUUID("a"); len(rec.PendingCommands["10.0.0.1"]) != 1 {
+		t.Fatal(rec.PendingCommands)
+	}
+	// Rotate-key command hands out the key, hence it is confirmed as a retrieval
+	rotateKey := SendCommandReq{Password: passHash, UUID: "a", IP: "10.0.0.1", Action: keydb.CMD_ROTATE_KEY, Validity: time.Minute, Admin: "alice@host1"}
+	if err := client.SendCommand(rotateKey); err == nil {
+		t.Fatal("did not error")
+	}
+	resp, err = client.RequestDualControl(RequestDualControlReq{Password: passHash, Admin: "alice@host1", Action: DUAL_CONTROL_RETRIEVE, UUIDs: []string{"a"}, APIToken: aliceToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ConfirmDualControl(DualControlReq{Password: passHash, ID: resp.Request.ID, APIToken: bobToken}); err != nil {
+		t.Fatal(err)
+	}
+	rotateKey.DualControlID = resp.Request.ID
+	if err := client.SendCommand(rotateKey); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := srv.KeyDB.GetByUUID("a"); len(rec.PendingCommands["10.0.0.1"]) != 2 {
+		t.Fatal(rec.PendingCommands)
+	}
+	// Erasure is confirmed by a second administrator
+	resp, err = client.RequestDualControl(RequestDualControlReq{Password: passHash, Admin: "alice@host1", Action: DUAL_CONTROL_ERASE, UUIDs: []string{"a"}, APIToken: aliceToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs, err := client.ListDualControl(DualControlReq{Password: passHash}); err != nil || len(reqs) != 2 {
+		t.Fatal(err, reqs)
+	}
+	if err := client.EraseKey(EraseKeyReq{Password: passHash, UUID: "a", Admin: "alice@host1", DualControlID: resp.Request.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, found := srv.KeyDB.GetByUUID("a"); !found {
+		t.Fatal("erased without confirmation")
+	}
+	if _, err := client.ConfirmDualControl(DualControlReq{Password: passHash, Admin: "bob@host2", ID: resp.Request.ID, APIToken: bobToken}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EraseKey(EraseKeyReq{Password: passHash, UUID: "a", Admin: "alice@host1", DualControlID: resp.Request.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := srv.KeyDB.GetByUUID("a"); found {
+		t.Fatal("did not erase")
+	}
+	var types []string
+	for _, event := range srv.Events.Since(0) {
+		types = append(types, event.Type)
+	}
+	if !strings.Contains(strings.Join(types, " "), "dual-requested dual-confirmed key-granted dual-requested dual-confirmed command-added dual-requested dual-confirmed command-added dual-requested dual-confirmed key-erased") {
+		t.Fatal(types)
+	}
+}
+
+func TestLeaseRPC(t *testing.T) {
+	srv, client, passHash, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+13, 10, 10)
+	defer tearDown()
+	if _, err := client.CreateKey(CreateKeyReq{Password: passHash, Hostname: "localhost", UUID: "a", MountPoint: "/a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// The key comes with a lease
+	resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client"})
+	lease := resp.Leases["a"]
+	if err != nil || len(resp.Granted["a"].Key) == 0 || lease.ID == "" || !lease.Expiry.After(time.Now()) {
+		t.Fatal(err, resp)
+	}
+	// Heartbeat renews the lease by its ID
+	beat, err := client.Heartbeat(HeartbeatReq{Hostname: "client", UUIDs: []string{"a"}, Leases: map[string]string{"a": lease.ID}})
+	if err != nil || len(beat.Rejected) != 0 || beat.Leases["a"].ID != lease.ID {
+		t.Fatal(err, beat)
+	}
+	// Password is required
+	if _, err := client.ListLeases(ListLeasesReq{UUID: "a"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if leases, err := client.ListLeases(ListLeasesReq{Password: passHash, UUID: "a"}); err != nil || len(leases) != 1 || leases[0].ID != lease.ID {
+		t.Fatal(leases, err)
+	}
+	if err := client.RevokeLease(RevokeLeaseReq{ID: lease.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.RevokeLease(RevokeLeaseReq{Password: passHash, ID: "does-not-exist"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.RevokeLease(RevokeLeaseReq{Password: passHash, ID: lease.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if events := srv.Events.Since(0); events[len(events)-1].Type != EVENT_LEASE_REVOKED {
+		t.Fatal(events)
+	}
+	// The computer holding the revoked lease is told to let go of the key
+	beat, err = client.Heartbeat(HeartbeatReq{Hostname: "client", UUIDs: []string{"a"}, Leases: map[string]string{"a": lease.ID}})
+	if err != nil || !reflect.DeepEqual(beat.Rejected, []string{"a"}) {
+		t.Fatal(err, beat)
+	}
+	if leases, err := client.ListLeases(ListLeasesReq{Password: passHash}); err != nil || len(leases) != 0 {
+		t.Fatal(leases, err)
+	}
+	// Fencing takes away the key from the computer
+	if resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client"}); err != nil || len(resp.Granted) != 1 {
+		t.Fatal(err, resp)
+	}
+	if _, err := client.FenceHost(FenceHostReq{Host: "client"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := client.FenceHost(FenceHostReq{Password: passHash}); err == nil {
+		t.Fatal("did not error")
+	}
+	if fenced, err := client.FenceHost(FenceHostReq{Password: passHash, Host: "client"}); err != nil || !reflect.DeepEqual(fenced, []string{"a"}) {
+		t.Fatal(fenced, err)
+	}
+	if events := srv.Events.Since(0); events[len(events)-1].Type != EVENT_HOST_FENCED {
+		t.Fatal(events)
+	}
+	if resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client2"}); err != nil || len(resp.Granted) != 1 {
+		t.Fatal(err, resp)
+	}
+}
+
+func TestReleaseKey(t *testing.T) {
+	srv, client, passHash, tearDown := startConnTestServer(t, SRV_DEFAULT_PORT+14, 10, 10)
+	defer tearDown()
+	if _, err := client.CreateKey(CreateKeyReq{Password: passHash, Hostname: "localhost", UUID: "a", MountPoint: "/a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client"})
+	if err != nil || len(resp.Granted["a"].Key) == 0 {
+		t.Fatal(err, resp)
+	}
+	// Retrieving the key again without presenting the lease counts as another computer
+	if again, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client"}); err != nil || len(again.Rejected) != 1 {
+		t.Fatal(err, again)
+	}
+	// Retrieving the key again with the lease replaces the lease rather than counting the computer twice
+	again, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client", Leases: map[string]string{"a": resp.Leases["a"].ID}})
+	if err != nil || len(again.Granted["a"].Key) == 0 || again.Leases["a"].ID == resp.Leases["a"].ID {
+		t.Fatal(err, again)
+	}
+	if leases := srv.KeyDB.ListLeases("a"); len(leases) != 1 || leases[0].ID != again.Leases["a"].ID {
+		t.Fatal(leases)
+	}
+	if resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client2"}); err != nil || len(resp.Rejected) != 1 {
+		t.Fatal(err, resp)
+	}
+	// Releasing the key lets the next retrieval through right away
+	released, err := client.ReleaseKey(ReleaseKeyReq{Hostname: "client", UUIDs: []string{"a", "does-not-exist"}, Leases: map[string]string{"a": again.Leases["a"].ID}})
+	if err != nil || !reflect.DeepEqual(released, []string{"a"}) {
+		t.Fatal(released, err)
+	}
+	if events := srv.Events.Since(0); events[len(events)-1].Type != EVENT_KEY_RELEASED {
+		t.Fatal(events)
+	}
+	if released, err := client.ReleaseKey(ReleaseKeyReq{Hostname: "client", UUIDs: []string{"a"}}); err != nil || len(released) != 0 {
+		t.Fatal(released, err)
+	}
+	if resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"a"}, Hostname: "client2"}); err != nil || len(resp.Granted["a"].Key) == 0 {
+		t.Fatal(err, resp)
+	}
+}
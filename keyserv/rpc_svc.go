@@ -4,6 +4,7 @@ package keyserv
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/subtle"
 	"crypto/tls"
@@ -23,6 +24,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -31,6 +33,10 @@ const (
 	LEN_PASS_SALT     = 64   // length of random salt to go with each password
 	SRV_DEFAULT_PORT  = 3737 // default port for the key server to listen on
 
+	SRV_DEFAULT_MAX_CONNS        = 1000 // default maximum number of concurrent client connections
+	SRV_DEFAULT_IDLE_TIMEOUT_SEC = 300  // default duration after which an idle client connection is closed
+	WAIT_COMMAND_MAX_SEC         = 60   // maximum duration for a client to wait for pending commands in a single call
+
 	SRV_CONF_PASS_HASH           = "AUTH_PASSWORD_HASH"
 	SRV_CONF_PASS_SALT           = "AUTH_PASSWORD_SALT"
 	SRV_CONF_TLS_CA              = "TLS_CA_PEM"
@@ -40,6 +46,20 @@ const (
 	SRV_CONF_LISTEN_ADDR         = "LISTEN_ADDRESS"
 	SRV_CONF_LISTEN_PORT         = "LISTEN_PORT"
 	SRV_CONF_KEYDB_DIR           = "KEY_DB_DIR"
+	SRV_CONF_BINDING_KEY         = "BINDING_KEY_PEM"
+	SRV_CONF_CA_CERT             = "CA_CERT_PEM"
+	SRV_CONF_CA_KEY              = "CA_KEY_PEM"
+	SRV_CONF_TLS_CRL             = "TLS_CRL_PEM"
+	SRV_CONF_CLIENT_CERT_DAYS    = "CLIENT_CERT_VALIDITY_DAYS"
+	SRV_CONF_CERT_EXPIRY_WARN    = "CERT_EXPIRY_WARNING_DAYS"
+	SRV_CONF_TLS_AUDIT_LOG       = "TLS_AUDIT_LOG"
+	SRV_CONF_LEGACY_RPC          = "LEGACY_RPC"
+	SRV_CONF_API_PORT            = "API_PORT"
+	SRV_CONF_API_GRANTS          = "API_GRANTS"
+	SRV_CONF_MAX_CONNS           = "MAX_CONNECTIONS"
+	SRV_CONF_IDLE_TIMEOUT        = "CONNECTION_IDLE_TIMEOUT_SEC"
+	SRV_CONF_DUAL_CONTROL        = "DUAL_CONTROL"
+	SRV_CONF_DUAL_CONTROL_WINDOW = "DUAL_CONTROL_WINDOW_SEC"
 	SRV_CONF_MAIL_CREATION_SUBJ  = "EMAIL_KEY_CREATION_SUBJECT"
 	SRV_CONF_MAIL_CREATION_TEXT  = "EMAIL_KEY_CREATION_GREETING"
 	SRV_CONF_MAIL_RETRIEVAL_SUBJ = "EMAIL_KEY_RETRIEVAL_SUBJECT"
@@ -101,6 +121,21 @@ type CryptServiceConfig struct {
 	Address              string              // address of the network interface to listen on
 	Port                 int                 // port to listen on
 	KeyDBDir             string              // key database directory
+	BindingKeyPEM        string              // optional binding key for network-bound disk keys, generated on first use
+	CACertPEM            string              // optional built-in CA certificate that issues client certificates upon enrolment
+	CAKeyPEM             string              // private key of the built-in CA
+	CRLPEM               string              // optional revocation list enforced on client certificates
+	ClientCertDays       int                 // validity of client certificates issued upon enrolment
+	CertExpiryWarnDays   int                 // warn about certificates that expire within so many days
+	TLSPolicy            TLSPolicy           // TLS versions and algorithms of RPC and KMIP connections
+	TLSAuditLog          bool                // log negotiated TLS parameters of each incoming connection
+	LegacyRPC            bool                // serve net/rpc with gob encoding (protocol version 1) to clients of earlier versions
+	APIPort              int                 // port of HTTPS management API, or 0 to disable the API
+	APIGrants            []string            // roles granted to API tokens and client certificates (ROLE:IDENTITY)
+	MaxConnections       int                 // maximum number of concurrent client connections over TCP, or 0 for unlimited
+	IdleTimeoutSec       int                 // close client connections that have been idle for so long, or 0 to keep them
+	DualControl          bool                // retrieving keys with password and erasing keys require a second administrator
+	DualControlWindowSec int                 // the second administrator has to confirm within so many seconds
 	KeyCreationSubject   string              // subject of the notification email sent by key creation request
 	KeyCreationGreeting  string              // greeting of the notification email sent by key creation request
 	KeyRetrievalSubject  string              // subject of the notification email sent by key retrieval request
@@ -126,6 +161,26 @@ func (conf *CryptServiceConfig) Validate() error {
 		return errors.New("Validate: network port to listen on is not specified")
 	} else if !strings.HasPrefix(conf.KeyDBDir, "/") {
 		return fmt.Errorf("Validate: key database directory \"%s\" should be an absolute path", conf.KeyDBDir)
+	} else if conf.BindingKeyPEM != "" && !strings.HasPrefix(conf.BindingKeyPEM, "/") {
+		return fmt.Errorf("Validate: binding key file \"%s\" should be an absolute path", conf.BindingKeyPEM)
+	} else if (conf.CACertPEM == "") != (conf.CAKeyPEM == "") {
+		return errors.New("Validate: built-in CA requires both certificate and key files")
+	} else if conf.CACertPEM != "" && conf.ClientCertDays < 1 {
+		return fmt.Errorf("Validate: client certificate validity (%d days) must be at least one day", conf.ClientCertDays)
+	} else if conf.APIPort != 0 && conf.APIPort == conf.Port {
+		return fmt.Errorf("Validate: HTTP API port %d must differ from RPC port", conf.APIPort)
+	} else if conf.MaxConnections < 0 {
+		return fmt.Errorf("Validate: maximum number of connections (%d) must not be negative", conf.MaxConnections)
+	} else if conf.IdleTimeoutSec < 0 || conf.IdleTimeoutSec == 1 {
+		// Clients waiting for commands are let go after half of the idle timeout, which must be at least a second.
+		return fmt.Errorf("Validate: connection idle timeout (%d seconds) must be 0 or at least 2 seconds", conf.IdleTimeoutSec)
+	} else if conf.DualControl && conf.DualControlWindowSec < 1 {
+		return fmt.Errorf("Validate: dual control window (%d seconds) must be at least one second", conf.DualControlWindowSec)
+	}
+	for _, grant := range conf.APIGrants {
+		if _, _, err := ParseAPIGrant(grant); err != nil {
+			return fmt.Errorf("Validate: %v", err)
+		}
 	}
 	return nil
 }
@@ -151,6 +206,23 @@ func (conf *CryptServiceConfig) ReadFromSysconfig(sysconf *sys.Sysconfig) error
 	conf.Port = sysconf.GetInt(SRV_CONF_LISTEN_PORT, SRV_DEFAULT_PORT)
 
 	conf.KeyDBDir = sysconf.GetString(SRV_CONF_KEYDB_DIR, "/var/lib/cryptctl/keydb")
+	conf.BindingKeyPEM = sysconf.GetString(SRV_CONF_BINDING_KEY, "")
+	conf.CACertPEM = sysconf.GetString(SRV_CONF_CA_CERT, "")
+	conf.CAKeyPEM = sysconf.GetString(SRV_CONF_CA_KEY, "")
+	conf.CRLPEM = sysconf.GetString(SRV_CONF_TLS_CRL, "")
+	conf.ClientCertDays = sysconf.GetInt(SRV_CONF_CLIENT_CERT_DAYS, CLIENT_CERT_DEFAULT_VALIDITY_DAYS)
+	conf.CertExpiryWarnDays = sysconf.GetInt(SRV_CONF_CERT_EXPIRY_WARN, CERT_EXPIRY_DEFAULT_WARN_DAYS)
+	if conf.TLSPolicy, err = ReadTLSPolicyFromSysconfig(sysconf); err != nil {
+		return err
+	}
+	conf.TLSAuditLog = sysconf.GetBool(SRV_CONF_TLS_AUDIT_LOG, false)
+	conf.LegacyRPC = sysconf.GetBool(SRV_CONF_LEGACY_RPC, true)
+	conf.APIPort = sysconf.GetInt(SRV_CONF_API_PORT, 0)
+	conf.APIGrants = sysconf.GetStringArray(SRV_CONF_API_GRANTS, []string{})
+	conf.MaxConnections = sysconf.GetInt(SRV_CONF_MAX_CONNS, SRV_DEFAULT_MAX_CONNS)
+	conf.IdleTimeoutSec = sysconf.GetInt(SRV_CONF_IDLE_TIMEOUT, SRV_DEFAULT_IDLE_TIMEOUT_SEC)
+	conf.DualControl = sysconf.GetBool(SRV_CONF_DUAL_CONTROL, false)
+	conf.DualControlWindowSec = sysconf.GetInt(SRV_CONF_DUAL_CONTROL_WINDOW, DUAL_CONTROL_DEFAULT_WINDOW_SEC)
 
 	conf.KeyCreationSubject = sysconf.GetString(SRV_CONF_MAIL_CREATION_SUBJ, "A new file system has been encrypted")
 	conf.KeyCreationGreeting = sysconf.GetString(SRV_CONF_MAIL_CREATION_TEXT, "The key server now has encryption key for the following file system:")
@@ -169,15 +241,66 @@ func (conf *CryptServiceConfig) ReadFromSysconfig(sysconf *sys.Sysconfig) error
 
 // RPC and KMIP server for accessing encryption keys.
 type CryptServer struct {
-	Config            CryptServiceConfig // service configuration
-	Mailer            *Mailer            // mail notification sender
-	KeyDB             *keydb.DB          // encryption key database
-	TLSConfig         *tls.Config        // TLS certificate chain and private key
-	TCPListener       net.Listener       // TCPListener is the TCP server that serves all RPC functions
-	UnixListener      net.Listener       // UnixListener is the Unix domain socket that serves all RPC functions
-	BuiltInKMIPServer *KMIPServer        // Built-in KMIP server in case there's no external server
-	KMIPClient        *KMIPClient        // KMIP client connected to either built-in KMIP server or external server
-	AdminChallenge    []byte             // a random secret that must be verified for incoming shutdown/reload requests
+	Config             CryptServiceConfig // service configuration
+	Mailer             *Mailer            // mail notification sender
+	KeyDB              *keydb.DB          // encryption key database
+	TLSConfig          *tls.Config        // TLS certificate chain and private key
+	TCPListener        net.Listener       // TCPListener is the TCP server that serves all RPC functions
+	UnixListener       net.Listener       // UnixListener is the Unix domain socket that serves all RPC functions
+	BuiltInKMIPServer  *KMIPServer        // Built-in KMIP server in case there's no external server
+	KMIPClient         *KMIPClient        // KMIP client connected to either built-in KMIP server or external server
+	AdminChallenge     []byte             // a random secret that must be verified for incoming shutdown/reload requests
+	TLS                *TLSMaterial       // certificate, key, and client CAs that are reloaded upon change
+	Revocation         *RevocationList    // revocation list enforced on client certificates, or nil
+	Events             *EventLog          // most recent events for HTTP API
+	CommandIssued      *CommandSignal     // wakes up clients waiting for pending commands
+	DualControl        *DualControl       // requests to retrieve or erase keys that await a second administrator
+	APIListener        net.Listener       // APIListener is the TCP server that serves HTTP API, or nil if API is disabled
+	connSlots          chan struct{}      // each TCP connection occupies a slot, or nil if connections are unlimited
+	bindingKey         *BindingKey        // binding key of network-bound disk keys, loaded on first use
+	bindingKeyMutex    *sync.Mutex        // protects bindingKey from concurrent loading
+	shutdownTLSMonitor chan bool          // tells MonitorTLS to quit
+	pollMutex          *sync.Mutex        // prevents a pending command from being delivered twice by concurrent polls
+	rotations          *keyRotations      // key rotations that have begun but not yet been committed
+}
+
+// keyRotations are the new keys handed to clients by disk UUID, they take effect once committed by the clients.
+type keyRotations struct {
+	mutex   *sync.Mutex
+	pending map[string]keyRotation
+}
+
+// keyRotation is a new key handed to a client for a disk.
+type keyRotation struct {
+	commandID string    // commandID is the rotate-key command that the client is carrying out
+	ip        string    // ip is the client that received the new key
+	kmipID    string    // kmipID refers to the new key in KMIP server
+	key       []byte    // key is the new key, it is only saved in database if key is kept by built-in KMIP server
+	expiry    time.Time // expiry is the moment the rotate-key command expires, the rotation is abandoned afterwards
+}
+
+/*
+Destroy the new key of a rotation that will not be committed, unless the key is kept in the database record by built-in
+KMIP server. Caller must hold the mutex of rotations.
+*/
+func (srv *CryptServer) discardKeyRotation(uuid string, rotation keyRotation) {
+	if rec, found := srv.KeyDB.GetByUUID(uuid); found && rec.ID == rotation.kmipID {
+		return
+	}
+	if err := srv.KMIPClient.DestroyKey(rotation.kmipID); err != nil {
+		log.Printf("CryptServer.discardKeyRotation: KMIP did not erase the unused new key of \"%s\" - %v", uuid, err)
+	}
+}
+
+// Abandon the key rotations of expired rotate-key commands. Caller must hold the mutex of rotations.
+func (srv *CryptServer) expireKeyRotations() {
+	now := time.Now()
+	for uuid, rotation := range srv.rotations.pending {
+		if now.After(rotation.expiry) {
+			srv.discardKeyRotation(uuid, rotation)
+			delete(srv.rotations.pending, uuid)
+		}
+	}
 }
 
 // Initialise an RPC server from sysconfig file text.
@@ -186,9 +309,19 @@ func NewCryptServer(config CryptServiceConfig, mailer Mailer) (srv *CryptServer,
 		return nil, err
 	}
 	srv = &CryptServer{
-		Config:    config,
-		Mailer:    &mailer,
-		TLSConfig: new(tls.Config),
+		Config:             config,
+		Mailer:             &mailer,
+		TLSConfig:          new(tls.Config),
+		Events:             NewEventLog(),
+		CommandIssued:      NewCommandSignal(),
+		DualControl:        NewDualControl(time.Duration(config.DualControlWindowSec) * time.Second),
+		bindingKeyMutex:    new(sync.Mutex),
+		pollMutex:          new(sync.Mutex),
+		rotations:          &keyRotations{mutex: new(sync.Mutex), pending: make(map[string]keyRotation)},
+		shutdownTLSMonitor: make(chan bool, 1),
+	}
+	if config.MaxConnections > 0 {
+		srv.connSlots = make(chan struct{}, config.MaxConnections)
 	}
 	srv.KeyDB, err = keydb.OpenDB(config.KeyDBDir)
 	if err != nil {
@@ -197,20 +330,31 @@ func NewCryptServer(config CryptServiceConfig, mailer Mailer) (srv *CryptServer,
 	/*
 	 The author of TLS related libraries in Go has an opinion about CRL
 	*/
-	srv.TLSConfig.Certificates = make([]tls.Certificate, 1)
-	srv.TLSConfig.Certificates[0], err = tls.LoadX509KeyPair(config.CertPEM, config.KeyPEM)
-	// Configure client authentication upon request
-	if config.ValidateClientCert {
-		caPEM, err := ioutil.ReadFile(config.CertAuthorityPEM)
-		if err != nil {
-			return nil, err
+	// Certificate, key, and client CAs may be reloaded while server is running, hence they are looked up upon handshake.
+	if srv.TLS, err = LoadTLSMaterial(config); err != nil {
+		return nil, err
+	}
+	clientCAs, _ := srv.TLS.ClientCAs()
+	if config.ValidateClientCert && len(clientCAs) == 0 {
+		return nil, errors.New("NewCryptServer: client certificate validation requires a certificate authority")
+	}
+	config.TLSPolicy.Apply(srv.TLSConfig)
+	// Clients that announce JSON-RPC learn that the server speaks it too
+	srv.TLSConfig.NextProtos = []string{PROTOCOL_ALPN}
+	srv.TLSConfig.GetCertificate = srv.TLS.GetCertificate
+	srv.TLSConfig.GetConfigForClient = srv.getConfigForClient
+	// Revoked client certificates are rejected during handshake
+	if config.CRLPEM != "" {
+		srv.Revocation = NewRevocationList(config.CRLPEM, clientCAs)
+		srv.TLSConfig.VerifyPeerCertificate = srv.Revocation.VerifyPeerCertificate
+		// A resumed session skips certificate verification, yet the certificate may have been revoked since.
+		srv.TLSConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if state.DidResume && len(state.PeerCertificates) > 0 {
+				return srv.Revocation.Check(state.PeerCertificates[0])
+			}
+			return nil
 		}
-		caPool := x509.NewCertPool()
-		caPool.AppendCertsFromPEM(caPEM)
-		srv.TLSConfig.ClientCAs = caPool
-		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	srv.TLSConfig.BuildNameToCertificate()
 	// Admin challenge is an array of random bytes
 	srv.AdminChallenge = make([]byte, LenAdminChallenge)
 	if _, err = rand.Read(srv.AdminChallenge); err != nil {
@@ -219,6 +363,32 @@ func NewCryptServer(config CryptServiceConfig, mailer Mailer) (srv *CryptServer,
 	return
 }
 
+/*
+Return TLS configuration for an incoming connection, the configuration uses the latest client CAs. The function
+signature is compatible with tls.Config.GetConfigForClient.
+*/
+func (srv *CryptServer) getConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	conf := srv.TLSConfig.Clone()
+	conf.GetConfigForClient = nil
+	clientCAs, clientCAPool := srv.TLS.ClientCAs()
+	conf.ClientCAs = clientCAPool
+	if srv.Config.ValidateClientCert {
+		if srv.TLS.CertAuthority() == nil {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			// Clients without certificate may connect to enrol, ServeConn restricts them to enrolment.
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if len(clientCAs) > 0 {
+		// Client certificate is optional, but its names can only be trusted after verification.
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	} else {
+		// Client certificate is optional and cannot be verified, yet its fingerprint may still identify the client.
+		conf.ClientAuth = tls.RequestClientCert
+	}
+	return conf, nil
+}
+
 /*
 Start RPC server. If the RPC server does not have KMIP connectivity settings, start an incomplete implementation
 of KMIP server.
@@ -231,6 +401,7 @@ func (srv *CryptServer) ListenTCP() error {
 		if srv.BuiltInKMIPServer, err = NewKMIPServer(srv.KeyDB, srv.Config.CertPEM, srv.Config.KeyPEM); err != nil {
 			return err
 		}
+		srv.Config.TLSPolicy.Apply(srv.BuiltInKMIPServer.TLSConfig)
 		if err := srv.BuiltInKMIPServer.Listen(); err != nil {
 			return err
 		}
@@ -258,6 +429,7 @@ func (srv *CryptServer) ListenTCP() error {
 			caCert, srv.Config.KMIPCertPEM, srv.Config.KMIPKeyPEM); err != nil {
 			return err
 		}
+		srv.Config.TLSPolicy.Apply(srv.KMIPClient.TLSConfig)
 		if !srv.Config.KMIPTLSDoVerify {
 			log.Printf("CryptServer.ListenTCP: KMIP client will not verify KMIP server's identity, as instructed by configuration.")
 			srv.KMIPClient.TLSConfig.InsecureSkipVerify = !srv.Config.KMIPTLSDoVerify
@@ -292,10 +464,22 @@ func (srv *CryptServer) HandleTCPConnections() {
 			log.Printf("CryptServer.HandleTCPConnections: quit now - %v", err)
 			return
 		}
+		if srv.connSlots != nil {
+			select {
+			case srv.connSlots <- struct{}{}:
+			default:
+				log.Printf("CryptServer.HandleTCPConnections: refuse connection from %s because there are already %d connections", incoming.RemoteAddr(), srv.Config.MaxConnections)
+				incoming.Close()
+				continue
+			}
+		}
 		// The connection is served by a dedicated RPC server instance
 		go func(conn net.Conn) {
 			srv.ServeConn(conn)
 			conn.Close()
+			if srv.connSlots != nil {
+				<-srv.connSlots
+			}
 		}(incoming)
 	}
 }
@@ -329,6 +513,13 @@ func (srv *CryptServer) Shutdown() {
 	if kmipServer := srv.BuiltInKMIPServer; kmipServer != nil {
 		kmipServer.Shutdown()
 	}
+	if srv.APIListener != nil {
+		srv.APIListener.Close()
+	}
+	select {
+	case srv.shutdownTLSMonitor <- true:
+	default:
+	}
 }
 
 /*
@@ -356,16 +547,9 @@ func (srv *CryptServer) CheckInitialSetup() error {
 	return nil
 }
 
-// Validate a password against stored hash.
+// Validate a password against stored hash. The password grants admin role, the same role is checked by HTTP API.
 func (srv *CryptServer) ValidatePassword(pass HashedPassword) error {
-	// Fail straight away if server setup is missing
-	if err := srv.CheckInitialSetup(); err != nil {
-		return err
-	}
-	if subtle.ConstantTimeCompare(pass[:], srv.Config.PasswordHash[:]) != 1 {
-		return errors.New("ValidatePassword: password is incorrect")
-	}
-	return nil
+	return srv.Authorise(Credential{Password: &pass}, ROLE_ADMIN)
 }
 
 // Create an RPC service object that handles requests from an incoming connection.
@@ -380,19 +564,142 @@ func (srv *CryptServer) ServeConn(incoming net.Conn) {
 	if remoteHost == "::1" {
 		remoteHost = "127.0.0.1"
 	}
-	if err := rpcSvc.Register(&CryptServiceConn{RemoteHost: remoteHost, Svc: srv}); err != nil {
+	identity := keydb.ClientIdentity{IP: remoteHost}
+	var clientCert *x509.Certificate
+	idleTimeout := time.Duration(srv.Config.IdleTimeoutSec) * time.Second
+	if tlsConn, isTLS := incoming.(*tls.Conn); isTLS {
+		if idleTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(idleTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("CryptServer.ServeConn: TLS handshake with %s failed - %v", remoteHost, err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		if srv.Config.TLSAuditLog {
+			log.Printf("CryptServer.ServeConn: %s connected via %s", remoteHost, GetTLSAudit(state))
+		}
+		identity = GetClientIdentity(remoteHost, state)
+		if len(state.VerifiedChains) > 0 {
+			clientCert = state.PeerCertificates[0]
+		}
+	}
+	rpcConn := &CryptServiceConn{RemoteHost: remoteHost, Identity: identity, ClientCert: clientCert, Svc: srv}
+	if _, isTLS := incoming.(*tls.Conn); isTLS && srv.Config.ValidateClientCert && clientCert == nil {
+		// The client must enrol before it may use the other functions
+		err = rpcSvc.RegisterName(reflect.TypeOf(CryptServiceConn{}).Name(), &EnrolmentConn{rpcConn: rpcConn})
+	} else {
+		err = rpcSvc.Register(rpcConn)
+	}
+	if err != nil {
 		log.Panicf("ServeConn: failed to register RPC service - %v", err)
 	}
-	rpcSvc.ServeConn(incoming)
+	if idleTimeout > 0 {
+		incoming = &idleTimeoutConn{Conn: incoming, timeout: idleTimeout}
+	}
+	if clientCert != nil {
+		// The connection may outlive the certificate
+		incoming = &verifiedConn{Conn: incoming, cert: clientCert, revocation: srv.Revocation}
+	}
+	srv.serveRPC(rpcSvc, incoming, remoteHost)
+}
+
+// verifiedConn closes the connection once the client certificate expires or gets revoked.
+type verifiedConn struct {
+	net.Conn
+	cert       *x509.Certificate
+	revocation *RevocationList
+}
+
+// Verify the certificate upon receiving data, since the request may arrive long after the connection went idle.
+func (conn *verifiedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		if verifyErr := conn.verify(); verifyErr != nil {
+			log.Printf("CryptServer.ServeConn: close connection from %s - %v", conn.RemoteAddr(), verifyErr)
+			return 0, verifyErr
+		}
+	}
+	return n, err
+}
+
+// Return an error if the client certificate is no longer valid.
+func (conn *verifiedConn) verify() error {
+	if time.Now().After(conn.cert.NotAfter) {
+		return fmt.Errorf("client certificate \"%s\" has expired", conn.cert.Subject.CommonName)
+	}
+	if conn.revocation != nil {
+		return conn.revocation.Check(conn.cert)
+	}
+	return nil
+}
+
+// idleTimeoutConn closes the connection if the client neither sends a request nor reads a response for a while.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (conn *idleTimeoutConn) Read(b []byte) (int, error) {
+	conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Read(b)
+}
+
+func (conn *idleTimeoutConn) Write(b []byte) (int, error) {
+	conn.Conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Write(b)
+}
+
+/*
+Return the identity of a client connected via TLS. Names of the client certificate are only considered if the
+certificate has been verified by the certificate authority.
+*/
+func GetClientIdentity(remoteHost string, state tls.ConnectionState) (identity keydb.ClientIdentity) {
+	identity.IP = remoteHost
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	identity.CertFingerprint = hex.EncodeToString(fingerprint[:])
+	if len(state.VerifiedChains) > 0 {
+		identity.CertNames = append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	}
 	return
 }
 
 // Serve RPC routines for key creation/retrieval services.
 type CryptServiceConn struct {
-	RemoteHost string
+	RemoteHost string               // RemoteHost is the client's IP address
+	Identity   keydb.ClientIdentity // Identity is the client's IP address and certificate
+	ClientCert *x509.Certificate    // ClientCert is the client's verified certificate, or nil
 	Svc        *CryptServer
 }
 
+/*
+Divide the UUIDs into those that the client may retrieve without password, and those that the client is not permitted
+to. Missing UUIDs are considered permitted.
+*/
+func (rpcConn *CryptServiceConn) checkClientIdentity(uuids []string, tokens map[string]string) (permitted, denied []string) {
+	permitted = make([]string, 0, len(uuids))
+	denied = make([]string, 0, 0)
+	for _, uuid := range uuids {
+		rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid)
+		identity := rpcConn.Identity
+		identity.Token = tokens[uuid]
+		if found && !rec.IsClientAllowed(identity) {
+			denied = append(denied, uuid)
+		} else {
+			permitted = append(permitted, uuid)
+		}
+	}
+	if len(denied) > 0 {
+		log.Printf("CryptServiceConn: %s (certificate fingerprint \"%s\") is not allowed to access %v",
+			rpcConn.RemoteHost, rpcConn.Identity.CertFingerprint, denied)
+	}
+	return
+}
+
 var RPCObjNameFmt = reflect.TypeOf(CryptServiceConn{}).Name() + ".%s" // for constructing RPC function name in RPC call
 
 // A request to ping server and test its readiness for key operations.
@@ -423,6 +730,7 @@ type CreateKeyReq struct {
 	MaxActive        int            // maximum allowed active key users (computers), set to <=0 to allow unlimited.
 	AliveIntervalSec int            //interval in seconds at which all user of the file system holding this key must report they're online
 	AliveCount       int            //a computer holding the file system is considered offline after missing so many alive messages
+	AllowedClients   []string       // computers that may retrieve the key without password (see keydb.ClientIdentity), or empty for any
 }
 
 // Make sure that the request attributes are sane.
@@ -432,12 +740,21 @@ func (req CreateKeyReq) Validate() error {
 	} else if req.MountPoint == "" {
 		return errors.New("Mount point must not be empty")
 	}
+	for _, entry := range req.AllowedClients {
+		if entry == keydb.CLIENT_ID_NEW_TOKEN {
+			continue
+		}
+		if _, err := keydb.NormaliseAllowedClient(entry); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // A response to a newly saved key
 type CreateKeyResp struct {
 	KeyContent []byte // Disk encryption key
+	Token      string // Enrolment token for the client to retrieve the key later, if it was asked for
 }
 
 // Save a new key record.
@@ -482,6 +799,19 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 	keyRecord.MaxActive = req.MaxActive
 	keyRecord.AliveIntervalSec = req.AliveIntervalSec
 	keyRecord.AliveCount = req.AliveCount
+	keyRecord.AllowedClients = make([]string, 0, len(req.AllowedClients))
+	for _, entry := range req.AllowedClients {
+		if entry == keydb.CLIENT_ID_NEW_TOKEN {
+			var tokenEntry string
+			if resp.Token, tokenEntry, err = keydb.NewClientToken(); err != nil {
+				return err
+			}
+			keyRecord.AllowedClients = append(keyRecord.AllowedClients, tokenEntry)
+		} else {
+			normalised, _ := keydb.NormaliseAllowedClient(entry)
+			keyRecord.AllowedClients = append(keyRecord.AllowedClients, normalised)
+		}
+	}
 	if _, err := rpcConn.Svc.KeyDB.Upsert(keyRecord); err != nil {
 		return fmt.Errorf("CryptServiceConn.CreateKey: failed to save key tracking record into database - %v", err)
 	}
@@ -496,6 +826,7 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 	// Always log the event to system journal
 	log.Printf(`CryptServiceConn.CreateKey: %s (%s) has saved new key %s`,
 		rpcConn.RemoteHost, req.Hostname, journalRec.FormatAttrs(" "))
+	rpcConn.Svc.Events.Add(EVENT_KEY_CREATED, rpcConn.RemoteHost, journalRec.UUID, req.Hostname)
 	// Send optional notification email in background
 	if rpcConn.Svc.Mailer.ValidateConfig() == nil {
 		go func() {
@@ -514,7 +845,7 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 }
 
 // Log key retrieval event to stderr and send optional notification emails.
-func (rpcConn *CryptServiceConn) logRetrieval(uuids []string, hostname string, granted map[string]keydb.Record, rejected, missing []string) {
+func (rpcConn *CryptServiceConn) logRetrieval(uuids []string, hostname string, granted map[string]keydb.Record, rejected map[string]string, missing []string) {
 	// Always log to system journal
 	retrievedUUIDs := make([]string, 0, len(uuids))
 	for uuid := range granted {
@@ -525,8 +856,14 @@ func (rpcConn *CryptServiceConn) logRetrieval(uuids []string, hostname string, g
 			rpcConn.RemoteHost, hostname, strings.Join(retrievedUUIDs, " "))
 	}
 	if len(rejected) > 0 {
-		log.Printf(`CryptServiceConn.logRetrieval: %s (%s) has been rejected keys of: %s`,
-			rpcConn.RemoteHost, hostname, strings.Join(rejected, " "))
+		log.Printf(`CryptServiceConn.logRetrieval: %s (%s) has been rejected keys of: %v`,
+			rpcConn.RemoteHost, hostname, rejected)
+	}
+	for _, uuid := range retrievedUUIDs {
+		rpcConn.Svc.Events.Add(EVENT_KEY_GRANTED, rpcConn.RemoteHost, uuid, hostname)
+	}
+	for uuid, reason := range rejected {
+		rpcConn.Svc.Events.Add(EVENT_KEY_REJECTED, rpcConn.RemoteHost, uuid, hostname+": "+reason)
 	}
 	// There is really no need to log the missing keys
 	// Send optional notification email in background
@@ -548,8 +885,10 @@ func (rpcConn *CryptServiceConn) logRetrieval(uuids []string, hostname string, g
 
 // A request to retrieve encryption keys without using password.
 type AutoRetrieveKeyReq struct {
-	UUIDs    []string // (locked) file system UUIDs
-	Hostname string   // client's host name (for logging only)
+	UUIDs    []string          // (locked) file system UUIDs
+	Hostname string            // client's host name (for logging only)
+	Tokens   map[string]string // enrolment tokens in UUID - token pairs
+	Leases   map[string]string // leases handed out earlier in UUID - lease ID pairs, the retrieval replaces them
 }
 
 // A response to key retrieval (without using password) request.
@@ -557,6 +896,9 @@ type AutoRetrieveKeyResp struct {
 	Granted  map[string]keydb.Record // these keys are now granted to the requester
 	Rejected []string                // these keys exist in database but are not allowed to be retrieved at the moment
 	Missing  []string                // these keys cannot be found in database
+	Denied   []string                // these keys exist in database but the requester is not among their allowed clients
+	Reasons  map[string]string       // reasons of rejection in UUID - keydb.REJECT_* pairs
+	Leases   map[string]keydb.Lease  // leases of the granted keys in UUID - lease pairs, renewed by heartbeats
 }
 
 // Retrieve key content by KMIP record ID. Return key content.
@@ -579,7 +921,15 @@ func (rpcConn *CryptServiceConn) AutoRetrieveKey(req AutoRetrieveKeyReq, resp *A
 		Hostname:  req.Hostname,
 		Timestamp: time.Now().Unix(),
 	}
-	resp.Granted, resp.Rejected, resp.Missing = rpcConn.Svc.KeyDB.Select(requester, true, req.UUIDs...)
+	var permitted []string
+	permitted, resp.Denied = rpcConn.checkClientIdentity(req.UUIDs, req.Tokens)
+	resp.Granted, resp.Leases, resp.Reasons, resp.Missing = rpcConn.Svc.KeyDB.SelectWithClaim(requester, rpcConn.getLeaseClaim(req.Leases, req.Tokens), true, permitted...)
+	resp.Rejected = make([]string, 0, len(resp.Reasons))
+	for _, uuid := range permitted {
+		if _, rejected := resp.Reasons[uuid]; rejected {
+			resp.Rejected = append(resp.Rejected, uuid)
+		}
+	}
 	// Key content of granted records are stored in KMIP
 	for uuid, grantedRecord := range resp.Granted {
 		key, err := rpcConn.askForKeyContent(grantedRecord.ID)
@@ -589,7 +939,7 @@ func (rpcConn *CryptServiceConn) AutoRetrieveKey(req AutoRetrieveKeyReq, resp *A
 		grantedRecord.Key = key
 		resp.Granted[uuid] = grantedRecord
 	}
-	rpcConn.logRetrieval(req.UUIDs, req.Hostname, resp.Granted, resp.Rejected, resp.Missing)
+	rpcConn.logRetrieval(req.UUIDs, req.Hostname, resp.Granted, resp.Reasons, resp.Missing)
 	return nil
 }
 
@@ -598,26 +948,41 @@ type ManualRetrieveKeyReq struct {
 	Password HashedPassword // access to keys is granted only after the correct password is given.
 	UUIDs    []string       // (locked) file system UUIDs
 	Hostname string         // client's host name (for logging only)
+
+	Admin         string // name of the administrator, required by dual control
+	DualControlID string // request confirmed by a second administrator, required by dual control
 }
 
 // A response to forced key retrieval (with password) request.
 type ManualRetrieveKeyResp struct {
 	Granted map[string]keydb.Record // these keys are now granted to the requester
 	Missing []string                // these keys cannot be found in database
+	Leases  map[string]keydb.Lease  // leases of the granted keys in UUID - lease pairs, renewed by heartbeats
 }
 
-// Retrieve encryption keys using a password. All requested keys will be granted regardless of MaxActive restriction.
+/*
+Retrieve encryption keys using a password. All requested keys will be granted regardless of MaxActive restriction. If
+dual control is enabled, a second administrator must have confirmed the retrieval.
+*/
 func (rpcConn *CryptServiceConn) ManualRetrieveKey(req ManualRetrieveKeyReq, resp *ManualRetrieveKeyResp) error {
 	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
 		return err
 	}
+	hostname := req.Hostname
+	if rpcConn.Svc.Config.DualControl {
+		confirmed, err := rpcConn.useDualControl(req.DualControlID, DUAL_CONTROL_RETRIEVE, req.UUIDs, req.Admin)
+		if err != nil {
+			return err
+		}
+		hostname = fmt.Sprintf("%s, %s", req.Hostname, confirmed)
+	}
 	// Retrieve the keys and write down who retrieved it
 	requester := keydb.AliveMessage{
 		IP:        rpcConn.RemoteHost,
 		Hostname:  req.Hostname,
 		Timestamp: time.Now().Unix(),
 	}
-	resp.Granted, _, resp.Missing = rpcConn.Svc.KeyDB.Select(requester, false, req.UUIDs...)
+	resp.Granted, resp.Leases, _, resp.Missing = rpcConn.Svc.KeyDB.SelectWithClaim(requester, rpcConn.getLeaseClaim(nil, nil), false, req.UUIDs...)
 	// Key content of granted records are stored in KMIP
 	for uuid, grantedRecord := range resp.Granted {
 		key, err := rpcConn.askForKeyContent(grantedRecord.ID)
@@ -627,14 +992,16 @@ func (rpcConn *CryptServiceConn) ManualRetrieveKey(req ManualRetrieveKeyReq, res
 		grantedRecord.Key = key
 		resp.Granted[uuid] = grantedRecord
 	}
-	rpcConn.logRetrieval(req.UUIDs, req.Hostname, resp.Granted, []string{}, resp.Missing)
+	rpcConn.logRetrieval(req.UUIDs, hostname, resp.Granted, nil, resp.Missing)
 	return nil
 }
 
 // A request to submit an alive report.
 type ReportAliveReq struct {
-	Hostname string   // client's host name (for logging only)
-	UUIDs    []string // UUID of disks that are reportedly alive
+	Hostname string            // client's host name (for logging only)
+	UUIDs    []string          // UUID of disks that are reportedly alive
+	Tokens   map[string]string // enrolment tokens in UUID - token pairs
+	Leases   map[string]string // lease IDs in UUID - lease ID pairs, the requester is identified by IP if absent
 }
 
 /*
@@ -648,7 +1015,58 @@ func (rpcConn *CryptServiceConn) ReportAlive(req ReportAliveReq, rejectedUUIDs *
 		Hostname:  req.Hostname,
 		Timestamp: time.Now().Unix(),
 	}
-	*rejectedUUIDs = rpcConn.Svc.KeyDB.UpdateAliveMessage(requester, req.UUIDs...)
+	permitted, denied := rpcConn.checkClientIdentity(req.UUIDs, req.Tokens)
+	_, rejected := rpcConn.Svc.KeyDB.RenewLeases(requester, false, rpcConn.getLeaseClaim(req.Leases, req.Tokens), permitted...)
+	*rejectedUUIDs = append(rejected, denied...)
+	return nil
+}
+
+// A heartbeat that covers all encrypted disks held online by the requester.
+type HeartbeatReq struct {
+	Hostname  string            // client's host name (for logging only)
+	UUIDs     []string          // UUID of all disks that the requester holds online, each of them is reportedly alive
+	Tokens    map[string]string // enrolment tokens in UUID - token pairs
+	PollUUIDs []string          // UUID of disks to poll pending commands from, including those that are not online
+	Leases    map[string]string // lease IDs in UUID - lease ID pairs, the requester is identified by IP if absent
+}
+
+// The response to a heartbeat.
+type HeartbeatResp struct {
+	Rejected    []string                          // UUID of disks that no longer consider the requester eligible to hold them
+	Commands    map[string][]keydb.PendingCommand // the oldest unseen pending command of each polled disk
+	IntervalSec int                               // the requester should send the next heartbeat within so many seconds, 0 if unknown
+	Leases      map[string]keydb.Lease            // renewed leases in UUID - lease pairs
+}
+
+/*
+Submit a single heartbeat on behalf of all encrypted disks held online by the requester, and poll pending commands in
+the same round trip. No password required. The server keeps liveness of the requester as a whole, the disks that are
+no longer mentioned by the heartbeat are no longer kept alive by the requester. The heartbeat renews the requester's
+lease of each disk, the disks without a valid lease are rejected. A lease only moves to the requester's IP if the
+requester proves to be its holder (see keydb.Lease.IsHolder).
+*/
+func (rpcConn *CryptServiceConn) Heartbeat(req HeartbeatReq, resp *HeartbeatResp) error {
+	requester := keydb.AliveMessage{
+		IP:        rpcConn.RemoteHost,
+		Hostname:  req.Hostname,
+		Timestamp: time.Now().Unix(),
+	}
+	permitted, denied := rpcConn.checkClientIdentity(req.UUIDs, req.Tokens)
+	var rejected []string
+	resp.Leases, rejected = rpcConn.Svc.KeyDB.RenewLeases(requester, true, rpcConn.getLeaseClaim(req.Leases, req.Tokens), permitted...)
+	resp.Rejected = append(rejected, denied...)
+	resp.Commands = rpcConn.pollCommands(req.PollUUIDs)
+	// Tell the requester to keep up with the most demanding disk that it still holds
+	isRejected := make(map[string]bool)
+	for _, uuid := range rejected {
+		isRejected[uuid] = true
+	}
+	for _, uuid := range permitted {
+		if rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid); found && !isRejected[uuid] && rec.AliveIntervalSec > 0 &&
+			(resp.IntervalSec == 0 || rec.AliveIntervalSec < resp.IntervalSec) {
+			resp.IntervalSec = rec.AliveIntervalSec
+		}
+	}
 	return nil
 }
 
@@ -657,12 +1075,24 @@ type EraseKeyReq struct {
 	Password HashedPassword // access is granted only after the correct password is given
 	Hostname string         // client's host name (for logging only)
 	UUID     string         // UUID of the disk to delete key for
+
+	Admin         string // name of the administrator, required by dual control
+	DualControlID string // request confirmed by a second administrator, required by dual control
 }
 
+// Erase an encryption key. If dual control is enabled, a second administrator must have confirmed the erasure.
 func (rpcConn *CryptServiceConn) EraseKey(req EraseKeyReq, _ *DummyAttr) error {
 	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
 		return err
 	}
+	hostname := req.Hostname
+	if rpcConn.Svc.Config.DualControl {
+		confirmed, err := rpcConn.useDualControl(req.DualControlID, DUAL_CONTROL_ERASE, []string{req.UUID}, req.Admin)
+		if err != nil {
+			return err
+		}
+		hostname = fmt.Sprintf("%s, %s", req.Hostname, confirmed)
+	}
 	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
 	if !found {
 		// No need to return error in case key has already disappeared from key server
@@ -670,6 +1100,9 @@ func (rpcConn *CryptServiceConn) EraseKey(req EraseKeyReq, _ *DummyAttr) error {
 	}
 	kmipErr := rpcConn.Svc.KMIPClient.DestroyKey(rec.ID)
 	dbErr := rpcConn.Svc.KeyDB.Erase(req.UUID)
+	if dbErr == nil {
+		rpcConn.Svc.Events.Add(EVENT_KEY_ERASED, rpcConn.RemoteHost, req.UUID, hostname)
+	}
 	if dbErr == nil && kmipErr != nil {
 		return fmt.Errorf("EraseKey: key tracking record has been erased from database, but KMIP did not erase it - %v", kmipErr)
 	}
@@ -690,12 +1123,174 @@ func (rpcConn *CryptServiceConn) Shutdown(req ShutdownReq, _ *DummyAttr) error {
 	return err
 }
 
+// Return the binding key of network-bound disk keys. Load it, or generate it, upon the first call.
+func (srv *CryptServer) GetBindingKey() (*BindingKey, error) {
+	srv.bindingKeyMutex.Lock()
+	defer srv.bindingKeyMutex.Unlock()
+	if srv.Config.BindingKeyPEM == "" {
+		return nil, errors.New("GetBindingKey: network-bound disk keys are not enabled on this server")
+	}
+	if srv.bindingKey == nil {
+		key, err := LoadOrCreateBindingKey(srv.Config.BindingKeyPEM)
+		if err != nil {
+			return nil, err
+		}
+		srv.bindingKey = key
+	}
+	return srv.bindingKey, nil
+}
+
+// A response that carries server's binding public key.
+type GetBindingKeyResp struct {
+	KeyID     string // KeyID identifies the binding key
+	PublicKey []byte // PublicKey is the binding public key in uncompressed point form
+}
+
+// Hand over the binding public key, with which a client computes a network-bound disk key.
+func (rpcConn *CryptServiceConn) GetBindingKey(_ DummyAttr, resp *GetBindingKeyResp) error {
+	key, err := rpcConn.Svc.GetBindingKey()
+	if err != nil {
+		return err
+	}
+	resp.KeyID = key.ID()
+	resp.PublicKey = key.PublicKey()
+	return nil
+}
+
+// A request to help recovering a network-bound disk key.
+type ExchangeBindingReq struct {
+	Hostname string // client's host name (for logging only)
+	KeyID    string // KeyID identifies the binding key that the disk key is bound to
+	Blinded  []byte // Blinded is the blinded point X computed by client
+}
+
+/*
+Respond to a client recovering its network-bound disk key. The exchange reveals neither the disk key nor anything about
+the disk to the server, hence it does not need a password.
+*/
+func (rpcConn *CryptServiceConn) ExchangeBinding(req ExchangeBindingReq, resp *[]byte) error {
+	key, err := rpcConn.Svc.GetBindingKey()
+	if err != nil {
+		return err
+	}
+	if req.KeyID != key.ID() {
+		return fmt.Errorf("ExchangeBinding: server does not have binding key \"%s\"", req.KeyID)
+	}
+	if *resp, err = key.Exchange(req.Blinded); err != nil {
+		return err
+	}
+	log.Printf(`ExchangeBinding: helped %s (%s) to recover a network-bound disk key`, rpcConn.RemoteHost, req.Hostname)
+	rpcConn.Svc.Events.Add(EVENT_BINDING_USED, rpcConn.RemoteHost, "", req.Hostname)
+	return nil
+}
+
 // Hand over the salt that was used to hash server's access password.
 func (rpcConn *CryptServiceConn) GetSalt(_ DummyAttr, salt *PasswordSalt) error {
 	copy((*salt)[:], rpcConn.Svc.Config.PasswordSalt[:])
 	return nil
 }
 
+// A request to issue a client certificate signed by the built-in CA.
+type EnrolClientReq struct {
+	Password HashedPassword // access is granted only after the correct password is given
+	Hostname string         // computer host name (for logging only)
+	CSR      []byte         // PEM-encoded certificate signing request
+}
+
+// A response that carries a newly issued client certificate.
+type EnrolClientResp struct {
+	Certificate   []byte // PEM-encoded client certificate
+	CACertificate []byte // PEM-encoded certificate of the built-in CA
+}
+
+/*
+Issue a client certificate from the request. A fresh certificate carries the common name and DNS names of the request,
+a certificate that replaces the current one carries the names of the current certificate.
+*/
+func (rpcConn *CryptServiceConn) issueClientCert(csr []byte, current *x509.Certificate, resp *EnrolClientResp) error {
+	ca := rpcConn.Svc.TLS.CertAuthority()
+	if ca == nil {
+		return errors.New("key server does not have a built-in certificate authority for client enrolment")
+	}
+	validity := time.Duration(rpcConn.Svc.Config.ClientCertDays) * 24 * time.Hour
+	var certPEM []byte
+	var cert *x509.Certificate
+	var err error
+	if current == nil {
+		certPEM, cert, err = ca.SignClientCSR(csr, validity)
+	} else {
+		certPEM, cert, err = ca.RenewClientCSR(csr, current, validity)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Certificate = certPEM
+	resp.CACertificate = ca.CertPEM
+	log.Printf(`CryptServiceConn: issued certificate "%s" (serial %s) valid until %s to %s`,
+		cert.Subject.CommonName, cert.SerialNumber, cert.NotAfter.Format(time.RFC3339), rpcConn.RemoteHost)
+	rpcConn.Svc.Events.Add(EVENT_CERT_ISSUED, rpcConn.RemoteHost, "",
+		fmt.Sprintf("%s (serial %s)", cert.Subject.CommonName, cert.SerialNumber))
+	return nil
+}
+
+// Issue a client certificate to a password-authenticated client.
+func (rpcConn *CryptServiceConn) EnrolClient(req EnrolClientReq, resp *EnrolClientResp) error {
+	if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
+		return err
+	}
+	if err := rpcConn.issueClientCert(req.CSR, nil, resp); err != nil {
+		return fmt.Errorf("EnrolClient: %v", err)
+	}
+	log.Printf(`EnrolClient: %s (%s) has enrolled`, rpcConn.RemoteHost, req.Hostname)
+	return nil
+}
+
+/*
+EnrolmentConn serves a client that has not presented a certificate to a server that validates client certificates. The
+client may only enrol with the built-in certificate authority.
+*/
+type EnrolmentConn struct {
+	rpcConn *CryptServiceConn
+}
+
+// Hand over the salt that was used to hash server's access password.
+func (enrolConn *EnrolmentConn) GetSalt(dummy DummyAttr, salt *PasswordSalt) error {
+	return enrolConn.rpcConn.GetSalt(dummy, salt)
+}
+
+// Check password and server readiness, so that the client may test its password before enrolment.
+func (enrolConn *EnrolmentConn) Ping(req PingRequest, dummy *DummyAttr) error {
+	return enrolConn.rpcConn.Ping(req, dummy)
+}
+
+// Issue a client certificate to a password-authenticated client.
+func (enrolConn *EnrolmentConn) EnrolClient(req EnrolClientReq, resp *EnrolClientResp) error {
+	return enrolConn.rpcConn.EnrolClient(req, resp)
+}
+
+// A request to renew the client certificate presented on the connection.
+type RenewClientCertReq struct {
+	CSR []byte // PEM-encoded certificate signing request for a new key, it must carry the same common name and DNS names.
+}
+
+/*
+Issue a fresh client certificate to a client that presents a valid certificate previously issued by the built-in CA.
+The presented certificate authenticates the client, hence password is not needed. Revoked certificates never make it
+past TLS handshake. The fresh certificate carries the names of the presented one, only its key comes from the request.
+*/
+func (rpcConn *CryptServiceConn) RenewClientCert(req RenewClientCertReq, resp *EnrolClientResp) error {
+	ca := rpcConn.Svc.TLS.CertAuthority()
+	if ca == nil {
+		return errors.New("RenewClientCert: key server does not have a built-in certificate authority")
+	} else if rpcConn.ClientCert == nil || !ca.IsIssuerOf(rpcConn.ClientCert) {
+		return errors.New("RenewClientCert: client must present a valid certificate issued by the built-in certificate authority")
+	}
+	if err := rpcConn.issueClientCert(req.CSR, rpcConn.ClientCert, resp); err != nil {
+		return fmt.Errorf("RenewClientCert: %v", err)
+	}
+	return nil
+}
+
 // ReloadRecordReq instructs server to reload one record from disk into database.
 type ReloadRecordReq struct {
 	Password HashedPassword // Password is provided by client and validated to grant access to this function.
@@ -710,6 +1305,8 @@ func (rpcConn *CryptServiceConn) ReloadRecord(req ReloadRecordReq, _ *DummyAttr)
 	if err := rpcConn.Svc.KeyDB.ReloadRecord(req.UUID); err != nil {
 		return err
 	}
+	// The record may carry new pending commands
+	rpcConn.Svc.CommandIssued.Raise()
 	return nil
 }
 
@@ -725,9 +1322,53 @@ type PollCommandResp struct {
 
 // PollCommand returns exactly one unseen pending command.
 func (rpcConn *CryptServiceConn) PollCommand(req PollCommandReq, resp *PollCommandResp) error {
-	*resp = PollCommandResp{Commands: make(map[string][]keydb.PendingCommand)}
-	counter := 0
-	for _, uuid := range req.UUIDs {
+	*resp = PollCommandResp{Commands: rpcConn.pollCommands(req.UUIDs)}
+	return nil
+}
+
+// WaitCommandReq instructs server to return pending commands as soon as they are issued to requested UUIDs.
+type WaitCommandReq struct {
+	UUIDs      []string // UUIDs is an array of UUID to wait for commands from.
+	TimeoutSec int      // TimeoutSec is the maximum duration to wait, server may wait for a shorter duration.
+}
+
+/*
+WaitCommand returns the oldest unseen pending command of each requested UUID. If there are none, it waits until a
+command is issued or the timeout elapses, and returns an empty response in case of timeout. Clients call it repeatedly
+to receive commands the moment they are issued.
+*/
+func (rpcConn *CryptServiceConn) WaitCommand(req WaitCommandReq, resp *PollCommandResp) error {
+	timeoutSec := req.TimeoutSec
+	if timeoutSec <= 0 || timeoutSec > WAIT_COMMAND_MAX_SEC {
+		timeoutSec = WAIT_COMMAND_MAX_SEC
+	}
+	// A waiting client does not send anything, do not let the connection reach idle timeout in the meantime.
+	if idleSec := rpcConn.Svc.Config.IdleTimeoutSec; idleSec > 0 && timeoutSec > idleSec/2 {
+		timeoutSec = idleSec / 2
+	}
+	timeout := time.NewTimer(time.Duration(timeoutSec) * time.Second)
+	defer timeout.Stop()
+	for {
+		issued := rpcConn.Svc.CommandIssued.Wait()
+		if commands := rpcConn.pollCommands(req.UUIDs); len(commands) > 0 {
+			*resp = PollCommandResp{Commands: commands}
+			return nil
+		}
+		select {
+		case <-issued:
+		case <-timeout.C:
+			*resp = PollCommandResp{Commands: make(map[string][]keydb.PendingCommand)}
+			return nil
+		}
+	}
+}
+
+// Return the oldest unseen pending command of each disk for the requester, and mark them seen.
+func (rpcConn *CryptServiceConn) pollCommands(uuids []string) map[string][]keydb.PendingCommand {
+	rpcConn.Svc.pollMutex.Lock()
+	defer rpcConn.Svc.pollMutex.Unlock()
+	commands := make(map[string][]keydb.PendingCommand)
+	for _, uuid := range uuids {
 		rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid)
 		if !found {
 			// Not-found UUID is not an error condition
@@ -740,30 +1381,153 @@ func (rpcConn *CryptServiceConn) PollCommand(req PollCommandReq, resp *PollComma
 		}
 		for _, cmd := range cmds {
 			if cmd.IsValid() && !cmd.SeenByClient {
-				if _, found := resp.Commands[uuid]; !found {
-					resp.Commands[uuid] = make([]keydb.PendingCommand, 0, 1)
-				}
 				// Respond with the oldest yet still valid pending command of the record
-				resp.Commands[uuid] = append(resp.Commands[uuid], cmd)
+				commands[uuid] = []keydb.PendingCommand{cmd}
 				// The command is now "seen" by client.
-				rpcConn.Svc.KeyDB.UpdateSeenFlag(uuid, rpcConn.RemoteHost, cmd.Content)
-				counter++
+				if cmd.Command.ID == "" {
+					rpcConn.Svc.KeyDB.UpdateSeenFlag(uuid, rpcConn.RemoteHost, cmd.Content)
+				} else {
+					rpcConn.Svc.KeyDB.UpdateSeenFlagByID(uuid, rpcConn.RemoteHost, cmd.Command.ID)
+				}
 				break
 			}
 		}
 	}
-	return nil
+	return commands
 }
 
 // SaveCommandResultReq saves execution result of a pending command that was previously polled by a client.
 type SaveCommandResultReq struct {
-	UUID           string      // UUID is the UUID of record.
-	CommandContent interface{} // CommandContent is the content of pending command as it was originally received.
-	Result         string      // Result is a human readable text representation of execution result
+	UUID           string              // UUID is the UUID of record.
+	CommandContent interface{}         // CommandContent is the content of pending command as it was originally received.
+	Result         string              // Result is a human readable text representation of execution result
+	CommandID      string              // CommandID identifies the command, it is empty if the command does not have an ID.
+	Outcome        keydb.CommandResult // Outcome is the structured execution result of a command that has an ID.
 }
 
 // SaveCommandResult saves execution result of a pending command.
 func (rpcConn *CryptServiceConn) SaveCommandResult(req SaveCommandResultReq, _ *DummyAttr) error {
-	rpcConn.Svc.KeyDB.UpdateCommandResult(req.UUID, rpcConn.RemoteHost, req.CommandContent, req.Result)
+	if req.CommandID == "" {
+		rpcConn.Svc.KeyDB.UpdateCommandResult(req.UUID, rpcConn.RemoteHost, req.CommandContent, req.Result)
+		rpcConn.Svc.Events.Add(EVENT_COMMAND_RESULT, rpcConn.RemoteHost, req.UUID, fmt.Sprintf("%v: %s", req.CommandContent, req.Result))
+		return nil
+	}
+	req.Outcome.Finished = time.Now()
+	rpcConn.Svc.KeyDB.UpdateCommandOutcome(req.UUID, rpcConn.RemoteHost, req.CommandID, req.Outcome)
+	outcome := "failure"
+	if req.Outcome.Success {
+		outcome = "success"
+	}
+	rpcConn.Svc.Events.Add(EVENT_COMMAND_RESULT, rpcConn.RemoteHost, req.UUID, fmt.Sprintf("%v %s: %s", req.CommandContent, outcome, req.Outcome.Message))
+	return nil
+}
+
+// A request to begin replacing the key of a disk, as told by a rotate-key command.
+type BeginKeyRotationReq struct {
+	UUID      string            // UUID is the disk to rotate the key for.
+	CommandID string            // CommandID is the rotate-key command that the client is carrying out.
+	Hostname  string            // client's host name (for logging only)
+	Tokens    map[string]string // enrolment tokens in UUID - token pairs
+}
+
+// The current and new key of the disk, the client installs the new key on the disk and commits the rotation.
+type BeginKeyRotationResp struct {
+	CurrentKey []byte // CurrentKey is the disk key in use
+	NewKey     []byte // NewKey will replace the current key once the rotation is committed
+}
+
+/*
+Hand out a new key to a client that has been told to rotate the key of a disk, as long as the client currently holds the
+disk's key by a lease or alive messages and the usage policy allows it to retrieve the key. The current key remains in
+effect until the client commits the rotation, so that the disk can still be unlocked if the client fails to install the
+new key. The new key of a rotation begun earlier for the same disk is destroyed, as it will never be committed.
+*/
+func (rpcConn *CryptServiceConn) BeginKeyRotation(req BeginKeyRotationReq, resp *BeginKeyRotationResp) error {
+	if permitted, _ := rpcConn.checkClientIdentity([]string{req.UUID}, req.Tokens); len(permitted) == 0 {
+		return fmt.Errorf("CryptServiceConn.BeginKeyRotation: %s is not allowed to access \"%s\"", rpcConn.RemoteHost, req.UUID)
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		return fmt.Errorf("CryptServiceConn.BeginKeyRotation: record \"%s\" does not exist", req.UUID)
+	}
+	cmdFound := false
+	rotation := keyRotation{commandID: req.CommandID, ip: rpcConn.RemoteHost}
+	for _, cmd := range rec.PendingCommands[rpcConn.RemoteHost] {
+		if cmd.IsValid() && cmd.Command.ID == req.CommandID && cmd.Command.Action == keydb.CMD_ROTATE_KEY {
+			cmdFound = true
+			rotation.expiry = cmd.ValidFrom.Add(cmd.Validity)
+			break
+		}
+	}
+	if !cmdFound {
+		return fmt.Errorf("CryptServiceConn.BeginKeyRotation: %s has not been told to rotate the key of \"%s\"", rpcConn.RemoteHost, req.UUID)
+	}
+	// The command alone does not entitle the client to the key, it must hold the key already and still be allowed to.
+	if !rpcConn.Svc.KeyDB.IsHeldByIP(req.UUID, rpcConn.RemoteHost) {
+		return fmt.Errorf("CryptServiceConn.BeginKeyRotation: %s does not currently hold the key of \"%s\"", rpcConn.RemoteHost, req.UUID)
+	} else if reason := rec.CheckPolicy(rpcConn.RemoteHost, time.Now()); reason != "" {
+		return fmt.Errorf("CryptServiceConn.BeginKeyRotation: %s may not retrieve the key of \"%s\" - %s", rpcConn.RemoteHost, req.UUID, reason)
+	}
+	var err error
+	if resp.CurrentKey, err = rpcConn.askForKeyContent(rec.ID); err != nil {
+		return err
+	}
+	if rpcConn.Svc.BuiltInKMIPServer != nil {
+		// Built-in KMIP server keeps the key in database record
+		rotation.kmipID = rec.ID
+		rotation.key = GetNewDiskEncryptionKeyBits()
+		resp.NewKey = rotation.key
+	} else {
+		if rotation.kmipID, err = rpcConn.Svc.KMIPClient.CreateKey(KeyNamePrefix + req.UUID); err != nil {
+			return fmt.Errorf("CryptServiceConn.BeginKeyRotation: KMIP client refused to create the key - %v", err)
+		}
+		if resp.NewKey, err = rpcConn.askForKeyContent(rotation.kmipID); err != nil {
+			return err
+		}
+	}
+	rpcConn.Svc.rotations.mutex.Lock()
+	rpcConn.Svc.expireKeyRotations()
+	if abandoned, found := rpcConn.Svc.rotations.pending[req.UUID]; found {
+		// The new key handed out earlier will never be committed
+		rpcConn.Svc.discardKeyRotation(req.UUID, abandoned)
+	}
+	rpcConn.Svc.rotations.pending[req.UUID] = rotation
+	rpcConn.Svc.rotations.mutex.Unlock()
+	log.Printf("CryptServiceConn.BeginKeyRotation: %s (%s) has begun rotating the key of %s", rpcConn.RemoteHost, req.Hostname, req.UUID)
+	return nil
+}
+
+// A request to put the new key of a disk into effect, after the client has installed it on the disk.
+type CommitKeyRotationReq struct {
+	UUID      string // UUID is the disk to rotate the key for.
+	CommandID string // CommandID is the rotate-key command that the client is carrying out.
+	Hostname  string // client's host name (for logging only)
+}
+
+// Replace the key of a disk by the new key handed out earlier to the same client for the same command.
+func (rpcConn *CryptServiceConn) CommitKeyRotation(req CommitKeyRotationReq, _ *DummyAttr) error {
+	rpcConn.Svc.rotations.mutex.Lock()
+	defer rpcConn.Svc.rotations.mutex.Unlock()
+	rpcConn.Svc.expireKeyRotations()
+	rotation, found := rpcConn.Svc.rotations.pending[req.UUID]
+	if !found || rotation.commandID != req.CommandID || rotation.ip != rpcConn.RemoteHost {
+		return fmt.Errorf("CryptServiceConn.CommitKeyRotation: %s has not begun rotating the key of \"%s\"", rpcConn.RemoteHost, req.UUID)
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		return fmt.Errorf("CryptServiceConn.CommitKeyRotation: record \"%s\" does not exist", req.UUID)
+	}
+	if err := rpcConn.Svc.KeyDB.ReplaceKey(req.UUID, rotation.kmipID, rotation.key); err != nil {
+		return fmt.Errorf("CryptServiceConn.CommitKeyRotation: failed to save the new key - %v", err)
+	}
+	delete(rpcConn.Svc.rotations.pending, req.UUID)
+	if rec.ID != rotation.kmipID {
+		// The client has taken the previous key off the disk, or is about to.
+		if err := rpcConn.Svc.KMIPClient.DestroyKey(rec.ID); err != nil {
+			log.Printf("CryptServiceConn.CommitKeyRotation: the new key of %s is in effect, but KMIP did not erase the previous key - %v", req.UUID, err)
+		}
+	}
+	log.Printf("CryptServiceConn.CommitKeyRotation: %s (%s) has rotated the key of %s", rpcConn.RemoteHost, req.Hostname, req.UUID)
+	rpcConn.Svc.Events.Add(EVENT_KEY_ROTATED, rpcConn.RemoteHost, req.UUID, req.Hostname)
 	return nil
 }
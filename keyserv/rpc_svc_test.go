@@ -4,6 +4,7 @@ package keyserv
 
 import (
 	"crypto/sha512"
+	"crypto/tls"
 	"encoding/hex"
 	"path"
 	"reflect"
@@ -103,6 +104,15 @@ func TestServiceReadFromSysconfig(t *testing.T) {
 		Address:              "1.1.1.1",
 		Port:                 1234,
 		KeyDBDir:             "/abc",
+		BindingKeyPEM:        "/var/lib/cryptctl/binding-key.pem",
+		ClientCertDays:       7,
+		CertExpiryWarnDays:   30,
+		TLSPolicy:            TLSPolicy{MinVersion: tls.VersionTLS12},
+		LegacyRPC:            true,
+		APIGrants:            []string{},
+		MaxConnections:       SRV_DEFAULT_MAX_CONNS,
+		IdleTimeoutSec:       SRV_DEFAULT_IDLE_TIMEOUT_SEC,
+		DualControlWindowSec: DUAL_CONTROL_DEFAULT_WINDOW_SEC,
 		KeyCreationSubject:   "a",
 		KeyCreationGreeting:  "b",
 		KeyRetrievalSubject:  "c",
@@ -112,6 +122,11 @@ func TestServiceReadFromSysconfig(t *testing.T) {
 	}) {
 		t.Fatalf("%+v", svcConf)
 	}
+	// Idle timeout of a single second would let clients waiting for commands go right away
+	sysconf.Set(SRV_CONF_IDLE_TIMEOUT, 1)
+	if err := svcConf.ReadFromSysconfig(sysconf); err == nil {
+		t.Fatal("did not error")
+	}
 }
 
 // RPC functions are tested by CryptClient test cases.
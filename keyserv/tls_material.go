@@ -0,0 +1,336 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TLS_RELOAD_CHECK_INTERVAL_SEC  = 60        // TLS_RELOAD_CHECK_INTERVAL_SEC is the interval of checking TLS files for changes.
+	CERT_EXPIRY_CHECK_INTERVAL_SEC = 12 * 3600 // CERT_EXPIRY_CHECK_INTERVAL_SEC is the interval of checking certificates for upcoming expiry.
+	CERT_EXPIRY_DEFAULT_WARN_DAYS  = 30        // CERT_EXPIRY_DEFAULT_WARN_DAYS is the default number of days to warn before a certificate expires.
+	MSG_CERT_EXPIRY_SUBJECT        = "Key server certificate is about to expire"
+	MSG_CERT_EXPIRY_GREETING       = "The following certificates used by the key server will expire soon, please renew them:"
+)
+
+/*
+TLSMaterial holds key server's own certificate and key, along with the certificate authorities that verify clients.
+They are loaded from files, and may be reloaded while the server is running; the previous material remains in use if
+reloading fails.
+*/
+type TLSMaterial struct {
+	CertPEM          string // CertPEM is the path to PEM-encoded TLS certificate.
+	KeyPEM           string // KeyPEM is the path to PEM-encoded TLS certificate key.
+	CertAuthorityPEM string // CertAuthorityPEM is the path to PEM-encoded CA certificates that issue client certificates.
+	CACertPEM        string // CACertPEM is the path to certificate of the built-in CA.
+	CAKeyPEM         string // CAKeyPEM is the path to key of the built-in CA.
+	CRLPEM           string // CRLPEM is the path to revocation list maintained by the built-in CA.
+
+	mutex         *sync.RWMutex
+	cert          *tls.Certificate
+	leaf          *x509.Certificate
+	clientCAs     []*x509.Certificate
+	clientCAPool  *x509.CertPool
+	certAuthority *CertAuthority
+	modTimes      map[string]time.Time
+}
+
+// Load TLS material from the files specified in configuration.
+func LoadTLSMaterial(config CryptServiceConfig) (*TLSMaterial, error) {
+	material := &TLSMaterial{
+		CertPEM:          config.CertPEM,
+		KeyPEM:           config.KeyPEM,
+		CertAuthorityPEM: config.CertAuthorityPEM,
+		CACertPEM:        config.CACertPEM,
+		CAKeyPEM:         config.CAKeyPEM,
+		CRLPEM:           config.CRLPEM,
+		mutex:            new(sync.RWMutex),
+	}
+	if err := material.Reload(); err != nil {
+		return nil, err
+	}
+	return material, nil
+}
+
+// Return the files that make up the material.
+func (material *TLSMaterial) files() []string {
+	ret := make([]string, 0, 5)
+	for _, filePath := range []string{material.CertPEM, material.KeyPEM, material.CertAuthorityPEM, material.CACertPEM, material.CAKeyPEM} {
+		if filePath != "" {
+			ret = append(ret, filePath)
+		}
+	}
+	return ret
+}
+
+// Return modification time of the material files, a missing file has zero time.
+func (material *TLSMaterial) readModTimes() map[string]time.Time {
+	ret := make(map[string]time.Time)
+	for _, filePath := range material.files() {
+		if stat, err := os.Stat(filePath); err == nil {
+			ret[filePath] = stat.ModTime()
+		} else {
+			ret[filePath] = time.Time{}
+		}
+	}
+	return ret
+}
+
+// Read all certificates from a PEM file.
+func readCertsPEMFile(filePath string) ([]*x509.Certificate, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("readCertsPEMFile: failed to read \"%s\" - %v", filePath, err)
+	}
+	ret := make([]*x509.Certificate, 0, 1)
+	for rest := content; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		} else if block.Type != PEM_TYPE_CERT {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("readCertsPEMFile: failed to parse certificate in \"%s\" - %v", filePath, err)
+		}
+		ret = append(ret, cert)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("readCertsPEMFile: \"%s\" does not contain a certificate", filePath)
+	}
+	return ret, nil
+}
+
+// Read all material from files and replace the material in use only if all of them are good.
+func (material *TLSMaterial) Reload() error {
+	modTimes := material.readModTimes()
+	cert, err := tls.LoadX509KeyPair(material.CertPEM, material.KeyPEM)
+	if err != nil {
+		return fmt.Errorf("TLSMaterial.Reload: failed to load certificate \"%s\" and key \"%s\" - %v", material.CertPEM, material.KeyPEM, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("TLSMaterial.Reload: failed to parse certificate \"%s\" - %v", material.CertPEM, err)
+	}
+	// Built-in CA issues client certificates, hence clients presenting them must be verified against it.
+	clientCAs := make([]*x509.Certificate, 0, 4)
+	var certAuthority *CertAuthority
+	if material.CACertPEM != "" {
+		if certAuthority, err = LoadCertAuthority(material.CACertPEM, material.CAKeyPEM, material.CRLPEM); err != nil {
+			return fmt.Errorf("TLSMaterial.Reload: %v", err)
+		}
+		clientCAs = append(clientCAs, certAuthority.Cert)
+	}
+	if material.CertAuthorityPEM != "" {
+		caCerts, err := readCertsPEMFile(material.CertAuthorityPEM)
+		if err != nil {
+			return fmt.Errorf("TLSMaterial.Reload: %v", err)
+		}
+		clientCAs = append(clientCAs, caCerts...)
+	}
+	var clientCAPool *x509.CertPool
+	if len(clientCAs) > 0 {
+		clientCAPool = x509.NewCertPool()
+		for _, caCert := range clientCAs {
+			clientCAPool.AddCert(caCert)
+		}
+	}
+	material.mutex.Lock()
+	defer material.mutex.Unlock()
+	if certAuthority != nil && material.certAuthority != nil {
+		// Revocations must remain serialised across reloads
+		certAuthority.mutex = material.certAuthority.mutex
+	}
+	material.cert = &cert
+	material.leaf = leaf
+	material.clientCAs = clientCAs
+	material.clientCAPool = clientCAPool
+	material.certAuthority = certAuthority
+	material.modTimes = modTimes
+	return nil
+}
+
+// Reload the material if any of its files has changed since last load. Return true if reloaded.
+func (material *TLSMaterial) ReloadIfChanged() (bool, error) {
+	material.mutex.RLock()
+	previous := material.modTimes
+	material.mutex.RUnlock()
+	current := material.readModTimes()
+	changed := false
+	for filePath, modTime := range current {
+		if !modTime.Equal(previous[filePath]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	if err := material.Reload(); err != nil {
+		/*
+			A renewed certificate and its key are rarely written at the same instant, remember the change so that the
+			reload is not attempted again until the files change once more.
+		*/
+		material.mutex.Lock()
+		material.modTimes = current
+		material.mutex.Unlock()
+		return false, err
+	}
+	return true, nil
+}
+
+// Return the certificate to present to clients, the function signature is compatible with tls.Config.GetCertificate.
+func (material *TLSMaterial) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	material.mutex.RLock()
+	defer material.mutex.RUnlock()
+	return material.cert, nil
+}
+
+// Return key server's own certificate.
+func (material *TLSMaterial) Leaf() *x509.Certificate {
+	material.mutex.RLock()
+	defer material.mutex.RUnlock()
+	return material.leaf
+}
+
+// Return the certificate authorities that verify clients and their pool, the pool is nil if there is none.
+func (material *TLSMaterial) ClientCAs() ([]*x509.Certificate, *x509.CertPool) {
+	material.mutex.RLock()
+	defer material.mutex.RUnlock()
+	return material.clientCAs, material.clientCAPool
+}
+
+// Return the built-in certificate authority, or nil if there is none.
+func (material *TLSMaterial) CertAuthority() *CertAuthority {
+	material.mutex.RLock()
+	defer material.mutex.RUnlock()
+	return material.certAuthority
+}
+
+/*
+Return a warning for each certificate that expires within the number of days (or has already expired), the warnings
+are sorted by expiry.
+*/
+func CheckCertExpiry(certs map[string]*x509.Certificate, now time.Time, warnDays int) []string {
+	type expiry struct {
+		notAfter time.Time
+		text     string
+	}
+	expiries := make([]expiry, 0, len(certs))
+	deadline := now.AddDate(0, 0, warnDays)
+	for description, cert := range certs {
+		if cert == nil || cert.NotAfter.After(deadline) {
+			continue
+		}
+		var text string
+		if now.After(cert.NotAfter) {
+			text = fmt.Sprintf("%s \"%s\" has expired on %s", description, cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+		} else {
+			text = fmt.Sprintf("%s \"%s\" expires in %d days on %s", description, cert.Subject.CommonName,
+				int(cert.NotAfter.Sub(now).Hours()/24), cert.NotAfter.Format(time.RFC3339))
+		}
+		expiries = append(expiries, expiry{notAfter: cert.NotAfter, text: text})
+	}
+	sort.Slice(expiries, func(i, j int) bool {
+		return expiries[i].notAfter.Before(expiries[j].notAfter)
+	})
+	ret := make([]string, len(expiries))
+	for i, exp := range expiries {
+		ret[i] = exp.text
+	}
+	return ret
+}
+
+// Reload key server's TLS material, the previous material remains in use if reloading fails.
+func (srv *CryptServer) ReloadTLS() error {
+	if err := srv.TLS.Reload(); err != nil {
+		return err
+	}
+	srv.afterTLSReload()
+	return nil
+}
+
+// Apply newly loaded TLS material to revocation list.
+func (srv *CryptServer) afterTLSReload() {
+	if srv.Revocation != nil {
+		clientCAs, _ := srv.TLS.ClientCAs()
+		srv.Revocation.SetIssuers(clientCAs)
+	}
+	log.Printf("CryptServer: loaded TLS certificate \"%s\" valid until %s",
+		srv.TLS.Leaf().Subject.CommonName, srv.TLS.Leaf().NotAfter.Format(time.RFC3339))
+}
+
+// Return warnings for server certificate, client certificate authorities, and KMIP client certificate about to expire.
+func (srv *CryptServer) CheckCertExpiry(now time.Time) []string {
+	certs := map[string]*x509.Certificate{
+		"Server certificate " + srv.Config.CertPEM: srv.TLS.Leaf(),
+	}
+	clientCAs, _ := srv.TLS.ClientCAs()
+	for i, caCert := range clientCAs {
+		certs[fmt.Sprintf("Client certificate authority #%d", i+1)] = caCert
+	}
+	if srv.Config.KMIPCertPEM != "" {
+		if kmipCerts, err := readCertsPEMFile(srv.Config.KMIPCertPEM); err != nil {
+			log.Printf("CryptServer.CheckCertExpiry: %v", err)
+		} else {
+			certs["KMIP client certificate "+srv.Config.KMIPCertPEM] = kmipCerts[0]
+		}
+	}
+	return CheckCertExpiry(certs, now, srv.Config.CertExpiryWarnDays)
+}
+
+// Log warnings of certificates about to expire and send them in an optional notification email.
+func (srv *CryptServer) warnCertExpiry() {
+	warnings := srv.CheckCertExpiry(time.Now())
+	if len(warnings) == 0 {
+		return
+	}
+	for _, warning := range warnings {
+		log.Printf("CryptServer.warnCertExpiry: %s", warning)
+	}
+	if srv.Mailer.ValidateConfig() == nil {
+		text := fmt.Sprintf("%s\r\n\r\n%s\r\n", MSG_CERT_EXPIRY_GREETING, strings.Join(warnings, "\r\n"))
+		if err := srv.Mailer.Send(MSG_CERT_EXPIRY_SUBJECT, text); err != nil {
+			log.Printf("CryptServer.warnCertExpiry: failed to send email notification - %v", err)
+		}
+	}
+}
+
+/*
+Continuously reload TLS material upon file changes, and warn about certificates that are about to expire. Block caller
+until the server shuts down.
+*/
+func (srv *CryptServer) MonitorTLS() {
+	srv.warnCertExpiry()
+	lastExpiryCheck := time.Now()
+	for {
+		select {
+		case <-srv.shutdownTLSMonitor:
+			return
+		case <-time.After(TLS_RELOAD_CHECK_INTERVAL_SEC * time.Second):
+		}
+		if reloaded, err := srv.TLS.ReloadIfChanged(); err != nil {
+			log.Printf("CryptServer.MonitorTLS: TLS files have changed but failed to reload, keep using the previous ones - %v", err)
+		} else if reloaded {
+			srv.afterTLSReload()
+			srv.warnCertExpiry()
+			lastExpiryCheck = time.Now()
+		}
+		if time.Since(lastExpiryCheck) > CERT_EXPIRY_CHECK_INTERVAL_SEC*time.Second {
+			srv.warnCertExpiry()
+			lastExpiryCheck = time.Now()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSMaterialReload(t *testing.T) {
+	fixture := NewTestTLS(t, "a.example.com")
+	defer os.RemoveAll(fixture.Dir)
+	ca, srvCert, srvKey := fixture.CA, fixture.SrvCert, fixture.SrvKey
+	material, err := LoadTLSMaterial(CryptServiceConfig{CertPEM: srvCert, KeyPEM: srvKey, CACertPEM: fixture.CACert, CAKeyPEM: fixture.CAKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if material.Leaf().Subject.CommonName != "a.example.com" || material.CertAuthority() == nil {
+		t.Fatal(material.Leaf().Subject)
+	}
+	if clientCAs, pool := material.ClientCAs(); len(clientCAs) != 1 || pool == nil {
+		t.Fatal(clientCAs)
+	}
+	if reloaded, err := material.ReloadIfChanged(); reloaded || err != nil {
+		t.Fatal(reloaded, err)
+	}
+	// Replace the certificate and key, the new certificate is picked up by handshake
+	os.Remove(srvCert)
+	os.Remove(srvKey)
+	if err := ca.IssueServerCert("b.example.com", 10, srvCert, srvKey); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(srvCert, later, later)
+	if reloaded, err := material.ReloadIfChanged(); !reloaded || err != nil {
+		t.Fatal(reloaded, err)
+	}
+	cert, err := material.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.Subject.CommonName != "b.example.com" {
+		t.Fatal(leaf.Subject)
+	}
+	// Damaged certificate does not replace the one in use
+	if err := ioutil.WriteFile(srvCert, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(srvCert, later, later)
+	if reloaded, err := material.ReloadIfChanged(); reloaded || err == nil {
+		t.Fatal(reloaded, err)
+	}
+	if material.Leaf().Subject.CommonName != "b.example.com" {
+		t.Fatal(material.Leaf().Subject)
+	}
+	// The failure is not retried until the files change again
+	if reloaded, err := material.ReloadIfChanged(); reloaded || err != nil {
+		t.Fatal(reloaded, err)
+	}
+	if err := material.Reload(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestCheckCertExpiry(t *testing.T) {
+	now := time.Now()
+	certs := map[string]*x509.Certificate{
+		"far":     {NotAfter: now.AddDate(0, 0, 100)},
+		"soon":    {NotAfter: now.AddDate(0, 0, 10).Add(time.Hour)},
+		"expired": {NotAfter: now.AddDate(0, 0, -1)},
+		"missing": nil,
+	}
+	warnings := CheckCertExpiry(certs, now, 30)
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "expired \"\" has expired") || !strings.Contains(warnings[1], "soon \"\" expires in 10 days") {
+		t.Fatal(warnings)
+	}
+	if warnings := CheckCertExpiry(certs, now, 0); len(warnings) != 1 {
+		t.Fatal(warnings)
+	}
+}
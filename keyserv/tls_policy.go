@@ -0,0 +1,208 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	TLS_CONF_MIN_VERSION   = "TLS_MIN_VERSION"   // TLS_CONF_MIN_VERSION is the lowest TLS version to accept, "1.2" or "1.3".
+	TLS_CONF_CIPHER_SUITES = "TLS_CIPHER_SUITES" // TLS_CONF_CIPHER_SUITES are space-separated cipher suite names for TLS 1.2.
+	TLS_CONF_CURVES        = "TLS_CURVES"        // TLS_CONF_CURVES are space-separated key exchange curves in order of preference.
+	TLS_CONF_PINNED_KEYS   = "TLS_PINNED_KEYS"   // TLS_CONF_PINNED_KEYS are space-separated SPKI pins of key server, client only.
+	TLS_DEFAULT_MIN        = "1.2"               // TLS_DEFAULT_MIN is the default lowest TLS version.
+	SPKI_PIN_PREFIX        = "sha256//"          // SPKI_PIN_PREFIX prefixes base64-encoded SHA-256 hash of a public key.
+)
+
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13} // tlsVersions are the acceptable TLS floors.
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+} // tlsCurves are the key exchange curves that may be configured.
+
+// TLSPolicy restricts the protocol versions and algorithms used in TLS connections.
+type TLSPolicy struct {
+	MinVersion       uint16        // MinVersion is the lowest TLS version to accept.
+	CipherSuites     []uint16      // CipherSuites are the allowed TLS 1.2 cipher suites, or empty for Go's secure default.
+	CurvePreferences []tls.CurveID // CurvePreferences are the key exchange curves, or empty for Go's default.
+}
+
+// Return the policy used in the absence of configuration: TLS 1.2 and newer with Go's secure defaults.
+func DefaultTLSPolicy() TLSPolicy {
+	return TLSPolicy{MinVersion: tls.VersionTLS12}
+}
+
+/*
+Parse a TLS policy from its textual form. The minimum version must be "1.2" or "1.3", cipher suites are IANA names
+(e.g. TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384) and curves are X25519, P256, P384, or P521. Empty text leaves the
+corresponding setting at its default. Insecure cipher suites are refused.
+*/
+func ParseTLSPolicy(minVersion, cipherSuites, curves string) (policy TLSPolicy, err error) {
+	policy = DefaultTLSPolicy()
+	if minVersion = strings.TrimSpace(minVersion); minVersion != "" {
+		version, found := tlsVersions[minVersion]
+		if !found {
+			return policy, fmt.Errorf("ParseTLSPolicy: minimum TLS version \"%s\" should be either 1.2 or 1.3", minVersion)
+		}
+		policy.MinVersion = version
+	}
+	secureSuites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secureSuites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Fields(cipherSuites) {
+		id, found := secureSuites[name]
+		if !found {
+			return policy, fmt.Errorf("ParseTLSPolicy: cipher suite \"%s\" is unknown or insecure", name)
+		}
+		policy.CipherSuites = append(policy.CipherSuites, id)
+	}
+	for _, name := range strings.Fields(curves) {
+		id, found := tlsCurves[name]
+		if !found {
+			return policy, fmt.Errorf("ParseTLSPolicy: curve \"%s\" should be one of X25519, P256, P384, P521", name)
+		}
+		policy.CurvePreferences = append(policy.CurvePreferences, id)
+	}
+	return policy, nil
+}
+
+// Read TLS policy from sysconfig keys TLS_MIN_VERSION, TLS_CIPHER_SUITES, and TLS_CURVES.
+func ReadTLSPolicyFromSysconfig(sysconf *sys.Sysconfig) (TLSPolicy, error) {
+	return ParseTLSPolicy(
+		sysconf.GetString(TLS_CONF_MIN_VERSION, TLS_DEFAULT_MIN),
+		sysconf.GetString(TLS_CONF_CIPHER_SUITES, ""),
+		sysconf.GetString(TLS_CONF_CURVES, ""))
+}
+
+// Apply the policy to TLS configuration.
+func (policy TLSPolicy) Apply(conf *tls.Config) {
+	conf.MinVersion = policy.MinVersion
+	conf.CipherSuites = policy.CipherSuites
+	conf.CurvePreferences = policy.CurvePreferences
+}
+
+// Return the SPKI pin (sha256//BASE64) of a certificate's public key.
+func GetSPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return SPKI_PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Parse space-separated SPKI pins in the form of sha256//BASE64, the form is the same as curl's --pinnedpubkey.
+func ParseSPKIPins(pins string) ([]string, error) {
+	ret := make([]string, 0, 2)
+	for _, pin := range strings.Fields(pins) {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, SPKI_PIN_PREFIX))
+		if !strings.HasPrefix(pin, SPKI_PIN_PREFIX) || err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("ParseSPKIPins: \"%s\" should look like %sBASE64", pin, SPKI_PIN_PREFIX)
+		}
+		ret = append(ret, pin)
+	}
+	return ret, nil
+}
+
+/*
+Return a function that accepts the peer only if its verified certificate chain carries a pinned public key. The
+function signature is compatible with tls.Config.VerifyConnection, it runs after the ordinary certificate verification,
+and also on resumed sessions. Certificates that the peer presents outside of the verified chain do not count.
+*/
+func VerifyPinnedKeys(pins []string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		return MatchPinnedKeys(pins, state.VerifiedChains)
+	}
+}
+
+// Return nil only if a certificate of the verified chains, the leaf or any of its issuers, carries a pinned public key.
+func MatchPinnedKeys(pins []string, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			certPin := GetSPKIPin(cert)
+			for _, pin := range pins {
+				if certPin == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("MatchPinnedKeys: none of the verified certificates of key server carries a pinned public key")
+}
+
+// TLSAudit describes the parameters negotiated in a TLS connection.
+type TLSAudit struct {
+	Version          string              // Version is the negotiated TLS version.
+	CipherSuite      string              // CipherSuite is the negotiated cipher suite.
+	ServerName       string              // ServerName is the server name indicated by client.
+	PeerCertificates []*x509.Certificate // PeerCertificates are the certificates presented by peer.
+	Verified         bool                // Verified is true if the peer certificate has been verified.
+
+	VerifiedChains [][]*x509.Certificate // VerifiedChains are the peer certificate followed by its verified issuers.
+}
+
+// Collect negotiated parameters from TLS connection state.
+func GetTLSAudit(state tls.ConnectionState) TLSAudit {
+	return TLSAudit{
+		Version:          tls.VersionName(state.Version),
+		CipherSuite:      tls.CipherSuiteName(state.CipherSuite),
+		ServerName:       state.ServerName,
+		PeerCertificates: state.PeerCertificates,
+		Verified:         len(state.VerifiedChains) > 0,
+		VerifiedChains:   state.VerifiedChains,
+	}
+}
+
+// Return the audit in a single line, suitable for logging.
+func (audit TLSAudit) String() string {
+	peer := "no certificate"
+	if len(audit.PeerCertificates) > 0 {
+		fingerprint := sha256.Sum256(audit.PeerCertificates[0].Raw)
+		peer = fmt.Sprintf("certificate \"%s\" (fingerprint %x, verified %v)",
+			audit.PeerCertificates[0].Subject.CommonName, fingerprint, audit.Verified)
+	}
+	return fmt.Sprintf("%s %s, %s", audit.Version, audit.CipherSuite, peer)
+}
+
+// Return the audit in multiple lines, suitable for reading by system administrator.
+func (audit TLSAudit) Describe() string {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "TLS version:  %s\n", audit.Version)
+	fmt.Fprintf(&out, "Cipher suite: %s\n", audit.CipherSuite)
+	fmt.Fprintf(&out, "Verified:     %v\n", audit.Verified)
+	for i, cert := range audit.PeerCertificates {
+		fmt.Fprintf(&out, "Certificate #%d:\n", i)
+		fmt.Fprintf(&out, "  Subject:    %s\n", cert.Subject)
+		fmt.Fprintf(&out, "  Issuer:     %s\n", cert.Issuer)
+		fmt.Fprintf(&out, "  Valid:      %s - %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+		fmt.Fprintf(&out, "  Public key: %s\n", GetSPKIPin(cert))
+	}
+	return out.String()
+}
+
+// Establish a TLS connection to key server without making an RPC, and report the negotiated parameters.
+func (client *CryptClient) AuditTLS() (TLSAudit, error) {
+	if client.Type != "tcp" {
+		return TLSAudit{}, fmt.Errorf("AuditTLS: TLS is not involved in %s connection", client.Type)
+	}
+	// Audit a full handshake rather than a resumed session
+	conf := client.tlsConfig.Clone()
+	conf.ClientSessionCache = nil
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: RPC_DIAL_TIMEOUT_SEC * time.Second}, "tcp", client.Address, conf)
+	if err != nil {
+		return TLSAudit{}, fmt.Errorf("AuditTLS: failed to connect to %s - %v", client.Address, err)
+	}
+	defer conn.Close()
+	return GetTLSAudit(conn.ConnectionState()), nil
+}
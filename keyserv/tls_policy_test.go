@@ -0,0 +1,158 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	if policy, err := ParseTLSPolicy("", "", ""); err != nil || !reflect.DeepEqual(policy, DefaultTLSPolicy()) {
+		t.Fatal(policy, err)
+	}
+	policy, err := ParseTLSPolicy("1.3", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "X25519 P384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(policy, TLSPolicy{
+		MinVersion:       tls.VersionTLS13,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP384},
+	}) {
+		t.Fatalf("%+v", policy)
+	}
+	if _, err := ParseTLSPolicy("1.1", "", ""); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := ParseTLSPolicy("", "TLS_RSA_WITH_RC4_128_SHA", ""); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := ParseTLSPolicy("", "", "P224"); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestParseSPKIPins(t *testing.T) {
+	pin := SPKI_PIN_PREFIX + "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	if pins, err := ParseSPKIPins(" " + pin + " "); err != nil || !reflect.DeepEqual(pins, []string{pin}) {
+		t.Fatal(pins, err)
+	}
+	if pins, err := ParseSPKIPins(""); err != nil || len(pins) != 0 {
+		t.Fatal(pins, err)
+	}
+	for _, bad := range []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "sha256//abc", "sha256//!!!"} {
+		if _, err := ParseSPKIPins(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestAuditTLS(t *testing.T) {
+	fixture := NewTestTLS(t, "localhost")
+	sysconf := fixture.SysConf()
+	sysconf.Set(SRV_CONF_LISTEN_PORT, SRV_DEFAULT_PORT+2)
+	sysconf.Set(SRV_CONF_TLS_AUDIT_LOG, true)
+	sysconf.Set(TLS_CONF_MIN_VERSION, "1.3")
+	_, tearDown := fixture.StartServer(t, sysconf)
+	defer tearDown()
+	ca, caPEM := fixture.CA, fixture.CA.CertPEM
+	client, err := NewCryptClient("tcp", fmt.Sprintf("localhost:%d", SRV_DEFAULT_PORT+2), caPEM, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := client.AuditTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audit.Version != "TLS 1.3" || !audit.Verified || len(audit.PeerCertificates) == 0 ||
+		audit.PeerCertificates[0].Subject.CommonName != "localhost" {
+		t.Fatal(audit.Describe())
+	}
+	if !strings.Contains(audit.Describe(), GetSPKIPin(audit.PeerCertificates[0])) || !strings.HasPrefix(audit.String(), "TLS 1.3 ") {
+		t.Fatal(audit.Describe(), audit.String())
+	}
+	// Server refuses to go below its TLS floor
+	client.tlsConfig.MaxVersion = tls.VersionTLS12
+	if _, err := client.AuditTLS(); err == nil {
+		t.Fatal("did not error")
+	}
+	client.tlsConfig.MaxVersion = 0
+	// Pinned key must match server's key or its issuer's key
+	unrelatedPin := SPKI_PIN_PREFIX + "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	client.PinKeys([]string{unrelatedPin})
+	if _, err := client.AuditTLS(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := MatchPinnedKeys([]string{GetSPKIPin(ca.Cert)}, audit.VerifiedChains); err != nil {
+		t.Fatal(err)
+	}
+	client.PinKeys([]string{unrelatedPin, GetSPKIPin(audit.PeerCertificates[0])})
+	if _, err := client.AuditTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(PingRequest{}); err == nil || strings.Contains(err.Error(), "MatchPinnedKeys") {
+		// The RPC fails on password rather than on TLS
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyPinnedKeys_UnverifiedCert(t *testing.T) {
+	fixture := NewTestTLS(t, "localhost")
+	defer os.RemoveAll(fixture.Dir)
+	ca := fixture.CA
+	// The genuine key server and a man-in-the-middle both hold certificates trusted by the CA
+	genuineCert, genuineKey := fixture.SrvCert, fixture.SrvKey
+	mitmCert, mitmKey := path.Join(fixture.Dir, "mitm.crt"), path.Join(fixture.Dir, "mitm.key")
+	if err := ca.IssueServerCert("localhost", 10, mitmCert, mitmKey); err != nil {
+		t.Fatal(err)
+	}
+	genuine, err := tls.LoadX509KeyPair(genuineCert, genuineKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mitm, err := tls.LoadX509KeyPair(mitmCert, mitmKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genuineX509, err := x509.ParseCertificate(genuine.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	clientConf := &tls.Config{RootCAs: roots, ServerName: "localhost", VerifyConnection: VerifyPinnedKeys([]string{GetSPKIPin(genuineX509)})}
+	handshake := func(serverCert tls.Certificate) error {
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConf)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+	if err := handshake(genuine); err != nil {
+		t.Fatal(err)
+	}
+	// The man-in-the-middle sends its own certificate followed by the pinned certificate of the genuine server
+	mitm.Certificate = append(mitm.Certificate, genuine.Certificate[0])
+	if err := handshake(mitm); err == nil || !strings.Contains(err.Error(), "MatchPinnedKeys") {
+		t.Fatal(err)
+	}
+}
@@ -24,13 +24,45 @@ Maintain a key server:
   cryptctl list-keys       Show all encryption keys.
   cryptctl show-key UUID   Display pending-commands and details of a key.
   cryptctl edit-key UUID   Edit stored key information.
-  cryptctl send-command    Record a pending mount/umount command for a disk.
+  cryptctl send-command    Record a pending command for a disk.
+  cryptctl send-fleet-command
+                           Record a pending command for disks picked by tags or host names.
+  cryptctl show-batch BATCH
+                           Display the outcome of a fleet-wide command.
+  cryptctl tag-host IP [TAG...]
+                           Replace the tags of a computer.
+  cryptctl approve-retrieval UUID IP
+                           Let a computer retrieve a key that requires approval.
+  cryptctl list-leases [UUID]
+                           List computers that hold keys online and their leases.
+  cryptctl revoke-lease ID Tell a computer to let go of a key in its next heartbeat.
+  cryptctl fence-host IP|HOSTNAME
+                           Take away all keys from a computer fenced by a cluster.
+  cryptctl list-requests   List requests that await a second administrator.
+  cryptctl confirm-request ID
+                           Confirm a request as the second administrator using an admin API token.
   cryptctl clear-commands  Clear all pending commands of a disk.
+  cryptctl revoke-client CERT_FILE|SERIAL
+                           Revoke a client certificate issued upon enrolment.
+  cryptctl new-api-token reader|admin
+                           Generate a token for HTTP management API.
 
 Encrypt/unlock file systems:
+  cryptctl enrol-client    Obtain a client certificate from key server.
+  cryptctl audit-tls       Report TLS parameters and public key of key server.
   cryptctl encrypt         Set up a new file system for encryption.
   cryptctl online-unlock   Forcibly unlock all file systems via key server.
   cryptctl offline-unlock  Unlock a file system via a key record file.
+  cryptctl initrd-unlock [UUID...]
+                           Unlock disks in initramfs (see rd.cryptctl.uuid).
+
+Unlock file systems via systemd-cryptsetup:
+  cryptctl install-crypttab         Unlock a disk via crypttab and mount it via a mount unit.
+  cryptctl uninstall-crypttab UUID  Remove crypttab entry and mount unit of a disk.
+
+Manage shared disks in a Pacemaker cluster:
+  cryptctl ocf start|stop|monitor|validate-all|meta-data UUID
+                           Act as OCF resource agent (see ospackage/ocf).
 `)
 	os.Exit(exitStatus)
 }
@@ -97,15 +129,107 @@ func main() {
 		if err := command.SendCommand(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "send-fleet-command":
+		if err := command.SendFleetCommand(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "show-batch":
+		// Server - show the aggregated outcome of a fleet-wide command
+		if len(os.Args) < 3 {
+			sys.ErrorExit("Please specify the batch ID printed by send-fleet-command.")
+		}
+		if err := command.ShowBatch(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "tag-host":
+		// Server - tag a computer for fleet-wide commands, no tag removes all tags
+		if len(os.Args) < 3 {
+			sys.ErrorExit("Please specify the IP address of the computer to tag.")
+		}
+		if err := command.TagHost(os.Args[2], os.Args[3:]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "approve-retrieval":
+		// Server - let a computer retrieve a key once despite the policy requiring approval
+		if len(os.Args) < 4 {
+			sys.ErrorExit("Please specify the disk UUID and the IP address of the computer to approve.")
+		}
+		if err := command.ApproveRetrieval(os.Args[2], os.Args[3]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "list-leases":
+		// Server - list leases of keys held by computers
+		uuid := ""
+		if len(os.Args) > 2 {
+			uuid = os.Args[2]
+		}
+		if err := command.ListLeases(uuid); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "revoke-lease":
+		// Server - revoke the lease of a key held by a computer
+		if len(os.Args) < 3 {
+			sys.ErrorExit("Please specify the ID of the lease to revoke.")
+		}
+		if err := command.RevokeLease(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "fence-host":
+		// Server - take away all keys from a computer fenced by a cluster
+		if len(os.Args) < 3 {
+			sys.ErrorExit("Please specify the IP or host name of the fenced computer.")
+		}
+		if err := command.FenceHost(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "list-requests":
+		// Server - list requests to retrieve or erase keys under dual control
+		if err := command.ListDualControl(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "confirm-request":
+		// Server - confirm a request to retrieve or erase keys as the second administrator
+		if len(os.Args) < 3 {
+			sys.ErrorExit("Please specify the ID of the request to confirm.")
+		}
+		if err := command.ConfirmDualControl(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "clear-commands":
 		if err := command.ClearPendingCommands(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "revoke-client":
+		// Server - revoke a client certificate issued by the built-in certificate authority
+		if len(os.Args) < 3 {
+			sys.ErrorExit("Please specify the certificate file or serial number to revoke.")
+		}
+		if err := command.RevokeClientCert(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "new-api-token":
+		// Server - generate a token for HTTP management API
+		if len(os.Args) < 3 {
+			sys.ErrorExit("Please specify the role of the token, either reader or admin.")
+		}
+		if err := command.NewAPIToken(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "client-daemon":
 		// Client - run daemon that primarily polls and reacts to pending commands issued by RPC server
 		if err := command.ClientDaemon(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "enrol-client":
+		// Client - obtain a client certificate from key server's built-in certificate authority
+		if err := command.EnrolClient(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "audit-tls":
+		// Client - report negotiated TLS parameters and check public key pins
+		if err := command.AuditTLS(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "encrypt":
 		// Client - set up a new encrypted disk
 		if err := command.EncryptFS(); err != nil {
@@ -119,6 +243,24 @@ func main() {
 		if err := command.AutoOnlineUnlockFS(os.Args[2]); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "release-key":
+		// Client - close a disk and release its key, invoked by cryptctl-auto-unlock@.service when it stops
+		if len(os.Args) < 3 {
+			sys.ErrorExit("UUID is missing from command line parameters")
+		}
+		if err := command.ReleaseKey(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "ocf":
+		// Client - act as OCF resource agent of an encrypted disk, invoked by Pacemaker via the agent in ospackage/ocf
+		if len(os.Args) < 3 {
+			os.Exit(command.OCF_ERR_UNIMPLEMENTED)
+		}
+		uuid := os.Getenv("OCF_RESKEY_uuid")
+		if len(os.Args) > 3 {
+			uuid = os.Args[3]
+		}
+		os.Exit(command.OCFResourceAgent(os.Args[2], uuid))
 	case "online-unlock":
 		// Client - manually unlock all file systems using a key server and password
 		if err := command.ManOnlineUnlockFS(); err != nil {
@@ -129,6 +271,40 @@ func main() {
 		if err := command.ManOfflineUnlockFS(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "initrd-unlock":
+		// Client - unlock encrypted disks (e.g. root file system) in initramfs, invoked by dracut module
+		if err := command.InitrdUnlockFS(os.Args[2:]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "install-crypttab":
+		// Client - let systemd-cryptsetup unlock an encrypted disk and mount it via a mount unit
+		if err := command.InstallCrypttab(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "uninstall-crypttab":
+		// Client - remove crypttab entry and mount unit of an encrypted disk
+		if len(os.Args) < 3 {
+			sys.ErrorExit("UUID is missing from command line parameters")
+		}
+		if err := command.UninstallCrypttab(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "fetch-key":
+		// Client - retrieve key for systemd-cryptsetup, invoked by cryptctl-fetch-key@.service
+		if len(os.Args) < 3 {
+			sys.ErrorExit("UUID is missing from command line parameters")
+		}
+		if err := command.FetchKey(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "erase-fetched-key":
+		// Client - erase key file after systemd-cryptsetup has unlocked the disk
+		if len(os.Args) < 3 {
+			sys.ErrorExit("UUID is missing from command line parameters")
+		}
+		if err := command.EraseFetchedKey(os.Args[2]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "erase":
 		// Client - erase encryption headers for the encrypted disk
 		if err := command.EraseKey(); err != nil {
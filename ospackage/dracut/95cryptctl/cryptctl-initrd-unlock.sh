@@ -0,0 +1,10 @@
+#!/bin/sh
+# cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+# This source code is licensed under GPL version 3 that can be found in LICENSE file.
+#
+# Unlock an encrypted disk using key from cryptctl key server, or ask for its passphrase on the console as a fallback.
+
+[ -b "/dev/mapper/cryptctl-unlocked-$1" ] && exit 0
+# Boot splash would hide the passphrase prompt
+command -v plymouth >/dev/null && plymouth --ping && plymouth hide-splash
+/usr/sbin/cryptctl initrd-unlock "$1" </dev/console >/dev/console 2>&1
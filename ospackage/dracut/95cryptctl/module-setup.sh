@@ -0,0 +1,35 @@
+#!/bin/bash
+# cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+# This source code is licensed under GPL version 3 that can be found in LICENSE file.
+#
+# Dracut module that unlocks encrypted disks (e.g. root file system) in initramfs using key from cryptctl key server.
+# Include it via "dracut --add cryptctl", and name the disks via kernel parameter "rd.cryptctl.uuid=UUID".
+
+check() {
+    require_binaries /usr/sbin/cryptctl cryptsetup || return 1
+    # Only include the module when it is explicitly asked for
+    return 255
+}
+
+depends() {
+    echo network crypt
+    return 0
+}
+
+install() {
+    local pem_file
+    inst_multiple /usr/sbin/cryptctl cryptsetup
+    # Key server address and TLS files of client configuration
+    inst_simple /etc/sysconfig/cryptctl-client
+    for pem_file in $(. /etc/sysconfig/cryptctl-client && echo "$TLS_CA_PEM" "$TLS_CERT_PEM" "$TLS_CERT_KEY_PEM"); do
+        [ -f "$pem_file" ] && inst_simple "$pem_file"
+    done
+    # Network-bound disks recover their keys using the bindings
+    [ -d /etc/cryptctl/bindings ] && inst_multiple -o /etc/cryptctl/bindings/*
+    # Enrolment tokens identify this computer to key server
+    [ -d /etc/cryptctl/tokens ] && inst_multiple -o /etc/cryptctl/tokens/*
+    # Well-known certificate authorities, for a key server certificate that is not issued by a custom authority
+    inst_multiple -o /etc/ssl/ca-bundle.pem /etc/ssl/certs/ca-certificates.crt /etc/pki/tls/certs/ca-bundle.crt
+    inst_hook cmdline 05 "$moddir/parse-cryptctl.sh"
+    inst_script "$moddir/cryptctl-initrd-unlock.sh" /sbin/cryptctl-initrd-unlock
+}
@@ -0,0 +1,25 @@
+#!/bin/sh
+# cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+# This source code is licensed under GPL version 3 that can be found in LICENSE file.
+#
+# Bring up network and unlock the disks named by "rd.cryptctl.uuid" as soon as they appear.
+
+type getargs >/dev/null 2>&1 || . /lib/dracut-lib.sh
+
+CRYPTCTL_UUIDS=$(getargs rd.cryptctl.uuid | tr ',' ' ')
+[ -z "$CRYPTCTL_UUIDS" ] && return 0
+
+# Key server is reached over network
+echo "rd.neednet=1" > /etc/cmdline.d/50-cryptctl.conf
+# Unless told otherwise, do not let dracut's crypt module ask for the passphrase of the very same disks
+if [ -z "$(getargs rd.luks.uuid)" ] && getargbool 1 rd.luks; then
+    echo "rd.luks=0" >> /etc/cmdline.d/50-cryptctl.conf
+fi
+
+for uuid in $CRYPTCTL_UUIDS; do
+    uuid=${uuid#UUID=}
+    uuid=${uuid#luks-}
+    printf -- 'ENV{ID_FS_TYPE}=="crypto_LUKS", ENV{ID_FS_UUID}=="%s", RUN+="%s --onetime --unique --settled --name cryptctl-%s /sbin/cryptctl-initrd-unlock %s"\n' \
+        "$uuid" "$(command -v initqueue)" "$uuid" "$uuid" >> /etc/udev/rules.d/70-cryptctl.rules
+    wait_for_dev -n "/dev/mapper/cryptctl-unlocked-$uuid"
+done
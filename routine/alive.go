@@ -0,0 +1,104 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"strings"
+	"time"
+)
+
+/*
+AliveDiskDir registers the encrypted disks that the client daemon keeps alive on key server, one empty file per disk
+named after its UUID. The directory does not survive reboot.
+*/
+var AliveDiskDir = "/run/cryptctl/alive"
+
+// Ask client daemon to keep the encrypted disk alive on key server.
+func RegisterAliveDisk(uuid string) error {
+	if err := saveStateFile(AliveDiskDir, uuid, ""); err != nil {
+		return fmt.Errorf("RegisterAliveDisk: %v", err)
+	}
+	return nil
+}
+
+// Stop keeping the encrypted disk alive. It is not an error if the disk was not registered.
+func UnregisterAliveDisk(uuid string) error {
+	if err := removeStateFile(AliveDiskDir, uuid); err != nil {
+		return fmt.Errorf("UnregisterAliveDisk: %v", err)
+	}
+	return nil
+}
+
+// Return sorted UUIDs of the registered disks, regardless of whether they are still unlocked.
+func GetRegisteredAliveDisks() []string {
+	return listStateFiles(AliveDiskDir)
+}
+
+// Return sorted UUIDs of the registered disks that are still unlocked on this computer.
+func GetAliveDisks() []string {
+	uuids := make([]string, 0, 8)
+	for _, uuid := range GetRegisteredAliveDisks() {
+		if _, found := GetUnlockedDevice(uuid); found {
+			uuids = append(uuids, uuid)
+		}
+	}
+	return uuids
+}
+
+/*
+Send a single heartbeat on behalf of all of the alive disks, and poll pending commands of the disks in pollUUIDs. If the
+key server is too old to understand heartbeat, fall back to an alive report followed by a command poll.
+*/
+func SendHeartbeat(client *keyserv.CryptClient, aliveUUIDs, pollUUIDs []string) (keyserv.HeartbeatResp, error) {
+	hostname, _ := sys.GetHostnameAndIP()
+	resp, err := client.Heartbeat(keyserv.HeartbeatReq{
+		Hostname:  hostname,
+		UUIDs:     aliveUUIDs,
+		Tokens:    GetClientTokens(aliveUUIDs...),
+		PollUUIDs: pollUUIDs,
+		Leases:    GetLeases(aliveUUIDs...),
+	})
+	if err == nil || !isUnknownMethod(err) {
+		return resp, err
+	}
+	resp = keyserv.HeartbeatResp{}
+	if len(aliveUUIDs) > 0 {
+		if resp.Rejected, err = client.ReportAlive(keyserv.ReportAliveReq{
+			Hostname: hostname,
+			UUIDs:    aliveUUIDs,
+			Tokens:   GetClientTokens(aliveUUIDs...),
+			Leases:   GetLeases(aliveUUIDs...),
+		}); err != nil {
+			return resp, fmt.Errorf("SendHeartbeat: failed to report alive - %v", err)
+		}
+	}
+	poll, err := client.PollCommand(keyserv.PollCommandReq{UUIDs: pollUUIDs})
+	if err != nil {
+		return resp, fmt.Errorf("SendHeartbeat: failed to poll commands - %v", err)
+	}
+	resp.Commands = poll.Commands
+	return resp, nil
+}
+
+/*
+Wait up to timeoutSec for pending commands of the UUIDs, return as soon as server hands out commands. If the key server
+is too old to deliver commands as they are issued, wait for the entire duration and return no command, the commands
+will then arrive in heartbeat response.
+*/
+func WaitForCommands(client *keyserv.CryptClient, uuids []string, timeoutSec int) (map[string][]keydb.PendingCommand, error) {
+	resp, err := client.WaitCommand(keyserv.WaitCommandReq{UUIDs: uuids, TimeoutSec: timeoutSec})
+	if err != nil && isUnknownMethod(err) {
+		time.Sleep(time.Duration(timeoutSec) * time.Second)
+		return map[string][]keydb.PendingCommand{}, nil
+	}
+	return resp.Commands, err
+}
+
+// Return true only if the RPC error says that server does not have the function, i.e. server is of an earlier version.
+func isUnknownMethod(err error) bool {
+	return strings.Contains(err.Error(), "can't find method")
+}
@@ -0,0 +1,52 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestAliveDisks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-alivetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	origDir := AliveDiskDir
+	AliveDiskDir = path.Join(tmpDir, "alive")
+	defer func() {
+		AliveDiskDir = origDir
+	}()
+
+	if uuids := GetRegisteredAliveDisks(); len(uuids) != 0 {
+		t.Fatal(uuids)
+	}
+	for _, uuid := range []string{"b", "a", "b"} {
+		if err := RegisterAliveDisk(uuid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RegisterAliveDisk("../c"); err == nil {
+		t.Fatal("did not error")
+	}
+	if uuids := GetRegisteredAliveDisks(); !reflect.DeepEqual(uuids, []string{"a", "b"}) {
+		t.Fatal(uuids)
+	}
+	// Neither disk is unlocked on this computer
+	if uuids := GetAliveDisks(); len(uuids) != 0 {
+		t.Fatal(uuids)
+	}
+	if err := UnregisterAliveDisk("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnregisterAliveDisk("a"); err != nil {
+		t.Fatal(err)
+	}
+	if uuids := GetRegisteredAliveDisks(); !reflect.DeepEqual(uuids, []string{"b"}) {
+		t.Fatal(uuids)
+	}
+}
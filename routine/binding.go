@@ -0,0 +1,158 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	DISK_BINDING_FILE_MODE = 0600 // DISK_BINDING_FILE_MODE is the permission of disk binding files.
+	DISK_BINDING_DIR_MODE  = 0700 // DISK_BINDING_DIR_MODE is the permission of the directory of disk binding files.
+)
+
+var DiskBindingDir = "/etc/cryptctl/bindings" // DiskBindingDir holds a binding file for each network-bound disk.
+
+/*
+DiskBinding tells how to recover the key of a network-bound disk with key server's help. It does not contain any
+secret, the key cannot be recovered from it without the key server.
+*/
+type DiskBinding struct {
+	UUID         string   // UUID is the UUID of the encrypted disk.
+	Server       string   // Server is the address of key server at the time of encryption, for information only.
+	KeyID        string   // KeyID identifies the server's binding key that the disk key is bound to.
+	ClientPoint  []byte   // ClientPoint is the point C computed at the time of encryption.
+	MountPoint   string   // MountPoint is where the unlocked file system is mounted.
+	MountOptions []string // MountOptions are the options for mounting the unlocked file system.
+}
+
+// Return path to the binding file of a network-bound disk.
+func GetDiskBindingFile(uuid string) string {
+	return path.Join(DiskBindingDir, uuid)
+}
+
+// Write the binding into its file.
+func SaveDiskBinding(binding DiskBinding) error {
+	if err := keydb.ValidateUUID(binding.UUID); err != nil {
+		return fmt.Errorf("SaveDiskBinding: %v", err)
+	}
+	content, err := json.MarshalIndent(binding, "", "  ")
+	if err != nil {
+		return fmt.Errorf("SaveDiskBinding: failed to serialise binding - %v", err)
+	}
+	if err := os.MkdirAll(DiskBindingDir, DISK_BINDING_DIR_MODE); err != nil {
+		return fmt.Errorf("SaveDiskBinding: failed to make directory \"%s\" - %v", DiskBindingDir, err)
+	}
+	bindingFile := GetDiskBindingFile(binding.UUID)
+	if err := ioutil.WriteFile(bindingFile, content, DISK_BINDING_FILE_MODE); err != nil {
+		return fmt.Errorf("SaveDiskBinding: failed to write \"%s\" - %v", bindingFile, err)
+	}
+	return nil
+}
+
+// Return the binding of an encrypted disk, if the disk key is network-bound instead of being stored on key server.
+func GetDiskBinding(uuid string) (binding DiskBinding, found bool) {
+	if keydb.ValidateUUID(uuid) != nil {
+		return
+	}
+	content, err := ioutil.ReadFile(GetDiskBindingFile(uuid))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(content, &binding); err != nil || binding.UUID != uuid {
+		return DiskBinding{}, false
+	}
+	return binding, true
+}
+
+// Remove the binding file of a network-bound disk. It is not an error if the file does not exist.
+func RemoveDiskBinding(uuid string) error {
+	bindingFile := GetDiskBindingFile(uuid)
+	if err := os.Remove(bindingFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("RemoveDiskBinding: failed to remove \"%s\" - %v", bindingFile, err)
+	}
+	return nil
+}
+
+// Recover the key of a network-bound disk with key server's help in a single attempt.
+func recoverBoundKeyOnce(client *keyserv.CryptClient, binding DiskBinding) ([]byte, error) {
+	bindingKey, err := client.GetBindingKey()
+	if err != nil {
+		return nil, err
+	}
+	if bindingKey.KeyID != binding.KeyID || keyserv.GetBindingKeyID(bindingKey.PublicKey) != binding.KeyID {
+		return nil, fmt.Errorf("key server no longer has binding key \"%s\"", binding.KeyID)
+	}
+	blinded, ephemeral, err := keyserv.BlindBindingRequest(binding.ClientPoint)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	response, err := client.ExchangeBinding(keyserv.ExchangeBindingReq{
+		Hostname: hostname,
+		KeyID:    binding.KeyID,
+		Blinded:  blinded,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keyserv.UnblindBindingResponse(bindingKey.PublicKey, ephemeral, response)
+}
+
+/*
+Make continuous attempts to recover the key of a network-bound disk with key server's help. If maxRetrySec is zero or
+negative, then only one attempt will be made.
+*/
+func RecoverBoundKey(progressOut io.Writer, client *keyserv.CryptClient, binding DiskBinding, maxRetrySec int64) ([]byte, error) {
+	numFailures := 0
+	begin := time.Now().Unix()
+	for {
+		key, err := recoverBoundKeyOnce(client, binding)
+		if err == nil {
+			return key, nil
+		}
+		if time.Now().Unix() > begin+maxRetrySec {
+			return nil, fmt.Errorf("RecoverBoundKey: failed to recover key of \"%s\" (%v) and have given up after %d seconds",
+				binding.UUID, err, maxRetrySec)
+		}
+		// In case of failure, only report the first few occasions among consecutive failures.
+		if numFailures == 5 {
+			fmt.Fprint(progressOut, "RecoverBoundKey: suppress further failure messages until success\n")
+		} else if numFailures < 5 {
+			fmt.Fprintf(progressOut, "RecoverBoundKey: failed to recover key of \"%s\", will retry in %d seconds - %v\n",
+				binding.UUID, AUTO_UNLOCK_RETRY_INTERVAL_SEC, err)
+		}
+		numFailures++
+		time.Sleep(AUTO_UNLOCK_RETRY_INTERVAL_SEC * time.Second)
+	}
+}
+
+/*
+Obtain the key for unlocking a disk without using a password. A network-bound disk key is recovered with key server's
+help, otherwise the key is retrieved from key server subject to its MaxActive restriction.
+*/
+func RetrieveKeyForUnlock(progressOut io.Writer, client *keyserv.CryptClient, uuid string, maxRetrySec int64) (keydb.Record, error) {
+	binding, found := GetDiskBinding(uuid)
+	if !found {
+		return AutoRetrieveKey(progressOut, client, uuid, maxRetrySec)
+	}
+	key, err := RecoverBoundKey(progressOut, client, binding, maxRetrySec)
+	if err != nil {
+		return keydb.Record{}, err
+	}
+	return keydb.Record{
+		UUID:         binding.UUID,
+		Key:          key,
+		MountPoint:   binding.MountPoint,
+		MountOptions: binding.MountOptions,
+	}, nil
+}
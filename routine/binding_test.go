@@ -0,0 +1,57 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestDiskBinding(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-bindingtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	origDir := DiskBindingDir
+	DiskBindingDir = path.Join(tmpDir, "bindings")
+	defer func() {
+		DiskBindingDir = origDir
+	}()
+
+	if _, found := GetDiskBinding("aaa"); found {
+		t.Fatal("should not have found it")
+	}
+	binding := DiskBinding{
+		UUID:         "aaa",
+		Server:       "localhost:3737",
+		KeyID:        "0123456789abcdef0123456789abcdef",
+		ClientPoint:  []byte{4, 1, 2, 3},
+		MountPoint:   "/a",
+		MountOptions: []string{"rw", "noatime"},
+	}
+	if err := SaveDiskBinding(binding); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, found := GetDiskBinding("aaa"); !found || !reflect.DeepEqual(loaded, binding) {
+		t.Fatal(loaded, found)
+	}
+	if st, err := os.Stat(GetDiskBindingFile("aaa")); err != nil || st.Mode().Perm() != DISK_BINDING_FILE_MODE {
+		t.Fatal(st, err)
+	}
+	if err := SaveDiskBinding(DiskBinding{UUID: "../a"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := RemoveDiskBinding("aaa"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := GetDiskBinding("aaa"); found {
+		t.Fatal("should have been removed")
+	}
+	if err := RemoveDiskBinding("aaa"); err != nil {
+		t.Fatal(err)
+	}
+}
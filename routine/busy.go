@@ -0,0 +1,132 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/fs"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	BUSY_TERMINATE_WAIT_SEC     = 10                  // BUSY_TERMINATE_WAIT_SEC is the time terminated processes have to exit before umount is tried again.
+	BUSY_LAZY_WAIT_SEC          = 10                  // BUSY_LAZY_WAIT_SEC is the time a lazily umounted file system has to let go of its crypt device.
+	BUSY_DETAILS_KEY            = "busy_processes"    // BUSY_DETAILS_KEY is the command result detail that lists the processes keeping a file system busy.
+	BUSY_STILL_OPEN_DETAILS_KEY = "crypt_device_open" // BUSY_STILL_OPEN_DETAILS_KEY is the command result detail that tells why a crypt device could not be closed yet.
+)
+
+/*
+Return the processes, except this one, that keep the file system mounted on the mount point busy because their working
+directory or any of their open files is on it.
+*/
+func GetMountUsers(mountPoint string) ([]sys.Proc, error) {
+	mountPoint = filepath.Clean(mountPoint)
+	isOnMount := func(filePath string) bool {
+		return filePath == mountPoint || strings.HasPrefix(filePath, mountPoint+"/")
+	}
+	users := make([]sys.Proc, 0, 8)
+	err := sys.WalkProcs(func(proc sys.Proc) bool {
+		if proc.PID == os.Getpid() {
+			return true
+		}
+		if proc.Cwd != "" && isOnMount(proc.Cwd) {
+			users = append(users, proc)
+			return true
+		}
+		for _, openFile := range proc.OpenFiles {
+			if isOnMount(openFile) {
+				users = append(users, proc)
+				break
+			}
+		}
+		return true
+	})
+	return users, err
+}
+
+// Return "PID COMMAND-LINE" of each process.
+func DescribeProcs(procs []sys.Proc) []string {
+	ret := make([]string, 0, len(procs))
+	for _, proc := range procs {
+		ret = append(ret, strings.TrimSpace(fmt.Sprintf("%d %s", proc.PID, strings.Join(proc.CmdLine, " "))))
+	}
+	return ret
+}
+
+/*
+Umount the file system. Before the umount, look for processes that keep the file system busy, what happens to them is
+told by onBusy (keydb.ON_BUSY_*): leave them alone and fail without attempting the umount, umount lazily, or terminate
+them and umount once they have exited. Return the processes that kept the file system busy.
+*/
+func UmountBusy(progressOut io.Writer, mountPoint, onBusy string) (busy []sys.Proc, err error) {
+	busy, err = GetMountUsers(mountPoint)
+	if err != nil {
+		// Let umount tell whether the file system is busy
+		fmt.Fprintf(progressOut, "UmountBusy: failed to look for processes using \"%s\" - %v\n", mountPoint, err)
+	}
+	if len(busy) == 0 {
+		return busy, fs.Umount(mountPoint)
+	}
+	procs := DescribeProcs(busy)
+	switch onBusy {
+	case keydb.ON_BUSY_LAZY:
+		fmt.Fprintf(progressOut, "UmountBusy: \"%s\" is in use by %s, umount it lazily\n", mountPoint, strings.Join(procs, ", "))
+		return busy, fs.UmountLazy(mountPoint)
+	case keydb.ON_BUSY_TERMINATE:
+		fmt.Fprintf(progressOut, "UmountBusy: \"%s\" is in use by %s, terminate them\n", mountPoint, strings.Join(procs, ", "))
+		for _, proc := range busy {
+			if err := syscall.Kill(proc.PID, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+				fmt.Fprintf(progressOut, "UmountBusy: failed to terminate process %d - %v\n", proc.PID, err)
+			}
+		}
+		for i := 0; i < BUSY_TERMINATE_WAIT_SEC; i++ {
+			if remaining, err := GetMountUsers(mountPoint); err == nil && len(remaining) == 0 {
+				break
+			}
+			time.Sleep(1 * time.Second)
+		}
+		if err := fs.Umount(mountPoint); err != nil {
+			return busy, fmt.Errorf("UmountBusy: \"%s\" is still in use after terminating %s - %v", mountPoint, strings.Join(procs, ", "), err)
+		}
+		return busy, nil
+	}
+	return busy, fmt.Errorf("UmountBusy: \"%s\" is in use by %s", mountPoint, strings.Join(procs, ", "))
+}
+
+/*
+Wait for the crypt device to be let go of by its holders and whoever keeps it open, such as a file system that was
+umounted lazily, for up to maxWaitSec seconds. Return an error describing what still keeps the device open.
+*/
+func WaitCryptDevReleased(cryptDev fs.BlockDevice, maxWaitSec int) error {
+	var stillOpen error
+	for i := 0; ; i++ {
+		stillOpen = nil
+		if sysfsDev, err := fs.GetSysfsBlockDevice(cryptDev.Path); err == nil {
+			if holders := sysfsDev.Holders(); len(holders) > 0 {
+				names := make([]string, 0, len(holders))
+				for _, holder := range holders {
+					names = append(names, holder.StableName())
+				}
+				stillOpen = fmt.Errorf("\"%s\" is held by %s", cryptDev.Path, strings.Join(names, ", "))
+			}
+		}
+		if stillOpen == nil {
+			if count, err := fs.DMOpenCount(cryptDev.Name); err != nil {
+				stillOpen = err
+			} else if count > 0 {
+				stillOpen = fmt.Errorf("\"%s\" is still open %d time(s)", cryptDev.Path, count)
+			}
+		}
+		if stillOpen == nil || i >= maxWaitSec {
+			return stillOpen
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
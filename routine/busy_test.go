@@ -0,0 +1,61 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestGetMountUsers(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-busytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// This process is never among the users
+	openFile, err := os.Create(path.Join(tmpDir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer openFile.Close()
+	if users, err := GetMountUsers(tmpDir); err != nil || len(users) != 0 {
+		t.Fatal(users, err)
+	}
+	// A process working in the directory keeps it busy
+	cmd := exec.Command("sleep", "60")
+	cmd.Dir = tmpDir
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	users, err := GetMountUsers(tmpDir + "/")
+	if err != nil || len(users) != 1 || users[0].PID != cmd.Process.Pid {
+		t.Fatal(users, err)
+	}
+	if procs := DescribeProcs(users); !reflect.DeepEqual(procs, []string{fmt.Sprintf("%d sleep 60", cmd.Process.Pid)}) {
+		t.Fatal(procs)
+	}
+	if users, err := GetMountUsers(tmpDir + "-other"); err != nil || len(users) != 0 {
+		t.Fatal(users, err)
+	}
+	// Umount does not go ahead while the process is left alone
+	if busy, err := UmountBusy(ioutil.Discard, tmpDir, keydb.ON_BUSY_FAIL); err == nil || len(busy) != 1 {
+		t.Fatal(busy, err)
+	}
+	if _, err := UmountBusy(ioutil.Discard, tmpDir, keydb.ON_BUSY_TERMINATE); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Fatal("process was not terminated")
+	}
+	if users, err := GetMountUsers(tmpDir); err != nil || len(users) != 0 {
+		t.Fatal(users, err)
+	}
+}
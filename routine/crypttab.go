@@ -0,0 +1,252 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/fs"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	CRYPTTAB_KEY_DIR        = "/run/cryptctl/keys"  // CRYPTTAB_KEY_DIR holds key files for systemd-cryptsetup briefly during unlocking.
+	SYSTEMD_UNIT_DIR        = "/etc/systemd/system" // SYSTEMD_UNIT_DIR is where cryptctl places mount units and drop-ins.
+	FETCH_KEY_DAEMON        = "cryptctl-fetch-key@" // FETCH_KEY_DAEMON is the service that retrieves key for systemd-cryptsetup.
+	CRYPTSETUP_DAEMON       = "systemd-cryptsetup@" // CRYPTSETUP_DAEMON is the service generated by systemd from crypttab.
+	CRYPTSETUP_DROP_IN_NAME = "cryptctl.conf"       // CRYPTSETUP_DROP_IN_NAME is the file name of drop-in for systemd-cryptsetup.
+	BIN_CRYPTCTL            = "/usr/sbin/cryptctl"  // BIN_CRYPTCTL is the installed location of cryptctl program.
+	CRYPTTAB_OPTIONS        = "luks,_netdev,nofail" // CRYPTTAB_OPTIONS are the crypttab options of cryptctl entries.
+	CRYPTTAB_MOUNT_OPTIONS  = "_netdev,nofail"      // CRYPTTAB_MOUNT_OPTIONS are appended to the mount unit's options.
+	CRYPTTAB_WANTED_BY      = "remote-fs.target"    // CRYPTTAB_WANTED_BY is the target that pulls in the mount unit.
+	CRYPTTAB_UNIT_MODE      = 0644                  // CRYPTTAB_UNIT_MODE is the permission of generated unit files.
+	CRYPTTAB_KEY_MODE       = 0600                  // CRYPTTAB_KEY_MODE is the permission of the temporary key file.
+	CRYPTTAB_KEY_DIR_MODE   = 0700                  // CRYPTTAB_KEY_DIR_MODE is the permission of the temporary key directory.
+	CRYPTTAB_UNIT_HEADER    = "# Generated by cryptctl, do not edit. Remove via \"cryptctl uninstall-crypttab\".\n"
+)
+
+// Return the device mapper name of an encrypted disk that is unlocked by systemd-cryptsetup.
+func MakeCrypttabMapperName(uuid string) string {
+	return DM_NAME_PREFIX + uuid
+}
+
+// Return path to the temporary key file handed to systemd-cryptsetup.
+func GetCrypttabKeyFile(uuid string) string {
+	return path.Join(CRYPTTAB_KEY_DIR, uuid)
+}
+
+// Return the systemd-cryptsetup service name of an encrypted disk that is unlocked by systemd-cryptsetup.
+func GetCryptsetupServiceName(uuid string) string {
+	return CRYPTSETUP_DAEMON + fs.SystemdEscape(MakeCrypttabMapperName(uuid)) + ".service"
+}
+
+/*
+Return the crypttab entry of an encrypted disk, if the disk is to be unlocked by systemd-cryptsetup instead of
+cryptctl's own unlocking service.
+*/
+func GetCrypttabEntry(uuid string) (entry fs.CrypttabEntry, found bool) {
+	tab, err := fs.ParseCrypttabFile(fs.CRYPTTAB_PATH)
+	if err != nil {
+		return
+	}
+	if ptr, exists := tab.Entries[MakeCrypttabMapperName(uuid)]; exists {
+		return *ptr, true
+	}
+	return
+}
+
+// Make the content of a mount unit that mounts the unlocked disk after systemd-cryptsetup has unlocked it.
+func MakeCrypttabMountUnit(uuid, mountPoint string, mountOptions []string) string {
+	options := strings.Join(append(append([]string{}, mountOptions...), CRYPTTAB_MOUNT_OPTIONS), ",")
+	return fmt.Sprintf(`%s[Unit]
+Description=Disk encryption utility (cryptctl) - mount %s from encrypted disk %s
+Requires=%s
+After=%s
+
+[Mount]
+What=/dev/mapper/%s
+Where=%s
+Options=%s
+
+[Install]
+WantedBy=%s
+`, CRYPTTAB_UNIT_HEADER, mountPoint, uuid,
+		GetCryptsetupServiceName(uuid), GetCryptsetupServiceName(uuid),
+		MakeCrypttabMapperName(uuid), mountPoint, strings.TrimPrefix(options, ","), CRYPTTAB_WANTED_BY)
+}
+
+// Make the content of a systemd-cryptsetup drop-in that retrieves key from key server before unlocking the disk.
+func MakeCryptsetupDropIn(uuid string) string {
+	fetchKeyService := FETCH_KEY_DAEMON + uuid + ".service"
+	return fmt.Sprintf(`%s[Unit]
+Requires=%s
+After=%s
+
+[Service]
+ExecStartPost=-%s erase-fetched-key %s
+`, CRYPTTAB_UNIT_HEADER, fetchKeyService, fetchKeyService, BIN_CRYPTCTL, uuid)
+}
+
+/*
+Set up an encrypted disk to be unlocked by systemd-cryptsetup using a key retrieved from key server, and to be mounted
+by a systemd mount unit. Other services may then order themselves against the mount point via RequiresMountsFor=.
+*/
+func InstallCrypttabUnlock(progressOut io.Writer, uuid, mountPoint string, mountOptions []string) error {
+	if !path.IsAbs(mountPoint) || path.Clean(mountPoint) == "/" {
+		return fmt.Errorf("InstallCrypttabUnlock: mount point \"%s\" must be an absolute path and must not be /", mountPoint)
+	}
+	mountPoint = path.Clean(mountPoint)
+	if _, found := fs.GetBlockDevices().GetByCriteria(uuid, "", "", "crypto_LUKS", "", "", ""); !found {
+		return fmt.Errorf("InstallCrypttabUnlock: cannot find an encrypted disk with UUID \"%s\"", uuid)
+	}
+	// Place the entry into crypttab
+	tab, err := fs.ParseCrypttabFile(fs.CRYPTTAB_PATH)
+	if err != nil {
+		return err
+	}
+	tab.Set(fs.CrypttabEntry{
+		Name:    MakeCrypttabMapperName(uuid),
+		Device:  "UUID=" + uuid,
+		KeyFile: GetCrypttabKeyFile(uuid),
+		Options: strings.Split(CRYPTTAB_OPTIONS, ","),
+	})
+	if err := tab.WriteFile(fs.CRYPTTAB_PATH, CRYPTTAB_UNIT_MODE); err != nil {
+		return fmt.Errorf("InstallCrypttabUnlock: %v", err)
+	}
+	fmt.Fprintf(progressOut, "Updated %s\n", fs.CRYPTTAB_PATH)
+	// Ask systemd-cryptsetup to retrieve the key before unlocking
+	dropInDir := path.Join(SYSTEMD_UNIT_DIR, GetCryptsetupServiceName(uuid)+".d")
+	if err := os.MkdirAll(dropInDir, 0755); err != nil {
+		return fmt.Errorf("InstallCrypttabUnlock: failed to make directory \"%s\" - %v", dropInDir, err)
+	}
+	dropInPath := path.Join(dropInDir, CRYPTSETUP_DROP_IN_NAME)
+	if err := ioutil.WriteFile(dropInPath, []byte(MakeCryptsetupDropIn(uuid)), CRYPTTAB_UNIT_MODE); err != nil {
+		return fmt.Errorf("InstallCrypttabUnlock: failed to write \"%s\" - %v", dropInPath, err)
+	}
+	fmt.Fprintf(progressOut, "Created %s\n", dropInPath)
+	// Mount the file system via a mount unit
+	mountUnit := fs.GetSystemdMountNameForDir(mountPoint)
+	mountUnitPath := path.Join(SYSTEMD_UNIT_DIR, mountUnit)
+	if err := ioutil.WriteFile(mountUnitPath, []byte(MakeCrypttabMountUnit(uuid, mountPoint, mountOptions)), CRYPTTAB_UNIT_MODE); err != nil {
+		return fmt.Errorf("InstallCrypttabUnlock: failed to write \"%s\" - %v", mountUnitPath, err)
+	}
+	fmt.Fprintf(progressOut, "Created %s\n", mountUnitPath)
+	if err := sys.SystemctlDaemonReload(); err != nil {
+		return err
+	}
+	return sys.SystemctlEnable(mountUnit)
+}
+
+// Remove crypttab entry, mount unit, and drop-in of an encrypted disk that was set up by InstallCrypttabUnlock.
+func UninstallCrypttabUnlock(progressOut io.Writer, uuid string) error {
+	tab, err := fs.ParseCrypttabFile(fs.CRYPTTAB_PATH)
+	if err != nil {
+		return err
+	}
+	if !tab.Remove(MakeCrypttabMapperName(uuid)) {
+		return fmt.Errorf("UninstallCrypttabUnlock: \"%s\" does not have an entry in %s", uuid, fs.CRYPTTAB_PATH)
+	}
+	if err := tab.WriteFile(fs.CRYPTTAB_PATH, CRYPTTAB_UNIT_MODE); err != nil {
+		return fmt.Errorf("UninstallCrypttabUnlock: %v", err)
+	}
+	fmt.Fprintf(progressOut, "Updated %s\n", fs.CRYPTTAB_PATH)
+	// Look for the mount unit that mounts the unlocked disk
+	mapperPath := "What=/dev/mapper/" + MakeCrypttabMapperName(uuid) + "\n"
+	unitFiles, err := ioutil.ReadDir(SYSTEMD_UNIT_DIR)
+	if err != nil {
+		return fmt.Errorf("UninstallCrypttabUnlock: failed to read directory \"%s\" - %v", SYSTEMD_UNIT_DIR, err)
+	}
+	for _, unitFile := range unitFiles {
+		unitPath := path.Join(SYSTEMD_UNIT_DIR, unitFile.Name())
+		if !strings.HasSuffix(unitFile.Name(), ".mount") || fs.FileContains(unitPath, mapperPath) != nil {
+			continue
+		}
+		if err := sys.SystemctlDisable(unitFile.Name()); err != nil {
+			fmt.Fprintf(progressOut, "  *%v\n", err)
+		}
+		if err := os.Remove(unitPath); err != nil {
+			return fmt.Errorf("UninstallCrypttabUnlock: failed to remove \"%s\" - %v", unitPath, err)
+		}
+		fmt.Fprintf(progressOut, "Removed %s\n", unitPath)
+	}
+	dropInDir := path.Join(SYSTEMD_UNIT_DIR, GetCryptsetupServiceName(uuid)+".d")
+	if err := os.RemoveAll(dropInDir); err != nil {
+		return fmt.Errorf("UninstallCrypttabUnlock: failed to remove \"%s\" - %v", dropInDir, err)
+	}
+	fmt.Fprintf(progressOut, "Removed %s\n", dropInDir)
+	return sys.SystemctlDaemonReload()
+}
+
+/*
+Retrieve encryption key of the disk from key server without using a password, and write the key into a temporary file
+for systemd-cryptsetup to unlock the disk. Make continuous attempts for up to maxRetrySec seconds. The pre-unlock hook
+scripts run right before the key is handed to systemd-cryptsetup.
+*/
+func FetchKeyForCrypttab(progressOut io.Writer, client *keyserv.CryptClient, uuid string, maxRetrySec int64) error {
+	sys.LockMem()
+	rec, err := RetrieveKeyForUnlock(progressOut, client, uuid, maxRetrySec)
+	if err != nil {
+		return err
+	}
+	RunPhaseHooks(progressOut, HOOK_PRE_UNLOCK, uuid, rec.MountPoint)
+	if err := os.MkdirAll(CRYPTTAB_KEY_DIR, CRYPTTAB_KEY_DIR_MODE); err != nil {
+		return fmt.Errorf("FetchKeyForCrypttab: failed to make directory \"%s\" - %v", CRYPTTAB_KEY_DIR, err)
+	}
+	keyFile := GetCrypttabKeyFile(uuid)
+	if err := ioutil.WriteFile(keyFile, rec.Key, CRYPTTAB_KEY_MODE); err != nil {
+		return fmt.Errorf("FetchKeyForCrypttab: failed to write key file \"%s\" - %v", keyFile, err)
+	}
+	fmt.Fprintf(progressOut, "FetchKeyForCrypttab: key of \"%s\" is ready for systemd-cryptsetup\n", uuid)
+	return nil
+}
+
+// Erase the temporary key file written by FetchKeyForCrypttab. It is not an error if the file does not exist.
+func EraseFetchedKey(uuid string) error {
+	keyFile := GetCrypttabKeyFile(uuid)
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		return nil
+	}
+	return fs.SecureErase(keyFile, true)
+}
+
+/*
+Wait for up to maxWaitSec seconds until systemd-cryptsetup has unlocked the disk specified by UUID.
+The key server considers the computer to be holding the key only after the disk has been unlocked.
+*/
+func WaitForCrypttabUnlock(progressOut io.Writer, uuid string, maxWaitSec int64) error {
+	mapperDev := path.Join("/dev/mapper", MakeCrypttabMapperName(uuid))
+	begin := time.Now().Unix()
+	fmt.Fprintf(progressOut, "WaitForCrypttabUnlock: waiting for systemd-cryptsetup to unlock \"%s\"\n", uuid)
+	for {
+		if _, err := os.Stat(mapperDev); err == nil {
+			return nil
+		}
+		if time.Now().Unix() > begin+maxWaitSec {
+			return fmt.Errorf("WaitForCrypttabUnlock: \"%s\" did not appear in %d seconds", mapperDev, maxWaitSec)
+		}
+		time.Sleep(AUTO_UNLOCK_RETRY_INTERVAL_SEC * time.Second)
+	}
+}
+
+/*
+Wait for up to maxWaitSec seconds until the mount unit has mounted the disk unlocked by systemd-cryptsetup, then run the
+post-mount hook scripts on its behalf, as the mount unit cannot run them. Return the outcome of the hook scripts.
+*/
+func RunCrypttabPostMountHooks(progressOut io.Writer, uuid string, maxWaitSec int64) (map[string]string, error) {
+	begin := time.Now().Unix()
+	for {
+		if cryptDev, found := GetUnlockedDevice(uuid); found && cryptDev.MountPoint != "" {
+			return RunPhaseHooks(progressOut, HOOK_POST_MOUNT, uuid, cryptDev.MountPoint)
+		}
+		if time.Now().Unix() > begin+maxWaitSec {
+			return nil, fmt.Errorf("RunCrypttabPostMountHooks: \"%s\" was not mounted in %d seconds", uuid, maxWaitSec)
+		}
+		time.Sleep(AUTO_UNLOCK_RETRY_INTERVAL_SEC * time.Second)
+	}
+}
@@ -0,0 +1,61 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io"
+	"time"
+)
+
+const DUAL_CONTROL_POLL_INTERVAL_SEC = 5 // DUAL_CONTROL_POLL_INTERVAL_SEC is the interval of checking whether a request has been confirmed.
+
+// Return the name of the administrator using this computer, such as "alice@host1".
+func GetAdminName() string {
+	hostname, _ := sys.GetHostnameAndIP()
+	return sys.GetLoginName() + "@" + hostname
+}
+
+/*
+Ask key server whether a second administrator has to confirm the action on the disks. If so, ask the administrator for
+their admin API token by calling askToken, which may be nil if the administrator presents a client certificate granted
+the admin role instead, then wait until the request is confirmed and return its ID, which has to accompany the action.
+Return an empty ID if the action may go ahead right away.
+*/
+func WaitDualControl(progressOut io.Writer, client *keyserv.CryptClient, password keyserv.HashedPassword, admin, action string, uuids []string, askToken func() string) (string, error) {
+	req := keyserv.RequestDualControlReq{Password: password, Admin: admin, Action: action, UUIDs: uuids}
+	resp, err := client.RequestDualControl(req)
+	if err != nil && isUnknownMethod(err) {
+		// Server of an earlier version does not know dual control
+		return "", nil
+	} else if err != nil || !resp.Required {
+		return "", err
+	}
+	if resp.Request.ID == "" && askToken != nil {
+		// Key server password is shared among administrators, the requester proves who they are by their own token.
+		req.APIToken = askToken()
+		if resp, err = client.RequestDualControl(req); err != nil {
+			return "", err
+		}
+	}
+	if resp.Request.ID == "" {
+		return "", errors.New("WaitDualControl: a second administrator has to confirm this action, please present your admin API token or client certificate")
+	}
+	fmt.Fprintf(progressOut, "Another administrator has to confirm this action by running \"cryptctl confirm-request %s\" on key server before %s.\n",
+		resp.Request.ID, resp.Request.Expiry.Format(time.RFC3339))
+	fmt.Fprintln(progressOut, "Waiting for the confirmation...")
+	for {
+		time.Sleep(DUAL_CONTROL_POLL_INTERVAL_SEC * time.Second)
+		req, err := client.GetDualControl(keyserv.DualControlReq{Password: password, ID: resp.Request.ID})
+		if err != nil {
+			return "", err
+		}
+		if req.IsApproved() {
+			fmt.Fprintf(progressOut, "%s has confirmed the action.\n", req.Approver)
+			return req.ID, nil
+		}
+	}
+}
@@ -15,7 +15,6 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"unicode"
 )
 
 const (
@@ -26,6 +25,7 @@ const (
 	MSG_E_ENCRYPT_DISK_NOT_FOUND  = "Cannot find disk \"%s\". See output of \"lsblk\" command to determine available disks."
 	MSG_E_MOUNT_UNDERNEATH        = "The directory to encrypt has a mount point (\"%s\") underneath, please unmount all drives underneath before proceeding with encryption."
 	MSG_E_ENC_ALREADY_OPEN        = "The disk to encrypt (\"%s\") is being actively used as an encrypted disk (\"%s\"), please destroy its data and try again."
+	MSG_E_ENC_DISK_IN_USE         = "The disk to encrypt (\"%s\") is being used by \"%s\" (e.g. LVM, RAID, or multipath), please deactivate it before proceeding with encryption."
 	MSG_E_CALC_DIR_SIZE           = "Failed to calculate size of directory \"%s - %v"
 	MSG_E_DISK_TOO_SMALL          = "Disk \"%s\" is too small to hold encrypted data. It should have at least %d MBytes in capacity."
 	MSG_E_WALK_PROC               = "Failed to inspect running processes - %v"
@@ -35,6 +35,7 @@ const (
 	MSG_STEP_1                    = "\n1. Completely erase disk \"%s\" and install encryption key on it.\n"
 	MSG_STEP_2                    = "\n2. Copy data from \"%s\" into the disk.\n"
 	MSG_STEP_3                    = "\n3. Announce the encrypted disk to key server \"%s\".\n"
+	MSG_STEP_3_BOUND              = "\n3. Record the key binding in \"%s\".\n"
 	MSG_E_MKDIR                   = "Failed to make directory \"%s\" - %v"
 	MSG_E_RENAME_DIR              = "Failed to rename directory \"%s\" into \"%s\" - %v"
 	MSG_E_NO_DEV_INFO             = "Failed to retrieve block device information of \"%s\""
@@ -54,9 +55,16 @@ func MakeUUID() string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:])
 }
 
-// Return a computed mapper device name from a crypto device name.
+/*
+Return a computed mapper device name from a crypto device name.
+The device is looked up in sysfs so that LVM volumes, multipath maps, MD arrays, and symbolic links such as
+/dev/disk/by-id/xxx all end up with unique names that are derived from the device rather than its path.
+*/
 func MakeDeviceMapperName(devName string) string {
 	if strings.Contains(devName, "/") {
+		if dev, err := fs.GetSysfsBlockDevice(devName); err == nil {
+			return DM_NAME_PREFIX + dev.StableName()
+		}
 		return DM_NAME_PREFIX + path.Base(devName)
 	}
 	return DM_NAME_PREFIX + devName
@@ -87,13 +95,18 @@ func EncryptFSPreCheck(srcDir, encDisk string) error {
 			return fmt.Errorf(MSG_E_MOUNT_UNDERNEATH, mountPoint.MountPoint)
 		}
 	}
-	// The disk to encrypt may not have partitions underneath that are already mounted
-	if !unicode.IsDigit(rune(encDisk[len(encDisk)-1])) {
+	encDiskSysfs, err := fs.GetSysfsBlockDevice(encDisk)
+	if err != nil {
+		return fmt.Errorf(MSG_E_ENCRYPT_DISK_NOT_FOUND, encDisk)
+	}
+	// The disk to encrypt may not have partitions or volumes underneath that are already mounted
+	for _, descendant := range encDiskSysfs.Descendants() {
 		for _, mp := range mountPoints {
-			if strings.HasPrefix(mp.DeviceNode, encDisk) {
-				if unicode.IsDigit(rune(mp.DeviceNode[len(encDisk)])) {
-					return fmt.Errorf(MSG_E_MOUNT_UNDERNEATH, mp.MountPoint)
-				}
+			if !strings.HasPrefix(mp.DeviceNode, "/dev/") {
+				continue
+			}
+			if mpDev, err := fs.GetSysfsBlockDevice(mp.DeviceNode); err == nil && mpDev.Equals(descendant) {
+				return fmt.Errorf(MSG_E_MOUNT_UNDERNEATH, mp.MountPoint)
 			}
 		}
 	}
@@ -102,15 +115,29 @@ func EncryptFSPreCheck(srcDir, encDisk string) error {
 	if openedEncDev, found := blkDevs.GetByCriteria("", "/dev/mapper/"+dmName, "", "", "", "", ""); found {
 		return fmt.Errorf(MSG_E_ENC_ALREADY_OPEN, encDisk, openedEncDev.Path)
 	}
-	// The directory to encrypt may not be mounted from the disk to encrypt
+	for _, holder := range encDiskSysfs.Holders() {
+		if holder.IsCrypt() {
+			return fmt.Errorf(MSG_E_ENC_ALREADY_OPEN, encDisk, "/dev/mapper/"+holder.DMName())
+		}
+		// The disk may not be a building block of an active LVM volume group, RAID array, or multipath map
+		return fmt.Errorf(MSG_E_ENC_DISK_IN_USE, encDisk, holder.StableName())
+	}
+	// The directory to encrypt may not be mounted from the disk to encrypt, nor from a volume built on top of the disk
 	srcDirMount, found := mountPoints.GetMountPointOfPath(srcDir)
 	if !found {
 		return fmt.Errorf(MSG_E_SRC_DIR_MOUNT_NOT_FOUND, srcDir)
-	} else if srcDirMount.DeviceNode == encDisk {
+	} else if fs.SameBlockDevice(srcDirMount.DeviceNode, encDisk) {
 		return fmt.Errorf(MSG_E_SRC_DIR_NESTED_IN_DISK, srcDir, encDisk)
 	} else if strings.HasPrefix(srcDirMount.FileSystem, "nfs") || strings.HasPrefix(srcDirMount.FileSystem, "cifs") {
 		return fmt.Errorf(MSG_E_ENC_REMOTE_FS, srcDir)
 	}
+	if srcDirDev, err := fs.GetSysfsBlockDevice(srcDirMount.DeviceNode); err == nil {
+		for _, ancestor := range srcDirDev.Ancestors() {
+			if ancestor.Equals(encDiskSysfs) {
+				return fmt.Errorf(MSG_E_SRC_DIR_NESTED_IN_DISK, srcDir, encDisk)
+			}
+		}
+	}
 
 	// Look for SAP keywords among encryption paths
 	encSAP := false
@@ -127,12 +154,12 @@ func EncryptFSPreCheck(srcDir, encDisk string) error {
 	if encSAP {
 		// If encryption path touches SAP, make sure SAP keywords don't appear in the running process list.
 		var seenSAPProc string
-		walkErr := sys.WalkProcs(func(cmdLine []string) bool {
-			for _, seg := range strings.Split(cmdLine[0], fmt.Sprintf("%c", os.PathSeparator)) {
+		walkErr := sys.WalkProcs(func(proc sys.Proc) bool {
+			for _, seg := range strings.Split(proc.CmdLine[0], fmt.Sprintf("%c", os.PathSeparator)) {
 				seg = strings.ToLower(seg)
 				for _, kw := range sapKeywords {
 					if kw == seg {
-						seenSAPProc = strings.Join(cmdLine, " ")
+						seenSAPProc = strings.Join(proc.CmdLine, " ")
 						return false
 					}
 				}
@@ -165,10 +192,12 @@ func EncryptFSPreCheck(srcDir, encDisk string) error {
 /*
 Set up encryption on a file system using a randomly generated key and upload the key to key server. Return UUID of
 now encrypted block device and any error encountered during the routine.
+The allowed clients restrict which computers may retrieve the key without password (see keydb.ClientIdentity), an
+entry of "token" asks the key server to issue an enrolment token that is then kept on this computer.
 */
 func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 	password, srcDir, encDisk string,
-	keyMaxActive, keyAliveIntervalSec, keyAliveCount int) (string, error) {
+	keyMaxActive, keyAliveIntervalSec, keyAliveCount int, allowedClients []string) (string, error) {
 	sys.LockMem()
 	srcDir = filepath.Clean(srcDir)
 	encDisk = filepath.Clean(encDisk)
@@ -198,16 +227,101 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 		MaxActive:        keyMaxActive,
 		AliveIntervalSec: keyAliveIntervalSec,
 		AliveCount:       keyAliveCount,
+		AllowedClients:   allowedClients,
 	})
 	if err != nil {
 		return "", fmt.Errorf(MSG_E_RPC_KEY_CREATE, err)
 	}
+	if encryptionKeyResp.Token != "" {
+		if err := SaveClientToken(cryptDevUUID, encryptionKeyResp.Token); err != nil {
+			return "", err
+		}
+	}
+	srcDataDir, err := encryptFSWithKey(progressOut, encryptionKeyResp.KeyContent, cryptDevUUID, srcDir, encDisk, mountPoints, srcDirMount)
+	if err != nil {
+		return "", err
+	}
 
+	// Step 3. Announce the encrypted disk to key server.
+	fmt.Fprintf(progressOut, MSG_STEP_3, client.Address)
+	cryptDev, found := fs.GetBlockDevice(encDisk)
+	if !found {
+		return "", fmt.Errorf(MSG_E_NO_DEV_INFO, encDisk)
+	}
+	fmt.Fprintf(progressOut, MSG_OK_CONGRATS, srcDir, encDisk, srcDataDir)
+	return cryptDev.UUID, nil
+}
+
+/*
+Encrypt a file system just like EncryptFS does, but bind the encryption key to key server's binding key instead of
+storing it on the key server. The key can only be recovered with key server's help, yet the key server never sees the
+key and does not keep any record of the disk. Return UUID of the encrypted disk.
+*/
+func EncryptFSBound(progressOut io.Writer, client *keyserv.CryptClient, srcDir, encDisk string) (string, error) {
+	sys.LockMem()
+	srcDir = filepath.Clean(srcDir)
+	encDisk = filepath.Clean(encDisk)
+
+	// Step 0 - check pre-conditions for encryption
+	if err := EncryptFSPreCheck(srcDir, encDisk); err != nil {
+		return "", err
+	}
+
+	// Step 1 - compute an encryption key bound to key server
+	mountPoints := fs.ParseMtab()
+	srcDirMount, found := mountPoints.GetMountPointOfPath(srcDir)
+	if !found {
+		return "", fmt.Errorf(MSG_E_SRC_DIR_MOUNT_NOT_FOUND, srcDir)
+	}
+	bindingKey, err := client.GetBindingKey()
+	if err != nil {
+		return "", fmt.Errorf(MSG_E_RPC_KEY_CREATE, err)
+	}
+	if keyID := keyserv.GetBindingKeyID(bindingKey.PublicKey); keyID != bindingKey.KeyID {
+		return "", fmt.Errorf(MSG_E_RPC_KEY_CREATE, fmt.Sprintf("server presented a binding key with wrong ID \"%s\"", bindingKey.KeyID))
+	}
+	clientPoint, diskKey, err := keyserv.BindDiskKey(bindingKey.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf(MSG_E_RPC_KEY_CREATE, err)
+	}
+	cryptDevUUID := MakeUUID()
+	srcDataDir, err := encryptFSWithKey(progressOut, diskKey, cryptDevUUID, srcDir, encDisk, mountPoints, srcDirMount)
+	if err != nil {
+		return "", err
+	}
+
+	// Step 3. Remember how to recover the key on this computer.
+	fmt.Fprintf(progressOut, MSG_STEP_3_BOUND, GetDiskBindingFile(cryptDevUUID))
+	cryptDev, found := fs.GetBlockDevice(encDisk)
+	if !found {
+		return "", fmt.Errorf(MSG_E_NO_DEV_INFO, encDisk)
+	}
+	srcDirMount.DiscardBtrfsSubvolume()
+	if err := SaveDiskBinding(DiskBinding{
+		UUID:         cryptDev.UUID,
+		Server:       client.Address,
+		KeyID:        bindingKey.KeyID,
+		ClientPoint:  clientPoint,
+		MountPoint:   srcDir,
+		MountOptions: srcDirMount.Options,
+	}); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(progressOut, MSG_OK_CONGRATS, srcDir, encDisk, srcDataDir)
+	return cryptDev.UUID, nil
+}
+
+/*
+Erase the disk, format it using the encryption key, and then copy data from source directory into the encrypted disk.
+Return the new location of original un-encrypted data.
+*/
+func encryptFSWithKey(progressOut io.Writer, key []byte, cryptDevUUID, srcDir, encDisk string,
+	mountPoints fs.MountPoints, srcDirMount fs.MountPoint) (string, error) {
 	// Step 1. Un-mount the disk to encrypt
 	fmt.Fprintf(progressOut, MSG_STEP_1, encDisk)
 	for {
 		// Repeat until the disk has no more mount points
-		if mountPoint, found := mountPoints.GetByCriteria(encDisk, "", ""); found {
+		if mountPoint, found := mountPoints.GetByBlockDevice(encDisk); found {
 			if err := fs.Umount(mountPoint.MountPoint); err != nil {
 				return "", err
 			}
@@ -217,11 +331,11 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 		break
 	}
 	// Step 1 (cont). Wipe the disk and install encryption key
-	if err := fs.CryptFormat(encryptionKeyResp.KeyContent, encDisk, cryptDevUUID); err != nil {
+	if err := fs.CryptFormat(key, encDisk, cryptDevUUID); err != nil {
 		return "", err
 	}
 	dmName := MakeDeviceMapperName(encDisk)
-	if err := fs.CryptOpen(encryptionKeyResp.KeyContent, encDisk, dmName); err != nil {
+	if err := fs.CryptOpen(key, encDisk, dmName); err != nil {
 		return "", err
 	}
 	encDiskMapper := path.Join("/dev/mapper", dmName)
@@ -260,13 +374,5 @@ func EncryptFS(progressOut io.Writer, client *keyserv.CryptClient,
 	if err := fs.MirrorFiles(srcDataDir, srcDir, progressOut); err != nil {
 		return "", err
 	}
-
-	// Step 3. Announce the encrypted disk to key server.
-	fmt.Fprintf(progressOut, MSG_STEP_3, client.Address)
-	cryptDev, found := fs.GetBlockDevice(encDisk)
-	if !found {
-		return "", fmt.Errorf(MSG_E_NO_DEV_INFO, encDisk)
-	}
-	fmt.Fprintf(progressOut, MSG_OK_CONGRATS, srcDir, encDisk, srcDataDir)
-	return cryptDev.UUID, nil
+	return srcDataDir, nil
 }
@@ -231,12 +231,12 @@ func TestEncryptDecrypt(t *testing.T) {
 	var encUUID0, encUUID1 string
 	// Run encryption routine on two directories + two disks
 	// The first disk can be unlocked twice at the same time
-	encUUID0, err = EncryptFS(os.Stdout, client, keyserv.TEST_RPC_PASS, srcDir0, "/dev/loop0", 2, REPORT_ALIVE_INTERVAL_SEC, 2)
+	encUUID0, err = EncryptFS(os.Stdout, client, keyserv.TEST_RPC_PASS, srcDir0, "/dev/loop0", 2, REPORT_ALIVE_INTERVAL_SEC, 2, nil)
 	if err != nil || encUUID0 == "" {
 		t.Fatal(err, encUUID0)
 	}
 	//The second disk can only be unlocked once.
-	encUUID1, err = EncryptFS(os.Stdout, client, keyserv.TEST_RPC_PASS, srcDir1, "/dev/loop1", 1, REPORT_ALIVE_INTERVAL_SEC, 2)
+	encUUID1, err = EncryptFS(os.Stdout, client, keyserv.TEST_RPC_PASS, srcDir1, "/dev/loop1", 1, REPORT_ALIVE_INTERVAL_SEC, 2, nil)
 	if err != nil || encUUID1 == "" {
 		t.Fatal(err, encUUID1)
 	}
@@ -299,7 +299,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	*/
 	resetDisks()
 	// Unlock disks with password
-	if err := ManOnlineUnlockFS(os.Stdout, client, keyserv.TEST_RPC_PASS); err != nil {
+	if err := ManOnlineUnlockFS(os.Stdout, client, keyserv.TEST_RPC_PASS, nil); err != nil {
 		t.Fatal(err)
 	}
 	checkSecret0()
@@ -320,7 +320,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	go srv.HandleTCPConnections()
 
 	// There's no need to make a new RPC client because the client does not hold a persistent connection
-	if err := ManOnlineUnlockFS(os.Stdout, client, keyserv.TEST_RPC_PASS); err != nil {
+	if err := ManOnlineUnlockFS(os.Stdout, client, keyserv.TEST_RPC_PASS, nil); err != nil {
 		t.Fatal(err)
 	}
 	checkSecret0()
@@ -364,7 +364,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	for i := 0; i < 2; i++ {
 		go func(i int) {
 			log.Printf("About to run auto-unlock routine #%d on disk %s", i, loop0Dev.UUID)
-			err := AutoOnlineUnlockFS(os.Stdout, client, loop0Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
+			_, err := AutoOnlineUnlockFS(os.Stdout, client, loop0Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
 			// Once key is retrieved successfully, begin sending alive messages.
 			if err == nil {
 				log.Printf("Auto-unlock routine #%d of disk %s succeeded, going to send keep-alive in background.", i, loop0Dev.UUID)
@@ -385,7 +385,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	// Next two attempts are made against loop1 that only allows one active user. Only one attempt should succeed.
 	for i := 2; i < 4; i++ {
 		go func(i int) {
-			err := AutoOnlineUnlockFS(os.Stdout, client, loop1Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
+			_, err := AutoOnlineUnlockFS(os.Stdout, client, loop1Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
 			// Once key is retrieved successfully, begin sending alive messages.
 			if err == nil {
 				go func() {
@@ -401,7 +401,8 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 	// The second last attempt is made against a disk that does not have key on the server.
 	go func() {
-		onlineUnlockAttempt[4] <- AutoOnlineUnlockFS(os.Stdout, client, "this-uuid-does-not-exist", 15)
+		_, err := AutoOnlineUnlockFS(os.Stdout, client, "this-uuid-does-not-exist", 15)
+		onlineUnlockAttempt[4] <- err
 	}()
 
 	// Bring server online now
@@ -506,7 +507,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	for _, record := range srv.KeyDB.RecordsByUUID {
 		records = append(records, record)
 		fmt.Println("Offline-unlocking", record.MountPoint, record.UUID)
-		if err := UnlockFS(os.Stdout, record, 3); err != nil {
+		if _, err := UnlockFS(os.Stdout, record, 3); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -520,7 +521,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		MountPoint:   "/tmp",
 		MountOptions: []string{},
 	}
-	if err := UnlockFS(os.Stdout, bogusRecord, 3); err == nil {
+	if _, err := UnlockFS(os.Stdout, bogusRecord, 3); err == nil {
 		t.Fatal("did not error")
 	}
 	checkSecret0()
@@ -532,7 +533,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		===============================================
 	*/
 	// First attempt erases an open & mounted file system
-	if err := EraseKey(os.Stdout, client, keyserv.TEST_RPC_PASS, encUUID0); err != nil {
+	if err := EraseKey(os.Stdout, client, keyserv.TEST_RPC_PASS, encUUID0, nil); err != nil {
 		t.Fatal(err)
 	}
 	// Second attempt erases a not yet mounted file system
@@ -542,7 +543,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	if err := fs.CryptClose(loop1Crypt); err != nil {
 		t.Fatal(err)
 	}
-	if err := EraseKey(os.Stdout, client, keyserv.TEST_RPC_PASS, encUUID1); err != nil {
+	if err := EraseKey(os.Stdout, client, keyserv.TEST_RPC_PASS, encUUID1, nil); err != nil {
 		t.Fatal(err)
 	}
 	if len(srv.KeyDB.RecordsByUUID) != 0 {
@@ -571,10 +572,10 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 
 	// Now those records won't be able to unlock disks anymore
-	if err := UnlockFS(os.Stdout, records[0], 3); err == nil {
+	if _, err := UnlockFS(os.Stdout, records[0], 3); err == nil {
 		t.Fatal("did not error")
 	}
-	if err := UnlockFS(os.Stdout, records[1], 3); err == nil {
+	if _, err := UnlockFS(os.Stdout, records[1], 3); err == nil {
 		t.Fatal("did not error")
 	}
 
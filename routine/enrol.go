@@ -0,0 +1,83 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io/ioutil"
+	"time"
+)
+
+/*
+Enrol this computer with key server's built-in certificate authority using the server's access password. The new client
+certificate and its key are written into files, and so is the CA certificate if caPath is not empty.
+*/
+func EnrolClient(client *keyserv.CryptClient, password keyserv.HashedPassword, commonName, certPath, keyPath, caPath string) (*x509.Certificate, error) {
+	csrPEM, keyPEM, err := keyserv.NewClientCSR(commonName)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	resp, err := client.EnrolClient(keyserv.EnrolClientReq{
+		Password: password,
+		Hostname: hostname,
+		CSR:      csrPEM,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("EnrolClient: failed to enrol with key server - %v", err)
+	}
+	cert, err := keyserv.ParseCertPEM(resp.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("EnrolClient: key server responded with a malformed certificate - %v", err)
+	}
+	if caPath != "" {
+		if err := ioutil.WriteFile(caPath, resp.CACertificate, keyserv.CERT_FILE_MODE); err != nil {
+			return nil, fmt.Errorf("EnrolClient: failed to write \"%s\" - %v", caPath, err)
+		}
+	}
+	if err := keyserv.SaveClientCert(certPath, keyPath, resp.Certificate, keyPEM); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+/*
+Renew the client certificate with key server's built-in certificate authority if less than a third of its validity
+remains. The current certificate must still be valid, it authenticates the client in place of a password.
+Return the renewed certificate, or nil if renewal was not due.
+*/
+func RenewClientCertIfDue(client *keyserv.CryptClient, certPath, keyPath string) (*x509.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("RenewClientCertIfDue: failed to read \"%s\" - %v", certPath, err)
+	}
+	current, err := keyserv.ParseCertPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("RenewClientCertIfDue: failed to parse \"%s\" - %v", certPath, err)
+	}
+	if !keyserv.CertNeedsRenewal(current, time.Now()) {
+		return nil, nil
+	} else if time.Now().After(current.NotAfter) {
+		return nil, fmt.Errorf("RenewClientCertIfDue: certificate \"%s\" expired on %s, please run \"cryptctl enrol-client\" again",
+			certPath, current.NotAfter.Format(time.RFC3339))
+	}
+	csrPEM, keyPEM, err := keyserv.NewClientCSR(current.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.RenewClientCert(keyserv.RenewClientCertReq{CSR: csrPEM})
+	if err != nil {
+		return nil, fmt.Errorf("RenewClientCertIfDue: failed to renew certificate - %v", err)
+	}
+	renewed, err := keyserv.ParseCertPEM(resp.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("RenewClientCertIfDue: key server responded with a malformed certificate - %v", err)
+	}
+	if err := keyserv.SaveClientCert(certPath, keyPath, resp.Certificate, keyPEM); err != nil {
+		return nil, err
+	}
+	return renewed, nil
+}
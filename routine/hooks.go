@@ -0,0 +1,72 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io"
+	"io/ioutil"
+	"path"
+)
+
+// The phases around which hook scripts run, each phase has its own directory of scripts under HookDir.
+const (
+	HOOK_PRE_UNLOCK  = "pre-unlock"  // HOOK_PRE_UNLOCK runs before the disk is unlocked.
+	HOOK_POST_MOUNT  = "post-mount"  // HOOK_POST_MOUNT runs after the unlocked disk is mounted, such as to start applications.
+	HOOK_PRE_UMOUNT  = "pre-umount"  // HOOK_PRE_UMOUNT runs before the disk is umounted, such as to stop applications.
+	HOOK_POST_UMOUNT = "post-umount" // HOOK_POST_UMOUNT runs after the disk is umounted.
+	HOOK_PRE_LOCK    = "pre-lock"    // HOOK_PRE_LOCK runs before the crypt device of the disk is closed.
+	HOOK_POST_LOCK   = "post-lock"   // HOOK_POST_LOCK runs after the crypt device of the disk is closed.
+)
+
+// Return the directory of hook scripts that run in the phase, such as /etc/cryptctl/hooks/pre-umount.d.
+func GetPhaseHookDir(phase string) string {
+	return path.Join(HookDir, phase+".d")
+}
+
+/*
+Run the executable scripts in the directory of the phase one after another in the order of their names. The scripts
+learn about the disk and the phase from environment variables, each of them is given up after HOOK_TIMEOUT_SEC. A failed
+script does not stop the others, the first failure is returned. Return the exit status and trailing output of each
+script in command result details, keyed by phase and script name.
+*/
+func RunPhaseHooks(progressOut io.Writer, phase, uuid, mountPoint string) (details map[string]string, err error) {
+	details = make(map[string]string)
+	// ReadDir sorts the scripts by name, a phase without a directory has nothing to run.
+	hookDir := GetPhaseHookDir(phase)
+	files, readErr := ioutil.ReadDir(hookDir)
+	if readErr != nil {
+		return details, nil
+	}
+	env := []string{HOOK_ENV_UUID + "=" + uuid, HOOK_ENV_MOUNT + "=" + mountPoint, HOOK_ENV_PHASE + "=" + phase}
+	if _, cryptDev, unlocked, _ := getDiskDevices(uuid); unlocked {
+		env = append(env, HOOK_ENV_CRYPT_DEV+"="+cryptDev.Path)
+	}
+	for _, file := range files {
+		hookFile := path.Join(hookDir, file.Name())
+		if !keydb.RegexHookName.MatchString(file.Name()) || !isExecutableFile(hookFile) {
+			continue
+		}
+		fmt.Fprintf(progressOut, "RunPhaseHooks: running %s hook \"%s\" for disk \"%s\"\n", phase, hookFile, uuid)
+		exitStatus, out, hookErr := runHookFile(hookFile, env)
+		key := phase + "/" + file.Name()
+		details[key+".exit_status"] = exitStatus
+		details[key+".output"] = out
+		if hookErr != nil {
+			fmt.Fprintf(progressOut, "RunPhaseHooks: \"%s\" has failed - %v %s\n", hookFile, hookErr, out)
+			if err == nil {
+				err = fmt.Errorf("RunPhaseHooks: \"%s\" has failed - %v", hookFile, hookErr)
+			}
+		}
+	}
+	return details, err
+}
+
+// Run the hook scripts of the phase and add their outcome to the details. A failed script is recorded in the details.
+func addPhaseHookDetails(details map[string]string, progressOut io.Writer, phase, uuid, mountPoint string) {
+	hookDetails, _ := RunPhaseHooks(progressOut, phase, uuid, mountPoint)
+	for key, val := range hookDetails {
+		details[key] = val
+	}
+}
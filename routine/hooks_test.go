@@ -0,0 +1,63 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRunPhaseHooks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-hooktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	origDir := HookDir
+	HookDir = tmpDir
+	defer func() {
+		HookDir = origDir
+	}()
+
+	// A phase without a directory has nothing to run
+	if details, err := RunPhaseHooks(ioutil.Discard, HOOK_PRE_UMOUNT, "a", "/mnt"); err != nil || len(details) != 0 {
+		t.Fatal(details, err)
+	}
+	hookDir := GetPhaseHookDir(HOOK_PRE_UMOUNT)
+	if err := os.MkdirAll(hookDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	scripts := map[string]string{
+		"10-ok":   "#!/bin/sh\necho $CRYPTCTL_PHASE $CRYPTCTL_UUID $CRYPTCTL_MOUNT_POINT\n",
+		"20-fail": "#!/bin/sh\necho oops\nexit 3\n",
+		"30-ok":   "#!/bin/sh\necho still run\n",
+	}
+	for name, content := range scripts {
+		if err := ioutil.WriteFile(path.Join(hookDir, name), []byte(content), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files that may not be executed are skipped
+	if err := ioutil.WriteFile(path.Join(hookDir, "40-not-executable"), []byte("#!/bin/sh\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	details, err := RunPhaseHooks(ioutil.Discard, HOOK_PRE_UMOUNT, "a", "/mnt")
+	if err == nil {
+		t.Fatal("did not error")
+	}
+	if len(details) != 6 ||
+		details["pre-umount/10-ok.exit_status"] != "0" || details["pre-umount/10-ok.output"] != "pre-umount a /mnt\n" ||
+		details["pre-umount/20-fail.exit_status"] != "3" || details["pre-umount/20-fail.output"] != "oops\n" ||
+		details["pre-umount/30-ok.exit_status"] != "0" || details["pre-umount/30-ok.output"] != "still run\n" {
+		t.Fatal(details)
+	}
+	// The outcome of several phases adds up in one command result
+	details = map[string]string{"mount_point": "/mnt"}
+	addPhaseHookDetails(details, ioutil.Discard, HOOK_POST_MOUNT, "a", "/mnt")
+	addPhaseHookDetails(details, ioutil.Discard, HOOK_PRE_UMOUNT, "a", "/mnt")
+	if len(details) != 7 || details["mount_point"] != "/mnt" || details["pre-umount/20-fail.exit_status"] != "3" {
+		t.Fatal(details)
+	}
+}
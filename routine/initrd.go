@@ -0,0 +1,95 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/fs"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	INITRD_CMDLINE_UUID        = "rd.cryptctl.uuid"    // INITRD_CMDLINE_UUID is the kernel parameter that names a disk to unlock in initramfs.
+	INITRD_CMDLINE_TIMEOUT     = "rd.cryptctl.timeout" // INITRD_CMDLINE_TIMEOUT is the kernel parameter of seconds to wait for key server.
+	INITRD_DEFAULT_TIMEOUT_SEC = 60                    // INITRD_DEFAULT_TIMEOUT_SEC is the default seconds to wait for key server.
+	MSG_INITRD_FALLBACK        = "Cannot retrieve key of disk \"%s\" from key server, please enter the disk's passphrase.\n"
+)
+
+/*
+Return disk UUIDs and key server timeout specified on kernel command line via rd.cryptctl.uuid (may be repeated or
+comma-separated) and rd.cryptctl.timeout. Timeout is INITRD_DEFAULT_TIMEOUT_SEC if it is absent or malformed.
+*/
+func ParseInitrdCmdline(cmdline string) (uuids []string, timeoutSec int64) {
+	uuids = make([]string, 0, 2)
+	timeoutSec = INITRD_DEFAULT_TIMEOUT_SEC
+	for _, param := range strings.Fields(cmdline) {
+		keyValue := strings.SplitN(param, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		switch keyValue[0] {
+		case INITRD_CMDLINE_UUID:
+			for _, uuid := range strings.Split(keyValue[1], ",") {
+				// Tolerate the "UUID=" and "luks-" prefixes that are common among other rd.* parameters
+				uuid = strings.TrimPrefix(strings.TrimPrefix(uuid, "UUID="), "luks-")
+				if uuid != "" {
+					uuids = append(uuids, uuid)
+				}
+			}
+		case INITRD_CMDLINE_TIMEOUT:
+			if sec, err := strconv.ParseInt(keyValue[1], 10, 64); err == nil && sec >= 0 {
+				timeoutSec = sec
+			}
+		}
+	}
+	return
+}
+
+// Return the unlocked device of an encrypted disk, regardless of whether cryptctl, initramfs, or systemd unlocked it.
+func GetUnlockedDevice(uuid string) (unlockedDev fs.BlockDevice, found bool) {
+	blkDevs := fs.GetBlockDevices()
+	hostDev, foundHost := blkDevs.GetByCriteria(uuid, "", "", "", "", "", "")
+	if !foundHost {
+		return
+	}
+	return blkDevs.GetByCriteria("", "", "crypt", "", "", hostDev.Name, "")
+}
+
+/*
+Unlock an encrypted disk in initramfs before the root file system is mounted. The unlocked disk is named after its
+UUID (see MakeCrypttabMapperName), so that kernel parameters such as "root=" may refer to it. The file system is not
+mounted, initramfs will mount it according to kernel parameters or fstab.
+If client is nil, or the key cannot be retrieved within maxRetrySec, ask for the disk's passphrase on the console.
+*/
+func InitrdUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid string, maxRetrySec int64) error {
+	sys.LockMem()
+	blkDev, found := fs.GetBlockDevices().GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return fmt.Errorf("InitrdUnlockFS: failed to get information of \"%s\"", uuid)
+	} else if !blkDev.IsLUKSEncrypted() {
+		return fmt.Errorf("InitrdUnlockFS: \"%s\" is not a LUKS-encrypted block device", uuid)
+	}
+	if unlockedDev, found := GetUnlockedDevice(uuid); found {
+		fmt.Fprintf(progressOut, "InitrdUnlockFS: \"%s\" has already been unlocked as \"%s\"\n", uuid, unlockedDev.Path)
+		return nil
+	}
+	dmName := MakeCrypttabMapperName(uuid)
+	if client != nil {
+		rec, err := RetrieveKeyForUnlock(progressOut, client, uuid, maxRetrySec)
+		if err == nil {
+			if err := fs.CryptOpen(rec.Key, blkDev.Path, dmName); err != nil {
+				return err
+			}
+			fmt.Fprintf(progressOut, "InitrdUnlockFS: \"%s\" has been unlocked as \"/dev/mapper/%s\"\n", uuid, dmName)
+			return nil
+		}
+		fmt.Fprintf(progressOut, "InitrdUnlockFS: %v\n", err)
+	}
+	// Fall back to a passphrase, which system administrator may have added to the disk via "cryptsetup luksAddKey".
+	fmt.Fprintf(progressOut, MSG_INITRD_FALLBACK, uuid)
+	return fs.CryptOpenInteractive(blkDev.Path, dmName)
+}
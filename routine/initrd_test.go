@@ -0,0 +1,22 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInitrdCmdline(t *testing.T) {
+	uuids, timeout := ParseInitrdCmdline("BOOT_IMAGE=/vmlinuz root=/dev/mapper/cryptctl-unlocked-a quiet\n")
+	if len(uuids) != 0 || timeout != INITRD_DEFAULT_TIMEOUT_SEC {
+		t.Fatal(uuids, timeout)
+	}
+	uuids, timeout = ParseInitrdCmdline("rd.cryptctl.uuid=a,UUID=b rd.cryptctl.timeout=120 rd.cryptctl.uuid=luks-c rd.cryptctl.uuid=\n")
+	if !reflect.DeepEqual(uuids, []string{"a", "b", "c"}) || timeout != 120 {
+		t.Fatal(uuids, timeout)
+	}
+	if _, timeout = ParseInitrdCmdline("rd.cryptctl.timeout=abc"); timeout != INITRD_DEFAULT_TIMEOUT_SEC {
+		t.Fatal(timeout)
+	}
+}
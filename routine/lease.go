@@ -0,0 +1,78 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io"
+)
+
+/*
+LeaseDir remembers the lease ID that key server handed out along with each disk key, one file per disk named after its
+UUID. Heartbeats carry the lease IDs, so that server recognises the computer even if its IP changes. The directory does
+not survive reboot.
+*/
+var LeaseDir = "/run/cryptctl/leases"
+
+// Remember the lease of a disk key granted by key server.
+func SaveLease(uuid, leaseID string) error {
+	if err := saveStateFile(LeaseDir, uuid, leaseID+"\n"); err != nil {
+		return fmt.Errorf("SaveLease: %v", err)
+	}
+	return nil
+}
+
+// Return lease IDs of the disks in UUID - lease ID pairs. Disks without a lease are left out.
+func GetLeases(uuids ...string) map[string]string {
+	leases := make(map[string]string)
+	for _, uuid := range uuids {
+		if leaseID, found := readStateFile(LeaseDir, uuid); found && leaseID != "" {
+			leases[uuid] = leaseID
+		}
+	}
+	return leases
+}
+
+// Forget the lease of a disk. It is not an error if the lease does not exist.
+func RemoveLease(uuid string) error {
+	if err := removeStateFile(LeaseDir, uuid); err != nil {
+		return fmt.Errorf("RemoveLease: %v", err)
+	}
+	return nil
+}
+
+/*
+Stop keeping the closed disk alive, then tell key server that this computer no longer counts as an active holder of its
+key. A key server of an earlier version does not understand the release, it instead lets the computer go after the
+computer misses the alive reports.
+*/
+func ReleaseKey(progressOut io.Writer, client *keyserv.CryptClient, uuid string) error {
+	leases := GetLeases(uuid)
+	if err := UnregisterAliveDisk(uuid); err != nil {
+		return err
+	}
+	if err := RemoveLease(uuid); err != nil {
+		return err
+	}
+	if err := RemoveSelfLock(uuid); err != nil {
+		return err
+	}
+	if err := RemoveOfflineTolerance(uuid); err != nil {
+		return err
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	released, err := client.ReleaseKey(keyserv.ReleaseKeyReq{
+		Hostname: hostname,
+		UUIDs:    []string{uuid},
+		Tokens:   GetClientTokens(uuid),
+		Leases:   leases,
+	})
+	if err != nil && !isUnknownMethod(err) {
+		return fmt.Errorf("ReleaseKey: failed to release key of disk \"%s\" - %v", uuid, err)
+	} else if len(released) > 0 {
+		fmt.Fprintf(progressOut, "ReleaseKey: key server no longer considers this computer to hold disk \"%s\"\n", uuid)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestLease(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-leasetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	origDir := LeaseDir
+	LeaseDir = path.Join(tmpDir, "leases")
+	defer func() {
+		LeaseDir = origDir
+	}()
+
+	if leases := GetLeases("a", "b"); len(leases) != 0 {
+		t.Fatal(leases)
+	}
+	if err := SaveLease("a", "lease-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveLease("../b", "lease-b"); err == nil {
+		t.Fatal("did not error")
+	}
+	if leases := GetLeases("a", "b", "../a"); !reflect.DeepEqual(leases, map[string]string{"a": "lease-a"}) {
+		t.Fatal(leases)
+	}
+	if err := RemoveLease("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveLease("a"); err != nil {
+		t.Fatal(err)
+	}
+	if leases := GetLeases("a"); len(leases) != 0 {
+		t.Fatal(leases)
+	}
+}
@@ -0,0 +1,94 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io"
+	"path"
+	"strconv"
+	"time"
+)
+
+/*
+OfflineDir remembers for how long each disk may stay unlocked while key server is unreachable, one file per disk named
+after its UUID. The tolerance comes from the usage policy of the key at the time it is retrieved. The directory does not
+survive reboot.
+*/
+var OfflineDir = "/run/cryptctl/offline"
+
+// Remember the offline tolerance of the key's usage policy. A key without the tolerance leaves nothing behind.
+func SaveOfflineTolerance(rec keydb.Record) error {
+	if rec.Policy.MaxOfflineSec <= 0 {
+		return RemoveOfflineTolerance(rec.UUID)
+	}
+	if err := saveStateFile(OfflineDir, rec.UUID, fmt.Sprintf("%d\n", rec.Policy.MaxOfflineSec)); err != nil {
+		return fmt.Errorf("SaveOfflineTolerance: %v", err)
+	}
+	return nil
+}
+
+// Return the number of seconds the disk may stay unlocked while key server is unreachable, or 0 for no limit.
+func GetOfflineTolerance(uuid string) int {
+	content, found := readStateFile(OfflineDir, uuid)
+	if !found {
+		return 0
+	}
+	maxOfflineSec, err := strconv.Atoi(content)
+	if err != nil || maxOfflineSec < 0 {
+		return 0
+	}
+	return maxOfflineSec
+}
+
+// Forget the offline tolerance of a disk. It is not an error if the tolerance was not remembered.
+func RemoveOfflineTolerance(uuid string) error {
+	if err := removeStateFile(OfflineDir, uuid); err != nil {
+		return fmt.Errorf("RemoveOfflineTolerance: %v", err)
+	}
+	return nil
+}
+
+// Return the disks among the UUIDs that have exceeded their offline tolerance, given the last contact with key server.
+func GetOfflineExceeded(lastContact, moment time.Time, uuids ...string) []string {
+	exceeded := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		if maxOfflineSec := GetOfflineTolerance(uuid); maxOfflineSec > 0 && moment.Sub(lastContact) > time.Duration(maxOfflineSec)*time.Second {
+			exceeded = append(exceeded, uuid)
+		}
+	}
+	return exceeded
+}
+
+/*
+Lock the disk because key server has been unreachable for longer than its offline tolerance, such as when the computer
+has been taken away. Stop keeping the disk alive, umount and close the disk, and erase the copy of its key fetched for
+systemd-cryptsetup. The hook scripts that stop applications run along the way, the disk is locked even if they fail,
+and processes that still use the file system are terminated. The single executable "pre-lock" in HookDir, which stopped
+applications before the hook directories of each phase were introduced, still runs first.
+*/
+func LockOfflineDisk(progressOut io.Writer, uuid string) error {
+	if err := UnregisterAliveDisk(uuid); err != nil {
+		return err
+	}
+	if err := RemoveLease(uuid); err != nil {
+		fmt.Fprintf(progressOut, "LockOfflineDisk: %v\n", err)
+	}
+	if isExecutableFile(path.Join(HookDir, HOOK_PRE_LOCK)) {
+		if _, err := RunHook(HOOK_PRE_LOCK, uuid); err != nil {
+			fmt.Fprintf(progressOut, "LockOfflineDisk: %v\n", err)
+		}
+	}
+	if _, _, err := CloseDisk(progressOut, uuid, keydb.ON_BUSY_TERMINATE); err != nil {
+		return fmt.Errorf("LockOfflineDisk: failed to close disk \"%s\" - %v", uuid, err)
+	}
+	if err := EraseFetchedKey(uuid); err != nil {
+		return fmt.Errorf("LockOfflineDisk: failed to erase fetched key of disk \"%s\" - %v", uuid, err)
+	}
+	fmt.Fprintf(progressOut, "LockOfflineDisk: disk \"%s\" has been umounted and closed\n", uuid)
+	if err := RemoveSelfLock(uuid); err != nil {
+		return err
+	}
+	return RemoveOfflineTolerance(uuid)
+}
@@ -0,0 +1,66 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOfflineTolerance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-offlinetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	origDir := OfflineDir
+	OfflineDir = path.Join(tmpDir, "offline")
+	defer func() {
+		OfflineDir = origDir
+	}()
+
+	if maxOfflineSec := GetOfflineTolerance("a"); maxOfflineSec != 0 {
+		t.Fatal(maxOfflineSec)
+	}
+	if err := SaveOfflineTolerance(keydb.Record{UUID: "../a", Policy: keydb.Policy{MaxOfflineSec: 60}}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := SaveOfflineTolerance(keydb.Record{UUID: "a", Policy: keydb.Policy{MaxOfflineSec: 60}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveOfflineTolerance(keydb.Record{UUID: "b", Policy: keydb.Policy{MaxOfflineSec: 600}}); err != nil {
+		t.Fatal(err)
+	}
+	if maxOfflineSec := GetOfflineTolerance("a"); maxOfflineSec != 60 {
+		t.Fatal(maxOfflineSec)
+	}
+	// Only the disks whose tolerance is exceeded are locked
+	lastContact := time.Now()
+	if exceeded := GetOfflineExceeded(lastContact, lastContact.Add(30*time.Second), "a", "b", "c"); len(exceeded) != 0 {
+		t.Fatal(exceeded)
+	}
+	if exceeded := GetOfflineExceeded(lastContact, lastContact.Add(61*time.Second), "a", "b", "c"); !reflect.DeepEqual(exceeded, []string{"a"}) {
+		t.Fatal(exceeded)
+	}
+	// A key without the tolerance forgets the earlier one
+	if err := SaveOfflineTolerance(keydb.Record{UUID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if maxOfflineSec := GetOfflineTolerance("a"); maxOfflineSec != 0 {
+		t.Fatal(maxOfflineSec)
+	}
+	if err := RemoveOfflineTolerance("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveOfflineTolerance("b"); err != nil {
+		t.Fatal(err)
+	}
+	if maxOfflineSec := GetOfflineTolerance("b"); maxOfflineSec != 0 {
+		t.Fatal(maxOfflineSec)
+	}
+}
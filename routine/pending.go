@@ -0,0 +1,242 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"context"
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/fs"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HOOK_TIMEOUT_SEC   = 300  // HOOK_TIMEOUT_SEC is the maximum duration of a hook script.
+	HOOK_MAX_OUTPUT    = 4096 // HOOK_MAX_OUTPUT is the number of trailing bytes of hook output reported to key server.
+	HOOK_ENV_UUID      = "CRYPTCTL_UUID"
+	HOOK_ENV_CRYPT_DEV = "CRYPTCTL_CRYPT_DEVICE"
+	HOOK_ENV_MOUNT     = "CRYPTCTL_MOUNT_POINT"
+	HOOK_ENV_PHASE     = "CRYPTCTL_PHASE"
+)
+
+/*
+HookDir holds the hook scripts that pending commands may run, the computer's administrator puts them in place. Key
+server may only ask for a script by its name, it cannot make the computer run anything else.
+*/
+var HookDir = "/etc/cryptctl/hooks"
+
+// Return the block device of the encrypted disk, and its unlocked crypt device if the disk is unlocked.
+func getDiskDevices(uuid string) (blkDev, cryptDev fs.BlockDevice, unlocked bool, err error) {
+	blkDevs := fs.GetBlockDevices()
+	blkDev, found := blkDevs.GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return blkDev, cryptDev, false, fmt.Errorf("the disk \"%s\" is not present on this computer", uuid)
+	}
+	cryptDev, unlocked = blkDevs.GetByCriteria("", "", "crypt", "", "", blkDev.Name, "")
+	return
+}
+
+// Remount the file system of the unlocked disk read-only. Return the mount point.
+func RemountDiskReadOnly(uuid string) (string, error) {
+	_, cryptDev, unlocked, err := getDiskDevices(uuid)
+	if err != nil {
+		return "", err
+	} else if !unlocked || cryptDev.MountPoint == "" {
+		return "", fmt.Errorf("RemountDiskReadOnly: the disk \"%s\" is not mounted", uuid)
+	}
+	return cryptDev.MountPoint, fs.RemountReadOnly(cryptDev.MountPoint)
+}
+
+/*
+Umount the file system of the disk and close the crypt device, running the hook scripts of the phases along the way.
+Processes that keep the file system busy are dealt with as told by onBusy (keydb.ON_BUSY_*). Return true if the disk was
+unlocked, along with the outcome of the hook scripts and the processes that kept the file system busy. It is not an
+error if the disk was not unlocked to begin with, and a failed hook script does not stop the disk from being closed.
+A disk umounted lazily is closed once its file system lets go of it; if that takes too long the disk is left unlocked
+but unmounted, and closing it again later finishes the job.
+*/
+func CloseDisk(progressOut io.Writer, uuid, onBusy string) (wasUnlocked bool, details map[string]string, err error) {
+	details = make(map[string]string)
+	_, cryptDev, unlocked, err := getDiskDevices(uuid)
+	if err != nil || !unlocked {
+		return false, details, err
+	}
+	runHooks := func(phase string) {
+		addPhaseHookDetails(details, progressOut, phase, uuid, cryptDev.MountPoint)
+	}
+	if cryptDev.MountPoint != "" {
+		runHooks(HOOK_PRE_UMOUNT)
+		busy, err := UmountBusy(progressOut, cryptDev.MountPoint, onBusy)
+		if len(busy) > 0 {
+			details[BUSY_DETAILS_KEY] = strings.Join(DescribeProcs(busy), "\n")
+		}
+		if err != nil {
+			return true, details, err
+		}
+		runHooks(HOOK_POST_UMOUNT)
+		if len(busy) > 0 && onBusy == keydb.ON_BUSY_LAZY {
+			// The lazily umounted file system lets go of the crypt device only after its last user has exited
+			if err := WaitCryptDevReleased(cryptDev, BUSY_LAZY_WAIT_SEC); err != nil {
+				details[BUSY_STILL_OPEN_DETAILS_KEY] = err.Error()
+				return true, details, fmt.Errorf("CloseDisk: the file system is umounted but the disk cannot be closed yet, lock or umount it again later - %v", err)
+			}
+		}
+	}
+	runHooks(HOOK_PRE_LOCK)
+	if err := fs.CryptClose(cryptDev.Name); err != nil {
+		return true, details, err
+	}
+	runHooks(HOOK_POST_LOCK)
+	return true, details, nil
+}
+
+// Return encryption status, mount options, and space usage of the disk.
+func GetDiskStatus(uuid string) (map[string]string, error) {
+	blkDev, cryptDev, unlocked, err := getDiskDevices(uuid)
+	if err != nil {
+		return nil, err
+	}
+	status := map[string]string{
+		"device":   blkDev.Path,
+		"size":     strconv.FormatInt(blkDev.SizeByte, 10),
+		"unlocked": strconv.FormatBool(unlocked),
+	}
+	if !unlocked {
+		return status, nil
+	}
+	status["crypt_device"] = cryptDev.Path
+	mapping, err := fs.CryptStatus(cryptDev.Name)
+	if err != nil {
+		return status, err
+	}
+	status["crypt_type"] = mapping.Type
+	status["cipher"] = mapping.Cipher
+	status["key_size"] = strconv.Itoa(mapping.KeySize)
+	status["mount_point"] = cryptDev.MountPoint
+	if cryptDev.MountPoint == "" {
+		return status, nil
+	}
+	if mount, found := fs.ParseMtab().GetByCriteria("", cryptDev.MountPoint, ""); found {
+		status["file_system"] = mount.FileSystem
+		status["mount_options"] = strings.Join(mount.Options, ",")
+		if total, err := mount.GetFileSystemSizeByte(); err == nil {
+			status["fs_size"] = strconv.FormatInt(total, 10)
+		}
+		if avail, err := mount.GetFileSystemAvailableByte(); err == nil {
+			status["fs_available"] = strconv.FormatInt(avail, 10)
+		}
+	}
+	return status, nil
+}
+
+/*
+Run the hook script of the name from HookDir for the disk, and return its exit status along with the trailing part of
+its output. The script learns about the disk from environment variables.
+*/
+func RunHook(name, uuid string) (map[string]string, error) {
+	if !keydb.RegexHookName.MatchString(name) {
+		return nil, fmt.Errorf("RunHook: \"%s\" is not a valid hook name", name)
+	}
+	hookFile := path.Join(HookDir, name)
+	if !isExecutableFile(hookFile) {
+		return nil, fmt.Errorf("RunHook: \"%s\" is not an executable file", hookFile)
+	}
+	env := []string{HOOK_ENV_UUID + "=" + uuid}
+	if _, cryptDev, unlocked, _ := getDiskDevices(uuid); unlocked {
+		env = append(env, HOOK_ENV_CRYPT_DEV+"="+cryptDev.Path, HOOK_ENV_MOUNT+"="+cryptDev.MountPoint)
+	}
+	exitStatus, out, err := runHookFile(hookFile, env)
+	details := map[string]string{"hook": name, "output": out, "exit_status": exitStatus}
+	if err != nil {
+		return details, fmt.Errorf("RunHook: \"%s\" has failed - %v", hookFile, err)
+	}
+	return details, nil
+}
+
+// Return true if the file is a regular file that may be executed.
+func isExecutableFile(filePath string) bool {
+	info, err := os.Stat(filePath)
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+/*
+Run the hook script with the additional environment variables, and give up after HOOK_TIMEOUT_SEC. Return its exit
+status and the trailing part of its output.
+*/
+func runHookFile(hookFile string, env []string) (exitStatus, out string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HOOK_TIMEOUT_SEC*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hookFile)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Dir = "/"
+	outBytes, err := cmd.CombinedOutput()
+	if len(outBytes) > HOOK_MAX_OUTPUT {
+		outBytes = outBytes[len(outBytes)-HOOK_MAX_OUTPUT:]
+	}
+	exitStatus = "0"
+	if exitErr, isExit := err.(*exec.ExitError); isExit {
+		exitStatus = strconv.Itoa(exitErr.ExitCode())
+	}
+	return exitStatus, string(outBytes), err
+}
+
+/*
+Replace the key of the disk by a new key from key server, as told by the rotate-key command of the ID. The new key is
+installed on the disk before key server puts it into effect, and the current key is only removed from the disk
+afterwards, so that the disk can always be unlocked by the key kept by key server.
+*/
+func RotateDiskKey(client *keyserv.CryptClient, uuid, commandID string) error {
+	blkDev, _, _, err := getDiskDevices(uuid)
+	if err != nil {
+		return err
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	keys, err := client.BeginKeyRotation(keyserv.BeginKeyRotationReq{
+		UUID:      uuid,
+		CommandID: commandID,
+		Hostname:  hostname,
+		Tokens:    GetClientTokens(uuid),
+	})
+	if err != nil {
+		return err
+	}
+	if err := fs.CryptAddKey(keys.CurrentKey, keys.NewKey, blkDev.Path); err != nil {
+		return err
+	}
+	if err := client.CommitKeyRotation(keyserv.CommitKeyRotationReq{UUID: uuid, CommandID: commandID, Hostname: hostname}); err != nil {
+		// Server may or may not have put the new key into effect, hence leave both keys on the disk.
+		return fmt.Errorf("RotateDiskKey: the disk accepts both the current and the new key, because server did not confirm the new key - %v", err)
+	}
+	if err := fs.CryptRemoveKey(keys.CurrentKey, blkDev.Path); err != nil {
+		return fmt.Errorf("RotateDiskKey: the new key is in effect, but the disk still accepts the previous key - %v", err)
+	}
+	return nil
+}
+
+/*
+Erase encryption headers of the disk, rendering all data on the disk irreversibly lost, and remove the traces of the
+disk's key from this computer. The disk must have been closed.
+*/
+func SelfDestructDisk(uuid string) error {
+	blkDev, _, unlocked, err := getDiskDevices(uuid)
+	if err != nil {
+		return err
+	} else if unlocked {
+		return fmt.Errorf("SelfDestructDisk: the disk \"%s\" is still unlocked", uuid)
+	}
+	if err := fs.CryptErase(blkDev.Path); err != nil {
+		return err
+	}
+	if err := EraseFetchedKey(uuid); err != nil {
+		return err
+	}
+	return RemoveClientToken(uuid)
+}
@@ -0,0 +1,89 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"github.com/HouzuoGuo/cryptctl/keyserv"
+	"github.com/HouzuoGuo/cryptctl/sys"
+	"io"
+)
+
+const (
+	BIN_WALL = "/usr/bin/wall" // BIN_WALL notifies the users logged in.
+)
+
+/*
+SelfLockDir remembers what the computer does to each disk after key server rejects it, one file per disk named after
+its UUID. The action comes from the usage policy of the key at the time it is retrieved, it is remembered so that the
+computer acts on its own even if key server is unreachable. The directory does not survive reboot.
+*/
+var SelfLockDir = "/run/cryptctl/self-lock"
+
+// Remember the self-lock action of the key's usage policy.
+func SaveSelfLock(rec keydb.Record) error {
+	action, graceSec := rec.Policy.GetSelfLock()
+	if err := saveStateFile(SelfLockDir, rec.UUID, fmt.Sprintf("%s %d\n", action, graceSec)); err != nil {
+		return fmt.Errorf("SaveSelfLock: %v", err)
+	}
+	return nil
+}
+
+// Return the self-lock action of the disk and its grace period. The action is to log only if it is not remembered.
+func GetSelfLock(uuid string) (action string, graceSec int) {
+	content, found := readStateFile(SelfLockDir, uuid)
+	if !found {
+		return keydb.SELF_LOCK_LOG, 0
+	}
+	pol := keydb.Policy{}
+	if _, err := fmt.Sscanf(content, "%s %d", &pol.SelfLock, &pol.SelfLockGraceSec); err != nil || pol.Validate() != nil {
+		return keydb.SELF_LOCK_LOG, 0
+	}
+	return pol.GetSelfLock()
+}
+
+// Forget the self-lock action of a disk. It is not an error if the action was not remembered.
+func RemoveSelfLock(uuid string) error {
+	if err := removeStateFile(SelfLockDir, uuid); err != nil {
+		return fmt.Errorf("RemoveSelfLock: %v", err)
+	}
+	return nil
+}
+
+/*
+Carry out the self-lock action of the disk after key server has rejected this computer. The lock action keeps trying to
+re-acquire the key throughout its grace period, the disk is umounted and closed only if key server does not let this
+computer hold the key again. Return true if the key has been re-acquired, the disk is then kept alive once again.
+*/
+func SelfLockDisk(progressOut io.Writer, client *keyserv.CryptClient, uuid string) (reacquired bool, err error) {
+	action, graceSec := GetSelfLock(uuid)
+	switch action {
+	case keydb.SELF_LOCK_NOTIFY:
+		msg := fmt.Sprintf("cryptctl: key server no longer considers this computer to hold encrypted disk \"%s\", "+
+			"the disk stays unlocked.", uuid)
+		fmt.Fprintln(progressOut, "SelfLockDisk: "+msg)
+		if _, _, stderr, err := sys.Exec(nil, nil, nil, BIN_WALL, msg); err != nil {
+			fmt.Fprintf(progressOut, "SelfLockDisk: failed to notify users - %v %s\n", err, stderr)
+		}
+	case keydb.SELF_LOCK_REMOUNT_RO:
+		mountPoint, err := RemountDiskReadOnly(uuid)
+		if err != nil {
+			return false, fmt.Errorf("SelfLockDisk: failed to remount disk \"%s\" read-only - %v", uuid, err)
+		}
+		fmt.Fprintf(progressOut, "SelfLockDisk: disk \"%s\" has been remounted read-only on \"%s\"\n", uuid, mountPoint)
+	case keydb.SELF_LOCK_LOCK:
+		fmt.Fprintf(progressOut, "SelfLockDisk: disk \"%s\" will be closed unless its key is re-acquired within %d seconds\n", uuid, graceSec)
+		if _, err := AutoRetrieveKey(progressOut, client, uuid, int64(graceSec)); err == nil {
+			fmt.Fprintf(progressOut, "SelfLockDisk: key of disk \"%s\" has been re-acquired, the disk stays unlocked\n", uuid)
+			return true, RegisterAliveDisk(uuid)
+		}
+		if _, _, err := CloseDisk(progressOut, uuid, keydb.ON_BUSY_TERMINATE); err != nil {
+			return false, fmt.Errorf("SelfLockDisk: failed to close disk \"%s\" - %v", uuid, err)
+		}
+		fmt.Fprintf(progressOut, "SelfLockDisk: disk \"%s\" has been umounted and closed\n", uuid)
+	default:
+		fmt.Fprintf(progressOut, "SelfLockDisk: key server no longer considers this computer to hold disk \"%s\", the disk stays unlocked\n", uuid)
+	}
+	return false, RemoveSelfLock(uuid)
+}
@@ -0,0 +1,57 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSelfLock(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-selflocktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	origDir := SelfLockDir
+	SelfLockDir = path.Join(tmpDir, "self-lock")
+	defer func() {
+		SelfLockDir = origDir
+	}()
+
+	if action, graceSec := GetSelfLock("a"); action != keydb.SELF_LOCK_LOG || graceSec != 0 {
+		t.Fatal(action, graceSec)
+	}
+	if err := SaveSelfLock(keydb.Record{UUID: "../a"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := SaveSelfLock(keydb.Record{UUID: "a", Policy: keydb.Policy{SelfLock: keydb.SELF_LOCK_LOCK, SelfLockGraceSec: 30}}); err != nil {
+		t.Fatal(err)
+	}
+	if action, graceSec := GetSelfLock("a"); action != keydb.SELF_LOCK_LOCK || graceSec != 30 {
+		t.Fatal(action, graceSec)
+	}
+	// Unknown action is never carried out
+	if err := ioutil.WriteFile(path.Join(SelfLockDir, "b"), []byte("explode 0\n"), STATE_FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+	if action, _ := GetSelfLock("b"); action != keydb.SELF_LOCK_LOG {
+		t.Fatal(action)
+	}
+	// Logging leaves the disk alone and forgets the action
+	if reacquired, err := SelfLockDisk(ioutil.Discard, nil, "b"); reacquired || err != nil {
+		t.Fatal(reacquired, err)
+	}
+	if _, err := os.Stat(path.Join(SelfLockDir, "b")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := RemoveSelfLock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveSelfLock("a"); err != nil {
+		t.Fatal(err)
+	}
+}
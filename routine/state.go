@@ -0,0 +1,86 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	STATE_FILE_MODE = 0600 // STATE_FILE_MODE is the permission of files that remember the state of a disk.
+	STATE_DIR_MODE  = 0700 // STATE_DIR_MODE is the permission of the directories of disk state.
+)
+
+/*
+Return the path to the state file of the disk. The client remembers its state of each unlocked disk under /run/cryptctl,
+one directory per kind of state and one file per disk named after its UUID. The UUID comes from command line and key
+server alike, it is validated in every operation so that the path never escapes the directory.
+*/
+func getStateFile(dir, uuid string) (string, error) {
+	if err := keydb.ValidateUUID(uuid); err != nil {
+		return "", err
+	}
+	return path.Join(dir, uuid), nil
+}
+
+// Write the state of a disk, making the directory if necessary.
+func saveStateFile(dir, uuid, content string) error {
+	stateFile, err := getStateFile(dir, uuid)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, STATE_DIR_MODE); err != nil {
+		return fmt.Errorf("failed to make directory \"%s\" - %v", dir, err)
+	}
+	if err := ioutil.WriteFile(stateFile, []byte(content), STATE_FILE_MODE); err != nil {
+		return fmt.Errorf("failed to write \"%s\" - %v", stateFile, err)
+	}
+	return nil
+}
+
+// Return the state of a disk with surrounding spaces trimmed, and whether it is remembered at all.
+func readStateFile(dir, uuid string) (string, bool) {
+	stateFile, err := getStateFile(dir, uuid)
+	if err != nil {
+		return "", false
+	}
+	content, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(content)), true
+}
+
+// Forget the state of a disk. It is not an error if the state was not remembered.
+func removeStateFile(dir, uuid string) error {
+	stateFile, err := getStateFile(dir, uuid)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove \"%s\" - %v", stateFile, err)
+	}
+	return nil
+}
+
+// Return sorted UUIDs of the disks that have their state remembered in the directory.
+func listStateFiles(dir string) []string {
+	uuids := make([]string, 0, 8)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return uuids
+	}
+	for _, file := range files {
+		if !file.IsDir() && keydb.ValidateUUID(file.Name()) == nil {
+			uuids = append(uuids, file.Name())
+		}
+	}
+	sort.Strings(uuids)
+	return uuids
+}
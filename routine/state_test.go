@@ -0,0 +1,70 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestStateFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-statetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	stateDir := path.Join(tmpDir, "state")
+	// A file outside of the directory must not be touched by a malformed UUID
+	outside := path.Join(tmpDir, "outside")
+	if err := ioutil.WriteFile(outside, []byte("keep\n"), STATE_FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+
+	if uuids := listStateFiles(stateDir); len(uuids) != 0 {
+		t.Fatal(uuids)
+	}
+	if _, found := readStateFile(stateDir, "a"); found {
+		t.Fatal("should not have found")
+	}
+	if err := saveStateFile(stateDir, "b", "state-b\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveStateFile(stateDir, "a", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"", "../outside", "a/b"} {
+		if err := saveStateFile(stateDir, uuid, "overwritten"); err == nil {
+			t.Fatal("did not error", uuid)
+		}
+		if _, found := readStateFile(stateDir, uuid); found {
+			t.Fatal("should not have found", uuid)
+		}
+		if err := removeStateFile(stateDir, uuid); err == nil {
+			t.Fatal("did not error", uuid)
+		}
+	}
+	if content, err := ioutil.ReadFile(outside); err != nil || string(content) != "keep\n" {
+		t.Fatal(string(content), err)
+	}
+	if content, found := readStateFile(stateDir, "b"); !found || content != "state-b" {
+		t.Fatal(content, found)
+	}
+	if content, found := readStateFile(stateDir, "a"); !found || content != "" {
+		t.Fatal(content, found)
+	}
+	if uuids := listStateFiles(stateDir); !reflect.DeepEqual(uuids, []string{"a", "b"}) {
+		t.Fatal(uuids)
+	}
+	if err := removeStateFile(stateDir, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStateFile(stateDir, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if uuids := listStateFiles(stateDir); !reflect.DeepEqual(uuids, []string{"a"}) {
+		t.Fatal(uuids)
+	}
+}
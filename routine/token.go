@@ -0,0 +1,64 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/cryptctl/keydb"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	CLIENT_TOKEN_FILE_MODE = 0600 // CLIENT_TOKEN_FILE_MODE is the permission of enrolment token files.
+	CLIENT_TOKEN_DIR_MODE  = 0700 // CLIENT_TOKEN_DIR_MODE is the permission of the directory of enrolment token files.
+)
+
+var ClientTokenDir = "/etc/cryptctl/tokens" // ClientTokenDir holds the enrolment token of each disk issued by key server.
+
+// Return path to the enrolment token file of an encrypted disk.
+func GetClientTokenFile(uuid string) string {
+	return path.Join(ClientTokenDir, uuid)
+}
+
+// Write the enrolment token issued by key server for an encrypted disk.
+func SaveClientToken(uuid, token string) error {
+	if err := keydb.ValidateUUID(uuid); err != nil {
+		return fmt.Errorf("SaveClientToken: %v", err)
+	}
+	if err := os.MkdirAll(ClientTokenDir, CLIENT_TOKEN_DIR_MODE); err != nil {
+		return fmt.Errorf("SaveClientToken: failed to make directory \"%s\" - %v", ClientTokenDir, err)
+	}
+	tokenFile := GetClientTokenFile(uuid)
+	if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), CLIENT_TOKEN_FILE_MODE); err != nil {
+		return fmt.Errorf("SaveClientToken: failed to write \"%s\" - %v", tokenFile, err)
+	}
+	return nil
+}
+
+// Return enrolment tokens of the encrypted disks in UUID - token pairs. Disks without a token are left out.
+func GetClientTokens(uuids ...string) map[string]string {
+	tokens := make(map[string]string)
+	for _, uuid := range uuids {
+		if keydb.ValidateUUID(uuid) != nil {
+			continue
+		}
+		if content, err := ioutil.ReadFile(GetClientTokenFile(uuid)); err == nil {
+			if token := strings.TrimSpace(string(content)); token != "" {
+				tokens[uuid] = token
+			}
+		}
+	}
+	return tokens
+}
+
+// Remove the enrolment token of an encrypted disk. It is not an error if the token does not exist.
+func RemoveClientToken(uuid string) error {
+	tokenFile := GetClientTokenFile(uuid)
+	if err := os.Remove(tokenFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("RemoveClientToken: failed to remove \"%s\" - %v", tokenFile, err)
+	}
+	return nil
+}
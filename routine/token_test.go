@@ -0,0 +1,46 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestClientToken(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-tokentest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	origDir := ClientTokenDir
+	ClientTokenDir = path.Join(tmpDir, "tokens")
+	defer func() {
+		ClientTokenDir = origDir
+	}()
+
+	if tokens := GetClientTokens("a", "b"); len(tokens) != 0 {
+		t.Fatal(tokens)
+	}
+	if err := SaveClientToken("a", "token-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveClientToken("../b", "token-b"); err == nil {
+		t.Fatal("did not error")
+	}
+	if tokens := GetClientTokens("a", "b", "../a"); !reflect.DeepEqual(tokens, map[string]string{"a": "token-a"}) {
+		t.Fatal(tokens)
+	}
+	if err := RemoveClientToken("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveClientToken("a"); err != nil {
+		t.Fatal(err)
+	}
+	if tokens := GetClientTokens("a"); len(tokens) != 0 {
+		t.Fatal(tokens)
+	}
+}
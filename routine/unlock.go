@@ -20,8 +20,11 @@ const (
 	REPORT_ALIVE_INTERVAL_SEC      = 10
 )
 
-// Forcibly unlock all file systems that have their keys on a key server.
-func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, password string) error {
+/*
+Forcibly unlock all file systems that have their keys on a key server. Under dual control, askToken asks the
+administrator for their admin API token (see WaitDualControl).
+*/
+func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, password string, askToken func() string) error {
 	sys.LockMem()
 	// Collect information about all encrypted file systems
 	blockDevs := fs.GetBlockDevices()
@@ -41,10 +44,17 @@ func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, passw
 	if err != nil {
 		return err
 	}
+	admin := GetAdminName()
+	dualControlID, err := WaitDualControl(progressOut, client, keyserv.HashPassword(salt, password), admin, keyserv.DUAL_CONTROL_RETRIEVE, reqUUIDs, askToken)
+	if err != nil {
+		return err
+	}
 	resp, err := client.ManualRetrieveKey(keyserv.ManualRetrieveKeyReq{
-		UUIDs:    reqUUIDs,
-		Hostname: hostname,
-		Password: keyserv.HashPassword(salt, password),
+		UUIDs:         reqUUIDs,
+		Hostname:      hostname,
+		Password:      keyserv.HashPassword(salt, password),
+		Admin:         admin,
+		DualControlID: dualControlID,
 	})
 	if err != nil {
 		return err
@@ -53,10 +63,16 @@ func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, passw
 	if len(resp.Granted) > 0 {
 		// Unlock and mount all disks that have keys on the server
 		for uuid, rec := range resp.Granted {
+			if lease, found := resp.Leases[uuid]; found {
+				if err := SaveLease(uuid, lease.ID); err != nil {
+					fmt.Fprintf(progressOut, "  *%v\n", err)
+				}
+			}
 			fmt.Fprintf(progressOut, "Mounting %s (%s) on %s...\n", reqDevs[uuid].Path, rec.GetMountOptionStr(), rec.MountPoint)
 			blkDev := reqDevs[uuid].Path
 			dmName := MakeDeviceMapperName(reqDevs[uuid].Path)
 			dmDev := path.Join("/dev/mapper/", dmName)
+			RunPhaseHooks(progressOut, HOOK_PRE_UNLOCK, uuid, rec.MountPoint)
 			// Resume on error, in case some operations fail due to them being already carried out in previous runs.
 			if err := fs.CryptOpen(rec.Key, blkDev, dmName); err != nil {
 				fmt.Fprintf(progressOut, "  *%v\n", err)
@@ -72,6 +88,9 @@ func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, passw
 					hasErr = true
 				}
 			}
+			if blk, found := fs.GetBlockDevice(dmDev); found && blk.MountPoint == rec.MountPoint {
+				RunPhaseHooks(progressOut, HOOK_POST_MOUNT, uuid, rec.MountPoint)
+			}
 			fmt.Fprintln(progressOut)
 		}
 	}
@@ -87,8 +106,12 @@ func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, passw
 	return nil
 }
 
-// Unlock a single file systems using a key record file.
-func UnlockFS(progressOut io.Writer, rec keydb.Record, maxAttempts int) error {
+/*
+Unlock a single file systems using a key record file. Return the outcome of the hook scripts that run before unlocking
+and after mounting.
+*/
+func UnlockFS(progressOut io.Writer, rec keydb.Record, maxAttempts int) (map[string]string, error) {
+	details := make(map[string]string)
 	// Collect information from all encrypted file systems
 	blockDevs := fs.GetBlockDevices()
 	reqUUIDs := make([]string, 0, 0)
@@ -102,7 +125,7 @@ func UnlockFS(progressOut io.Writer, rec keydb.Record, maxAttempts int) error {
 	// See if the record can unlock any file system
 	unlockDev, found := reqDevs[rec.UUID]
 	if !found {
-		return errors.New("The record does not belong to any encrypted file system on this computer (UUID mismatch).")
+		return details, errors.New("The record does not belong to any encrypted file system on this computer (UUID mismatch).")
 	}
 	// Mount the encrypted file system
 	// Resume on error, in case some operations fail due to them being already carried out in previous runs.
@@ -114,6 +137,7 @@ func UnlockFS(progressOut io.Writer, rec keydb.Record, maxAttempts int) error {
 		mounted file system.
 		Sleep a second between retries.
 	*/
+	addPhaseHookDetails(details, progressOut, HOOK_PRE_UNLOCK, rec.UUID, rec.MountPoint)
 	var succeeded bool
 	for i := 0; i < maxAttempts; i++ {
 		if err := fs.CryptOpen(rec.Key, unlockDev.Path, dmName); err != nil {
@@ -135,26 +159,42 @@ func UnlockFS(progressOut io.Writer, rec keydb.Record, maxAttempts int) error {
 	if succeeded {
 		fmt.Fprintf(progressOut, "The encrypted file system has been successfully mounted on \"%s\".\n", rec.MountPoint)
 	} else {
-		return errors.New("Failed to process the encrypted file system. Check output for more details.")
+		return details, errors.New("Failed to process the encrypted file system. Check output for more details.")
 	}
-	return nil
+	// Applications that depend on the file system may start now, their failure does not undo the unlock.
+	addPhaseHookDetails(details, progressOut, HOOK_POST_MOUNT, rec.UUID, rec.MountPoint)
+	return details, nil
 }
 
 /*
 Make continuous attempts to retrieve encryption key from key server to unlock a file system specified by the UUID.
-If maxRetrySec is zero or negative, then only one attempt will be made to unlock the file system.
+If maxRetrySec is zero or negative, then only one attempt will be made to unlock the file system. Return the outcome of
+the hook scripts.
 */
-func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid string, maxRetrySec int64) error {
+func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid string, maxRetrySec int64) (map[string]string, error) {
 	sys.LockMem()
 	// Find out UUID of the block device
 	blkDevs := fs.GetBlockDevices()
 	blkDev, found := blkDevs.GetByCriteria(uuid, "", "", "", "", "", "")
 	if !found {
-		return fmt.Errorf("AutoOnlineUnlockFS: failed to get information of \"%s\"", uuid)
+		return nil, fmt.Errorf("AutoOnlineUnlockFS: failed to get information of \"%s\"", uuid)
 	} else if !blkDev.IsLUKSEncrypted() {
 		fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: skip \"%s\" as it is not a LUKS-encrypted block device\n", uuid)
-		return nil
+		return nil, nil
+	}
+	rec, err := RetrieveKeyForUnlock(progressOut, client, blkDev.UUID, maxRetrySec)
+	if err != nil {
+		return nil, err
 	}
+	// Key has been granted by server, proceed to unlock disk.
+	return UnlockFS(progressOut, rec, 3)
+}
+
+/*
+Make continuous attempts to retrieve encryption key of the file system specified by the UUID from key server, without
+using a password. If maxRetrySec is zero or negative, then only one attempt will be made to retrieve the key.
+*/
+func AutoRetrieveKey(progressOut io.Writer, client *keyserv.CryptClient, uuid string, maxRetrySec int64) (keydb.Record, error) {
 	// Keep trying until maxRetrySec elapses
 	numFailures := 0
 	begin := time.Now().Unix()
@@ -163,35 +203,57 @@ func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid
 		hostname, _ := sys.GetHostnameAndIP()
 		resp, err := client.AutoRetrieveKey(keyserv.AutoRetrieveKeyReq{
 			Hostname: hostname,
-			UUIDs:    []string{blkDev.UUID},
+			UUIDs:    []string{uuid},
+			Tokens:   GetClientTokens(uuid),
+			Leases:   GetLeases(uuid),
 		})
 		if err == nil {
-			rec, exists := resp.Granted[blkDev.UUID]
-			if exists {
-				// Key has been granted by server, proceed to unlock disk.
-				return UnlockFS(progressOut, rec, 3)
+			if rec, exists := resp.Granted[uuid]; exists {
+				// Heartbeats renew the lease by its ID, server of an earlier version does not hand out leases.
+				if lease, found := resp.Leases[uuid]; found {
+					if err := SaveLease(uuid, lease.ID); err != nil {
+						fmt.Fprintf(progressOut, "AutoRetrieveKey: %v\n", err)
+					}
+				}
+				// The computer acts on its own once key server rejects it
+				if err := SaveSelfLock(rec); err != nil {
+					fmt.Fprintf(progressOut, "AutoRetrieveKey: %v\n", err)
+				}
+				// The computer locks the disk on its own once key server is unreachable for too long
+				if err := SaveOfflineTolerance(rec); err != nil {
+					fmt.Fprintf(progressOut, "AutoRetrieveKey: %v\n", err)
+				}
+				return rec, nil
 			}
 			if len(resp.Missing) > 0 {
 				// Stop trying if the server does not even have the key
-				return fmt.Errorf("AutoOnlineUnlockFS: server does not have encryption key for \"%s\"", blkDev.UUID)
+				return keydb.Record{}, fmt.Errorf("AutoRetrieveKey: server does not have encryption key for \"%s\"", uuid)
 			}
 		}
-		// Server may have rejected the key request due to MaxActive being exceeded
+		// Server may have rejected the key request due to MaxActive being exceeded, or due to the key's usage policy
 		if len(resp.Rejected) > 0 {
-			err = errors.New("MaxActive is exceeded")
+			err = errors.New(keydb.RejectReasonText[keydb.REJECT_MAX_ACTIVE])
+			// Server of an earlier version does not give a reason
+			if text, found := keydb.RejectReasonText[resp.Reasons[uuid]]; found {
+				err = errors.New(text)
+			}
+		}
+		// Server administrator may permit this computer to retrieve the key later on
+		if len(resp.Denied) > 0 {
+			err = errors.New("this computer is not among the allowed clients of the key")
 		}
 		// Retry the operation for a while
 		if time.Now().Unix() > begin+maxRetrySec {
-			return fmt.Errorf("AutoOnlineUnlockFS: failed to unlock \"%s\" (%v) and have given up after %d seconds",
-				blkDev.UUID, err, maxRetrySec)
+			return keydb.Record{}, fmt.Errorf("AutoRetrieveKey: failed to retrieve key of \"%s\" (%v) and have given up after %d seconds",
+				uuid, err, maxRetrySec)
 		}
 		// In case of failure, only report the first few occasions among consecutive failures.
 		if err != nil {
 			if numFailures == 5 {
-				fmt.Fprint(progressOut, "AutoOnlineUnlockFS: suppress further failure messages until success\n")
+				fmt.Fprint(progressOut, "AutoRetrieveKey: suppress further failure messages until success\n")
 			} else if numFailures < 5 {
-				fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: failed to unlock \"%s\", will retry in %d seconds - %v\n",
-					blkDev.UUID, AUTO_UNLOCK_RETRY_INTERVAL_SEC, err)
+				fmt.Fprintf(progressOut, "AutoRetrieveKey: failed to retrieve key of \"%s\", will retry in %d seconds - %v\n",
+					uuid, AUTO_UNLOCK_RETRY_INTERVAL_SEC, err)
 			}
 			numFailures++
 		}
@@ -201,19 +263,34 @@ func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid
 
 /*
 Continuously send alive reports to server to indicate that this computer is still holding onto the encrypted disk.
-Block caller until the program quits or server rejects this computer.
+Block caller until the program quits, server rejects this computer, or server stays unreachable for longer than the
+offline tolerance of the disk.
 */
 func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid string) error {
 	fmt.Fprintf(progressOut, "ReportAlive: begin sending messages for encrypted disk \"%s\"\n", uuid)
 	numFailures := 0
+	lastContact := time.Now()
 	for {
 		// Always send the up-to-date hostname in RPC request
 		hostname, _ := sys.GetHostnameAndIP()
 		rejected, err := client.ReportAlive(keyserv.ReportAliveReq{
 			Hostname: hostname,
 			UUIDs:    []string{uuid},
+			Tokens:   GetClientTokens(uuid),
+			Leases:   GetLeases(uuid),
 		})
 		if len(rejected) > 0 {
+			if err := RemoveLease(uuid); err != nil {
+				fmt.Fprintf(progressOut, "ReportAlive: %v\n", err)
+			}
+			if reacquired, err := SelfLockDisk(progressOut, client, uuid); err != nil {
+				fmt.Fprintf(progressOut, "ReportAlive: %v\n", err)
+			} else if reacquired {
+				continue
+			}
+			if err := UnregisterAliveDisk(uuid); err != nil {
+				fmt.Fprintf(progressOut, "ReportAlive: %v\n", err)
+			}
 			return fmt.Errorf("ReportAlive: stop sending messages for disk \"%s\" because server has rejected it", uuid)
 		}
 		// In case of failure, only report the first few occasions among consecutive failures.
@@ -222,7 +299,15 @@ func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid string
 				fmt.Fprintf(progressOut, "ReportAlive: succeeded for disk \"%s\"\n", uuid)
 			}
 			numFailures = 0
+			lastContact = time.Now()
 		} else {
+			if len(GetOfflineExceeded(lastContact, time.Now(), uuid)) > 0 {
+				if err := LockOfflineDisk(progressOut, uuid); err != nil {
+					fmt.Fprintf(progressOut, "ReportAlive: %v\n", err)
+				}
+				return fmt.Errorf("ReportAlive: stop sending messages for disk \"%s\" because server has been unreachable since %s",
+					uuid, lastContact.Format(time.RFC3339))
+			}
 			if numFailures == 5 {
 				fmt.Fprint(progressOut, "ReportAlive: suppress further failure messages until next success\n")
 			} else if numFailures < 5 {
@@ -236,41 +321,69 @@ func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid string
 
 /*
 Erase encryption metadata on the specified disk, and then ask server to erase its key.
-This process renders all data on the disk irreversibly lost.
+This process renders all data on the disk irreversibly lost. Under dual control, askToken asks the administrator for
+their admin API token (see WaitDualControl).
 */
-func EraseKey(progressOut io.Writer, client *keyserv.CryptClient, password, uuid string) error {
+func EraseKey(progressOut io.Writer, client *keyserv.CryptClient, password, uuid string, askToken func() string) error {
 	// Find the device node and erase the encryption metadata
 	blkDevs := fs.GetBlockDevices()
 	hostDev, foundHost := blkDevs.GetByCriteria(uuid, "", "", "", "", "", "")
 	if !foundHost {
 		return fmt.Errorf("EraseKey: cannot find a block device corresponding to UUID \"%s\"", uuid)
 	}
-	unlockedDevPath := MakeDeviceMapperName(hostDev.Path)
-	unlockedDev, foundUnlocked := blkDevs.GetByCriteria("", path.Join("/dev/mapper", unlockedDevPath), "", "", "", "", "")
-	if foundUnlocked {
-		// Unmount and close it before erasing the data
-		if unlockedDev.MountPoint != "" {
-			fmt.Fprintf(progressOut, "Umounting \"%s\"...\n", unlockedDev.MountPoint)
-			if err := fs.Umount(unlockedDev.MountPoint); err != nil {
-				return err
-			}
+	// A second administrator may have to confirm the erasure before anything is erased
+	_, isBound := GetDiskBinding(uuid)
+	admin := GetAdminName()
+	var dualControlID string
+	var salt keyserv.PasswordSalt
+	if !isBound {
+		var err error
+		if salt, err = client.GetSalt(); err != nil {
+			return err
+		}
+		if dualControlID, err = WaitDualControl(progressOut, client, keyserv.HashPassword(salt, password), admin, keyserv.DUAL_CONTROL_ERASE, []string{uuid}, askToken); err != nil {
+			return err
 		}
-		fmt.Fprintf(progressOut, "Closing \"%s\"...\n", unlockedDevPath)
-		if err := fs.CryptClose(unlockedDevPath); err != nil {
+	}
+	// The disk may have been unlocked either by cryptctl or by systemd-cryptsetup, hence look for it by its parent.
+	// Unmount and close it before erasing the data
+	if unlockedDev, foundUnlocked := blkDevs.GetByCriteria("", "", "crypt", "", "", hostDev.Name, ""); foundUnlocked {
+		fmt.Fprintf(progressOut, "Umounting and closing \"%s\"...\n", unlockedDev.Path)
+		if _, _, err := CloseDisk(progressOut, uuid, keydb.ON_BUSY_FAIL); err != nil {
 			return err
 		}
 	}
 	if err := fs.CryptErase(hostDev.Path); err != nil {
 		return err
 	}
+	// The disk will never be unlocked again, hence systemd-cryptsetup should no longer look for it.
+	if _, found := GetCrypttabEntry(uuid); found {
+		if err := UninstallCrypttabUnlock(progressOut, uuid); err != nil {
+			fmt.Fprintf(progressOut, "  *%v\n", err)
+		}
+	}
+	// A network-bound disk key is not stored on server, forgetting the binding suffices.
+	if isBound {
+		if err := RemoveDiskBinding(uuid); err != nil {
+			return err
+		}
+		fmt.Fprintf(progressOut, "Encryption header has been wiped successfully, data in \"%s\" (%s) is now irreversibly lost.\n",
+			uuid, hostDev.Path)
+		return nil
+	}
 	// After metadata is erased, ask server to remove its key record as well.
 	hostname, _ := sys.GetHostnameAndIP()
-	salt, err := client.GetSalt()
-	if err != nil {
+	if err := client.EraseKey(keyserv.EraseKeyReq{
+		Password:      keyserv.HashPassword(salt, password),
+		Hostname:      hostname,
+		UUID:          uuid,
+		Admin:         admin,
+		DualControlID: dualControlID,
+	}); err != nil {
 		return err
 	}
-	if err := client.EraseKey(keyserv.EraseKeyReq{Password: keyserv.HashPassword(salt, password), Hostname: hostname, UUID: uuid}); err != nil {
-		return err
+	if err := RemoveClientToken(uuid); err != nil {
+		fmt.Fprintf(progressOut, "  *%v\n", err)
 	}
 	fmt.Fprintf(progressOut, "Encryption header has been wiped successfully, data in \"%s\" (%s) is now irreversibly lost.\n",
 		uuid, hostDev.Path)
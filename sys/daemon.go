@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/user"
 	"regexp"
 	"strconv"
 	"strings"
@@ -48,6 +49,19 @@ func GetHostnameAndIP() (hostname string, ip string) {
 	return
 }
 
+// Return the name of the user who logged in, even if the program runs via sudo or su.
+func GetLoginName() string {
+	for _, env := range []string{"SUDO_USER", "LOGNAME", "USER"} {
+		if name := os.Getenv(env); name != "" {
+			return name
+		}
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
 // Call systemctl start on the service.
 func SystemctlStart(svc string) error {
 	if out, err := exec.Command("systemctl", "start", svc).CombinedOutput(); err != nil {
@@ -121,3 +135,27 @@ func SystemctlIsRunning(svc string) bool {
 	}
 	return false
 }
+
+// SystemctlEnable uses systemctl command to enable a unit without starting it.
+func SystemctlEnable(svc string) error {
+	if out, err := exec.Command("systemctl", "enable", svc).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to enable service \"%s\" -  %v %s", svc, err, out)
+	}
+	return nil
+}
+
+// SystemctlDisable uses systemctl command to disable a unit without stopping it.
+func SystemctlDisable(svc string) error {
+	if out, err := exec.Command("systemctl", "disable", svc).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to disable service \"%s\" -  %v %s", svc, err, out)
+	}
+	return nil
+}
+
+// SystemctlDaemonReload asks systemd to reload unit files and re-run generators.
+func SystemctlDaemonReload() error {
+	if out, err := exec.Command("systemctl", "daemon-reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to reload systemd units -  %v %s", err, out)
+	}
+	return nil
+}
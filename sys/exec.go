@@ -11,6 +11,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"syscall"
 )
 
@@ -71,23 +72,47 @@ func ErrorExit(template string, stuff ...interface{}) int {
 	return 1
 }
 
-// Run function on all running processes that are exposed via /proc.
-func WalkProcs(fun func(cmdLine []string) bool) error {
+// Proc is a running process exposed via /proc.
+type Proc struct {
+	PID       int      // PID is the process ID.
+	CmdLine   []string // CmdLine is the program followed by its arguments.
+	Cwd       string   // Cwd is the current working directory, empty if it cannot be read.
+	OpenFiles []string // OpenFiles are the paths of open file descriptors, those that cannot be read are left out.
+}
+
+/*
+Run function on all running processes that are exposed via /proc, along with their working directory and open files.
+Stop walking once the function returns false.
+*/
+func WalkProcs(fun func(proc Proc) bool) error {
 	entries, err := filepath.Glob("/proc/[0-9]*")
 	if err != nil {
 		return err
 	}
 	for _, entry := range entries {
+		pid, err := strconv.Atoi(path.Base(entry))
+		if err != nil {
+			continue
+		}
 		cmdline, err := ioutil.ReadFile(path.Join(entry, "cmdline"))
 		if err != nil {
 			// process is gone
 			continue
 		}
-		cmdLineStr := make([]string, 0, 0)
+		proc := Proc{PID: pid, CmdLine: make([]string, 0, 0), OpenFiles: make([]string, 0, 0)}
 		for _, seg := range bytes.Split(cmdline, []byte{0}) {
-			cmdLineStr = append(cmdLineStr, string(seg))
+			proc.CmdLine = append(proc.CmdLine, string(seg))
+		}
+		// Both are readable only by the process owner and root
+		proc.Cwd, _ = os.Readlink(path.Join(entry, "cwd"))
+		if fds, err := ioutil.ReadDir(path.Join(entry, "fd")); err == nil {
+			for _, fd := range fds {
+				if target, err := os.Readlink(path.Join(entry, "fd", fd.Name())); err == nil {
+					proc.OpenFiles = append(proc.OpenFiles, target)
+				}
+			}
 		}
-		if !fun(cmdLineStr) {
+		if !fun(proc) {
 			return nil
 		}
 	}
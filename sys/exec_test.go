@@ -4,6 +4,7 @@ package sys
 
 import (
 	"bytes"
+	"os"
 	"strings"
 	"testing"
 )
@@ -37,8 +38,8 @@ ddd`
 
 func TestWalkProcs(t *testing.T) {
 	var seen bool
-	if err := WalkProcs(func(cmdLine []string) bool {
-		if strings.Contains(cmdLine[0], "systemd") {
+	if err := WalkProcs(func(proc Proc) bool {
+		if strings.Contains(proc.CmdLine[0], "systemd") {
 			seen = true
 			return false
 		}
@@ -46,4 +47,19 @@ func TestWalkProcs(t *testing.T) {
 	}); err != nil || !seen {
 		t.Fatal(err, seen)
 	}
+	// This process is among them, along with its working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var self Proc
+	if err := WalkProcs(func(proc Proc) bool {
+		if proc.PID == os.Getpid() {
+			self = proc
+			return false
+		}
+		return true
+	}); err != nil || self.Cwd != cwd || len(self.OpenFiles) == 0 {
+		t.Fatal(err, self)
+	}
 }